@@ -7,6 +7,7 @@ require (
 	github.com/emirpasic/gods v1.18.1
 	github.com/smacker/go-tree-sitter v0.0.0-20240827094217-dd81d9e9be82
 	github.com/stretchr/testify v1.9.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
@@ -6,32 +6,92 @@ import (
 	"log"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 	"github.com/emirpasic/gods/sets/treeset"
 )
 
 const (
-	// JavaExcludeArtifact tells the resolver to disregard a given maven artifact.
-	// Can be repeated.
+	// JavaAllowTransitiveArtifact tells the resolver to treat a given maven artifact as
+	// directly usable even if it would otherwise be excluded or not visible, e.g. a
+	// transitive jar we know to be on the classpath. This is the inverse of
+	// JavaExcludeArtifact, and takes precedence over it. Can be repeated.
+	JavaAllowTransitiveArtifact = "java_allow_transitive_artifact"
+
+	// JavaExcludeArtifact tells the resolver to disregard a given maven artifact. The
+	// value may also be a glob pattern as understood by path.Match, e.g.
+	// "@maven//:org_scala_lang_*", to disregard every matching artifact. Can be repeated.
 	//
 	// Defaults to SCALA_STD_LIBS.
 	JavaExcludeArtifact = "java_exclude_artifact"
 
+	// JavaIncludeSourceClassifier tells the resolver to treat the "sources" classifier jar
+	// of a given maven artifact, named by the label of its plain jar, as a viable
+	// dependency. Source jars are otherwise skipped entirely. As the maven install file is
+	// only read once, this must be set where it is first read, i.e. in the root BUILD file
+	// or alongside JavaMavenInstallFile. Can be repeated.
+	JavaIncludeSourceClassifier = "java_include_source_classifier"
+
+	// JavaPreferredArtifactClassifier tells the resolver which classifier variant of a
+	// maven artifact to use when a package is provided by more than one variant of that
+	// same artifact, e.g. both a plain jar and its "tests" jar. If the preferred classifier
+	// is not among the providing variants, the plain jar is used.
+	//
+	// Defaults to DEFAULT_ARTIFACT_CLASSIFIER, i.e. the plain jar.
+	JavaPreferredArtifactClassifier = "java_preferred_artifact_classifier"
+
 	// JavaMavenInstallFile represents the directive that controls where the
 	// maven_install.json file is located.
 	//
 	// Defaults to DEFAULT_MAVEN_INSTALL_FILE.
 	JavaMavenInstallFile = "java_maven_install_file"
 
+	// JavaPackageIndexFile points the resolver at a sidecar json file, relative to the repo
+	// root, mapping packages to the labels of the maven jars providing them, e.g. as generated
+	// out-of-band via jdeps. It optionally takes a second argument, the precedence of the
+	// index over the mapping derived from the maven install lockfile: either
+	// PACKAGE_INDEX_OVERRIDE, where the index's labels replace the lockfile's for packages
+	// both provide, or PACKAGE_INDEX_SUPPLEMENT, where the index only adds packages missing
+	// from the lockfile. The index applies to the maven install in effect after any
+	// JavaMavenInstallFile in the same BUILD file.
+	//
+	// Defaults to PACKAGE_INDEX_OVERRIDE.
+	JavaPackageIndexFile = "java_package_index_file"
+
 	// JavaMavenRepositoryName tells the code generator what the repository name that
-	// contains all maven dependencies is.
+	// contains all maven dependencies is. It optionally takes a second argument, a maven
+	// coordinate prefix such as "com.example" or "com.example:widgets", in which case the
+	// repository name only applies to artifacts matching that prefix. The longest matching
+	// prefix wins. Can be repeated with different prefixes.
 	//
 	// Defaults to DEFAULT_MAVEN_REPO_NAME.
 	JavaMavenRepositoryName = "java_maven_repository_name"
 
+	// ScalaClearForcedTransitiveDeps drops every forced transitive dep mapping inherited from
+	// parent packages, including the defaults and those configured via
+	// ScalaTestForcedTransitiveDeps, for the current package and its descendants. It takes
+	// no arguments. Mappings configured after it in the same BUILD file still apply.
+	ScalaClearForcedTransitiveDeps = "scala_clear_forced_transitive_deps"
+
+	// ScalaDepRewriters gives a comma-separated list of the names of rewriters to apply, in
+	// order, to every dep resolved for the current package and its descendants, e.g.
+	// CollapseScalaMinorVersions. Rewriters can be added via RegisterDepRewriter. Replaces
+	// any rewriters inherited from parent packages, and an empty value disables them.
+	ScalaDepRewriters = "scala_dep_rewriters"
+
+	// ScalaExternalRepoMapping maps every symbol within an import prefix to a target in
+	// another Bazel repo, e.g. a bzlmod module or local_repository, for symbols which resolve
+	// to nothing in this repo or the maven install. It takes two arguments: the import prefix
+	// and an external label. A label whose package ends in '...', e.g. @shared_lib//... or
+	// @shared_lib//src/main/scala/..., has the '...' replaced by the path of the symbol's
+	// package, naming the target after the package's last segment. The longest matching
+	// prefix wins. Can be repeated, and is inherited by child packages.
+	ScalaExternalRepoMapping = "scala_external_repo_mapping"
+
 	// ScalaForcedTransitiveDeps provides a way to force additional labels to be added
 	// as deps when a particular label is added as a dep. It takes two arguments: the
 	// initial label and a comma separated string of other transitive dependency labels.
@@ -43,21 +103,161 @@ const (
 	//
 	// Defaults to DEFAULT_FORCED_TRANSITIVE_DEPS.
 	ScalaForcedTransitiveDeps = "scala_forced_transitive_deps"
+
+	// ScalaIgnoreImports tells the resolver to drop any used symbols within the given
+	// comma-separated list of namespaces before attempting to resolve them, e.g. for
+	// packages provided by the compiler which never map to a dep. A namespace covers
+	// itself and everything nested within it. Can be repeated, and is inherited by child
+	// packages.
+	ScalaIgnoreImports = "scala_ignore_imports"
+
+	// ScalaIgnoreInRepoSymbol tells the resolver to skip the in-repo rule index when
+	// looking up symbols within the given namespace, while still consulting resolve
+	// directives and maven jars. Matching symbols which map to nothing else are silently
+	// dropped rather than reported. This is intended as a temporary escape hatch while
+	// migrating a package across targets. Can be repeated, and is inherited by child
+	// packages.
+	ScalaIgnoreInRepoSymbol = "scala_ignore_in_repo_symbol"
+
+	// ScalaMapCompilerImports tells the resolver to map imports from namespaces provided
+	// by the Scala compiler jars, e.g. scala.reflect.runtime or scala.tools.nsc, directly
+	// to the scala-reflect or scala-compiler maven labels (see SCALA_COMPILER_NAMESPACES).
+	// These jars are often only present in the maven install transitively, in which case
+	// such imports otherwise fail to resolve. Accepted values are 'true' or 'false'.
+	//
+	// Defaults to false.
+	ScalaMapCompilerImports = "scala_map_compiler_imports"
+
+	// ScalaPackageAlias maps an imported package prefix to the package maven jars are keyed
+	// by in the maven install, e.g. for shaded or relocated jars whose classes are imported
+	// from a different package than the one recorded for them. It takes two arguments: the
+	// imported prefix and the real package prefix which replaces it when looking up maven
+	// packages. The longest matching prefix wins. Can be repeated, and is inherited by child
+	// packages.
+	ScalaPackageAlias = "scala_package_alias"
+
+	// ScalaPreferArtifact gives the resolver a comma-separated list of maven labels in
+	// priority order, used to break ties when a package is provided by more than one
+	// visible maven jar, e.g. a library and a shaded copy of it. Can be repeated, with
+	// later labels having lower priority. Labels listed in a package take priority over
+	// those inherited from its parent packages.
+	ScalaPreferArtifact = "scala_prefer_artifact"
+
+	// ScalaResolvePrefix maps every symbol within an import prefix to a given in-repo
+	// label, e.g. for generated code whose sources can't be parsed. It takes two arguments:
+	// the import prefix and the label, which may be relative to the declaring package. It
+	// is consulted before the rule index, and the longest matching prefix wins. Can be
+	// repeated, and is inherited by child packages.
+	ScalaResolvePrefix = "scala_resolve_prefix"
+
+	// ScalaResolveThroughExports tells the resolver to consider in-repo targets which
+	// re-export the target providing a symbol via their `exports` attribute. If the rule
+	// being resolved already depends on such an exporting target, and not on the provider
+	// itself, the symbol resolves to the exporting target instead. Exports are followed
+	// transitively. Accepted values are 'true' or 'false'.
+	//
+	// Defaults to false.
+	ScalaResolveThroughExports = "scala_resolve_through_exports"
+
+	// ScalaResolveToAncestorPackage tells the resolver to fall back to the nearest enclosing
+	// package of a symbol which resolves to nothing at all, for repos where a package has no
+	// BUILD file of its own and its sources belong to a target in an ancestor directory. Each
+	// enclosing package is looked up in the rule index in turn, only accepting targets whose
+	// Bazel package directory matches that package's path, e.g. //src/main/scala/com/foo for
+	// com.foo. Top-level packages are never considered. Accepted values are 'true' or 'false'.
+	//
+	// Defaults to false.
+	ScalaResolveToAncestorPackage = "scala_resolve_to_ancestor_package"
+
+	// ScalaRuntimeDeps maps a label to labels which are only needed at runtime alongside
+	// it, e.g. a logging backend discovered via ServiceLoader, and which should be added to
+	// the runtime_deps of rules depending on it rather than to their deps. It takes two
+	// arguments: the initial label and a comma separated string of runtime dependency
+	// labels. Can be repeated.
+	//
+	// Rules in packages where any runtime deps are configured have their runtime_deps
+	// managed like their deps. Elsewhere, existing runtime_deps are left untouched.
+	ScalaRuntimeDeps = "scala_runtime_deps"
+
+	// If ScalaStrictResolution is set to true, any used symbol which resolves to no label at
+	// all fails the run once all rules have been resolved, listing every such symbol. Symbols
+	// ignored via ScalaIgnoreImports are never reported. Accepted values are 'true' or
+	// 'false'. The -scala_strict_resolution flag sets the default for the whole repo.
+	//
+	// Defaults to false.
+	ScalaStrictResolution = "scala_strict_resolution"
+
+	// ScalaTestForcedTransitiveDeps works like ScalaForcedTransitiveDeps, but only forces
+	// the transitive dependency labels onto test rules, e.g. for test runtime jars which
+	// should not end up on library classpaths. Forced deps from both directives apply to
+	// test rules.
+	ScalaTestForcedTransitiveDeps = "scala_test_forced_transitive_deps"
+
+	// ScalaUnforceTransitiveDep removes a single forced transitive dep mapping inherited
+	// from a parent package's ScalaForcedTransitiveDeps or ScalaTestForcedTransitiveDeps,
+	// for the current package and its descendants. It takes two arguments: the initial
+	// label and the transitive dependency label which should no longer be forced. Can be
+	// repeated.
+	ScalaUnforceTransitiveDep = "scala_unforce_transitive_dep"
 )
 
 type JvmConfig struct {
-	excludedArtifacts    *treeset.Set
-	MavenInstall         *MavenInstallData
-	MavenLabelPrefix     string
-	ForcedTransitiveDeps *map[string][]string
+	allowedArtifacts            *treeset.Set
+	DepRewriters                []string
+	excludedArtifacts           *treeset.Set
+	ExternalRepoMappings        map[string]label.Label
+	ignoredImports              *treeset.Set
+	ignoredInRepoSymbols        *treeset.Set
+	includedSourceClassifiers   *treeset.Set
+	MapCompilerImports          bool
+	MavenInstall                *MavenInstallData
+	MavenLabelPrefix            string
+	MavenGroupLabelPrefixes     map[string]string
+	ForcedTransitiveDeps        *map[string][]string
+	PackageAliases              map[string]string
+	PreferredArtifactClassifier string
+	PreferredArtifacts          []string
+	ResolvePrefixes             map[string]label.Label
+	ResolveThroughExports       bool
+	ResolveToAncestorPackage    bool
+	RuntimeDeps                 *map[string][]string
+	StrictResolution            bool
+	TestForcedTransitiveDeps    *map[string][]string
+	// VerboseResolve logs every symbol resolved via a directive rather than the rule index
+	// or maven install alone. It is only set via the -scala_verbose_resolve flag.
+	VerboseResolve bool
 }
 
 func NewJvmConfig() *JvmConfig {
+	// Directives modify the forced deps map in place, so the defaults must be copied.
+	forcedTransitiveDeps := make(map[string][]string, len(DEFAULT_FORCED_TRANSITIVE_DEPS))
+	for key, value := range DEFAULT_FORCED_TRANSITIVE_DEPS {
+		forcedTransitiveDeps[key] = value
+	}
+
 	return &JvmConfig{
-		excludedArtifacts:    DEFAULT_ARTIFACT_EXCLUDES,
-		MavenInstall:         nil,
-		MavenLabelPrefix:     DEFAULT_MAVEN_LABEL_PREFIX,
-		ForcedTransitiveDeps: &DEFAULT_FORCED_TRANSITIVE_DEPS,
+		allowedArtifacts:            treeset.NewWithStringComparator(),
+		DepRewriters:                []string{},
+		excludedArtifacts:           treeset.NewWithStringComparator(),
+		ExternalRepoMappings:        make(map[string]label.Label),
+		ignoredImports:              treeset.NewWithStringComparator(),
+		ignoredInRepoSymbols:        treeset.NewWithStringComparator(),
+		includedSourceClassifiers:   treeset.NewWithStringComparator(),
+		MapCompilerImports:          false,
+		MavenInstall:                nil,
+		MavenLabelPrefix:            DEFAULT_MAVEN_LABEL_PREFIX,
+		MavenGroupLabelPrefixes:     make(map[string]string),
+		ForcedTransitiveDeps:        &forcedTransitiveDeps,
+		PackageAliases:              make(map[string]string),
+		PreferredArtifactClassifier: DEFAULT_ARTIFACT_CLASSIFIER,
+		PreferredArtifacts:          []string{},
+		ResolvePrefixes:             make(map[string]label.Label),
+		ResolveThroughExports:       false,
+		ResolveToAncestorPackage:    false,
+		RuntimeDeps:                 &map[string][]string{},
+		StrictResolution:            false,
+		TestForcedTransitiveDeps:    &map[string][]string{},
+		VerboseResolve:              false,
 	}
 }
 
@@ -68,22 +268,381 @@ func (c *JvmConfig) NewChild() *JvmConfig {
 	for key, value := range *c.ForcedTransitiveDeps {
 		childMap[key] = value
 	}
+	childTestMap := make(map[string][]string, len(*c.TestForcedTransitiveDeps))
+	for key, value := range *c.TestForcedTransitiveDeps {
+		childTestMap[key] = value
+	}
+
+	childGroupPrefixes := make(map[string]string, len(c.MavenGroupLabelPrefixes))
+	for coordinatePrefix, labelPrefix := range c.MavenGroupLabelPrefixes {
+		childGroupPrefixes[coordinatePrefix] = labelPrefix
+	}
+
+	childRuntimeMap := make(map[string][]string, len(*c.RuntimeDeps))
+	for key, value := range *c.RuntimeDeps {
+		childRuntimeMap[key] = value
+	}
+
+	childPackageAliases := make(map[string]string, len(c.PackageAliases))
+	for prefix, aliasedPrefix := range c.PackageAliases {
+		childPackageAliases[prefix] = aliasedPrefix
+	}
+
+	childResolvePrefixes := make(map[string]label.Label, len(c.ResolvePrefixes))
+	for prefix, prefixLabel := range c.ResolvePrefixes {
+		childResolvePrefixes[prefix] = prefixLabel
+	}
+
+	childExternalRepoMappings := make(map[string]label.Label, len(c.ExternalRepoMappings))
+	for prefix, externalLabel := range c.ExternalRepoMappings {
+		childExternalRepoMappings[prefix] = externalLabel
+	}
 
 	return &JvmConfig{
-		excludedArtifacts:    c.excludedArtifacts,
-		MavenInstall:         c.MavenInstall,
-		MavenLabelPrefix:     c.MavenLabelPrefix,
-		ForcedTransitiveDeps: &childMap,
+		allowedArtifacts:            c.allowedArtifacts,
+		DepRewriters:                c.DepRewriters,
+		excludedArtifacts:           c.excludedArtifacts,
+		ExternalRepoMappings:        childExternalRepoMappings,
+		ignoredImports:              c.ignoredImports,
+		ignoredInRepoSymbols:        c.ignoredInRepoSymbols,
+		includedSourceClassifiers:   c.includedSourceClassifiers,
+		MapCompilerImports:          c.MapCompilerImports,
+		MavenInstall:                c.MavenInstall,
+		MavenLabelPrefix:            c.MavenLabelPrefix,
+		MavenGroupLabelPrefixes:     childGroupPrefixes,
+		ForcedTransitiveDeps:        &childMap,
+		PackageAliases:              childPackageAliases,
+		PreferredArtifactClassifier: c.PreferredArtifactClassifier,
+		PreferredArtifacts:          c.PreferredArtifacts,
+		ResolvePrefixes:             childResolvePrefixes,
+		ResolveThroughExports:       c.ResolveThroughExports,
+		ResolveToAncestorPackage:    c.ResolveToAncestorPackage,
+		RuntimeDeps:                 &childRuntimeMap,
+		StrictResolution:            c.StrictResolution,
+		TestForcedTransitiveDeps:    &childTestMap,
+		VerboseResolve:              c.VerboseResolve,
+	}
+}
+
+// removeForcedTransitiveDep stops forcing transitiveDep to be added alongside dep, for
+// both library and test rules. The forced deps maps are copied for each child config, but
+// their values are shared, so we build a new slice rather than modifying the existing one.
+func (c *JvmConfig) removeForcedTransitiveDep(dep string, transitiveDep string) {
+	for _, forcedDepsMap := range []*map[string][]string{
+		c.ForcedTransitiveDeps,
+		c.TestForcedTransitiveDeps,
+	} {
+		transitiveDeps, exists := (*forcedDepsMap)[dep]
+		if !exists {
+			continue
+		}
+
+		remainingDeps := make([]string, 0, len(transitiveDeps))
+		for _, forcedDep := range transitiveDeps {
+			if forcedDep != transitiveDep {
+				remainingDeps = append(remainingDeps, forcedDep)
+			}
+		}
+
+		if len(remainingDeps) == 0 {
+			delete(*forcedDepsMap, dep)
+		} else {
+			(*forcedDepsMap)[dep] = remainingDeps
+		}
 	}
 }
 
+// clearForcedTransitiveDeps stops forcing any transitive deps, for both library and test
+// rules.
+func (c *JvmConfig) clearForcedTransitiveDeps() {
+	c.ForcedTransitiveDeps = &map[string][]string{}
+	c.TestForcedTransitiveDeps = &map[string][]string{}
+}
+
+// forcedTransitiveDeps returns the forced transitive deps map applying to library rules,
+// or for test rules, that map combined with the test-only forced transitive deps.
+func (c *JvmConfig) forcedTransitiveDeps(isTest bool) *map[string][]string {
+	if !isTest || len(*c.TestForcedTransitiveDeps) == 0 {
+		return c.ForcedTransitiveDeps
+	}
+
+	combinedMap := make(map[string][]string, len(*c.ForcedTransitiveDeps))
+	for key, value := range *c.ForcedTransitiveDeps {
+		combinedMap[key] = value
+	}
+	for key, value := range *c.TestForcedTransitiveDeps {
+		// Build a new slice, as the values are shared with the configs' maps.
+		combinedMap[key] = append(append([]string{}, combinedMap[key]...), value...)
+	}
+	return &combinedMap
+}
+
+func (c *JvmConfig) addAllowedArtifacts(artifacts *treeset.Set) {
+	c.allowedArtifacts = c.allowedArtifacts.Union(artifacts)
+}
+
 func (c *JvmConfig) addExcludedArtifacts(artifacts *treeset.Set) {
 	c.excludedArtifacts = c.excludedArtifacts.Union(artifacts)
 }
 
+func (c *JvmConfig) addIncludedSourceClassifiers(artifacts *treeset.Set) {
+	c.includedSourceClassifiers = c.includedSourceClassifiers.Union(artifacts)
+}
+
+func (c *JvmConfig) addIgnoredImports(namespaces *treeset.Set) {
+	c.ignoredImports = c.ignoredImports.Union(namespaces)
+}
+
+func (c *JvmConfig) addIgnoredInRepoSymbols(namespaces *treeset.Set) {
+	c.ignoredInRepoSymbols = c.ignoredInRepoSymbols.Union(namespaces)
+}
+
+// Returns whether the given symbol falls within any of the given namespaces.
+func inNamespaces(symbol string, namespaces *treeset.Set) bool {
+	for _, value := range namespaces.Values() {
+		namespace := value.(string)
+		if symbol == namespace || strings.HasPrefix(symbol, namespace+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnoredImport returns whether the given symbol falls within any ignored namespace.
+func (c *JvmConfig) isIgnoredImport(symbol string) bool {
+	return inNamespaces(symbol, c.ignoredImports)
+}
+
+// isIgnoredInRepoSymbol returns whether the given symbol should not be looked up in the
+// rule index.
+func (c *JvmConfig) isIgnoredInRepoSymbol(symbol string) bool {
+	return inNamespaces(symbol, c.ignoredInRepoSymbols)
+}
+
+// resolvePrefixLabel returns the label configured via ScalaResolvePrefix for the longest
+// import prefix containing the given symbol, if any.
+func (c *JvmConfig) resolvePrefixLabel(symbol string) (label.Label, bool) {
+	longestMatch := ""
+	var prefixLabel label.Label
+	for prefix, candidateLabel := range c.ResolvePrefixes {
+		if (symbol == prefix || strings.HasPrefix(symbol, prefix+".")) &&
+			len(prefix) > len(longestMatch) {
+			longestMatch = prefix
+			prefixLabel = candidateLabel
+		}
+	}
+
+	return prefixLabel, longestMatch != ""
+}
+
+// externalRepoLabel returns the label configured via ScalaExternalRepoMapping for the longest
+// import prefix containing symbol, if any, with any trailing '...' in its package replaced by
+// the path of the symbol's package.
+func (c *JvmConfig) externalRepoLabel(symbol string) (label.Label, bool) {
+	longestMatch := ""
+	var externalLabel label.Label
+	for prefix, candidateLabel := range c.ExternalRepoMappings {
+		if (symbol == prefix || strings.HasPrefix(symbol, prefix+".")) &&
+			len(prefix) > len(longestMatch) {
+			longestMatch = prefix
+			externalLabel = candidateLabel
+		}
+	}
+	if longestMatch == "" {
+		return externalLabel, false
+	}
+
+	basePkg, isPattern := strings.CutSuffix(externalLabel.Pkg, "...")
+	if !isPattern || externalLabel.Name != "..." {
+		return externalLabel, true
+	}
+
+	// The symbol's package is everything before its first type or object, or the whole
+	// symbol for e.g. wildcard imports of a package.
+	segments := strings.Split(symbol, ".")
+	pkgEnd := slices.IndexFunc(segments, isSymbol)
+	if pkgEnd == -1 {
+		pkgEnd = len(segments)
+	} else if pkgEnd == 0 {
+		return label.NoLabel, false
+	}
+	pkgPath := strings.Join(segments[:pkgEnd], "/")
+	return label.New(externalLabel.Repo, basePkg+pkgPath, segments[pkgEnd-1]), true
+}
+
+// aliasedPackage returns pkg with the longest prefix configured via ScalaPackageAlias
+// replaced by the package prefix it aliases, or pkg itself if no prefix matches.
+func (c *JvmConfig) aliasedPackage(pkg string) string {
+	longestMatch := ""
+	for prefix := range c.PackageAliases {
+		if (pkg == prefix || strings.HasPrefix(pkg, prefix+".")) &&
+			len(prefix) > len(longestMatch) {
+			longestMatch = prefix
+		}
+	}
+
+	if longestMatch == "" {
+		return pkg
+	}
+	return c.PackageAliases[longestMatch] + strings.TrimPrefix(pkg, longestMatch)
+}
+
+// compilerLabelForSymbol returns the label of the Scala compiler jar providing the given
+// symbol, if compiler imports are mapped and it falls within a compiler namespace.
+func (c *JvmConfig) compilerLabelForSymbol(symbol string) (string, bool) {
+	if !c.MapCompilerImports {
+		return "", false
+	}
+
+	longestMatch := ""
+	artifact := ""
+	for namespace, namespaceArtifact := range SCALA_COMPILER_NAMESPACES {
+		if (symbol == namespace || strings.HasPrefix(symbol, namespace+".")) &&
+			len(namespace) > len(longestMatch) {
+			longestMatch = namespace
+			artifact = namespaceArtifact
+		}
+	}
+
+	if longestMatch == "" {
+		return "", false
+	}
+	return c.MavenLabelPrefix + artifact, true
+}
+
+// isArtifactPattern returns whether the given artifact exclude is a glob pattern rather
+// than a single label.
+func isArtifactPattern(artifact string) bool {
+	return strings.ContainsAny(artifact, "*?[")
+}
+
+// matchesArtifact returns whether the given label is one of the given labels, or matches
+// one of them which is a glob pattern.
+func matchesArtifact(artifactLabel string, artifacts *treeset.Set) bool {
+	if artifacts.Contains(artifactLabel) {
+		return true
+	}
+
+	for _, value := range artifacts.Values() {
+		pattern := value.(string)
+		if isArtifactPattern(pattern) {
+			// Patterns are validated when configured, so errors can't happen here.
+			if matched, _ := path.Match(pattern, artifactLabel); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// defaultExcludedArtifactLabels returns the labels of DEFAULT_EXCLUDED_ARTIFACTS in the
+// configured maven repository.
+func (c *JvmConfig) defaultExcludedArtifactLabels() []string {
+	labels := make([]string, 0, len(DEFAULT_EXCLUDED_ARTIFACTS))
+	for _, artifact := range DEFAULT_EXCLUDED_ARTIFACTS {
+		labelPrefix := mavenLabelPrefixForArtifact(
+			artifact,
+			c.MavenLabelPrefix,
+			c.MavenGroupLabelPrefixes,
+		)
+		labels = append(labels, jarToLabel(artifact, labelPrefix))
+	}
+	return labels
+}
+
+// excludedArtifactLabels returns the labels and patterns of all excluded artifacts,
+// including the default excludes.
+func (c *JvmConfig) excludedArtifactLabels() *treeset.Set {
+	excludedLabels := treeset.NewWithStringComparator(c.excludedArtifacts.Values()...)
+	for _, defaultLabel := range c.defaultExcludedArtifactLabels() {
+		excludedLabels.Add(defaultLabel)
+	}
+	return excludedLabels
+}
+
+// matchesExcludedArtifact returns whether the given label is excluded, whether or not it
+// has also been explicitly allowed.
+func (c *JvmConfig) matchesExcludedArtifact(artifactLabel string) bool {
+	return matchesArtifact(artifactLabel, c.excludedArtifacts) ||
+		slices.Contains(c.defaultExcludedArtifactLabels(), artifactLabel)
+}
+
+// isExcludedArtifact returns whether the given label should never be considered for
+// dependency mapping. Explicitly allowed artifacts are never excluded.
+func (c *JvmConfig) isExcludedArtifact(artifactLabel string) bool {
+	return c.matchesExcludedArtifact(artifactLabel) && !c.allowedArtifacts.Contains(artifactLabel)
+}
+
+// isVisibleArtifact returns whether the given label may be used directly as a dep,
+// either because it is a viable maven install label or because it was explicitly
+// allowed.
+func (c *JvmConfig) isVisibleArtifact(artifactLabel string) bool {
+	return c.MavenInstall.ArtifactLabels.Contains(artifactLabel) ||
+		c.allowedArtifacts.Contains(artifactLabel)
+}
+
+// preferredArtifactVariant returns the label to use when all of the given labels are
+// classifier variants of the same maven artifact, preferring the configured classifier
+// and falling back to the plain jar. Returns false if the labels are not all variants of
+// one artifact, or if neither preferred variant is among them.
+func (c *JvmConfig) preferredArtifactVariant(artifactLabels *treeset.Set) (string, bool) {
+	baseLabel := ""
+	classifierLabels := make(map[string]string, artifactLabels.Size())
+
+	for _, value := range artifactLabels.Values() {
+		artifactLabel := value.(string)
+		variant, exists := c.MavenInstall.ArtifactVariants[artifactLabel]
+		if !exists || (baseLabel != "" && variant.BaseLabel != baseLabel) {
+			return "", false
+		}
+
+		baseLabel = variant.BaseLabel
+		classifierLabels[variant.Classifier] = artifactLabel
+	}
+
+	preferredClassifiers := []string{c.PreferredArtifactClassifier, DEFAULT_ARTIFACT_CLASSIFIER}
+	for _, classifier := range preferredClassifiers {
+		if artifactLabel, exists := classifierLabels[classifier]; exists {
+			return artifactLabel, true
+		}
+	}
+
+	return "", false
+}
+
+// preferredArtifact returns the highest priority label among the given labels according
+// to PreferredArtifacts. Returns false if none of them are listed.
+func (c *JvmConfig) preferredArtifact(artifactLabels *treeset.Set) (string, bool) {
+	for _, preferredLabel := range c.PreferredArtifacts {
+		if artifactLabels.Contains(preferredLabel) {
+			return preferredLabel, true
+		}
+	}
+
+	return "", false
+}
+
 func (c *JvmConfig) setMavenInstall(repoRoot string, filename string) {
 	absPath := filepath.Join(repoRoot, filename)
-	c.MavenInstall = ParseMavenInstall(absPath, c.MavenLabelPrefix, c.excludedArtifacts)
+	c.MavenInstall = ParseMavenInstall(
+		absPath,
+		c.MavenLabelPrefix,
+		c.MavenGroupLabelPrefixes,
+		c.excludedArtifactLabels(),
+		c.allowedArtifacts,
+		c.includedSourceClassifiers,
+	)
+}
+
+// applyPackageIndex merges the sidecar package index at the given path into the package
+// mapping of the current maven install, which is shared with other packages and so is copied.
+func (c *JvmConfig) applyPackageIndex(repoRoot string, filename string, override bool) {
+	absPath := filepath.Join(repoRoot, filename)
+	packageIndex, err := ReadPackageIndex(absPath)
+	if err != nil {
+		log.Fatalf("Error reading %s %s: %s\n", JavaPackageIndexFile, absPath, err)
+	}
+	c.MavenInstall = c.MavenInstall.WithPackageIndex(packageIndex, override)
 }
 
 // JvmConfigs is an extension of map[string]*JvmConfig. It provides finding methods
@@ -111,10 +670,28 @@ func JvmConfigForConfig(c *config.Config, pkg string) *JvmConfig {
 //
 // See config.Configurer for more information.
 type JvmConfigurer struct {
+	resolveTraceIn   string
+	resolveTraceOut  string
+	expectedTrace    *ResolveTrace
+	strictResolution bool
+	verboseResolve   bool
+	printUnused      bool
+
+	// ResolveTrace records resolution decisions if either trace flag is specified, and is
+	// nil otherwise.
+	ResolveTrace *ResolveTrace
+	// UnresolvedSymbols collects the symbols which could not be resolved in packages with
+	// ScalaStrictResolution enabled.
+	UnresolvedSymbols *UnresolvedSymbols
+	// UnusedArtifacts records the maven artifacts used as deps if
+	// -scala_print_unused_artifacts is specified, and is nil otherwise.
+	UnusedArtifacts *UnusedArtifacts
 }
 
 func NewJvmConfigurer() *JvmConfigurer {
-	return &JvmConfigurer{}
+	return &JvmConfigurer{
+		UnresolvedSymbols: NewUnresolvedSymbols(),
+	}
 }
 
 func (jc *JvmConfigurer) getOrInitJvmConfigs(c *config.Config) *JvmConfigs {
@@ -129,18 +706,133 @@ func (jc *JvmConfigurer) getOrInitJvmConfigs(c *config.Config) *JvmConfigs {
 }
 
 func (jc *JvmConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
+	fs.BoolVar(
+		&jc.printUnused,
+		"scala_print_unused_artifacts",
+		false,
+		"When specified, print the maven install artifacts which were never chosen as a dep "+
+			"or runtime dep of any rule once all deps have been resolved, ignoring artifacts "+
+			"excluded via '# gazelle:"+JavaExcludeArtifact+"'.",
+	)
+
+	fs.StringVar(
+		&jc.resolveTraceIn,
+		"scala_resolve_trace_in",
+		"",
+		"When specified, the resolve trace at the given path (as written by "+
+			"-scala_resolve_trace_out) is compared against the resolution decisions made "+
+			"during this run, and the run fails listing any divergences.",
+	)
+
+	fs.StringVar(
+		&jc.resolveTraceOut,
+		"scala_resolve_trace_out",
+		"",
+		"When specified, every resolution decision (the symbol, the lookups attempted and "+
+			"the labels chosen) is recorded to a json file at the given path.",
+	)
+
+	fs.BoolVar(
+		&jc.strictResolution,
+		"scala_strict_resolution",
+		false,
+		"When specified, fail the run if any used symbol resolves to no label at all, "+
+			"unless it is ignored via '# gazelle:"+ScalaIgnoreImports+"'. This sets the "+
+			"default for '# gazelle:"+ScalaStrictResolution+"' across the whole repo.",
+	)
+
+	fs.BoolVar(
+		&jc.verboseResolve,
+		"scala_verbose_resolve",
+		false,
+		"When specified, log every symbol resolved via a resolve override or artifact "+
+			"preference directive, along with the candidate labels and the directive which "+
+			"decided between them.",
+	)
 }
 
 func (jc *JvmConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
+	for _, tracePath := range []*string{&jc.resolveTraceIn, &jc.resolveTraceOut} {
+		if *tracePath != "" && !filepath.IsAbs(*tracePath) {
+			*tracePath = filepath.Join(c.RepoRoot, *tracePath)
+		}
+	}
+
+	if jc.resolveTraceIn != "" {
+		expectedTrace, err := ReadResolveTrace(jc.resolveTraceIn)
+		if err != nil {
+			return fmt.Errorf("error reading -scala_resolve_trace_in: %w", err)
+		}
+		jc.expectedTrace = expectedTrace
+	}
+
+	if jc.resolveTraceIn != "" || jc.resolveTraceOut != "" {
+		jc.ResolveTrace = NewResolveTrace()
+	}
+
+	if jc.strictResolution {
+		(*jc.getOrInitJvmConfigs(c))[""].StrictResolution = true
+	}
+
+	if jc.verboseResolve {
+		(*jc.getOrInitJvmConfigs(c))[""].VerboseResolve = true
+	}
+
+	if jc.printUnused {
+		jc.UnusedArtifacts = NewUnusedArtifacts()
+	}
+
+	return nil
+}
+
+// FinishResolveTrace writes out the resolve trace and compares it against the expected
+// trace, as configured. It should be called once all deps have been resolved.
+func (jc *JvmConfigurer) FinishResolveTrace() error {
+	if jc.resolveTraceOut != "" {
+		if err := jc.ResolveTrace.Write(jc.resolveTraceOut); err != nil {
+			return fmt.Errorf("error writing -scala_resolve_trace_out: %w", err)
+		}
+	}
+
+	if jc.expectedTrace != nil {
+		divergences := jc.ResolveTrace.Divergences(jc.expectedTrace)
+		if len(divergences) > 0 {
+			return fmt.Errorf(
+				"resolution diverged from the trace in %s:\n%s",
+				jc.resolveTraceIn,
+				strings.Join(divergences, "\n"),
+			)
+		}
+	}
+
 	return nil
 }
 
 func (jc *JvmConfigurer) KnownDirectives() []string {
 	return []string{
+		JavaAllowTransitiveArtifact,
 		JavaExcludeArtifact,
+		JavaIncludeSourceClassifier,
 		JavaMavenInstallFile,
 		JavaMavenRepositoryName,
+		JavaPackageIndexFile,
+		JavaPreferredArtifactClassifier,
+		ScalaClearForcedTransitiveDeps,
+		ScalaDepRewriters,
+		ScalaExternalRepoMapping,
 		ScalaForcedTransitiveDeps,
+		ScalaIgnoreImports,
+		ScalaIgnoreInRepoSymbol,
+		ScalaMapCompilerImports,
+		ScalaPackageAlias,
+		ScalaPreferArtifact,
+		ScalaResolvePrefix,
+		ScalaResolveThroughExports,
+		ScalaResolveToAncestorPackage,
+		ScalaRuntimeDeps,
+		ScalaStrictResolution,
+		ScalaTestForcedTransitiveDeps,
+		ScalaUnforceTransitiveDep,
 	}
 }
 
@@ -154,31 +846,162 @@ func (jc *JvmConfigurer) Configure(c *config.Config, rel string, f *rule.File) {
 		(*jvmConfigs)[rel] = jvmConfig
 	}
 
+	packageIndexFile := ""
+	packageIndexOverrides := true
+
 	if f != nil {
+		var artifactAllows *treeset.Set
 		var artifactExcludes *treeset.Set
+		sourceClassifierIncludes := treeset.NewWithStringComparator()
+		ignoredImports := treeset.NewWithStringComparator()
+		ignoredInRepoSymbols := treeset.NewWithStringComparator()
+		preferredArtifacts := []string{}
 		mavenInstallFile := ""
 
 		for _, d := range f.Directives {
 			switch d.Key {
+			case JavaAllowTransitiveArtifact:
+				if artifactAllows == nil {
+					artifactAllows = treeset.NewWithStringComparator(d.Value)
+				} else {
+					artifactAllows.Add(d.Value)
+				}
+
 			case JavaExcludeArtifact:
+				if isArtifactPattern(d.Value) {
+					if _, err := path.Match(d.Value, ""); err != nil {
+						log.Fatalf(
+							"Invalid pattern for %s directive '%s': %s\n",
+							JavaExcludeArtifact,
+							d.Value,
+							err,
+						)
+					}
+				}
+
 				if artifactExcludes == nil {
 					artifactExcludes = treeset.NewWithStringComparator(d.Value)
 				} else {
 					artifactExcludes.Add(d.Value)
 				}
 
+			case JavaIncludeSourceClassifier:
+				sourceClassifierIncludes.Add(strings.TrimSpace(d.Value))
+
 			case JavaMavenInstallFile:
 				mavenInstallFile = d.Value
 
 			case JavaMavenRepositoryName:
-				jvmConfig.MavenLabelPrefix = fmt.Sprintf("@%s//:", d.Value)
+				values := strings.Split(d.Value, " ")
+				if len(values) == 1 {
+					jvmConfig.MavenLabelPrefix = fmt.Sprintf("@%s//:", values[0])
+				} else if len(values) == 2 {
+					jvmConfig.MavenGroupLabelPrefixes[values[1]] = fmt.Sprintf("@%s//:", values[0])
+				} else {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 1 or 2 values but got %v\n",
+						JavaMavenRepositoryName,
+						values,
+					)
+				}
+
+			case JavaPackageIndexFile:
+				values := strings.Fields(d.Value)
+				if len(values) == 0 || len(values) > 2 {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 1 or 2 values but got %v\n",
+						JavaPackageIndexFile,
+						values,
+					)
+				}
+				packageIndexFile = values[0]
+				packageIndexOverrides = true
+				if len(values) == 2 {
+					switch values[1] {
+					case PACKAGE_INDEX_OVERRIDE:
+					case PACKAGE_INDEX_SUPPLEMENT:
+						packageIndexOverrides = false
+					default:
+						log.Fatalf(
+							"Invalid precedence for %s directive. Expected '%s' or '%s' but got '%s'\n",
+							JavaPackageIndexFile,
+							PACKAGE_INDEX_OVERRIDE,
+							PACKAGE_INDEX_SUPPLEMENT,
+							values[1],
+						)
+					}
+				}
+
+			case JavaPreferredArtifactClassifier:
+				jvmConfig.PreferredArtifactClassifier = d.Value
+
+			case ScalaClearForcedTransitiveDeps:
+				if d.Value != "" {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected no values but got '%s'\n",
+						ScalaClearForcedTransitiveDeps,
+						d.Value,
+					)
+				}
+
+				jvmConfig.clearForcedTransitiveDeps()
 
-			case ScalaForcedTransitiveDeps:
+			case ScalaDepRewriters:
+				rewriterNames := []string{}
+				for _, name := range strings.Split(d.Value, ",") {
+					name = strings.TrimSpace(name)
+					if name == "" {
+						continue
+					}
+					if _, exists := depRewriters[name]; !exists {
+						log.Fatalf(
+							"Unknown dep rewriter '%s' for %s directive, expected one of %v\n",
+							name,
+							ScalaDepRewriters,
+							depRewriterNames(),
+						)
+					}
+					rewriterNames = append(rewriterNames, name)
+				}
+				jvmConfig.DepRewriters = rewriterNames
+
+			case ScalaExternalRepoMapping:
+				values := strings.Fields(d.Value)
+				if len(values) != 2 {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 2 values but got %v\n",
+						ScalaExternalRepoMapping,
+						values,
+					)
+				}
+
+				// Accept both Scala and Java style wildcards, e.g. com.foo._ or com.foo.*
+				prefix := strings.TrimSuffix(strings.TrimSuffix(values[0], "._"), ".*")
+				externalLabel, err := label.Parse(values[1])
+				if err != nil {
+					log.Fatalf(
+						"Invalid label for %s directive '%s': %s\n",
+						ScalaExternalRepoMapping,
+						values[1],
+						err,
+					)
+				} else if externalLabel.Repo == "" {
+					log.Fatalf(
+						"Invalid label for %s directive '%s': expected a label in another repo, "+
+							"use '# gazelle:%s' for labels in this repo\n",
+						ScalaExternalRepoMapping,
+						values[1],
+						ScalaResolvePrefix,
+					)
+				}
+				jvmConfig.ExternalRepoMappings[prefix] = externalLabel
+
+			case ScalaForcedTransitiveDeps, ScalaTestForcedTransitiveDeps:
 				values := strings.Split(d.Value, " ")
 				if len(values) != 2 {
 					log.Fatalf(
 						"Invalid config for %s directive. Expected 2 values but got %v\n",
-						ScalaForcedTransitiveDeps,
+						d.Key,
 						values,
 					)
 				}
@@ -186,14 +1009,175 @@ func (jc *JvmConfigurer) Configure(c *config.Config, rel string, f *rule.File) {
 				dep := values[0]
 				transitiveDeps := strings.Split(values[1], ",")
 
-				(*jvmConfig.ForcedTransitiveDeps)[dep] = transitiveDeps
+				if d.Key == ScalaTestForcedTransitiveDeps {
+					(*jvmConfig.TestForcedTransitiveDeps)[dep] = transitiveDeps
+				} else {
+					(*jvmConfig.ForcedTransitiveDeps)[dep] = transitiveDeps
+				}
+
+			case ScalaIgnoreImports:
+				for _, namespace := range strings.Split(d.Value, ",") {
+					namespace = strings.TrimSuffix(strings.TrimSpace(namespace), "._")
+					if namespace != "" {
+						ignoredImports.Add(namespace)
+					}
+				}
+
+			case ScalaIgnoreInRepoSymbol:
+				namespace := strings.TrimSuffix(strings.TrimSpace(d.Value), "._")
+				if namespace == "" {
+					log.Fatalf("Invalid config for %s directive. Expected a symbol\n", ScalaIgnoreInRepoSymbol)
+				}
+				ignoredInRepoSymbols.Add(namespace)
+
+			case ScalaMapCompilerImports:
+				switch strings.ToLower(d.Value) {
+				case "true":
+					jvmConfig.MapCompilerImports = true
+				case "false":
+					jvmConfig.MapCompilerImports = false
+				default:
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 'true' or 'false' but got '%v'\n",
+						ScalaMapCompilerImports,
+						d.Value,
+					)
+				}
+
+			case ScalaPackageAlias:
+				values := strings.Fields(d.Value)
+				if len(values) != 2 {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 2 values but got %v\n",
+						ScalaPackageAlias,
+						values,
+					)
+				}
+				jvmConfig.PackageAliases[values[0]] = values[1]
+
+			case ScalaPreferArtifact:
+				for _, artifactLabel := range strings.Split(d.Value, ",") {
+					artifactLabel = strings.TrimSpace(artifactLabel)
+					if artifactLabel != "" {
+						preferredArtifacts = append(preferredArtifacts, artifactLabel)
+					}
+				}
+
+			case ScalaResolvePrefix:
+				values := strings.Fields(d.Value)
+				if len(values) != 2 {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 2 values but got %v\n",
+						ScalaResolvePrefix,
+						values,
+					)
+				}
+
+				prefix := strings.TrimSuffix(values[0], "._")
+				prefixLabel, err := label.Parse(values[1])
+				if err != nil {
+					log.Fatalf(
+						"Invalid label for %s directive '%s': %s\n",
+						ScalaResolvePrefix,
+						values[1],
+						err,
+					)
+				}
+				jvmConfig.ResolvePrefixes[prefix] = prefixLabel.Abs("", rel)
+
+			case ScalaResolveThroughExports:
+				switch strings.ToLower(d.Value) {
+				case "true":
+					jvmConfig.ResolveThroughExports = true
+				case "false":
+					jvmConfig.ResolveThroughExports = false
+				default:
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 'true' or 'false' but got '%v'\n",
+						ScalaResolveThroughExports,
+						d.Value,
+					)
+				}
+
+			case ScalaResolveToAncestorPackage:
+				switch strings.ToLower(d.Value) {
+				case "true":
+					jvmConfig.ResolveToAncestorPackage = true
+				case "false":
+					jvmConfig.ResolveToAncestorPackage = false
+				default:
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 'true' or 'false' but got '%v'\n",
+						ScalaResolveToAncestorPackage,
+						d.Value,
+					)
+				}
+
+			case ScalaRuntimeDeps:
+				values := strings.Split(d.Value, " ")
+				if len(values) != 2 {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 2 values but got %v\n",
+						ScalaRuntimeDeps,
+						values,
+					)
+				}
+
+				(*jvmConfig.RuntimeDeps)[values[0]] = strings.Split(values[1], ",")
+
+			case ScalaStrictResolution:
+				switch strings.ToLower(d.Value) {
+				case "true":
+					jvmConfig.StrictResolution = true
+				case "false":
+					jvmConfig.StrictResolution = false
+				default:
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 'true' or 'false' but got '%v'\n",
+						ScalaStrictResolution,
+						d.Value,
+					)
+				}
+
+			case ScalaUnforceTransitiveDep:
+				values := strings.Split(d.Value, " ")
+				if len(values) != 2 {
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 2 values but got %v\n",
+						ScalaUnforceTransitiveDep,
+						values,
+					)
+				}
+
+				jvmConfig.removeForcedTransitiveDep(values[0], values[1])
 			}
 		}
 
+		if artifactAllows != nil {
+			jvmConfig.addAllowedArtifacts(artifactAllows)
+		}
+
 		if artifactExcludes != nil {
 			jvmConfig.addExcludedArtifacts(artifactExcludes)
 		}
 
+		if !sourceClassifierIncludes.Empty() {
+			jvmConfig.addIncludedSourceClassifiers(sourceClassifierIncludes)
+		}
+
+		if !ignoredImports.Empty() {
+			jvmConfig.addIgnoredImports(ignoredImports)
+		}
+
+		if !ignoredInRepoSymbols.Empty() {
+			jvmConfig.addIgnoredInRepoSymbols(ignoredInRepoSymbols)
+		}
+
+		if len(preferredArtifacts) > 0 {
+			// Build a new slice rather than appending, as the inherited one is shared.
+			jvmConfig.PreferredArtifacts = append(preferredArtifacts, jvmConfig.PreferredArtifacts...)
+		}
+
 		if mavenInstallFile != "" {
 			jvmConfig.setMavenInstall(c.RepoRoot, mavenInstallFile)
 		}
@@ -202,4 +1186,8 @@ func (jc *JvmConfigurer) Configure(c *config.Config, rel string, f *rule.File) {
 	if jvmConfig.MavenInstall == nil {
 		jvmConfig.setMavenInstall(c.RepoRoot, DEFAULT_MAVEN_INSTALL_FILE)
 	}
+
+	if packageIndexFile != "" {
+		jvmConfig.applyPackageIndex(c.RepoRoot, packageIndexFile, packageIndexOverrides)
+	}
 }
@@ -5,16 +5,20 @@ import "github.com/emirpasic/gods/sets/treeset"
 const (
 	LANGUAGE_NAME = "jvm"
 
+	DEFAULT_ARTIFACT_CLASSIFIER = "jar"
+
 	DEFAULT_MAVEN_INSTALL_FILE = "maven_install.json"
 	DEFAULT_MAVEN_REPO_NAME    = "maven"
 	DEFAULT_MAVEN_LABEL_PREFIX = "@" + DEFAULT_MAVEN_REPO_NAME + "//:"
+
+	PACKAGE_INDEX_OVERRIDE   = "override"
+	PACKAGE_INDEX_SUPPLEMENT = "supplement"
 )
 
 var (
-	DEFAULT_ARTIFACT_EXCLUDES = treeset.NewWithStringComparator(
-		// Built-in Scala libraries which are on the classpath by default.
-		"@maven//:org_scala_lang_scala_library",
-	)
+	// Maven coordinates of built-in Scala libraries which are on the classpath by default,
+	// and so are always excluded. Their labels follow the configured maven repository name.
+	DEFAULT_EXCLUDED_ARTIFACTS = []string{"org.scala-lang:scala-library"}
 
 	DEFAULT_PACKAGE_MAP = map[string]*treeset.Set{
 		// There is nothing here now, but packages may be added if they would otherwise need
@@ -23,4 +27,23 @@ var (
 	}
 
 	DEFAULT_FORCED_TRANSITIVE_DEPS = map[string][]string{}
+
+	// Namespaces provided by the Scala compiler jars rather than scala-library, mapped to
+	// the maven artifact providing them. The longest matching namespace wins. Only used
+	// when ScalaMapCompilerImports is enabled.
+	SCALA_COMPILER_NAMESPACES = map[string]string{
+		"scala.reflect.api":             "org_scala_lang_scala_reflect",
+		"scala.reflect.internal":        "org_scala_lang_scala_reflect",
+		"scala.reflect.io":              "org_scala_lang_scala_reflect",
+		"scala.reflect.macros":          "org_scala_lang_scala_reflect",
+		"scala.reflect.runtime":         "org_scala_lang_scala_reflect",
+		"scala.reflect.macros.contexts": "org_scala_lang_scala_compiler",
+		"scala.reflect.macros.runtime":  "org_scala_lang_scala_compiler",
+		"scala.reflect.quasiquotes":     "org_scala_lang_scala_compiler",
+		"scala.reflect.reify":           "org_scala_lang_scala_compiler",
+		"scala.tools.cmd":               "org_scala_lang_scala_compiler",
+		"scala.tools.nsc":               "org_scala_lang_scala_compiler",
+		"scala.tools.reflect":           "org_scala_lang_scala_compiler",
+		"scala.tools.util":              "org_scala_lang_scala_compiler",
+	}
 )
@@ -0,0 +1,192 @@
+package jvm
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/repo"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/emirpasic/gods/sets/treeset"
+)
+
+// AmbiguousSymbol records a used symbol which is provided by several labels.
+type AmbiguousSymbol struct {
+	Labels *treeset.Set
+	From   *treeset.Set
+}
+
+// CoverageReport collects the used symbols which could not be resolved or which are
+// provided ambiguously, keyed by symbol, so that symbol coverage can be audited without
+// failing on the first problem.
+type CoverageReport struct {
+	// The number of used symbols resolved, counted once per rule using them.
+	UsedSymbols int
+	// Symbols which could not be resolved, mapped to the rules using them.
+	Unresolved map[string]*treeset.Set
+	Ambiguous  map[string]*AmbiguousSymbol
+}
+
+func NewCoverageReport() *CoverageReport {
+	return &CoverageReport{
+		Unresolved: make(map[string]*treeset.Set),
+		Ambiguous:  make(map[string]*AmbiguousSymbol),
+	}
+}
+
+func (r *CoverageReport) recordResolution(symbol string, from label.Label, resolved bool) {
+	r.UsedSymbols++
+	if resolved {
+		return
+	}
+
+	if _, exists := r.Unresolved[symbol]; !exists {
+		r.Unresolved[symbol] = treeset.NewWithStringComparator()
+	}
+	r.Unresolved[symbol].Add(from.String())
+}
+
+func (r *CoverageReport) recordAmbiguous(symbol string, from label.Label, labels []string) {
+	ambiguous, exists := r.Ambiguous[symbol]
+	if !exists {
+		ambiguous = &AmbiguousSymbol{
+			Labels: treeset.NewWithStringComparator(),
+			From:   treeset.NewWithStringComparator(),
+		}
+		r.Ambiguous[symbol] = ambiguous
+	}
+
+	for _, symbolLabel := range labels {
+		ambiguous.Labels.Add(symbolLabel)
+	}
+	ambiguous.From.Add(from.String())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write prints a summary of the report, listing each unresolved or ambiguous symbol along
+// with the rules using it.
+func (r *CoverageReport) Write(w io.Writer) {
+	fmt.Fprintf(
+		w,
+		"%d used symbols, %d unresolved, %d ambiguous\n",
+		r.UsedSymbols,
+		len(r.Unresolved),
+		len(r.Ambiguous),
+	)
+
+	if len(r.Unresolved) != 0 {
+		fmt.Fprintf(w, "\nUnresolved symbols:\n")
+		for _, symbol := range sortedKeys(r.Unresolved) {
+			fmt.Fprintf(w, "  %s\n", symbol)
+			for _, from := range r.Unresolved[symbol].Values() {
+				fmt.Fprintf(w, "    used by %s\n", from)
+			}
+		}
+	}
+
+	if len(r.Ambiguous) != 0 {
+		fmt.Fprintf(w, "\nAmbiguous symbols:\n")
+		for _, symbol := range sortedKeys(r.Ambiguous) {
+			ambiguous := r.Ambiguous[symbol]
+			fmt.Fprintf(w, "  %s\n", symbol)
+			for _, symbolLabel := range ambiguous.Labels.Values() {
+				fmt.Fprintf(w, "    provided by %s\n", symbolLabel)
+			}
+			for _, from := range ambiguous.From.Values() {
+				fmt.Fprintf(w, "    used by %s\n", from)
+			}
+		}
+	}
+}
+
+// coverageResolver indexes a single rule providing every symbol defined in the sources
+// being audited.
+type coverageResolver struct {
+	definedSymbols *treeset.Set
+}
+
+func (*coverageResolver) Name() string { return LANGUAGE_NAME }
+
+func (cr *coverageResolver) Imports(
+	c *config.Config,
+	r *rule.Rule,
+	f *rule.File,
+) []resolve.ImportSpec {
+	importSpecs := make([]resolve.ImportSpec, 0, cr.definedSymbols.Size())
+	for _, symbol := range cr.definedSymbols.Values() {
+		importSpec := resolve.ImportSpec{Lang: LANGUAGE_NAME, Imp: symbol.(string)}
+		importSpecs = append(importSpecs, importSpec)
+	}
+	return importSpecs
+}
+
+func (*coverageResolver) Embeds(r *rule.Rule, from label.Label) []label.Label { return nil }
+
+func (*coverageResolver) Resolve(
+	c *config.Config,
+	ix *resolve.RuleIndex,
+	rc *repo.RemoteCache,
+	r *rule.Rule,
+	imports interface{},
+	from label.Label,
+) {
+}
+
+// CheckSymbolCoverage resolves the symbols used by each source file against the given maven
+// install lockfile and the symbols defined by the sources themselves, using the default
+// JvmConfig, and reports any which are unresolved or ambiguous. usedSymbolsBySource is keyed
+// by source file path, which is used as the name of the rule using each symbol.
+func CheckSymbolCoverage(
+	mavenInstallFile string,
+	definedSymbols *treeset.Set,
+	usedSymbolsBySource map[string]*UsedSymbols,
+) *CoverageReport {
+	c := config.New()
+	// Registers the '# gazelle:resolve' override config consulted by lookUpSymbol.
+	resolveConfigurer := resolve.Configurer{}
+	resolveConfigurer.RegisterFlags(flag.NewFlagSet("coverage", flag.ContinueOnError), "", c)
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = ParseMavenInstall(
+		mavenInstallFile,
+		jvmConfig.MavenLabelPrefix,
+		jvmConfig.MavenGroupLabelPrefixes,
+		jvmConfig.excludedArtifactLabels(),
+		jvmConfig.allowedArtifacts,
+		jvmConfig.includedSourceClassifiers,
+	)
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": jvmConfig}
+
+	resolver := &coverageResolver{definedSymbols: definedSymbols}
+	ruleIndex := resolve.NewRuleIndex(func(r *rule.Rule, pkgRel string) resolve.Resolver {
+		return resolver
+	})
+	ruleIndex.AddRule(c, rule.NewRule("scala_library", "sources"), rule.EmptyFile("BUILD", ""))
+	ruleIndex.Finish()
+
+	coverage := NewCoverageReport()
+	for _, source := range sortedKeys(usedSymbolsBySource) {
+		ResolveJvmSymbols(
+			c,
+			ruleIndex,
+			label.New("", "", source),
+			LANGUAGE_NAME,
+			usedSymbolsBySource[source],
+			ResolveOptions{Coverage: coverage},
+		)
+	}
+
+	return coverage
+}
@@ -0,0 +1,62 @@
+package jvm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emirpasic/gods/sets/treeset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSymbolCoverage(t *testing.T) {
+	mavenInstallFile := filepath.Join(t.TempDir(), "maven_install.json")
+	require.NoError(t, os.WriteFile(mavenInstallFile, []byte(`{
+		"version": "2",
+		"artifacts": {
+			"com.google.guava:guava": {"shasums": {"jar": "abc"}, "version": "1.0.0"},
+			"com.split:first": {"shasums": {"jar": "def"}, "version": "1.0.0"},
+			"com.split:second": {"shasums": {"jar": "ghi"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"com.google.guava:guava": ["com.google.common.collect"],
+			"com.split:first": ["com.split"],
+			"com.split:second": ["com.split"]
+		}
+	}`), 0644))
+
+	aSymbols := NewUsedSymbols()
+	aSymbols.Symbols.Add(
+		"com.example.util.Helper",
+		"com.google.common.collect.ImmutableList",
+		"com.missing.Thing",
+		"com.split.Widget",
+	)
+	bSymbols := NewUsedSymbols()
+	bSymbols.Symbols.Add("com.missing.Thing")
+	// Resolves relative to its package, com.example.
+	bSymbols.AddRelativeSymbol("util.Helper", "com.example")
+
+	coverage := CheckSymbolCoverage(
+		mavenInstallFile,
+		treeset.NewWithStringComparator("com.example.util", "com.example.util.Helper"),
+		map[string]*UsedSymbols{"src/A.scala": aSymbols, "src/B.scala": bSymbols},
+	)
+
+	var b strings.Builder
+	coverage.Write(&b)
+	require.Equal(t, `6 used symbols, 1 unresolved, 1 ambiguous
+
+Unresolved symbols:
+  com.missing.Thing
+    used by //:src/A.scala
+    used by //:src/B.scala
+
+Ambiguous symbols:
+  com.split.Widget
+    provided by @maven//:com_split_first
+    provided by @maven//:com_split_second
+    used by //:src/A.scala
+`, b.String())
+}
@@ -0,0 +1,83 @@
+package jvm
+
+import (
+	"log"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/emirpasic/gods/sets/treeset"
+)
+
+// ExportsIndex records which in-repo targets re-export other targets via their `exports`
+// attribute, so that symbols may be resolved to a facade target rather than the target
+// actually providing them. Labels are stored in their absolute string form.
+type ExportsIndex struct {
+	exporters map[string]*treeset.Set
+}
+
+func NewExportsIndex() *ExportsIndex {
+	return &ExportsIndex{
+		exporters: make(map[string]*treeset.Set),
+	}
+}
+
+// Resolves a possibly relative label string against the package it was found in.
+func absoluteLabel(labelString string, from label.Label) (string, error) {
+	parsedLabel, err := label.Parse(labelString)
+	if err != nil {
+		return "", err
+	}
+	return parsedLabel.Abs(from.Repo, from.Pkg).String(), nil
+}
+
+// AddRule indexes the `exports` attribute of the given rule in package pkg.
+func (ix *ExportsIndex) AddRule(r *rule.Rule, pkg string) {
+	ruleLabel := label.New("", pkg, r.Name())
+
+	for _, export := range r.AttrStrings("exports") {
+		exportedLabel, err := absoluteLabel(export, ruleLabel)
+		if err != nil {
+			log.Printf("WARN: Invalid label '%s' in exports of %s: %s\n", export, ruleLabel, err)
+			continue
+		}
+
+		if _, exists := ix.exporters[exportedLabel]; !exists {
+			ix.exporters[exportedLabel] = treeset.NewWithStringComparator()
+		}
+		ix.exporters[exportedLabel].Add(ruleLabel.String())
+	}
+}
+
+// exporterInDeps returns a target in deps which exports target, either directly or via
+// a chain of other exporting targets, preferring the closest one. Returns false if
+// target is itself in deps or no such exporter exists.
+func (ix *ExportsIndex) exporterInDeps(target string, deps *treeset.Set) (string, bool) {
+	if deps.Contains(target) {
+		return "", false
+	}
+
+	seen := treeset.NewWithStringComparator(target)
+	toCheck := []string{target}
+	for len(toCheck) > 0 {
+		nextTarget := toCheck[0]
+		toCheck = toCheck[1:]
+
+		exporters, exists := ix.exporters[nextTarget]
+		if !exists {
+			continue
+		}
+
+		for _, value := range exporters.Values() {
+			exporter := value.(string)
+			if deps.Contains(exporter) {
+				return exporter, true
+			}
+			if !seen.Contains(exporter) {
+				seen.Add(exporter)
+				toCheck = append(toCheck, exporter)
+			}
+		}
+	}
+
+	return "", false
+}
@@ -1,11 +1,17 @@
 package jvm
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
@@ -15,9 +21,160 @@ import (
 
 // ArtifactLabels: maven deps viable for resolve mapping
 // PackageMapping: package -> set of providing BUILD labels
+// ArtifactVariants: BUILD label -> the base artifact and classifier it was built from
 type MavenInstallData struct {
-	ArtifactLabels *treeset.Set
-	PackageMapping map[string]*treeset.Set
+	ArtifactLabels   *treeset.Set
+	PackageMapping   map[string]*treeset.Set
+	ArtifactVariants map[string]ArtifactVariant
+}
+
+// NewMavenInstallData builds maven install data directly from a mapping of packages to the
+// labels of the jars providing them, along with the labels of every usable jar, e.g. for
+// tests or tools embedding the resolver without a lockfile on disk.
+func NewMavenInstallData(
+	packageToLabels map[string][]string,
+	artifactLabels []string,
+) *MavenInstallData {
+	packageMapping := make(map[string]*treeset.Set, len(packageToLabels))
+	for pkg, labels := range packageToLabels {
+		packageMapping[pkg] = treeset.NewWithStringComparator()
+		for _, mavenLabel := range labels {
+			packageMapping[pkg].Add(mavenLabel)
+		}
+	}
+
+	artifacts := treeset.NewWithStringComparator()
+	for _, artifactLabel := range artifactLabels {
+		artifacts.Add(artifactLabel)
+	}
+
+	return &MavenInstallData{
+		ArtifactLabels:   artifacts,
+		PackageMapping:   packageMapping,
+		ArtifactVariants: make(map[string]ArtifactVariant),
+	}
+}
+
+// ArtifactVariant identifies one of the jars published for a maven artifact, e.g. the
+// plain jar (with classifier "jar") or a "tests" jar.
+type ArtifactVariant struct {
+	BaseLabel  string
+	Classifier string
+}
+
+// UsedSymbols contains the symbols used by a rule which need to be resolved to deps.
+// RelativeSymbols maps any of those symbols which may have been imported relative to an
+// enclosing package to the set of packages they may be relative to, while
+// AbsoluteSymbols holds those which were explicitly imported as absolute and so must
+// never be resolved relative to any package. Sources optionally maps symbols to the
+// 'file:line' locations they were used at, for error reporting. ExistingDeps and
+// ExistingRuntimeDeps hold the deps and runtime_deps of any existing rule being
+// regenerated, as written in its build file.
+type UsedSymbols struct {
+	Symbols         *treeset.Set
+	RelativeSymbols map[string]*treeset.Set
+	AbsoluteSymbols *treeset.Set
+	Sources         map[string]*treeset.Set
+	ExistingDeps    *treeset.Set
+	// Kept by ResolveRuntimeDeps alongside any labels configured via ScalaRuntimeDeps.
+	ExistingRuntimeDeps *treeset.Set
+	// Whether the symbols are used by a test rule, to which test-only forced transitive
+	// deps also apply.
+	IsTest bool
+}
+
+func NewUsedSymbols() *UsedSymbols {
+	return &UsedSymbols{
+		Symbols:             treeset.NewWithStringComparator(),
+		RelativeSymbols:     make(map[string]*treeset.Set),
+		AbsoluteSymbols:     treeset.NewWithStringComparator(),
+		Sources:             make(map[string]*treeset.Set),
+		ExistingDeps:        treeset.NewWithStringComparator(),
+		ExistingRuntimeDeps: treeset.NewWithStringComparator(),
+	}
+}
+
+func (u *UsedSymbols) AddRelativeSymbol(symbol string, pkg string) {
+	u.Symbols.Add(symbol)
+	if _, exists := u.RelativeSymbols[symbol]; !exists {
+		u.RelativeSymbols[symbol] = treeset.NewWithStringComparator()
+	}
+	u.RelativeSymbols[symbol].Add(pkg)
+}
+
+func (u *UsedSymbols) AddAbsoluteSymbol(symbol string) {
+	u.Symbols.Add(symbol)
+	u.AbsoluteSymbols.Add(symbol)
+}
+
+func (u *UsedSymbols) AddSymbolSource(symbol string, source string) {
+	if _, exists := u.Sources[symbol]; !exists {
+		u.Sources[symbol] = treeset.NewWithStringComparator()
+	}
+	u.Sources[symbol].Add(source)
+}
+
+// Describes where the given symbol was used, for appending to error messages. Returns an
+// empty string if no source locations were recorded for it.
+func (u *UsedSymbols) describeSources(symbol string) string {
+	sources, exists := u.Sources[symbol]
+	if !exists {
+		return ""
+	}
+
+	sourceStrings := make([]string, 0, sources.Size())
+	for _, source := range sources.Values() {
+		sourceStrings = append(sourceStrings, source.(string))
+	}
+	return fmt.Sprintf(" (used at %s)", strings.Join(sourceStrings, ", "))
+}
+
+// Without returns a copy of the used symbols with the given fully qualified symbols removed,
+// e.g. to drop references between the source files of a single target, which need no dep.
+// Relative symbols are also removed if they are relative to one of the given symbols.
+func (u *UsedSymbols) Without(symbols *treeset.Set) *UsedSymbols {
+	difference := u.Union(NewUsedSymbols())
+	remove := func(symbol string) {
+		difference.Symbols.Remove(symbol)
+		delete(difference.RelativeSymbols, symbol)
+		difference.AbsoluteSymbols.Remove(symbol)
+		delete(difference.Sources, symbol)
+	}
+
+	for symbol, packages := range u.RelativeSymbols {
+		for _, pkg := range packages.Values() {
+			if symbols.Contains(pkg.(string) + "." + symbol) {
+				remove(symbol)
+				break
+			}
+		}
+	}
+	for _, symbol := range symbols.Values() {
+		remove(symbol.(string))
+	}
+	return difference
+}
+
+func (u *UsedSymbols) Union(other *UsedSymbols) *UsedSymbols {
+	union := NewUsedSymbols()
+	union.Symbols = u.Symbols.Union(other.Symbols)
+	union.AbsoluteSymbols = u.AbsoluteSymbols.Union(other.AbsoluteSymbols)
+	union.ExistingDeps = u.ExistingDeps.Union(other.ExistingDeps)
+	union.ExistingRuntimeDeps = u.ExistingRuntimeDeps.Union(other.ExistingRuntimeDeps)
+	union.IsTest = u.IsTest || other.IsTest
+	for _, usedSymbols := range []*UsedSymbols{u, other} {
+		for symbol, packages := range usedSymbols.RelativeSymbols {
+			for _, pkg := range packages.Values() {
+				union.AddRelativeSymbol(symbol, pkg.(string))
+			}
+		}
+		for symbol, sources := range usedSymbols.Sources {
+			for _, source := range sources.Values() {
+				union.AddSymbolSource(symbol, source.(string))
+			}
+		}
+	}
+	return union
 }
 
 func jarToLabel(jarOrJarPath string, mavenLabelPrefix string) string {
@@ -34,82 +191,397 @@ func jarToLabel(jarOrJarPath string, mavenLabelPrefix string) string {
 	return mavenLabelPrefix + rewritten
 }
 
+// Returns the label prefix for the given maven artifact coordinates, using the longest
+// matching coordinate prefix in groupLabelPrefixes if any.
+func mavenLabelPrefixForArtifact(
+	artifact string,
+	mavenLabelPrefix string,
+	groupLabelPrefixes map[string]string,
+) string {
+	longestMatch := ""
+	for coordinatePrefix, labelPrefix := range groupLabelPrefixes {
+		if strings.HasPrefix(artifact, coordinatePrefix) &&
+			len(coordinatePrefix) > len(longestMatch) {
+			longestMatch = coordinatePrefix
+			mavenLabelPrefix = labelPrefix
+		}
+	}
+
+	return mavenLabelPrefix
+}
+
+// Parsed lockfiles keyed by mavenInstallCacheKey, as packages may parse the same lockfile with
+// different label prefixes, excludes, allows or source classifier includes.
 var mavenInstallCache map[string]*MavenInstallData = make(map[string]*MavenInstallData)
 
-func ParseMavenInstall(
+// mavenInstallCacheKey returns a key identifying a lockfile path together with every other
+// input of ParseMavenInstall which affects its result.
+func mavenInstallCacheKey(
 	path string,
 	mavenLabelPrefix string,
+	groupLabelPrefixes map[string]string,
 	artifactExcludes *treeset.Set,
-) *MavenInstallData {
-	if mavenInstallData, exists := mavenInstallCache[path]; exists {
-		return mavenInstallData
+	artifactAllows *treeset.Set,
+	sourceClassifierIncludes *treeset.Set,
+) string {
+	groupPrefixes := make([]string, 0, len(groupLabelPrefixes))
+	for coordinatePrefix, labelPrefix := range groupLabelPrefixes {
+		groupPrefixes = append(groupPrefixes, coordinatePrefix+"="+labelPrefix)
+	}
+	slices.Sort(groupPrefixes)
+
+	parts := []string{path, mavenLabelPrefix, strings.Join(groupPrefixes, ",")}
+	for _, labels := range []*treeset.Set{
+		artifactExcludes,
+		artifactAllows,
+		sourceClassifierIncludes,
+	} {
+		labelStrings := []string{}
+		if labels != nil {
+			for _, value := range labels.Values() {
+				labelStrings = append(labelStrings, value.(string))
+			}
+		}
+		parts = append(parts, strings.Join(labelStrings, ","))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// A single jar listed in a maven install lockfile, independent of the lockfile format.
+type lockfileArtifact struct {
+	// Maven coordinates without a version or classifier, e.g. "com.example:widgets".
+	artifact   string
+	classifier string
+	packages   []string
+}
+
+// Reads the jars listed in a v1 lockfile, which nests them under a dependency tree:
+//
+//	{"dependency_tree": {"version": "0.1.0", "dependencies": [
+//	    {"coord": "com.example:widgets:jar:tests:1.0.0", "packages": [...], ...}, ...]}}
+func readLockfileV1(dependencyTree map[string]interface{}) ([]lockfileArtifact, error) {
+	dependencies, ok := dependencyTree["dependencies"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a 'dependency_tree.dependencies' list")
+	}
+
+	artifacts := make([]lockfileArtifact, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		dependencyData, ok := dependency.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected each dependency to be an object, found: %v", dependency)
+		}
+		coord, ok := dependencyData["coord"].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a 'coord' string for dependency: %v", dependency)
+		}
+
+		// Coordinates are either group:artifact:version or
+		// group:artifact:packaging:classifier:version.
+		parts := strings.Split(coord, ":")
+		classifier := DEFAULT_ARTIFACT_CLASSIFIER
+		switch len(parts) {
+		case 3, 4:
+		case 5:
+			classifier = parts[3]
+		default:
+			return nil, fmt.Errorf("unexpected maven coordinates '%s'", coord)
+		}
+
+		// Like the v2 format, only jars which provide packages are listed.
+		packagesData, ok := dependencyData["packages"]
+		if !ok {
+			continue
+		}
+		packages, err := readLockfilePackages(packagesData, coord)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, lockfileArtifact{
+			artifact:   parts[0] + ":" + parts[1],
+			classifier: classifier,
+			packages:   packages,
+		})
+	}
+
+	return artifacts, nil
+}
+
+// Reads the jars listed in a v2 lockfile, which keeps the packages of each jar separately
+// from its checksums:
+//
+//	{"version": "2",
+//	 "artifacts": {"com.example:widgets": {"shasums": {"jar": ..., "tests": ...}, ...}},
+//	 "packages": {"com.example:widgets:jar:tests": [...], ...}}
+//
+// Some configurations write lockfiles without the package index, in which case every jar is
+// listed without any packages, and imports can only be resolved to them via overrides.
+func readLockfileV2(
+	path string,
+	installJSON map[string]interface{},
+) ([]lockfileArtifact, error) {
+	artifactsJSON, ok := installJSON["artifacts"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an 'artifacts' object")
+	}
+
+	packagesJSON := make(map[string]interface{})
+	hasPackages := false
+	if packagesData, exists := installJSON["packages"]; exists {
+		if packagesJSON, ok = packagesData.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("expected 'packages' to be an object")
+		}
+		hasPackages = true
+	} else {
+		log.Printf(
+			"WARN: No 'packages' index in maven install lockfile %s, so no imports will be "+
+				"resolved to its artifacts. Check your rules_jvm_external configuration.\n",
+			path,
+		)
+	}
+
+	artifacts := make([]lockfileArtifact, 0, len(artifactsJSON))
+	for artifact, artifactData := range artifactsJSON {
+		artifactDataJSON, ok := artifactData.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected artifact '%s' to be an object", artifact)
+		}
+		shasums, ok := artifactDataJSON["shasums"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a 'shasums' object for artifact '%s'", artifact)
+		}
+
+		for classifier := range shasums {
+			classifiedArtifact := artifact
+			if classifier != DEFAULT_ARTIFACT_CLASSIFIER {
+				classifiedArtifact = fmt.Sprintf("%s:jar:%s", classifiedArtifact, classifier)
+			}
+
+			if !hasPackages {
+				artifacts = append(artifacts, lockfileArtifact{
+					artifact:   artifact,
+					classifier: classifier,
+				})
+			} else if packagesData, ok := packagesJSON[classifiedArtifact]; ok {
+				packages, err := readLockfilePackages(packagesData, classifiedArtifact)
+				if err != nil {
+					return nil, err
+				}
+				artifacts = append(artifacts, lockfileArtifact{
+					artifact:   artifact,
+					classifier: classifier,
+					packages:   packages,
+				})
+			}
+		}
+	}
+
+	return artifacts, nil
+}
+
+func readLockfilePackages(packagesData interface{}, artifact string) ([]string, error) {
+	packagesJSON, ok := packagesData.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of packages for '%s'", artifact)
+	}
+
+	packages := make([]string, 0, len(packagesJSON))
+	for _, pkg := range packagesJSON {
+		packageName, ok := pkg.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected package names for '%s' to be strings", artifact)
+		}
+		packages = append(packages, packageName)
+	}
+
+	return packages, nil
+}
+
+// Detects the format of the given lockfile and reads the jars it lists. Lockfiles written
+// by rules_jvm_external before its v2 format have no top level version, but nest everything
+// under a dependency tree instead.
+func readLockfile(path string, installJSON map[string]interface{}) ([]lockfileArtifact, error) {
+	if dependencyTree, ok := installJSON["dependency_tree"].(map[string]interface{}); ok {
+		return readLockfileV1(dependencyTree)
+	}
+
+	version, hasVersion := installJSON["version"]
+	switch version {
+	case "2":
+		return readLockfileV2(path, installJSON)
+	case nil:
+		if !hasVersion {
+			return readLockfileV2(path, installJSON)
+		}
 	}
 
+	return nil, fmt.Errorf("unsupported lockfile version %v", version)
+}
+
+// readMavenInstallJSON decodes the maven install lockfile at path, decompressing it first if
+// it has a .gz file extension.
+func readMavenInstallJSON(path string) (map[string]interface{}, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("Error opening maven_install.json: %s\n", err)
+		return nil, err
 	}
 	defer file.Close()
 
+	var reader io.Reader = file
+	if filepath.Ext(path) == ".gz" {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt gzip stream: %w", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
 	var installJSON map[string]interface{}
-	if err := json.NewDecoder(file).Decode(&installJSON); err != nil {
-		log.Fatalf("Error reading maven_install.json: %s\n", err)
+	if err := json.NewDecoder(reader).Decode(&installJSON); err != nil {
+		return nil, err
 	}
+	return installJSON, nil
+}
 
-	artifacts := treeset.NewWithStringComparator()
-	inversed := make(map[string]*treeset.Set)
-	for artifact, artifactData := range installJSON["artifacts"].(map[string]interface{}) {
-		for classifier := range artifactData.(map[string]interface{})["shasums"].(map[string]interface{}) {
-			classifiedArtifact := artifact
-			if classifier == "sources" {
-				// There are technically source jars which contain compiled classfiles, but there
-				// is probably no situation in which depending on them is correct.
-				continue
+// ParseMavenInstall reads the maven install lockfile at path, skipping artifacts which
+// match artifactExcludes (see JavaExcludeArtifact) unless they are in artifactAllows, and
+// source jars unless their artifact is in sourceClassifierIncludes (see
+// JavaIncludeSourceClassifier). Both the v1 and v2 lockfile formats of rules_jvm_external
+// are supported, either as plain json or gzipped with a .gz file extension.
+func ParseMavenInstall(
+	path string,
+	mavenLabelPrefix string,
+	groupLabelPrefixes map[string]string,
+	artifactExcludes *treeset.Set,
+	artifactAllows *treeset.Set,
+	sourceClassifierIncludes *treeset.Set,
+) *MavenInstallData {
+	cacheKey := mavenInstallCacheKey(
+		path,
+		mavenLabelPrefix,
+		groupLabelPrefixes,
+		artifactExcludes,
+		artifactAllows,
+		sourceClassifierIncludes,
+	)
+	if mavenInstallData, exists := mavenInstallCache[cacheKey]; exists {
+		return mavenInstallData
+	}
 
-			} else if classifier != "jar" {
-				classifiedArtifact = fmt.Sprintf("%s:jar:%s", classifiedArtifact, classifier)
-			}
+	installJSON, err := readMavenInstallJSON(path)
+	if err != nil {
+		log.Fatalf("Error reading maven install lockfile %s: %s\n", path, err)
+	}
 
-			if packages, ok := installJSON["packages"].(map[string]interface{})[classifiedArtifact]; ok {
-				label := jarToLabel(classifiedArtifact, mavenLabelPrefix)
-				if artifactExcludes.Contains(label) {
-					continue
-				}
+	lockfileArtifacts, err := readLockfile(path, installJSON)
+	if err != nil {
+		log.Fatalf("Error reading maven install lockfile %s: %s\n", path, err)
+	}
 
-				// TODO(jacob): When using `strict_visibility = True` with rules_jvm_external,
-				//		the lockfile still contains transitive jars that are not actually usable as
-				//		dependencies (they generate with private visibility). We could query for
-				//		viable labels via `attr(visibility, //visibility:public, kind(jvm_import, @maven//:all))`,
-				//		but that is potentially slow so instead we just ignore conflicting labels
-				//		manually. It would be nice to have an automated solution here though.
-				artifacts.Add(label)
-
-				for _, pkg := range packages.([]interface{}) {
-					packageName := pkg.(string)
-					if _, exists := inversed[packageName]; !exists {
-						inversed[packageName] = treeset.NewWithStringComparator()
-					}
-					inversed[packageName].Add(label)
-				}
-			}
+	artifacts := []string{}
+	inversed := make(map[string][]string)
+	variants := make(map[string]ArtifactVariant)
+	for _, lockfileArtifact := range lockfileArtifacts {
+		artifact := lockfileArtifact.artifact
+		classifier := lockfileArtifact.classifier
+		labelPrefix := mavenLabelPrefixForArtifact(artifact, mavenLabelPrefix, groupLabelPrefixes)
+
+		classifiedArtifact := artifact
+		if classifier == "sources" &&
+			!sourceClassifierIncludes.Contains(jarToLabel(artifact, labelPrefix)) {
+			// There are technically source jars which contain compiled classfiles, but there
+			// is almost never a situation in which depending on them is correct.
+			continue
+		}
+
+		if classifier != DEFAULT_ARTIFACT_CLASSIFIER {
+			classifiedArtifact = fmt.Sprintf("%s:jar:%s", classifiedArtifact, classifier)
+		}
+
+		label := jarToLabel(classifiedArtifact, labelPrefix)
+		if matchesArtifact(label, artifactExcludes) && !artifactAllows.Contains(label) {
+			continue
+		}
+
+		// TODO(jacob): When using `strict_visibility = True` with rules_jvm_external,
+		//		the lockfile still contains transitive jars that are not actually usable as
+		//		dependencies (they generate with private visibility). We could query for
+		//		viable labels via `attr(visibility, //visibility:public, kind(jvm_import, @maven//:all))`,
+		//		but that is potentially slow so instead we just ignore conflicting labels
+		//		manually. It would be nice to have an automated solution here though.
+		artifacts = append(artifacts, label)
+		variants[label] = ArtifactVariant{
+			BaseLabel:  jarToLabel(artifact, labelPrefix),
+			Classifier: classifier,
+		}
+
+		for _, packageName := range lockfileArtifact.packages {
+			inversed[packageName] = append(inversed[packageName], label)
 		}
 	}
 
+	mavenInstallData := NewMavenInstallData(inversed, artifacts)
+	mavenInstallData.ArtifactVariants = variants
+
 	for pkg, mavenLabels := range DEFAULT_PACKAGE_MAP {
 		// parsed maven package map takes priority over defaults
-		if _, exists := inversed[pkg]; !exists {
-			inversed[pkg] = mavenLabels
+		if _, exists := mavenInstallData.PackageMapping[pkg]; !exists {
+			mavenInstallData.PackageMapping[pkg] = mavenLabels
 		}
 	}
 
-	mavenInstallData := &MavenInstallData{
-		ArtifactLabels: artifacts,
-		PackageMapping: inversed,
-	}
-	mavenInstallCache[path] = mavenInstallData
+	mavenInstallCache[cacheKey] = mavenInstallData
 	return mavenInstallData
 }
 
+// ReadPackageIndex reads a sidecar package index, a json object mapping package names to
+// the labels of the jars providing them.
+func ReadPackageIndex(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var packageIndex map[string][]string
+	if err := json.NewDecoder(file).Decode(&packageIndex); err != nil {
+		return nil, err
+	}
+	return packageIndex, nil
+}
+
+// WithPackageIndex returns a copy of the maven install data with the given package index
+// merged into its package mapping. If override is set, the index's labels replace those
+// derived from the lockfile for any package both provide. Otherwise the index only adds
+// packages which the lockfile does not provide. Labels which are not among ArtifactLabels
+// are kept in the mapping, but are never visible as deps.
+func (m *MavenInstallData) WithPackageIndex(
+	packageIndex map[string][]string,
+	override bool,
+) *MavenInstallData {
+	packageMapping := make(map[string]*treeset.Set, len(m.PackageMapping)+len(packageIndex))
+	for pkg, mavenLabels := range m.PackageMapping {
+		packageMapping[pkg] = mavenLabels
+	}
+
+	for pkg, labels := range packageIndex {
+		if _, exists := packageMapping[pkg]; exists && !override {
+			continue
+		}
+		packageMapping[pkg] = treeset.NewWithStringComparator()
+		for _, mavenLabel := range labels {
+			packageMapping[pkg].Add(mavenLabel)
+		}
+	}
+
+	return &MavenInstallData{
+		ArtifactLabels:   m.ArtifactLabels,
+		PackageMapping:   packageMapping,
+		ArtifactVariants: m.ArtifactVariants,
+	}
+}
+
 func forcedTransitiveDepsForDep(
 	forcedDepsMap *map[string][]string,
 	symbolLabel string,
@@ -134,17 +606,76 @@ func forcedTransitiveDepsForDep(
 	return forcedDeps
 }
 
+// Guesses whether the given name refers to a type or object rather than a package, following
+// the convention that only the former start with an uppercase letter. Backticks quoting the
+// name are ignored, as are any leading underscores. Names which are empty or start with a
+// digit are never considered symbols.
 func isSymbol(name string) bool {
-	// Blindly assume the given name is a symbol and not a package if it isn't lowercased.
-	return name != strings.ToLower(name)
+	name = strings.TrimLeft(strings.Trim(name, "`"), "_")
+	firstRune, size := utf8.DecodeRuneInString(name)
+	if size == 0 || firstRune == utf8.RuneError {
+		return false
+	}
+	return unicode.IsUpper(firstRune) || unicode.IsTitle(firstRune)
 }
 
+// Returns the scopes to look symbol up under, from most to least specific. These are the
+// symbol itself, its enclosing scope, and then any further enclosing types up to the
+// package containing the outermost one. Imports of in-repo classes and packages generally
+// match the symbol itself, while maven jars are only indexed by package. For example,
+// org.jboss.netty.buffer.ChannelBuffers.copiedBuffer yields itself,
+// org.jboss.netty.buffer.ChannelBuffers and org.jboss.netty.buffer.
+func candidateScopes(symbol string) []string {
+	candidates := []string{symbol}
+	scope := symbol
+	for lastDotIndex := strings.LastIndex(scope, "."); lastDotIndex != -1; {
+		// The symbol itself may be a member of any name, e.g. a function in a package object,
+		// but beyond that we only peel off enclosing types.
+		if len(candidates) > 1 && !isSymbol(scope[lastDotIndex+1:]) {
+			break
+		}
+		scope = scope[:lastDotIndex]
+		candidates = append(candidates, scope)
+		lastDotIndex = strings.LastIndex(scope, ".")
+	}
+	return candidates
+}
+
+// Returns the JVM binary name of the class symbol refers to or is a member of, with nested classes
+// separated by $ rather than dots, along with the package containing that class. The class
+// is taken to start at the first capitalized segment of symbol and to extend over any
+// capitalized segments directly following it. For example, com.foo.Outer.Inner.method and
+// com.foo.Outer.Inner.field.Value both yield com.foo.Outer$Inner and com.foo. Returns false
+// if symbol has no capitalized segment, or starts with one.
+func nestedClassBinaryName(symbol string) (string, string, bool) {
+	segments := strings.Split(symbol, ".")
+	for i := 0; i < len(segments); i++ {
+		if !isSymbol(segments[i]) {
+			continue
+		} else if i == 0 {
+			return "", "", false
+		}
+		end := i + 1
+		for end < len(segments) && isSymbol(segments[end]) {
+			end++
+		}
+		pkg := strings.Join(segments[:i], ".")
+		return pkg + "." + strings.Join(segments[i:end], "$"), pkg, true
+	}
+	return "", "", false
+}
+
+// lookUpSymbol returns the labels providing symbol according to any resolve directives,
+// then any ScalaResolvePrefix directives, then the rule index unless skipRuleIndex is set.
+// If a directive provided the label, the name of that directive is returned as well.
 func lookUpSymbol(
 	c *config.Config,
+	jvmConfig *JvmConfig,
 	ruleIndex *resolve.RuleIndex,
 	lang string,
 	symbol string,
-) []label.Label {
+	skipRuleIndex bool,
+) ([]label.Label, string) {
 	importSpec := resolve.ImportSpec{
 		Lang: lang,
 		Imp:  symbol,
@@ -154,7 +685,30 @@ func lookUpSymbol(
 	//	namespace against this map, so that e.g. we can just list org.apache.thrift once
 	//	rather than having to list all its sub-packages individually.
 	if overrideLabel, exists := resolve.FindRuleWithOverride(c, importSpec, lang); exists {
-		return []label.Label{overrideLabel}
+		return []label.Label{overrideLabel}, "resolve"
+	}
+
+	if prefixLabel, exists := jvmConfig.resolvePrefixLabel(symbol); exists {
+		return []label.Label{prefixLabel}, ScalaResolvePrefix
+	}
+
+	if skipRuleIndex {
+		return nil, ""
+	}
+
+	return lookUpRuleIndex(c, ruleIndex, lang, symbol), ""
+}
+
+// lookUpRuleIndex returns the labels of the rules in the rule index providing symbol.
+func lookUpRuleIndex(
+	c *config.Config,
+	ruleIndex *resolve.RuleIndex,
+	lang string,
+	symbol string,
+) []label.Label {
+	importSpec := resolve.ImportSpec{
+		Lang: lang,
+		Imp:  symbol,
 	}
 
 	// NOTE(jacob): CrossResolve functions for other languages are called here via
@@ -169,140 +723,443 @@ func lookUpSymbol(
 	return labels
 }
 
+// lookUpPackageDirectory returns the labels of the rules in the rule index providing the
+// package pkg which live in the Bazel package directory matching its path, e.g. those in
+// //src/main/scala/com/foo for com.foo.
+func lookUpPackageDirectory(
+	c *config.Config,
+	ruleIndex *resolve.RuleIndex,
+	lang string,
+	pkg string,
+) []label.Label {
+	pkgPath := strings.ReplaceAll(pkg, ".", "/")
+	var labels []label.Label
+	for _, indexLabel := range lookUpRuleIndex(c, ruleIndex, lang, pkg) {
+		if indexLabel.Repo == "" &&
+			(indexLabel.Pkg == pkgPath || strings.HasSuffix(indexLabel.Pkg, "/"+pkgPath)) {
+			labels = append(labels, indexLabel)
+		}
+	}
+	return labels
+}
+
+// logDirectiveResolution logs that symbol was resolved to chosenLabel via the given
+// directive, rather than by the rule index or maven install alone, along with all of the
+// candidate labels it was chosen over. Used when VerboseResolve is set.
+func logDirectiveResolution(
+	from label.Label,
+	lang string,
+	symbol string,
+	chosenLabel string,
+	directive string,
+	candidates *treeset.Set,
+) {
+	log.Printf(
+		"Resolved %s for %s (%s) to %s via '# gazelle:%s', candidates: %v\n",
+		symbol,
+		from,
+		lang,
+		chosenLabel,
+		directive,
+		candidates.Values(),
+	)
+}
+
+// ResolveOptions holds the optional collaborators consulted or updated while resolving
+// symbols. The zero value resolves without any of them.
+type ResolveOptions struct {
+	// ExportsIndex is only consulted if the package is configured to resolve through
+	// exports.
+	ExportsIndex *ExportsIndex
+	// If set, every resolution decision is recorded to Trace.
+	Trace *ResolveTrace
+	// If set, unresolved and ambiguous symbols are recorded to Coverage rather than
+	// ambiguities failing the run.
+	Coverage *CoverageReport
+	// If set, symbols which resolve to nothing in packages with ScalaStrictResolution
+	// enabled are recorded to Unresolved.
+	Unresolved *UnresolvedSymbols
+}
+
+// ResolveJvmSymbols resolves usedSymbols to the set of labels from should depend on,
+// consulting and recording to the collaborators given in opts. Any rewriters configured
+// via ScalaDepRewriters are applied to the deps last of all.
 func ResolveJvmSymbols(
 	c *config.Config,
 	ruleIndex *resolve.RuleIndex,
 	from label.Label,
 	lang string,
-	usedSymbols *treeset.Set,
+	usedSymbols *UsedSymbols,
+	opts ResolveOptions,
 ) *treeset.Set {
+	exportsIndex := opts.ExportsIndex
+	trace := opts.Trace
+	coverage := opts.Coverage
+	unresolved := opts.Unresolved
+
 	jvmConfig := JvmConfigForConfig(c, from.Pkg)
+	strict := unresolved != nil && jvmConfig.StrictResolution
 	deps := treeset.NewWithStringComparator()
 
+	existingDeps := treeset.NewWithStringComparator()
+	if jvmConfig.ResolveThroughExports && exportsIndex != nil {
+		for _, value := range usedSymbols.ExistingDeps.Values() {
+			if existingDep, err := absoluteLabel(value.(string), from); err == nil {
+				existingDeps.Add(existingDep)
+			}
+		}
+	}
+
+	forcedDepsMap := jvmConfig.forcedTransitiveDeps(usedSymbols.IsTest)
 	addDep := func(dep string) {
-		if !jvmConfig.excludedArtifacts.Contains(dep) {
-			forcedDeps := forcedTransitiveDepsForDep(jvmConfig.ForcedTransitiveDeps, dep)
+		if !jvmConfig.isExcludedArtifact(dep) {
+			forcedDeps := forcedTransitiveDepsForDep(forcedDepsMap, dep)
 			deps = deps.Union(forcedDeps)
 		}
 	}
 
-	usedSymbolsIter := usedSymbols.Iterator()
-	for usedSymbolsIter.Next() {
-		symbol := usedSymbolsIter.Value().(string)
+	// Attempts to resolve a single symbol to its providing label(s) and add them as deps.
+	// Returns false if the symbol could not be mapped to anything at all. usedSymbol is the
+	// symbol as recorded in usedSymbols, which may differ for relative imports.
+	resolveSymbol := func(symbol string, usedSymbol string) bool {
 		originalSymbol := symbol
+		usedAt := usedSymbols.describeSources(usedSymbol)
+
+		// Track the lookups attempted and labels chosen for the resolve trace.
+		lookups := []string{}
+		chosenLabels := []string{}
+		if trace != nil {
+			defer func() {
+				trace.record(ResolveDecision{
+					From:    from.String(),
+					Symbol:  originalSymbol,
+					Lookups: lookups,
+					Labels:  chosenLabels,
+				})
+			}()
+		}
+
+		// The directive which provided the labels from the last index lookup, if any.
+		indexDirective := ""
+		lookUpIndex := func(symbol string) []label.Label {
+			var labels []label.Label
+			if jvmConfig.isIgnoredInRepoSymbol(symbol) {
+				lookups = append(lookups, "ignored_in_repo "+symbol)
+				labels, indexDirective = lookUpSymbol(c, jvmConfig, ruleIndex, lang, symbol, true)
+			} else {
+				lookups = append(lookups, "rule_index "+symbol)
+				labels, indexDirective = lookUpSymbol(c, jvmConfig, ruleIndex, lang, symbol, false)
+			}
+			return labels
+		}
+		lookUpPackage := func(pkg string) (*treeset.Set, bool) {
+			if aliasedPkg := jvmConfig.aliasedPackage(pkg); aliasedPkg != pkg {
+				lookups = append(lookups, "package_alias "+pkg)
+				pkg = aliasedPkg
+			}
+			lookups = append(lookups, "maven_package "+pkg)
+			mavenLabels, exists := jvmConfig.MavenInstall.PackageMapping[pkg]
+			return mavenLabels, exists
+		}
+		chooseDep := func(dep string) {
+			chosenLabels = append(chosenLabels, dep)
+			addDep(dep)
+		}
 
 		// Remove absolute path prefix in Scala imports.
 		symbol = strings.TrimPrefix(symbol, "_root_.")
 		// Wildcard imports are not in the symbol map explicitly.
 		symbol = strings.TrimSuffix(symbol, "._")
 
+		if jvmConfig.isIgnoredImport(symbol) {
+			lookups = append(lookups, "ignored "+symbol)
+			if strict {
+				unresolved.recordIgnored()
+			}
+			return true
+		}
+
+		if compilerLabel, ok := jvmConfig.compilerLabelForSymbol(symbol); ok {
+			lookups = append(lookups, "compiler_namespace "+symbol)
+			chooseDep(compilerLabel)
+			return true
+		}
+
+		// Look up each candidate scope of the symbol in turn, stopping at the first which
+		// either the rule index or the maven package mapping knows about. Note that we always
+		// check the package mapping even if we found a providing label in the rule index, as
+		// maven jars take precedence over in-repo targets where package namespace shadowing is
+		// concerned.
 		var labels []label.Label
 		var mavenLabels *treeset.Set
 		var packageExists bool
+		candidates := candidateScopes(symbol)
+		for _, candidate := range candidates {
+			symbol = candidate
+			labels = lookUpIndex(candidate)
+			mavenLabels, packageExists = lookUpPackage(candidate)
+			if len(labels) > 0 || packageExists {
+				break
+			}
+		}
 
-		runLookupWithFallback := func(skipIsSymbolCheck bool) {
-			if labels = lookUpSymbol(c, ruleIndex, lang, symbol); len(labels) == 0 {
-				mavenLabels, packageExists = jvmConfig.MavenInstall.PackageMapping[symbol]
-				if !packageExists && strings.Contains(symbol, ".") {
-					lastDotIndex := strings.LastIndex(symbol, ".")
-					if skipIsSymbolCheck || isSymbol(symbol[lastDotIndex+1:]) {
-						symbol = symbol[:lastDotIndex]
-					}
+		// Fall back to treating capitalized segments as nested Java classes, which may be
+		// indexed under their $-separated binary name, and their containing package. This
+		// catches symbols the candidate scopes stop short of, e.g. com.foo.Outer.field.Value.
+		if len(labels) == 0 && !packageExists {
+			binaryName, pkg, ok := nestedClassBinaryName(candidates[0])
+			// Skip any scopes the candidate scopes already covered.
+			lookUpClass := ok && !slices.Contains(candidates, binaryName)
+			lookUpClassPackage := ok && !slices.Contains(candidates, pkg)
+			if lookUpClass || lookUpClassPackage {
+				lookups = append(lookups, "nested_class "+binaryName)
+				if lookUpClass {
+					labels = lookUpIndex(binaryName)
+				}
+				if lookUpClassPackage {
+					mavenLabels, packageExists = lookUpPackage(pkg)
+				}
+				if len(labels) > 0 {
+					symbol = binaryName
+				} else if packageExists {
+					symbol = pkg
 				}
 			}
 		}
 
-		// Happy path: our first lookup here succeeds without any further help. This generally
-		// includes most imports of in-repo classes or imports of packages.
-		//
-		// We always fall back to peeling off the last node of the symbol here in the event of an
-		// unsuccessful lookup, to ensure imports of functions or variables will fall back to
-		// looking up their containing scope.
-		runLookupWithFallback(true)
+		// Fall back to the target of the nearest enclosing package in an ancestor directory,
+		// starting above the least specific scope already looked up.
+		if len(labels) == 0 && !packageExists && jvmConfig.ResolveToAncestorPackage {
+			for pkg := symbol; strings.Count(pkg, ".") > 1; {
+				pkg = pkg[:strings.LastIndex(pkg, ".")]
+				if jvmConfig.isIgnoredInRepoSymbol(pkg) {
+					continue
+				}
+				lookups = append(lookups, "ancestor_package "+pkg)
+				if labels = lookUpPackageDirectory(c, ruleIndex, lang, pkg); len(labels) > 0 {
+					symbol = pkg
+					break
+				}
+			}
+		}
 
-		// Second try: we look up the containing scope of the original symbol. This catches most
-		// imports of symbols from maven jars, which are indexed at the package level.
+		// Fall back to any external repo the symbol's prefix is mapped to.
 		if len(labels) == 0 && !packageExists {
-			runLookupWithFallback(false)
-		}
-
-		// One final go... catches cases like org.jboss.netty.buffer.ChannelBuffers.copiedBuffer
-		// where we might import a nested symbol from a jar which only exists in the maven package
-		// mapping -- we have to whittle down to org.jboss.netty.buffer before finding a match.
-		//
-		// Note that we always perform a final package match lookup even if we found a providing
-		// label in the rule index, as maven jars take precedence over in-repo targets where
-		// package namespace shadowing is concerned.
-		if !packageExists {
-			if len(labels) == 0 {
-				labels = lookUpSymbol(c, ruleIndex, lang, symbol)
+			if externalLabel, ok := jvmConfig.externalRepoLabel(candidates[0]); ok {
+				lookups = append(lookups, "external_repo "+candidates[0])
+				labels = []label.Label{externalLabel}
+				indexDirective = ScalaExternalRepoMapping
+				symbol = candidates[0]
 			}
-			mavenLabels, packageExists = jvmConfig.MavenInstall.PackageMapping[symbol]
 		}
 
-		if len(labels) > 1 {
+		if len(labels) > 1 && coverage != nil {
+			labelStrings := make([]string, len(labels))
+			for i, symbolLabel := range labels {
+				labelStrings[i] = symbolLabel.String()
+			}
+			coverage.recordAmbiguous(originalSymbol, from, labelStrings)
+
+		} else if len(labels) > 1 {
 			var b strings.Builder
 			fmt.Fprintf(
 				&b,
-				"Error during resolve for %s (%s): used symbol '%s' appears to have "+
+				"Error during resolve for %s (%s): used symbol '%s'%s appears to have "+
 					"multiple definitions in the following targets:\n",
 				from,
 				lang,
 				symbol,
+				usedAt,
 			)
+			// List the targets in sorted order, as the rule index returns them in the order
+			// rules happened to be indexed.
+			labelStrings := treeset.NewWithStringComparator()
 			for _, symbolLabel := range labels {
-				fmt.Fprintf(&b, "%s\n", symbolLabel)
+				labelStrings.Add(symbolLabel.String())
+			}
+			for _, value := range labelStrings.Values() {
+				fmt.Fprintf(&b, "%s\n", value)
 			}
 			log.Fatalf(b.String())
 
 		} else if len(labels) == 1 && (!packageExists ||
 			mavenLabels.Contains(labels[0].String()) ||
-			jvmConfig.excludedArtifacts.Contains(labels[0].String())) {
+			jvmConfig.matchesExcludedArtifact(labels[0].String())) {
+
+			symbolLabel := labels[0].String()
+			if !existingDeps.Empty() {
+				// The rule may already depend on a facade target re-exporting the provider.
+				if exporter, ok := exportsIndex.exporterInDeps(symbolLabel, existingDeps); ok {
+					symbolLabel = exporter
+				}
+			}
 
-			symbolLabel := labels[0]
 			// don't add self-dependencies
-			if from != symbolLabel {
-				addDep(symbolLabel.String())
+			if from.String() != symbolLabel {
+				chooseDep(symbolLabel)
+
+				if jvmConfig.VerboseResolve && indexDirective != "" {
+					// List what the symbol would have resolved to without the directive, so
+					// that directives which no longer break any tie can be spotted.
+					candidates := treeset.NewWithStringComparator(labels[0].String())
+					if !jvmConfig.isIgnoredInRepoSymbol(symbol) {
+						for _, indexLabel := range lookUpRuleIndex(c, ruleIndex, lang, symbol) {
+							candidates.Add(indexLabel.String())
+						}
+					}
+					if packageExists {
+						candidates = candidates.Union(mavenLabels)
+					}
+					logDirectiveResolution(
+						from, lang, originalSymbol, symbolLabel, indexDirective, candidates,
+					)
+				}
 			}
 
 		} else if packageExists {
 			visibleLabels := mavenLabels.Select(func(index int, value interface{}) bool {
-				return jvmConfig.MavenInstall.ArtifactLabels.Contains(value)
+				return jvmConfig.isVisibleArtifact(value.(string))
 			})
 
 			if visibleLabels.Size() == 1 {
-				addDep(visibleLabels.Values()[0].(string))
+				chooseDep(visibleLabels.Values()[0].(string))
+
+			} else if preferredLabel, ok := jvmConfig.preferredArtifact(visibleLabels); ok {
+				chooseDep(preferredLabel)
+				if jvmConfig.VerboseResolve {
+					logDirectiveResolution(
+						from,
+						lang,
+						originalSymbol,
+						preferredLabel,
+						ScalaPreferArtifact,
+						visibleLabels,
+					)
+				}
+
+			} else if preferredLabel, ok := jvmConfig.preferredArtifactVariant(visibleLabels); ok {
+				// The package is provided by several classifier variants of the same artifact,
+				// e.g. a jar and its tests jar, which is not a real ambiguity.
+				chooseDep(preferredLabel)
+				if jvmConfig.VerboseResolve {
+					logDirectiveResolution(
+						from,
+						lang,
+						originalSymbol,
+						preferredLabel,
+						JavaPreferredArtifactClassifier,
+						visibleLabels,
+					)
+				}
+
+			} else if coverage != nil {
+				if visibleLabels.Size() == 0 {
+					return false
+				}
+				labelStrings := make([]string, 0, visibleLabels.Size())
+				for _, visibleLabel := range visibleLabels.Values() {
+					labelStrings = append(labelStrings, visibleLabel.(string))
+				}
+				coverage.recordAmbiguous(originalSymbol, from, labelStrings)
 
 			} else if visibleLabels.Size() > 1 {
 				log.Fatalf(
-					"Error during resolve for %s (%s): %s (reduced from %s) was not present in "+
+					"Error during resolve for %s (%s): %s (reduced from %s%s) was not present in "+
 						"the rule index but is provided by more than one maven jar, please add "+
 						"a resolve directive for either the package or the original symbol to "+
-						"one of these labels: %v\n",
+						"one of these labels, or list the preferred label via '# gazelle:%s': %v\n",
 					from,
 					lang,
 					symbol,
 					originalSymbol,
+					usedAt,
+					ScalaPreferArtifact,
 					visibleLabels.Values(),
 				)
 
 			} else {
 				log.Fatalf(
-					"Error during resolve for %s (%s): %s is provided by at least one maven "+
+					"Error during resolve for %s (%s): %s%s is provided by at least one maven "+
 						"jar, but none of them were visible. This probably means you are "+
 						"importing from a transitive dependency and need to add it to the maven "+
-						"install so it can be used directly: %v\n",
+						"install so it can be used directly, or allow it via '# gazelle:%s': %v\n",
 					from,
 					lang,
 					symbol,
+					usedAt,
+					JavaAllowTransitiveArtifact,
 					mavenLabels.Values(),
 				)
 			}
 
 		} else {
 			// Garbage or otherwise unresolvable symbol.
+			return false
+		}
+
+		return true
+	}
+
+	usedSymbolsIter := usedSymbols.Symbols.Iterator()
+	for usedSymbolsIter.Next() {
+		symbol := usedSymbolsIter.Value().(string)
+
+		resolved := resolveSymbol(symbol, symbol)
+		if !resolved && !usedSymbols.AbsoluteSymbols.Contains(symbol) {
+			// The symbol may have been imported relative to its enclosing package, in which
+			// case we only learn so once the absolute lookup comes up empty.
+			if packages, exists := usedSymbols.RelativeSymbols[symbol]; exists {
+				packagesIter := packages.Iterator()
+				for packagesIter.Next() {
+					pkg := packagesIter.Value().(string)
+					if resolveSymbol(pkg+"."+symbol, symbol) {
+						resolved = true
+						break
+					}
+				}
+			}
+		}
+
+		if coverage != nil {
+			coverage.recordResolution(symbol, from, resolved)
+		}
+		if !resolved && strict {
+			unresolved.recordUnresolved(from, symbol, usedSymbols.describeSources(symbol))
 		}
 	}
 
-	return deps
+	return jvmConfig.rewriteDeps(from, deps)
+}
+
+// ResolveRuntimeDeps returns the runtime_deps of the rule from, given the deps it was
+// resolved to by ResolveJvmSymbols. These are the labels configured via ScalaRuntimeDeps
+// for any of its deps, added to the rule's existing runtime_deps, excluding any which are
+// already deps themselves. If no runtime deps are configured for the package, the rule's
+// existing runtime_deps are returned as is.
+func ResolveRuntimeDeps(
+	c *config.Config,
+	from label.Label,
+	deps *treeset.Set,
+	usedSymbols *UsedSymbols,
+) *treeset.Set {
+	jvmConfig := JvmConfigForConfig(c, from.Pkg)
+	if len(*jvmConfig.RuntimeDeps) == 0 {
+		return usedSymbols.ExistingRuntimeDeps
+	}
+
+	runtimeDeps := treeset.NewWithStringComparator()
+	addRuntimeDep := func(runtimeDep string) {
+		if !deps.Contains(runtimeDep) && runtimeDep != from.String() {
+			runtimeDeps.Add(runtimeDep)
+		}
+	}
+	for _, runtimeDep := range usedSymbols.ExistingRuntimeDeps.Values() {
+		addRuntimeDep(runtimeDep.(string))
+	}
+	for _, dep := range deps.Values() {
+		for _, runtimeDep := range (*jvmConfig.RuntimeDeps)[dep.(string)] {
+			addRuntimeDep(runtimeDep)
+		}
+	}
+	return runtimeDeps
 }
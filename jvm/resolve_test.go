@@ -0,0 +1,1778 @@
+package jvm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/repo"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/emirpasic/gods/sets/treeset"
+	"github.com/stretchr/testify/require"
+)
+
+const testPkg = "src/main/scala/com/example"
+
+func testConfig(jvmConfig *JvmConfig) *config.Config {
+	c := config.New()
+
+	// Registers the '# gazelle:resolve' override config consulted by lookUpSymbol.
+	resolveConfigurer := resolve.Configurer{}
+	resolveConfigurer.RegisterFlags(flag.NewFlagSet("test", flag.ContinueOnError), "", c)
+
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{testPkg: jvmConfig}
+	return c
+}
+
+// testResolver indexes in-repo rules under a fixed set of symbols per label.
+type testResolver struct {
+	symbolsByLabel map[label.Label][]string
+}
+
+func (*testResolver) Name() string { return "scala" }
+
+func (tr *testResolver) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	ruleLabel := label.New("", f.Pkg, r.Name())
+	var importSpecs []resolve.ImportSpec
+	for _, symbol := range tr.symbolsByLabel[ruleLabel] {
+		importSpecs = append(importSpecs, resolve.ImportSpec{Lang: "scala", Imp: symbol})
+	}
+	return importSpecs
+}
+
+func (*testResolver) Embeds(r *rule.Rule, from label.Label) []label.Label { return nil }
+
+func (*testResolver) Resolve(
+	c *config.Config,
+	ix *resolve.RuleIndex,
+	rc *repo.RemoteCache,
+	r *rule.Rule,
+	imports interface{},
+	from label.Label,
+) {
+}
+
+func testRuleIndex(c *config.Config, symbolsByLabel map[string][]string) *resolve.RuleIndex {
+	resolver := &testResolver{symbolsByLabel: make(map[label.Label][]string)}
+	ruleIndex := resolve.NewRuleIndex(func(r *rule.Rule, pkgRel string) resolve.Resolver {
+		return resolver
+	})
+
+	for labelString, symbols := range symbolsByLabel {
+		ruleLabel, err := label.Parse(labelString)
+		if err != nil {
+			panic(err)
+		}
+		resolver.symbolsByLabel[ruleLabel] = symbols
+
+		f := rule.EmptyFile(ruleLabel.Pkg+"/BUILD", ruleLabel.Pkg)
+		ruleIndex.AddRule(c, rule.NewRule("scala_library", ruleLabel.Name), f)
+	}
+
+	ruleIndex.Finish()
+	return ruleIndex
+}
+
+func resolveUsedSymbols(
+	jvmConfig *JvmConfig,
+	symbolsByLabel map[string][]string,
+	usedSymbols *UsedSymbols,
+) []interface{} {
+	c := testConfig(jvmConfig)
+	deps := ResolveJvmSymbols(
+		c,
+		testRuleIndex(c, symbolsByLabel),
+		label.New("", testPkg, "example"),
+		"scala",
+		usedSymbols,
+		ResolveOptions{},
+	)
+	return deps.Values()
+}
+
+func resolveSymbols(jvmConfig *JvmConfig, symbols ...interface{}) []interface{} {
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add(symbols...)
+	return resolveUsedSymbols(jvmConfig, nil, usedSymbols)
+}
+
+func TestAllowedTransitiveArtifactResolves(t *testing.T) {
+	transitiveLabel := "@maven//:com_example_transitive"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.transitive": {transitiveLabel}},
+		nil,
+	)
+	jvmConfig.addAllowedArtifacts(treeset.NewWithStringComparator(transitiveLabel))
+
+	deps := resolveSymbols(jvmConfig, "com.example.transitive.Thing")
+	require.Equal(t, []interface{}{transitiveLabel}, deps)
+}
+
+func TestAllowedTransitiveArtifactOverridesExclude(t *testing.T) {
+	transitiveLabel := "@maven//:com_example_transitive"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.transitive": {transitiveLabel}},
+		[]string{transitiveLabel},
+	)
+	jvmConfig.addExcludedArtifacts(treeset.NewWithStringComparator(transitiveLabel))
+	require.Empty(t, resolveSymbols(jvmConfig, "com.example.transitive.Thing"))
+
+	jvmConfig.addAllowedArtifacts(treeset.NewWithStringComparator(transitiveLabel))
+	deps := resolveSymbols(jvmConfig, "com.example.transitive.Thing")
+	require.Equal(t, []interface{}{transitiveLabel}, deps)
+}
+
+func TestRelativeImportResolvesAgainstEnclosingPackage(t *testing.T) {
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(nil, nil)
+
+	symbolsByLabel := map[string][]string{
+		"//src/main/scala/com/example/util:util": {"com.example.util", "com.example.util.Helper"},
+	}
+
+	absoluteSymbols := NewUsedSymbols()
+	absoluteSymbols.Symbols.Add("util.Helper")
+	require.Empty(t, resolveUsedSymbols(jvmConfig, symbolsByLabel, absoluteSymbols))
+
+	relativeSymbols := NewUsedSymbols()
+	relativeSymbols.AddRelativeSymbol("util.Helper", "com.example")
+	deps := resolveUsedSymbols(jvmConfig, symbolsByLabel, relativeSymbols)
+	require.Equal(t, []interface{}{"//src/main/scala/com/example/util"}, deps)
+
+	// Symbols explicitly imported as absolute never fall back to the enclosing package.
+	relativeSymbols.AddAbsoluteSymbol("util.Helper")
+	require.Empty(t, resolveUsedSymbols(jvmConfig, symbolsByLabel, relativeSymbols))
+	withoutHelper := relativeSymbols.Without(treeset.NewWithStringComparator("util.Helper"))
+	require.Empty(t, withoutHelper.AbsoluteSymbols.Values())
+}
+
+func TestUsedSymbolsUnionMergesSources(t *testing.T) {
+	first := NewUsedSymbols()
+	first.Symbols.Add("com.example.Thing")
+	first.AddSymbolSource("com.example.Thing", "A.scala:3")
+
+	second := NewUsedSymbols()
+	second.Symbols.Add("com.example.Thing")
+	second.AddSymbolSource("com.example.Thing", "B.scala:5")
+
+	union := first.Union(second)
+	require.Equal(t, " (used at A.scala:3, B.scala:5)", union.describeSources("com.example.Thing"))
+	require.Equal(t, "", union.describeSources("com.example.Other"))
+}
+
+func TestUsedSymbolsWithout(t *testing.T) {
+	used := NewUsedSymbols()
+	used.Symbols.Add("com.example.Defined", "com.example.Defined.member", "com.other.Thing")
+	used.AddSymbolSource("com.example.Defined", "B.scala:3")
+	used.AddRelativeSymbol("util.Helper", "com.example")
+	used.AddRelativeSymbol("other.Thing", "com.example")
+	used.ExistingDeps.Add("//existing")
+
+	defined := treeset.NewWithStringComparator("com.example.Defined", "com.example.util.Helper")
+	difference := used.Without(defined)
+	require.Equal(
+		t,
+		[]interface{}{"com.example.Defined.member", "com.other.Thing", "other.Thing"},
+		difference.Symbols.Values(),
+	)
+	require.NotContains(t, difference.RelativeSymbols, "util.Helper")
+	require.Contains(t, difference.RelativeSymbols, "other.Thing")
+	require.Empty(t, difference.Sources)
+	require.Equal(t, []interface{}{"//existing"}, difference.ExistingDeps.Values())
+
+	// The original is left untouched.
+	require.Equal(t, 5, used.Symbols.Size())
+	require.Contains(t, used.RelativeSymbols, "util.Helper")
+}
+
+func writeMavenInstall(t *testing.T, installJSON string) *MavenInstallData {
+	path := filepath.Join(t.TempDir(), "maven_install.json")
+	require.NoError(t, os.WriteFile(path, []byte(installJSON), 0644))
+	return ParseMavenInstall(
+		path,
+		DEFAULT_MAVEN_LABEL_PREFIX,
+		nil,
+		treeset.NewWithStringComparator(),
+		treeset.NewWithStringComparator(),
+		treeset.NewWithStringComparator(),
+	)
+}
+
+func TestClassifierVariantsPreferPlainJar(t *testing.T) {
+	baseLabel := "@maven//:com_example_widgets"
+	testsLabel := "@maven//:com_example_widgets_tests"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = writeMavenInstall(t, `{
+		"artifacts": {
+			"com.example:widgets": {
+				"shasums": {"jar": "abc", "tests": "def", "sources": "ghi"},
+				"version": "1.0.0"
+			}
+		},
+		"packages": {
+			"com.example:widgets": ["com.example.widgets"],
+			"com.example:widgets:jar:tests": ["com.example.widgets"]
+		}
+	}`)
+	require.Equal(
+		t,
+		[]interface{}{baseLabel, testsLabel},
+		jvmConfig.MavenInstall.PackageMapping["com.example.widgets"].Values(),
+	)
+
+	deps := resolveSymbols(jvmConfig, "com.example.widgets.Widget")
+	require.Equal(t, []interface{}{baseLabel}, deps)
+
+	jvmConfig.PreferredArtifactClassifier = "tests"
+	deps = resolveSymbols(jvmConfig, "com.example.widgets.Widget")
+	require.Equal(t, []interface{}{testsLabel}, deps)
+}
+
+func TestLockfileFormats(t *testing.T) {
+	v1Install := writeMavenInstall(t, `{
+		"dependency_tree": {
+			"version": "0.1.0",
+			"dependencies": [
+				{"coord": "com.example:widgets:1.0.0", "packages": ["com.example.widgets"]},
+				{"coord": "com.example:widgets:jar:tests:1.0.0", "packages": ["com.example.widgets"]},
+				{"coord": "com.example:widgets:jar:sources:1.0.0", "packages": []},
+				{"coord": "com.example:gadgets:1.0.0", "packages": ["com.example.gadgets"]},
+				{"coord": "com.example:bom:pom:1.0.0"}
+			]
+		}
+	}`)
+	v2Install := writeMavenInstall(t, `{
+		"version": "2",
+		"artifacts": {
+			"com.example:widgets": {
+				"shasums": {"jar": "abc", "tests": "def", "sources": "ghi"},
+				"version": "1.0.0"
+			},
+			"com.example:gadgets": {"shasums": {"jar": "jkl"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"com.example:widgets": ["com.example.widgets"],
+			"com.example:widgets:jar:tests": ["com.example.widgets"],
+			"com.example:gadgets": ["com.example.gadgets"]
+		}
+	}`)
+
+	for _, mavenInstall := range []*MavenInstallData{v1Install, v2Install} {
+		require.Equal(
+			t,
+			[]interface{}{
+				"@maven//:com_example_gadgets",
+				"@maven//:com_example_widgets",
+				"@maven//:com_example_widgets_tests",
+			},
+			mavenInstall.ArtifactLabels.Values(),
+		)
+		require.Equal(
+			t,
+			[]interface{}{"@maven//:com_example_widgets", "@maven//:com_example_widgets_tests"},
+			mavenInstall.PackageMapping["com.example.widgets"].Values(),
+		)
+		require.Equal(
+			t,
+			ArtifactVariant{BaseLabel: "@maven//:com_example_widgets", Classifier: "tests"},
+			mavenInstall.ArtifactVariants["@maven//:com_example_widgets_tests"],
+		)
+	}
+
+	_, err := readLockfile("maven_install.json", map[string]interface{}{"version": "3"})
+	require.EqualError(t, err, "unsupported lockfile version 3")
+}
+
+func TestGzippedLockfile(t *testing.T) {
+	installJSON := `{
+		"artifacts": {"com.example:widgets": {"shasums": {"jar": "abc"}, "version": "1.0.0"}},
+		"packages": {"com.example:widgets": ["com.example.widgets"]}
+	}`
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err := gzipWriter.Write([]byte(installJSON))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	dir := t.TempDir()
+	gzipPath := filepath.Join(dir, "maven_install.json.gz")
+	require.NoError(t, os.WriteFile(gzipPath, compressed.Bytes(), 0644))
+
+	gzipped := ParseMavenInstall(
+		gzipPath,
+		DEFAULT_MAVEN_LABEL_PREFIX,
+		nil,
+		treeset.NewWithStringComparator(),
+		treeset.NewWithStringComparator(),
+		treeset.NewWithStringComparator(),
+	)
+	plain := writeMavenInstall(t, installJSON)
+	require.Equal(t, plain.ArtifactLabels.Values(), gzipped.ArtifactLabels.Values())
+	require.Equal(
+		t,
+		[]interface{}{"@maven//:com_example_widgets"},
+		gzipped.PackageMapping["com.example.widgets"].Values(),
+	)
+
+	// Plain json with a .gz extension and truncated gzip streams both fail to read.
+	notGzipPath := filepath.Join(dir, "not_gzipped.json.gz")
+	require.NoError(t, os.WriteFile(notGzipPath, []byte(installJSON), 0644))
+	_, err = readMavenInstallJSON(notGzipPath)
+	require.ErrorContains(t, err, "corrupt gzip stream")
+
+	truncatedPath := filepath.Join(dir, "truncated.json.gz")
+	truncated := compressed.Bytes()[:compressed.Len()/2]
+	require.NoError(t, os.WriteFile(truncatedPath, truncated, 0644))
+	_, err = readMavenInstallJSON(truncatedPath)
+	require.Error(t, err)
+}
+
+func TestNewMavenInstallDataMatchesParsedLockfile(t *testing.T) {
+	parsed := writeMavenInstall(t, `{
+		"version": "2",
+		"artifacts": {
+			"com.example:widgets": {"shasums": {"jar": "abc"}, "version": "1.0.0"},
+			"com.example:gadgets": {"shasums": {"jar": "def"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"com.example:widgets": ["com.example.widgets", "com.example.shared"],
+			"com.example:gadgets": ["com.example.gadgets", "com.example.shared"]
+		}
+	}`)
+	built := NewMavenInstallData(
+		map[string][]string{
+			"com.example.widgets": {"@maven//:com_example_widgets"},
+			"com.example.gadgets": {"@maven//:com_example_gadgets"},
+			"com.example.shared": {
+				"@maven//:com_example_widgets",
+				"@maven//:com_example_gadgets",
+				"@maven//:com_example_widgets",
+			},
+		},
+		[]string{"@maven//:com_example_widgets", "@maven//:com_example_gadgets"},
+	)
+
+	require.Equal(t, parsed.ArtifactLabels.Values(), built.ArtifactLabels.Values())
+	for _, pkg := range []string{"com.example.widgets", "com.example.gadgets", "com.example.shared"} {
+		require.Equal(t, parsed.PackageMapping[pkg].Values(), built.PackageMapping[pkg].Values())
+	}
+	require.Empty(t, built.ArtifactVariants)
+}
+
+func TestMalformedLockfiles(t *testing.T) {
+	// Without a package index, artifacts are still known but map no packages.
+	mavenInstall := writeMavenInstall(t, `{
+		"version": "2",
+		"artifacts": {"com.example:widgets": {"shasums": {"jar": "abc"}, "version": "1.0.0"}}
+	}`)
+	require.Equal(
+		t,
+		[]interface{}{"@maven//:com_example_widgets"},
+		mavenInstall.ArtifactLabels.Values(),
+	)
+	require.NotContains(t, mavenInstall.PackageMapping, "com.example.widgets")
+
+	for installJSON, expectedError := range map[string]string{
+		`{"version": "2", "packages": {}}`:  "expected an 'artifacts' object",
+		`{"artifacts": {}, "packages": []}`: "expected 'packages' to be an object",
+		`{"artifacts": {"com.example:widgets": "1.0.0"}, "packages": {}}`: "expected artifact " +
+			"'com.example:widgets' to be an object",
+		`{"artifacts": {"com.example:widgets": {}}, "packages": {}}`: "expected a 'shasums' " +
+			"object for artifact 'com.example:widgets'",
+		`{"dependency_tree": {"dependencies": [{"coord": "com.example"}]}}`: "unexpected maven " +
+			"coordinates 'com.example'",
+	} {
+		var parsedJSON map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(installJSON), &parsedJSON))
+		_, err := readLockfile("maven_install.json", parsedJSON)
+		require.EqualError(t, err, expectedError, installJSON)
+	}
+}
+
+func TestPreferredArtifactVariantRequiresSameArtifact(t *testing.T) {
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(nil, nil)
+	jvmConfig.MavenInstall.ArtifactVariants = map[string]ArtifactVariant{
+		"@maven//:com_example_a": {BaseLabel: "@maven//:com_example_a", Classifier: "jar"},
+		"@maven//:com_example_b": {BaseLabel: "@maven//:com_example_b", Classifier: "jar"},
+	}
+
+	_, ok := jvmConfig.preferredArtifactVariant(
+		treeset.NewWithStringComparator("@maven//:com_example_a", "@maven//:com_example_b"),
+	)
+	require.False(t, ok)
+}
+
+func TestBarePackageImportResolves(t *testing.T) {
+	barLabel := "@maven//:com_foo_bar"
+	parentLabel := "@maven//:com_foo"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.foo":     {parentLabel},
+			"com.foo.bar": {barLabel},
+		},
+		[]string{barLabel, parentLabel},
+	)
+
+	// A bare package import must not be whittled down to its parent package.
+	deps := resolveSymbols(jvmConfig, "com.foo.bar")
+	require.Equal(t, []interface{}{barLabel}, deps)
+
+	// The same goes for a package object defined in-repo.
+	symbolsByLabel := map[string][]string{
+		"//src/main/scala/com/example/util:util": {"com.example.util", "com.example.util.helper"},
+		"//src/main/scala/com/example:example":   {"com.example"},
+	}
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add("com.example.util")
+	deps = resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols)
+	require.Equal(t, []interface{}{"//src/main/scala/com/example/util"}, deps)
+}
+
+func testBuildFile(t *testing.T, pkg string, directives ...string) *rule.File {
+	content := ""
+	for _, directive := range directives {
+		content += "# gazelle:" + directive + "\n"
+	}
+
+	f, err := rule.LoadData(filepath.Join(pkg, "BUILD"), pkg, []byte(content))
+	require.NoError(t, err)
+	return f
+}
+
+func TestWildcardArtifactExcludes(t *testing.T) {
+	reflectLabel := "@maven//:org_scala_lang_scala_reflect"
+	compilerLabel := "@maven//:org_scala_lang_scala_compiler"
+	widgetsLabel := "@maven//:com_example_widgets"
+
+	path := filepath.Join(t.TempDir(), "maven_install.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"artifacts": {
+			"org.scala-lang:scala-reflect": {"shasums": {"jar": "abc"}, "version": "2.13.0"},
+			"org.scala-lang:scala-compiler": {"shasums": {"jar": "def"}, "version": "2.13.0"},
+			"com.example:widgets": {"shasums": {"jar": "ghi"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"org.scala-lang:scala-reflect": ["scala.reflect.runtime"],
+			"org.scala-lang:scala-compiler": ["scala.tools.nsc"],
+			"com.example:widgets": ["com.example.widgets"]
+		}
+	}`), 0644))
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.addExcludedArtifacts(treeset.NewWithStringComparator("@maven//:org_scala_lang_*"))
+	jvmConfig.addAllowedArtifacts(treeset.NewWithStringComparator(compilerLabel))
+	jvmConfig.MavenInstall = ParseMavenInstall(
+		path,
+		DEFAULT_MAVEN_LABEL_PREFIX,
+		nil,
+		jvmConfig.excludedArtifacts,
+		jvmConfig.allowedArtifacts,
+		jvmConfig.includedSourceClassifiers,
+	)
+
+	require.Equal(
+		t,
+		[]interface{}{widgetsLabel, compilerLabel},
+		jvmConfig.MavenInstall.ArtifactLabels.Values(),
+	)
+	require.True(t, jvmConfig.isExcludedArtifact(reflectLabel))
+	require.False(t, jvmConfig.isExcludedArtifact(compilerLabel))
+	require.False(t, jvmConfig.isExcludedArtifact(widgetsLabel))
+
+	deps := resolveSymbols(
+		jvmConfig,
+		"scala.reflect.runtime.universe",
+		"scala.tools.nsc.Global",
+		"com.example.widgets.Widget",
+	)
+	require.Equal(t, []interface{}{widgetsLabel, compilerLabel}, deps)
+
+	// Values without wildcards still only match exactly.
+	require.False(
+		t,
+		matchesArtifact(reflectLabel, treeset.NewWithStringComparator("@maven//:org_scala_lang")),
+	)
+}
+
+func TestTestForcedTransitiveDepsOnlyApplyToTests(t *testing.T) {
+	triggerLabel := "@maven//:com_example_trigger"
+	forcedLabel := "@maven//:com_example_forced"
+	testForcedLabel := "@maven//:com_example_test_forced"
+	unforcedLabel := "@maven//:com_example_unforced"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.trigger": {triggerLabel}},
+		[]string{triggerLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaForcedTransitiveDeps+" "+triggerLabel+" "+forcedLabel,
+		ScalaTestForcedTransitiveDeps+" "+triggerLabel+" "+testForcedLabel+","+unforcedLabel,
+	))
+	configurer.Configure(c, "child", testBuildFile(
+		t,
+		"child",
+		ScalaUnforceTransitiveDep+" "+triggerLabel+" "+unforcedLabel,
+	))
+
+	resolveForRule := func(pkg string, isTest bool) []interface{} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add("com.example.trigger.Thing")
+		usedSymbols.IsTest = isTest
+		return resolveUsedSymbols(JvmConfigForConfig(c, pkg), nil, usedSymbols)
+	}
+
+	require.Equal(t, []interface{}{forcedLabel, triggerLabel}, resolveForRule("", false))
+	require.Equal(
+		t,
+		[]interface{}{forcedLabel, testForcedLabel, triggerLabel, unforcedLabel},
+		resolveForRule("", true),
+	)
+	require.Equal(
+		t,
+		[]interface{}{forcedLabel, testForcedLabel, triggerLabel},
+		resolveForRule("child", true),
+	)
+
+	// The library map is left untouched by combining it with the test-only one.
+	require.Equal(t, []string{forcedLabel}, (*rootConfig.ForcedTransitiveDeps)[triggerLabel])
+}
+
+func TestRuntimeDeps(t *testing.T) {
+	apiLabel := "@maven//:org_slf4j_slf4j_api"
+	backendLabel := "@maven//:ch_qos_logback_logback_classic"
+	otherLabel := "@maven//:com_example_other"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"org.slf4j": {apiLabel}, "com.example.other": {otherLabel}},
+		[]string{apiLabel, otherLabel},
+	)
+
+	c := testConfig(rootConfig)
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+	ruleIndex := testRuleIndex(c, nil)
+
+	from := label.New("", "", "example")
+	resolveRuntimeDeps := func(symbols ...interface{}) ([]interface{}, []interface{}) {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(symbols...)
+		usedSymbols.ExistingRuntimeDeps.Add("//hand:written")
+
+		deps := ResolveJvmSymbols(c, ruleIndex, from, "scala", usedSymbols, ResolveOptions{})
+		return deps.Values(), ResolveRuntimeDeps(c, from, deps, usedSymbols).Values()
+	}
+
+	// Without any runtime deps configured, existing runtime_deps are left untouched.
+	deps, runtimeDeps := resolveRuntimeDeps("org.slf4j.Logger")
+	require.Equal(t, []interface{}{apiLabel}, deps)
+	require.Equal(t, []interface{}{"//hand:written"}, runtimeDeps)
+
+	NewJvmConfigurer().Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaRuntimeDeps+" "+apiLabel+" "+backendLabel+","+otherLabel,
+	))
+
+	// The backend lands in runtime_deps rather than deps alongside the existing runtime_deps,
+	// while labels which are already compile deps are not repeated.
+	deps, runtimeDeps = resolveRuntimeDeps("org.slf4j.Logger")
+	require.Equal(t, []interface{}{apiLabel}, deps)
+	require.Equal(t, []interface{}{"//hand:written", backendLabel, otherLabel}, runtimeDeps)
+
+	deps, runtimeDeps = resolveRuntimeDeps("org.slf4j.Logger", "com.example.other.Thing")
+	require.Equal(t, []interface{}{otherLabel, apiLabel}, deps)
+	require.Equal(t, []interface{}{"//hand:written", backendLabel}, runtimeDeps)
+
+	deps, runtimeDeps = resolveRuntimeDeps("com.example.other.Thing")
+	require.Equal(t, []interface{}{otherLabel}, deps)
+	require.Equal(t, []interface{}{"//hand:written"}, runtimeDeps)
+}
+
+func TestChildPackageUnforcesInheritedTransitiveDep(t *testing.T) {
+	triggerLabel := "@maven//:com_example_trigger"
+	keptLabel := "@maven//:com_example_kept"
+	unforcedLabel := "@maven//:com_example_unforced"
+
+	rootConfig := NewJvmConfig()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.trigger": {triggerLabel}},
+		[]string{triggerLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaForcedTransitiveDeps+" "+triggerLabel+" "+keptLabel+","+unforcedLabel,
+	))
+	configurer.Configure(c, "child", testBuildFile(
+		t,
+		"child",
+		ScalaUnforceTransitiveDep+" "+triggerLabel+" "+unforcedLabel,
+	))
+	configurer.Configure(c, "child/grandchild", nil)
+
+	parentDeps := resolveSymbols(JvmConfigForConfig(c, ""), "com.example.trigger.Thing")
+	require.Equal(t, []interface{}{keptLabel, triggerLabel, unforcedLabel}, parentDeps)
+
+	for _, pkg := range []string{"child", "child/grandchild"} {
+		// The direct dep itself is still added, only the forced mapping is removed.
+		deps := resolveSymbols(JvmConfigForConfig(c, pkg), "com.example.trigger.Thing")
+		require.Equal(t, []interface{}{keptLabel, triggerLabel}, deps)
+	}
+}
+
+func TestRootForcedTransitiveDepsDoNotModifyDefaults(t *testing.T) {
+	triggerLabel := "@maven//:com_example_trigger"
+	forcedLabel := "@maven//:com_example_forced"
+
+	rootConfig := NewJvmConfig()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.trigger": {triggerLabel}},
+		[]string{triggerLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	NewJvmConfigurer().Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaForcedTransitiveDeps+" "+triggerLabel+" "+forcedLabel,
+		ScalaUnforceTransitiveDep+" "+triggerLabel+" "+forcedLabel,
+		ScalaForcedTransitiveDeps+" "+triggerLabel+" "+forcedLabel,
+	))
+
+	require.Equal(
+		t,
+		[]string{forcedLabel},
+		(*JvmConfigForConfig(c, "").ForcedTransitiveDeps)[triggerLabel],
+	)
+	require.Empty(t, *NewJvmConfig().ForcedTransitiveDeps)
+}
+
+func TestChildPackageClearsInheritedForcedTransitiveDeps(t *testing.T) {
+	triggerLabel := "@maven//:com_example_trigger"
+	forcedLabel := "@maven//:com_example_forced"
+	testForcedLabel := "@maven//:com_example_test_forced"
+	readdedLabel := "@maven//:com_example_readded"
+
+	rootConfig := NewJvmConfig()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.trigger": {triggerLabel}},
+		[]string{triggerLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaForcedTransitiveDeps+" "+triggerLabel+" "+forcedLabel,
+		ScalaTestForcedTransitiveDeps+" "+triggerLabel+" "+testForcedLabel,
+	))
+	configurer.Configure(c, "cleared", testBuildFile(t, "cleared", ScalaClearForcedTransitiveDeps))
+	configurer.Configure(c, "cleared/grandchild", nil)
+	configurer.Configure(c, "readded", testBuildFile(
+		t,
+		"readded",
+		ScalaClearForcedTransitiveDeps,
+		ScalaForcedTransitiveDeps+" "+triggerLabel+" "+readdedLabel,
+	))
+
+	resolveInPackage := func(pkg string, isTest bool) []interface{} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.IsTest = isTest
+		usedSymbols.Symbols.Add("com.example.trigger.Thing")
+		return resolveUsedSymbols(JvmConfigForConfig(c, pkg), nil, usedSymbols)
+	}
+
+	require.Equal(t, []interface{}{forcedLabel, triggerLabel}, resolveInPackage("", false))
+	require.Equal(
+		t,
+		[]interface{}{forcedLabel, testForcedLabel, triggerLabel},
+		resolveInPackage("", true),
+	)
+
+	for _, pkg := range []string{"cleared", "cleared/grandchild"} {
+		require.Equal(t, []interface{}{triggerLabel}, resolveInPackage(pkg, false))
+		require.Equal(t, []interface{}{triggerLabel}, resolveInPackage(pkg, true))
+	}
+
+	// Mappings configured after clearing in the same BUILD file still apply.
+	require.Equal(t, []interface{}{readdedLabel, triggerLabel}, resolveInPackage("readded", false))
+}
+
+func TestMavenRepositoryNamePerArtifactGroup(t *testing.T) {
+	repoRoot := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repoRoot, "test_install.json"), []byte(`{
+		"artifacts": {
+			"com.example:widgets": {"shasums": {"jar": "abc"}, "version": "1.0.0"},
+			"com.example.testing:fixtures": {"shasums": {"jar": "def"}, "version": "1.0.0"},
+			"com.example.testing:special": {"shasums": {"jar": "ghi"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"com.example:widgets": ["com.example.widgets"],
+			"com.example.testing:fixtures": ["com.example.testing.fixtures"],
+			"com.example.testing:special": ["com.example.testing.special"]
+		}
+	}`), 0644))
+
+	c := config.New()
+	c.RepoRoot = repoRoot
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": NewJvmConfig().NewChild()}
+
+	NewJvmConfigurer().Configure(c, "", testBuildFile(
+		t,
+		"",
+		JavaMavenRepositoryName+" maven_main",
+		JavaMavenRepositoryName+" maven_test com.example.testing",
+		JavaMavenRepositoryName+" maven_special com.example.testing:special",
+		JavaMavenInstallFile+" test_install.json",
+	))
+
+	jvmConfig := JvmConfigForConfig(c, "")
+	require.Equal(
+		t,
+		[]interface{}{
+			"@maven_main//:com_example_widgets",
+			"@maven_special//:com_example_testing_special",
+			"@maven_test//:com_example_testing_fixtures",
+		},
+		jvmConfig.MavenInstall.ArtifactLabels.Values(),
+	)
+
+	deps := resolveSymbols(jvmConfig, "com.example.testing.fixtures.Fixture")
+	require.Equal(t, []interface{}{"@maven_test//:com_example_testing_fixtures"}, deps)
+}
+
+func TestMavenRepositoryNameInChildPackage(t *testing.T) {
+	repoRoot := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repoRoot, "test_install.json"), []byte(`{
+		"artifacts": {
+			"com.example:widgets": {"shasums": {"jar": "abc"}, "version": "1.0.0"},
+			"com.example.testing:fixtures": {"shasums": {"jar": "def"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"com.example:widgets": ["com.example.widgets"],
+			"com.example.testing:fixtures": ["com.example.testing.fixtures"]
+		}
+	}`), 0644))
+
+	c := config.New()
+	c.RepoRoot = repoRoot
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": NewJvmConfig().NewChild()}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(t, "", JavaMavenInstallFile+" test_install.json"))
+	configurer.Configure(c, "testing", testBuildFile(
+		t,
+		"testing",
+		JavaMavenRepositoryName+" maven_test com.example.testing",
+		JavaMavenInstallFile+" test_install.json",
+	))
+
+	// The child package parses the same lockfile with its own group prefix, rather than
+	// reusing the labels the root package parsed it with.
+	symbol := "com.example.testing.fixtures.Fixture"
+	require.Equal(
+		t,
+		[]interface{}{"@maven//:com_example_testing_fixtures"},
+		resolveSymbols(JvmConfigForConfig(c, ""), symbol),
+	)
+	require.Equal(
+		t,
+		[]interface{}{"@maven_test//:com_example_testing_fixtures"},
+		resolveSymbols(JvmConfigForConfig(c, "testing"), symbol),
+	)
+}
+
+func TestScalaLibraryExcludeFollowsRepositoryName(t *testing.T) {
+	repoRoot := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repoRoot, "test_install.json"), []byte(`{
+		"artifacts": {
+			"org.scala-lang:scala-library": {"shasums": {"jar": "abc"}, "version": "2.13.16"},
+			"com.example:widgets": {"shasums": {"jar": "def"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"org.scala-lang:scala-library": ["scala.collection.mutable"],
+			"com.example:widgets": ["com.example.widgets"]
+		}
+	}`), 0644))
+
+	c := config.New()
+	c.RepoRoot = repoRoot
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": NewJvmConfig().NewChild()}
+
+	NewJvmConfigurer().Configure(c, "", testBuildFile(
+		t,
+		"",
+		JavaMavenRepositoryName+" maven_scala",
+		JavaMavenInstallFile+" test_install.json",
+	))
+
+	jvmConfig := JvmConfigForConfig(c, "")
+	require.Equal(
+		t,
+		[]interface{}{"@maven_scala//:com_example_widgets"},
+		jvmConfig.MavenInstall.ArtifactLabels.Values(),
+	)
+	require.True(t, jvmConfig.isExcludedArtifact("@maven_scala//:org_scala_lang_scala_library"))
+	require.False(t, jvmConfig.isExcludedArtifact("@maven//:org_scala_lang_scala_library"))
+
+	deps := resolveSymbols(
+		jvmConfig,
+		"scala.collection.mutable.ListBuffer",
+		"com.example.widgets.Widget",
+	)
+	require.Equal(t, []interface{}{"@maven_scala//:com_example_widgets"}, deps)
+}
+
+func TestIncludeSourceClassifier(t *testing.T) {
+	repoRoot := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repoRoot, "test_install.json"), []byte(`{
+		"artifacts": {
+			"com.example:widgets": {"shasums": {"jar": "abc", "sources": "def"}, "version": "1.0.0"},
+			"com.example:gadgets": {"shasums": {"jar": "ghi", "sources": "jkl"}, "version": "1.0.0"}
+		},
+		"packages": {
+			"com.example:widgets": ["com.example.widgets"],
+			"com.example:widgets:jar:sources": ["com.example.widgets.generated"],
+			"com.example:gadgets": ["com.example.gadgets"],
+			"com.example:gadgets:jar:sources": ["com.example.gadgets.generated"]
+		}
+	}`), 0644))
+
+	c := config.New()
+	c.RepoRoot = repoRoot
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": NewJvmConfig().NewChild()}
+
+	NewJvmConfigurer().Configure(c, "", testBuildFile(
+		t,
+		"",
+		JavaIncludeSourceClassifier+" @maven//:com_example_widgets",
+		JavaMavenInstallFile+" test_install.json",
+	))
+
+	// Only the included artifact's source jar is viable, the other is still skipped.
+	jvmConfig := JvmConfigForConfig(c, "")
+	require.Equal(
+		t,
+		[]interface{}{
+			"@maven//:com_example_gadgets",
+			"@maven//:com_example_widgets",
+			"@maven//:com_example_widgets_sources",
+		},
+		jvmConfig.MavenInstall.ArtifactLabels.Values(),
+	)
+
+	deps := resolveSymbols(jvmConfig, "com.example.widgets.generated.Widget")
+	require.Equal(t, []interface{}{"@maven//:com_example_widgets_sources"}, deps)
+}
+
+func TestInRepoSymbolPreferredOverMavenPackagePrefix(t *testing.T) {
+	mavenLabel := "@maven//:com_foo"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.foo": {mavenLabel}},
+		[]string{mavenLabel},
+	)
+
+	symbolsByLabel := map[string][]string{
+		"//src/main/scala/com/foo/bar:bar": {"com.foo", "com.foo.Bar", "com.foo.Bar.baz"},
+	}
+
+	// Symbol-level in-repo matches are more specific than the maven package prefix.
+	for _, symbol := range []string{"com.foo.Bar", "com.foo.Bar._", "com.foo.Bar.baz", "com.foo.Bar.Nested"} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(symbol)
+		deps := resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols)
+		require.Equal(t, []interface{}{"//src/main/scala/com/foo/bar"}, deps, symbol)
+	}
+
+	// Package-level matches still give the maven jar precedence.
+	for _, symbol := range []string{"com.foo.Other", "com.foo._"} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(symbol)
+		deps := resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols)
+		require.Equal(t, []interface{}{mavenLabel}, deps, symbol)
+	}
+}
+
+func TestResolveThroughExports(t *testing.T) {
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(nil, nil)
+
+	symbolsByLabel := map[string][]string{
+		"//src/api:api": {"com.example.api.Thing"},
+	}
+
+	exportsIndex := NewExportsIndex()
+	facadeRule := rule.NewRule("scala_library", "facade")
+	facadeRule.SetAttr("exports", []string{"//src/api"})
+	exportsIndex.AddRule(facadeRule, "src/facade")
+	outerRule := rule.NewRule("scala_library", "outer")
+	outerRule.SetAttr("exports", []string{":facade"})
+	exportsIndex.AddRule(outerRule, "src/facade")
+
+	resolveThing := func(resolveThroughExports bool, existingDeps ...interface{}) []interface{} {
+		jvmConfig.ResolveThroughExports = resolveThroughExports
+
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add("com.example.api.Thing")
+		usedSymbols.ExistingDeps.Add(existingDeps...)
+
+		c := testConfig(jvmConfig)
+		deps := ResolveJvmSymbols(
+			c,
+			testRuleIndex(c, symbolsByLabel),
+			label.New("", testPkg, "example"),
+			"scala",
+			usedSymbols,
+			ResolveOptions{ExportsIndex: exportsIndex},
+		)
+		return deps.Values()
+	}
+
+	// The symbol resolves to the facade the rule already depends on.
+	require.Equal(t, []interface{}{"//src/facade"}, resolveThing(true, "//src/facade:facade"))
+
+	// Exports are followed transitively.
+	require.Equal(t, []interface{}{"//src/facade:outer"}, resolveThing(true, "//src/facade:outer"))
+
+	// Depending directly on the provider takes precedence.
+	require.Equal(
+		t,
+		[]interface{}{"//src/api"},
+		resolveThing(true, "//src/api:api", "//src/facade:facade"),
+	)
+
+	// Without an exporting dep, or with the mode disabled, the provider is used.
+	require.Equal(t, []interface{}{"//src/api"}, resolveThing(true, "//src/other:other"))
+	require.Equal(t, []interface{}{"//src/api"}, resolveThing(false, "//src/facade:facade"))
+}
+
+func TestIgnoredImportsAreNotResolved(t *testing.T) {
+	reflectLabel := "@maven//:org_scala_lang_scala_reflect"
+	otherLabel := "@maven//:com_example_other"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"scala.reflect.runtime": {reflectLabel},
+			"scala.reflectx":        {otherLabel},
+		},
+		[]string{otherLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", nil)
+	configurer.Configure(c, "child", testBuildFile(
+		t,
+		"child",
+		ScalaIgnoreImports+" scala.reflect, scala.tools._",
+	))
+	configurer.Configure(c, "child/grandchild", nil)
+
+	symbols := []interface{}{
+		"scala.reflect.runtime.universe",
+		"scala.reflect.runtime.universe._",
+		"_root_.scala.tools.nsc.Global",
+		"scala.reflectx.Thing",
+	}
+
+	for _, pkg := range []string{"child", "child/grandchild"} {
+		// Matching is by namespace, so scala.reflectx is still resolved.
+		deps := resolveSymbols(JvmConfigForConfig(c, pkg), symbols...)
+		require.Equal(t, []interface{}{otherLabel}, deps)
+	}
+
+	// The parent package is unaffected.
+	require.False(t, JvmConfigForConfig(c, "").isIgnoredImport("scala.reflect.runtime.universe"))
+}
+
+func TestIgnoredInRepoSymbolsSkipRuleIndex(t *testing.T) {
+	mavenLabel := "@maven//:com_foo_legacy"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.foo.legacy": {mavenLabel}},
+		[]string{mavenLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", nil)
+	configurer.Configure(c, "child", testBuildFile(
+		t,
+		"child",
+		ScalaIgnoreInRepoSymbol+" com.foo.moving",
+		ScalaIgnoreInRepoSymbol+" com.foo.legacy._",
+	))
+	configurer.Configure(c, "child/grandchild", nil)
+
+	// Both the old and new targets define the moving symbols, which would otherwise be an
+	// ambiguity error.
+	symbolsByLabel := map[string][]string{
+		"//old:old":       {"com.foo.moving.Thing", "com.foo.Stable"},
+		"//new:new":       {"com.foo.moving.Thing"},
+		"//legacy:legacy": {"com.foo.legacy.Widget"},
+	}
+
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add(
+		"com.foo.moving.Thing",
+		"com.foo.moving.Thing.apply",
+		"com.foo.legacy.Widget",
+		"com.foo.Stable",
+	)
+
+	// Ignored symbols are still looked up in maven, and unaffected symbols in the rule
+	// index.
+	for _, pkg := range []string{"child", "child/grandchild"} {
+		deps := resolveUsedSymbols(JvmConfigForConfig(c, pkg), symbolsByLabel, usedSymbols)
+		require.Equal(t, []interface{}{"//old", mavenLabel}, deps)
+	}
+
+	require.False(t, JvmConfigForConfig(c, "").isIgnoredInRepoSymbol("com.foo.moving.Thing"))
+}
+
+func TestResolvePrefixMapsToInRepoLabel(t *testing.T) {
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(nil, nil)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaResolvePrefix+" com.example.thrift //idl/example:thrift",
+	))
+	configurer.Configure(c, "idl", nil)
+	configurer.Configure(c, "idl/special", testBuildFile(
+		t,
+		"idl/special",
+		ScalaResolvePrefix+" com.example.thrift.special._ :special_thrift",
+	))
+
+	// The generated symbols aren't in the rule index at all, and the prefix takes priority
+	// over anything which is.
+	symbolsByLabel := map[string][]string{
+		"//other:other": {"com.example.thrift.Indexed"},
+	}
+
+	resolveInPackage := func(pkg string, symbols ...interface{}) []interface{} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(symbols...)
+		return resolveUsedSymbols(JvmConfigForConfig(c, pkg), symbolsByLabel, usedSymbols)
+	}
+
+	require.Equal(
+		t,
+		[]interface{}{"//idl/example:thrift"},
+		resolveInPackage("", "com.example.thrift.Service", "com.example.thrift.Indexed"),
+	)
+	require.Equal(
+		t,
+		[]interface{}{"//idl/example:thrift", "//idl/special:special_thrift"},
+		resolveInPackage(
+			"idl/special",
+			"com.example.thrift.Service",
+			"com.example.thrift.special.Special",
+		),
+	)
+	// Prefixes only match whole namespace segments.
+	require.Empty(t, resolveInPackage("", "com.example.thriftless.Thing"))
+}
+
+func TestPreferredArtifactBreaksAmbiguity(t *testing.T) {
+	guavaLabel := "@maven//:com_google_guava_guava"
+	shadedLabel := "@maven//:com_example_shaded_guava"
+	otherLabel := "@maven//:com_example_other_guava"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.google.common.collect": {guavaLabel, shadedLabel, otherLabel}},
+		[]string{guavaLabel, shadedLabel, otherLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaPreferArtifact+" "+otherLabel,
+		ScalaPreferArtifact+" "+guavaLabel+", "+shadedLabel,
+	))
+	configurer.Configure(c, "shaded", testBuildFile(t, "shaded", ScalaPreferArtifact+" "+shadedLabel))
+
+	deps := resolveSymbols(JvmConfigForConfig(c, ""), "com.google.common.collect.ImmutableList")
+	require.Equal(t, []interface{}{otherLabel}, deps)
+
+	// Labels listed in a child package take priority over inherited ones.
+	deps = resolveSymbols(JvmConfigForConfig(c, "shaded"), "com.google.common.collect.ImmutableList")
+	require.Equal(t, []interface{}{shadedLabel}, deps)
+	require.Equal(
+		t,
+		[]string{shadedLabel, otherLabel, guavaLabel, shadedLabel},
+		JvmConfigForConfig(c, "shaded").PreferredArtifacts,
+	)
+	require.Equal(
+		t,
+		[]string{otherLabel, guavaLabel, shadedLabel},
+		JvmConfigForConfig(c, "").PreferredArtifacts,
+	)
+}
+
+func TestCompilerImportsMapToCompilerJars(t *testing.T) {
+	reflectLabel := "@maven//:org_scala_lang_scala_reflect"
+	compilerLabel := "@maven//:org_scala_lang_scala_compiler"
+
+	// scala-reflect is only present transitively, so is not visible.
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"scala.reflect.runtime": {reflectLabel}},
+		nil,
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", nil)
+	configurer.Configure(c, "macros", testBuildFile(t, "macros", ScalaMapCompilerImports+" true"))
+
+	require.Equal(
+		t,
+		[]interface{}{reflectLabel},
+		resolveSymbols(JvmConfigForConfig(c, "macros"), "scala.reflect.runtime.universe._"),
+	)
+	require.Equal(
+		t,
+		[]interface{}{compilerLabel, reflectLabel},
+		resolveSymbols(
+			JvmConfigForConfig(c, "macros"),
+			"scala.reflect.macros.blackbox.Context",
+			"scala.reflect.macros.contexts.Context",
+			"_root_.scala.tools.nsc.Global",
+		),
+	)
+
+	// Standard library and unrelated imports are unaffected.
+	require.Empty(
+		t,
+		resolveSymbols(JvmConfigForConfig(c, "macros"), "scala.reflect.ClassTag", "scala.toolsx.Thing"),
+	)
+	_, mapped := JvmConfigForConfig(c, "").compilerLabelForSymbol("scala.reflect.runtime.universe")
+	require.False(t, mapped)
+}
+
+func TestResolvedDepsAreSorted(t *testing.T) {
+	zebraLabel := "@maven//:com_example_zebra"
+	alphaLabel := "@maven//:com_example_alpha"
+	middleLabel := "@maven//:com_example_middle"
+	chainedLabel := "@maven//:com_example_chained"
+
+	jvmConfig := NewJvmConfig().NewChild()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.example.zebra": {zebraLabel},
+			"com.example.alpha": {alphaLabel},
+		},
+		[]string{zebraLabel, alphaLabel},
+	)
+	// Forced deps are listed out of order, including one forced in turn by another.
+	*jvmConfig.ForcedTransitiveDeps = map[string][]string{
+		zebraLabel:  {middleLabel, alphaLabel},
+		middleLabel: {chainedLabel},
+	}
+
+	symbolsByLabel := map[string][]string{
+		"//src/main/scala/com/example/zoo:lib": {"com.example.zoo.Zoo"},
+		"//src/main/scala/com/example/bar:lib": {"com.example.bar.Bar"},
+		"//src/main/scala/com/example/foo:lib": {"com.example.foo.Foo"},
+	}
+	symbolOrders := [][]string{
+		{"com.example.zebra.Z", "com.example.zoo.Zoo", "com.example.alpha.A", "com.example.bar.Bar"},
+		{"com.example.bar.Bar", "com.example.alpha.A", "com.example.zoo.Zoo", "com.example.zebra.Z"},
+		{"com.example.alpha.A", "com.example.zebra.Z", "com.example.bar.Bar", "com.example.zoo.Zoo"},
+	}
+
+	expected := []interface{}{
+		"//src/main/scala/com/example/bar:lib",
+		"//src/main/scala/com/example/zoo:lib",
+		alphaLabel,
+		chainedLabel,
+		middleLabel,
+		zebraLabel,
+	}
+	for i := 0; i < 5; i++ {
+		for _, symbols := range symbolOrders {
+			usedSymbols := NewUsedSymbols()
+			for _, symbol := range symbols {
+				usedSymbols.Symbols.Add(symbol)
+			}
+			require.Equal(t, expected, resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols))
+		}
+	}
+}
+
+func TestCandidateScopes(t *testing.T) {
+	tests := map[string][]string{
+		"Foo":                    {"Foo"},
+		"com.foo":                {"com.foo", "com"},
+		"com.foo.Bar":            {"com.foo.Bar", "com.foo"},
+		"com.foo.Bar.baz":        {"com.foo.Bar.baz", "com.foo.Bar", "com.foo"},
+		"com.foo.Outer.Inner.Fn": {"com.foo.Outer.Inner.Fn", "com.foo.Outer.Inner", "com.foo.Outer", "com.foo"},
+		"org.jboss.netty.buffer.ChannelBuffers.copiedBuffer": {
+			"org.jboss.netty.buffer.ChannelBuffers.copiedBuffer",
+			"org.jboss.netty.buffer.ChannelBuffers",
+			"org.jboss.netty.buffer",
+		},
+	}
+	for symbol, expected := range tests {
+		require.Equal(t, expected, candidateScopes(symbol), symbol)
+	}
+}
+
+func TestNestedSymbolsResolveToMavenPackage(t *testing.T) {
+	nettyLabel := "@maven//:io_netty_netty"
+	fooLabel := "@maven//:com_foo"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"org.jboss.netty.buffer": {nettyLabel},
+			"com.foo":                {fooLabel},
+		},
+		[]string{nettyLabel, fooLabel},
+	)
+
+	for symbol, expected := range map[string]string{
+		"org.jboss.netty.buffer.ChannelBuffers.copiedBuffer": nettyLabel,
+		"org.jboss.netty.buffer.ChannelBuffers":              nettyLabel,
+		"com.foo.Outer.Inner":                                fooLabel,
+		"com.foo.Outer.Inner.method":                         fooLabel,
+		"com.foo.Outer.Inner.Deepest._":                      fooLabel,
+	} {
+		require.Equal(t, []interface{}{expected}, resolveSymbols(jvmConfig, symbol), symbol)
+	}
+	require.Empty(t, resolveSymbols(jvmConfig, "com.foo.bar.Baz"))
+}
+
+func TestNestedClassBinaryName(t *testing.T) {
+	tests := map[string][2]string{
+		"com.foo.Outer":               {"com.foo.Outer", "com.foo"},
+		"com.foo.Outer.Inner":         {"com.foo.Outer$Inner", "com.foo"},
+		"com.foo.Outer.Inner.method":  {"com.foo.Outer$Inner", "com.foo"},
+		"com.foo.Outer.field.Value":   {"com.foo.Outer", "com.foo"},
+		"com.foo.A.B.C.d.E":           {"com.foo.A$B$C", "com.foo"},
+		"com.foo.bar.Outer.Inner.Fn_": {"com.foo.bar.Outer$Inner$Fn_", "com.foo.bar"},
+	}
+	for symbol, expected := range tests {
+		binaryName, pkg, ok := nestedClassBinaryName(symbol)
+		require.True(t, ok, symbol)
+		require.Equal(t, expected, [2]string{binaryName, pkg}, symbol)
+	}
+	for _, symbol := range []string{"com.foo", "Outer.Inner", "Outer"} {
+		_, _, ok := nestedClassBinaryName(symbol)
+		require.False(t, ok, symbol)
+	}
+}
+
+func TestNestedClassesResolveByBinaryName(t *testing.T) {
+	fooLabel := "@maven//:com_foo"
+	symbolsByLabel := map[string][]string{
+		"//src/main/java/com/bar:bar": {"com.bar.Outer$Inner"},
+	}
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.foo": {fooLabel}},
+		[]string{fooLabel},
+	)
+
+	// Nested classes from a maven jar resolve to the jar of their containing package, even
+	// when a lowercase member stops the candidate scopes short of it.
+	for _, symbol := range []string{
+		"com.foo.Outer.Inner",
+		"com.foo.Outer.field.Value",
+		"com.foo.Outer.Inner.field.Value._",
+	} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(symbol)
+		require.Equal(
+			t,
+			[]interface{}{fooLabel},
+			resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols),
+			symbol,
+		)
+	}
+
+	// In-repo nested classes may be indexed under their binary name.
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add("com.bar.Outer.Inner.method")
+	require.Equal(
+		t,
+		[]interface{}{"//src/main/java/com/bar"},
+		resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols),
+	)
+}
+
+func TestIsSymbol(t *testing.T) {
+	for _, name := range []string{"Foo", "FOO", "F", "`Foo`", "`Foo Bar`", "_Foo", "__Foo", "Ärger", "Σύμβολο", "ǅungla"} {
+		require.True(t, isSymbol(name), name)
+	}
+	for _, name := range []string{"", "_", "`", "``", "foo", "fOO", "`foo`", "_foo", "_root_", "2d", "2D", "ärger", "σύμβολο", "$Foo"} {
+		require.False(t, isSymbol(name), name)
+	}
+}
+
+func TestStrictResolutionReportsUnresolvedSymbols(t *testing.T) {
+	thingLabel := "@maven//:com_example_thing"
+
+	jvmConfig := NewJvmConfig().NewChild()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.thing": {thingLabel}},
+		[]string{thingLabel},
+	)
+	jvmConfig.addIgnoredImports(treeset.NewWithStringComparator("com.ignored"))
+
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add("com.example.thing.Thing", "com.ignored.Thing", "com.missing.Gone")
+	usedSymbols.AddSymbolSource("com.missing.Gone", "Example.scala:3")
+	usedSymbols.AddRelativeSymbol("nowhere.Else", "com.example")
+
+	resolve := func(strict bool) *UnresolvedSymbols {
+		jvmConfig.StrictResolution = strict
+		unresolved := NewUnresolvedSymbols()
+		c := testConfig(jvmConfig)
+		deps := ResolveJvmSymbols(
+			c,
+			testRuleIndex(c, nil),
+			label.New("", testPkg, "example"),
+			"scala",
+			usedSymbols,
+			ResolveOptions{Unresolved: unresolved},
+		)
+		require.Equal(t, []interface{}{thingLabel}, deps.Values())
+		return unresolved
+	}
+
+	require.NoError(t, resolve(false).Error())
+
+	err := resolve(true).Error()
+	require.ErrorContains(
+		t,
+		err,
+		label.New("", testPkg, "example").String()+":\n"+
+			"  com.missing.Gone (used at Example.scala:3)\n"+
+			"  nowhere.Else\n",
+	)
+	require.ErrorContains(t, err, "(1 used symbols were skipped this way)")
+	require.NotContains(t, err.Error(), "com.ignored.Thing")
+}
+
+func TestVerboseResolveLogsDirectiveDecisions(t *testing.T) {
+	guavaLabel := "@maven//:com_google_guava_guava"
+	shadedLabel := "@maven//:com_example_shaded_guava"
+
+	c := config.New()
+	configurer := NewJvmConfigurer()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configurer.RegisterFlags(fs, "", c)
+	require.NoError(t, fs.Parse([]string{"-scala_verbose_resolve"}))
+	require.NoError(t, configurer.CheckFlags(fs, c))
+
+	rootConfig := JvmConfigForConfig(c, "")
+	require.True(t, rootConfig.VerboseResolve)
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.google.common.collect": {guavaLabel, shadedLabel},
+			"com.google.common.base":    {guavaLabel},
+		},
+		[]string{guavaLabel, shadedLabel},
+	)
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaPreferArtifact+" "+guavaLabel,
+		ScalaResolvePrefix+" com.example.thrift //idl/example:thrift",
+	))
+	jvmConfig := JvmConfigForConfig(c, "")
+	require.True(t, jvmConfig.VerboseResolve)
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add(
+		"com.google.common.collect.ImmutableList",
+		"com.google.common.base.Strings",
+		"com.example.thrift.Service",
+	)
+	deps := resolveUsedSymbols(
+		jvmConfig,
+		map[string][]string{"//other:other": {"com.example.thrift.Service"}},
+		usedSymbols,
+	)
+	require.Equal(t, []interface{}{"//idl/example:thrift", guavaLabel}, deps)
+
+	from := label.New("", testPkg, "example")
+	require.Contains(
+		t,
+		logs.String(),
+		"Resolved com.google.common.collect.ImmutableList for "+from.String()+" (scala) to "+
+			guavaLabel+" via '# gazelle:"+ScalaPreferArtifact+"', candidates: "+
+			"["+shadedLabel+" "+guavaLabel+"]\n",
+	)
+	require.Contains(
+		t,
+		logs.String(),
+		"Resolved com.example.thrift.Service for "+from.String()+" (scala) to "+
+			"//idl/example:thrift via '# gazelle:"+ScalaResolvePrefix+"', candidates: "+
+			"[//idl/example:thrift //other]\n",
+	)
+	// Symbols resolved without any directive breaking a tie are not logged.
+	require.NotContains(t, logs.String(), "com.google.common.base.Strings")
+
+	logs.Reset()
+	jvmConfig.VerboseResolve = false
+	resolveUsedSymbols(jvmConfig, nil, usedSymbols)
+	require.Empty(t, logs.String())
+}
+
+func TestPackageAliasRewritesMavenLookup(t *testing.T) {
+	guavaLabel := "@maven//:com_google_guava_guava"
+	shadedLabel := "@maven//:com_example_shaded_guava"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.google.common.collect": {guavaLabel},
+			"com.example.shaded.base":   {shadedLabel},
+		},
+		[]string{guavaLabel, shadedLabel},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaPackageAlias+" shaded.guava com.google.common",
+	))
+	configurer.Configure(c, "special", testBuildFile(
+		t,
+		"special",
+		ScalaPackageAlias+" shaded.guava.base com.example.shaded.base",
+	))
+
+	require.Equal(
+		t,
+		[]interface{}{guavaLabel},
+		resolveSymbols(JvmConfigForConfig(c, ""), "shaded.guava.collect.ImmutableList"),
+	)
+	// Aliases only match whole package segments.
+	require.Empty(t, resolveSymbols(JvmConfigForConfig(c, ""), "shaded.guavax.collect.Thing"))
+
+	// The longest matching prefix wins, and aliases are inherited.
+	require.Equal(
+		t,
+		[]interface{}{shadedLabel, guavaLabel},
+		resolveSymbols(
+			JvmConfigForConfig(c, "special"),
+			"shaded.guava.collect.ImmutableList",
+			"shaded.guava.base.Strings",
+		),
+	)
+	require.Empty(t, resolveSymbols(JvmConfigForConfig(c, ""), "shaded.guava.base.Strings"))
+}
+
+func TestPackageIndexFileMergesWithMavenInstall(t *testing.T) {
+	widgetsLabel := "@maven//:com_example_widgets"
+	gadgetsLabel := "@maven//:com_example_gadgets"
+	thingsLabel := "@maven//:com_example_things"
+
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.example.widgets": {widgetsLabel},
+			"com.example.shared":  {widgetsLabel},
+		},
+		[]string{widgetsLabel, gadgetsLabel, thingsLabel},
+	)
+
+	c := config.New()
+	c.RepoRoot = t.TempDir()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+	require.NoError(t, os.WriteFile(filepath.Join(c.RepoRoot, "index.json"), []byte(`{
+		"com.example.shared": ["`+gadgetsLabel+`"],
+		"com.example.things": ["`+thingsLabel+`"]
+	}`), 0644))
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(t, ""))
+	configurer.Configure(c, "override", testBuildFile(t, "override", JavaPackageIndexFile+" index.json"))
+	configurer.Configure(c, "supplement", testBuildFile(
+		t,
+		"supplement",
+		JavaPackageIndexFile+" index.json "+PACKAGE_INDEX_SUPPLEMENT,
+	))
+
+	symbols := []interface{}{
+		"com.example.widgets.Widget",
+		"com.example.shared.Shared",
+		"com.example.things.Thing",
+	}
+
+	// Packages only in the index are added either way, and those only in the lockfile kept.
+	deps := resolveSymbols(JvmConfigForConfig(c, "override"), symbols...)
+	require.Equal(t, []interface{}{gadgetsLabel, thingsLabel, widgetsLabel}, deps)
+	deps = resolveSymbols(JvmConfigForConfig(c, "supplement"), symbols...)
+	require.Equal(t, []interface{}{thingsLabel, widgetsLabel}, deps)
+
+	// The shared maven install itself is left untouched.
+	deps = resolveSymbols(JvmConfigForConfig(c, ""), "com.example.shared.Shared")
+	require.Equal(t, []interface{}{widgetsLabel}, deps)
+	require.NotContains(t, rootConfig.MavenInstall.PackageMapping, "com.example.things")
+}
+
+func TestResolveToAncestorPackage(t *testing.T) {
+	symbolsByLabel := map[string][]string{
+		"//src/main/scala/com/acme:acme": {"com.acme", "com.acme.Top"},
+		// Provides the package, but from a directory which doesn't match its path.
+		"//lib/shared:shared": {"com.shared"},
+	}
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add("com.acme.nested.deeper.Thing", "com.shared.sub.Other", "com.Top")
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(nil, nil)
+	require.Empty(t, resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols))
+
+	// Symbols only resolve to targets in the directory of an enclosing package, and never
+	// via a top-level package.
+	jvmConfig.ResolveToAncestorPackage = true
+	require.Equal(
+		t,
+		[]interface{}{"//src/main/scala/com/acme"},
+		resolveUsedSymbols(jvmConfig, symbolsByLabel, usedSymbols),
+	)
+
+	// The directive is inherited by child packages.
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = jvmConfig.MavenInstall
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(t, "", ScalaResolveToAncestorPackage+" true"))
+	configurer.Configure(c, "nested", testBuildFile(t, "nested"))
+	require.True(t, JvmConfigForConfig(c, "nested").ResolveToAncestorPackage)
+}
+
+func TestExternalRepoMapping(t *testing.T) {
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.mycompany.shared.vendored": {"@maven//:com_mycompany_vendored"},
+		},
+		[]string{"@maven//:com_mycompany_vendored"},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(
+		t,
+		"",
+		ScalaExternalRepoMapping+" com.mycompany.shared.* @shared_lib//...",
+		ScalaExternalRepoMapping+" com.mycompany.shared.rpc @shared_rpc//src/main/scala/...",
+		ScalaExternalRepoMapping+" com.mycompany.tools @tools//cli:cli",
+	))
+	configurer.Configure(c, "nested", testBuildFile(t, "nested"))
+
+	// In-repo and maven symbols take priority over the mappings.
+	symbolsByLabel := map[string][]string{
+		"//local:local": {"com.mycompany.shared.local.Local"},
+	}
+
+	resolveInPackage := func(pkg string, symbols ...interface{}) []interface{} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(symbols...)
+		return resolveUsedSymbols(JvmConfigForConfig(c, pkg), symbolsByLabel, usedSymbols)
+	}
+
+	require.Equal(
+		t,
+		[]interface{}{
+			"//local",
+			"@maven//:com_mycompany_vendored",
+			"@shared_lib//com/mycompany/shared/foo",
+			"@shared_rpc//src/main/scala/com/mycompany/shared/rpc/client",
+			"@tools//cli",
+		},
+		resolveInPackage(
+			"nested",
+			"com.mycompany.shared.foo.Bar",
+			"com.mycompany.shared.foo.Bar.Nested",
+			"com.mycompany.shared.local.Local",
+			"com.mycompany.shared.rpc.client.Client",
+			"com.mycompany.shared.vendored.Thing",
+			"com.mycompany.tools.Main",
+		),
+	)
+	// Prefixes only match whole namespace segments.
+	require.Empty(t, resolveInPackage("", "com.mycompany.sharedless.Thing"))
+}
+
+func TestDepRewritersCollapseScalaVersions(t *testing.T) {
+	rootConfig := NewJvmConfig().NewChild()
+	rootConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"cats":        {"@maven//:org_typelevel_cats_core_2_12"},
+			"circe":       {"@maven//:io_circe_circe_core_2_13"},
+			"dotty.tools": {"@maven//:org_scala_lang_scala3_library_3"},
+			"guava":       {"@maven//:com_google_guava_guava"},
+		},
+		[]string{
+			"@maven//:org_typelevel_cats_core_2_12",
+			"@maven//:io_circe_circe_core_2_13",
+			"@maven//:org_scala_lang_scala3_library_3",
+			"@maven//:com_google_guava_guava",
+		},
+	)
+
+	c := config.New()
+	c.Exts[LANGUAGE_NAME] = &JvmConfigs{"": rootConfig}
+
+	configurer := NewJvmConfigurer()
+	configurer.Configure(c, "", testBuildFile(t, "", ScalaDepRewriters+" "+CollapseScalaMinorVersions))
+	configurer.Configure(c, "nested", testBuildFile(t, "nested"))
+	configurer.Configure(c, "scala3", testBuildFile(t, "scala3", ScalaDepRewriters+" "+CollapseScalaVersions))
+	configurer.Configure(c, "plain", testBuildFile(t, "plain", ScalaDepRewriters))
+
+	resolveInPackage := func(pkg string) []interface{} {
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add("cats.Monad", "circe.Json", "dotty.tools.Main", "guava.Lists")
+		return resolveUsedSymbols(JvmConfigForConfig(c, pkg), nil, usedSymbols)
+	}
+
+	// Both Scala 2 versions map to a shared alias, and the rewriter is inherited.
+	require.Equal(
+		t,
+		[]interface{}{
+			"@maven//:com_google_guava_guava",
+			"@maven//:io_circe_circe_core",
+			"@maven//:org_scala_lang_scala3_library_3",
+			"@maven//:org_typelevel_cats_core",
+		},
+		resolveInPackage("nested"),
+	)
+	require.Equal(
+		t,
+		[]interface{}{
+			"@maven//:com_google_guava_guava",
+			"@maven//:io_circe_circe_core",
+			"@maven//:org_scala_lang_scala3_library",
+			"@maven//:org_typelevel_cats_core",
+		},
+		resolveInPackage("scala3"),
+	)
+	// An empty value disables inherited rewriters.
+	require.Equal(
+		t,
+		[]interface{}{
+			"@maven//:com_google_guava_guava",
+			"@maven//:io_circe_circe_core_2_13",
+			"@maven//:org_scala_lang_scala3_library_3",
+			"@maven//:org_typelevel_cats_core_2_12",
+		},
+		resolveInPackage("plain"),
+	)
+}
+
+func TestRegisteredDepRewriter(t *testing.T) {
+	RegisterDepRewriter("test-umbrella", func(dep label.Label) []label.Label {
+		switch dep.Name {
+		case "com_google_guava_guava":
+			return []label.Label{label.New("", "third_party", "google")}
+		case "com_google_guava_failureaccess":
+			return nil
+		}
+		return []label.Label{dep}
+	})
+	t.Cleanup(func() { delete(depRewriters, "test-umbrella") })
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{
+			"com.google.common":   {"@maven//:com_google_guava_guava"},
+			"com.google.failures": {"@maven//:com_google_guava_failureaccess"},
+			"org.slf4j":           {"@maven//:org_slf4j_slf4j_api"},
+		},
+		[]string{
+			"@maven//:com_google_guava_guava",
+			"@maven//:com_google_guava_failureaccess",
+			"@maven//:org_slf4j_slf4j_api",
+		},
+	)
+	jvmConfig.DepRewriters = []string{"test-umbrella"}
+
+	require.Equal(
+		t,
+		[]interface{}{"//third_party:google", "@maven//:org_slf4j_slf4j_api"},
+		resolveSymbols(
+			jvmConfig,
+			"com.google.common.Lists",
+			"com.google.failures.Access",
+			"org.slf4j.Logger",
+		),
+	)
+}
@@ -0,0 +1,97 @@
+package jvm
+
+import (
+	"log"
+	"regexp"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/emirpasic/gods/sets/treeset"
+)
+
+// DepRewriter post-processes a single resolved dep, returning the labels to depend on in its
+// place. Returning the dep itself leaves it unchanged, and returning no labels drops it.
+type DepRewriter func(label.Label) []label.Label
+
+const (
+	// CollapseScalaMinorVersions strips the Scala 2 binary version suffix from label names,
+	// e.g. mapping both @maven//:cats_core_2_12 and @maven//:cats_core_2_13 to
+	// @maven//:cats_core, for repos which define version-independent aliases for artifacts.
+	CollapseScalaMinorVersions = "collapse-scala-minor-versions"
+
+	// CollapseScalaVersions works like CollapseScalaMinorVersions, but also strips the
+	// Scala 3 suffix, e.g. from @maven//:cats_core_3, for repos cross-building with Scala 3.
+	CollapseScalaVersions = "collapse-scala-versions"
+)
+
+var (
+	scalaMinorVersionSuffix = regexp.MustCompile(`_2_\d+$`)
+	scalaVersionSuffix      = regexp.MustCompile(`_(2_\d+|3)$`)
+)
+
+// stripNameSuffix returns a rewriter removing any match of suffix from label names.
+func stripNameSuffix(suffix *regexp.Regexp) DepRewriter {
+	return func(dep label.Label) []label.Label {
+		dep.Name = suffix.ReplaceAllString(dep.Name, "")
+		return []label.Label{dep}
+	}
+}
+
+var depRewriters = map[string]DepRewriter{
+	CollapseScalaMinorVersions: stripNameSuffix(scalaMinorVersionSuffix),
+	CollapseScalaVersions:      stripNameSuffix(scalaVersionSuffix),
+}
+
+// RegisterDepRewriter makes a rewriter available to the ScalaDepRewriters directive under
+// the given name. It must be called before any BUILD files are configured, e.g. from the
+// init function of a package linked into a custom Gazelle binary.
+func RegisterDepRewriter(name string, rewriter DepRewriter) {
+	if _, exists := depRewriters[name]; exists {
+		log.Fatalf("Dep rewriter '%s' is already registered\n", name)
+	}
+	depRewriters[name] = rewriter
+}
+
+// depRewriterNames returns the names of all registered rewriters in sorted order.
+func depRewriterNames() []string {
+	names := make([]string, 0, len(depRewriters))
+	for name := range depRewriters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rewriteDeps applies the rewriters configured via ScalaDepRewriters to each of deps in
+// order, dropping any rewritten dep on from itself. Deps which aren't valid labels are left
+// as they are.
+func (c *JvmConfig) rewriteDeps(from label.Label, deps *treeset.Set) *treeset.Set {
+	if len(c.DepRewriters) == 0 {
+		return deps
+	}
+
+	rewrittenDeps := treeset.NewWithStringComparator()
+	for _, value := range deps.Values() {
+		dep, err := label.Parse(value.(string))
+		if err != nil {
+			rewrittenDeps.Add(value)
+			continue
+		}
+
+		labels := []label.Label{dep}
+		for _, name := range c.DepRewriters {
+			var rewrittenLabels []label.Label
+			for _, depLabel := range labels {
+				rewrittenLabels = append(rewrittenLabels, depRewriters[name](depLabel)...)
+			}
+			labels = rewrittenLabels
+		}
+
+		for _, depLabel := range labels {
+			if depLabel.String() != from.String() {
+				rewrittenDeps.Add(depLabel.String())
+			}
+		}
+	}
+	return rewrittenDeps
+}
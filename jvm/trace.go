@@ -0,0 +1,126 @@
+package jvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ResolveDecision records how a single used symbol was resolved for a rule: the rule
+// index and maven package lookups attempted, in order, and the labels chosen as deps.
+type ResolveDecision struct {
+	From    string   `json:"from"`
+	Symbol  string   `json:"symbol"`
+	Lookups []string `json:"lookups"`
+	Labels  []string `json:"labels"`
+}
+
+func (d ResolveDecision) key() string {
+	return d.From + " " + d.Symbol
+}
+
+// ResolveTrace records every resolution decision made during a run, so that runs in
+// different environments can be compared to catch nondeterministic resolution.
+type ResolveTrace struct {
+	decisions map[string]ResolveDecision
+}
+
+func NewResolveTrace() *ResolveTrace {
+	return &ResolveTrace{
+		decisions: make(map[string]ResolveDecision),
+	}
+}
+
+func (t *ResolveTrace) record(decision ResolveDecision) {
+	t.decisions[decision.key()] = decision
+}
+
+// Decisions returns all recorded decisions sorted by rule and symbol.
+func (t *ResolveTrace) Decisions() []ResolveDecision {
+	keys := make([]string, 0, len(t.decisions))
+	for key := range t.decisions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	decisions := make([]ResolveDecision, 0, len(keys))
+	for _, key := range keys {
+		decisions = append(decisions, t.decisions[key])
+	}
+	return decisions
+}
+
+func (t *ResolveTrace) Write(path string) error {
+	content, err := json.MarshalIndent(t.Decisions(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+func ReadResolveTrace(path string) (*ResolveTrace, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var decisions []ResolveDecision
+	if err := json.Unmarshal(content, &decisions); err != nil {
+		return nil, fmt.Errorf("error parsing resolve trace %s: %w", path, err)
+	}
+
+	trace := NewResolveTrace()
+	for _, decision := range decisions {
+		trace.record(decision)
+	}
+	return trace, nil
+}
+
+func describeDecision(decision ResolveDecision) string {
+	return fmt.Sprintf(
+		"lookups [%s] chose [%s]",
+		strings.Join(decision.Lookups, ", "),
+		strings.Join(decision.Labels, ", "),
+	)
+}
+
+// Divergences compares this trace against an expected one, returning a description of
+// each decision which differs, is missing, or is unexpected.
+func (t *ResolveTrace) Divergences(expected *ResolveTrace) []string {
+	var divergences []string
+
+	for _, expectedDecision := range expected.Decisions() {
+		decision, exists := t.decisions[expectedDecision.key()]
+		if !exists {
+			divergences = append(divergences, fmt.Sprintf(
+				"%s: expected %s, but it was not resolved",
+				expectedDecision.key(),
+				describeDecision(expectedDecision),
+			))
+
+		} else if !slices.Equal(decision.Lookups, expectedDecision.Lookups) ||
+			!slices.Equal(decision.Labels, expectedDecision.Labels) {
+			divergences = append(divergences, fmt.Sprintf(
+				"%s: expected %s, but got %s",
+				expectedDecision.key(),
+				describeDecision(expectedDecision),
+				describeDecision(decision),
+			))
+		}
+	}
+
+	for _, decision := range t.Decisions() {
+		if _, exists := expected.decisions[decision.key()]; !exists {
+			divergences = append(divergences, fmt.Sprintf(
+				"%s: unexpectedly resolved, %s",
+				decision.key(),
+				describeDecision(decision),
+			))
+		}
+	}
+
+	return divergences
+}
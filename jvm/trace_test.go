@@ -0,0 +1,105 @@
+package jvm
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveTraceReplay(t *testing.T) {
+	thingLabel := "@maven//:com_example_thing"
+	otherThingLabel := "@maven//:com_example_other_thing"
+
+	symbolsByLabel := map[string][]string{
+		"//src/main/scala/com/example/util:util": {"com.example.util.Helper"},
+	}
+
+	resolveWithTrace := func(mavenInstall *MavenInstallData) *ResolveTrace {
+		jvmConfig := NewJvmConfig()
+		jvmConfig.MavenInstall = mavenInstall
+
+		usedSymbols := NewUsedSymbols()
+		usedSymbols.Symbols.Add(
+			"com.example.thing.Thing",
+			"com.example.util.Helper",
+			"com.example.unknown.Unknown",
+		)
+
+		trace := NewResolveTrace()
+		c := testConfig(jvmConfig)
+		ResolveJvmSymbols(
+			c,
+			testRuleIndex(c, symbolsByLabel),
+			label.New("", testPkg, "example"),
+			"scala",
+			usedSymbols,
+			ResolveOptions{Trace: trace},
+		)
+		return trace
+	}
+
+	mavenInstall := NewMavenInstallData(
+		map[string][]string{"com.example.thing": {thingLabel}},
+		[]string{thingLabel},
+	)
+
+	tracePath := filepath.Join(t.TempDir(), "trace.json")
+	recorded := resolveWithTrace(mavenInstall)
+	require.NoError(t, recorded.Write(tracePath))
+
+	require.Equal(
+		t,
+		[]ResolveDecision{
+			{
+				From:   "//src/main/scala/com/example",
+				Symbol: "com.example.thing.Thing",
+				Lookups: []string{
+					"rule_index com.example.thing.Thing",
+					"maven_package com.example.thing.Thing",
+					"rule_index com.example.thing",
+					"maven_package com.example.thing",
+				},
+				Labels: []string{thingLabel},
+			},
+			{
+				From:   "//src/main/scala/com/example",
+				Symbol: "com.example.unknown.Unknown",
+				Lookups: []string{
+					"rule_index com.example.unknown.Unknown",
+					"maven_package com.example.unknown.Unknown",
+					"rule_index com.example.unknown",
+					"maven_package com.example.unknown",
+				},
+				Labels: []string{},
+			},
+			{
+				From:   "//src/main/scala/com/example",
+				Symbol: "com.example.util.Helper",
+				Lookups: []string{
+					"rule_index com.example.util.Helper",
+					"maven_package com.example.util.Helper",
+				},
+				Labels: []string{"//src/main/scala/com/example/util"},
+			},
+		},
+		recorded.Decisions(),
+	)
+
+	expected, err := ReadResolveTrace(tracePath)
+	require.NoError(t, err)
+
+	// An identical run makes the same decisions.
+	require.Empty(t, resolveWithTrace(mavenInstall).Divergences(expected))
+
+	// A run in a different environment is flagged.
+	divergentInstall := NewMavenInstallData(
+		map[string][]string{"com.example.thing": {otherThingLabel}},
+		[]string{otherThingLabel},
+	)
+	divergences := resolveWithTrace(divergentInstall).Divergences(expected)
+	require.Len(t, divergences, 1)
+	require.Contains(t, divergences[0], "com.example.thing.Thing")
+	require.Contains(t, divergences[0], otherThingLabel)
+}
@@ -0,0 +1,73 @@
+package jvm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// UnresolvedSymbols collects the used symbols which resolved to no label at all in packages
+// with ScalaStrictResolution enabled, so that they can be reported together once every rule
+// has been resolved.
+type UnresolvedSymbols struct {
+	// Descriptions of the unresolved symbols, keyed by the rule using them.
+	unresolved map[string][]string
+	// How many used symbols were skipped via ScalaIgnoreImports instead.
+	ignored int
+}
+
+func NewUnresolvedSymbols() *UnresolvedSymbols {
+	return &UnresolvedSymbols{
+		unresolved: make(map[string][]string),
+	}
+}
+
+func (u *UnresolvedSymbols) recordUnresolved(from label.Label, symbol string, usedAt string) {
+	u.unresolved[from.String()] = append(u.unresolved[from.String()], symbol+usedAt)
+}
+
+func (u *UnresolvedSymbols) recordIgnored() {
+	u.ignored++
+}
+
+// Error returns an error listing every unresolved symbol by the rule using it, or nil if all
+// symbols were resolved.
+func (u *UnresolvedSymbols) Error() error {
+	if len(u.unresolved) == 0 {
+		return nil
+	}
+
+	froms := make([]string, 0, len(u.unresolved))
+	for from := range u.unresolved {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		"ERROR: the following used symbols look like packages or symbols, but could not be "+
+			"resolved to any label in the rule index or maven install, and strict resolution "+
+			"is enabled via '# gazelle:%s':\n",
+		ScalaStrictResolution,
+	)
+	for _, from := range froms {
+		symbols := u.unresolved[from]
+		sort.Strings(symbols)
+		fmt.Fprintf(&b, "%s:\n", from)
+		for _, symbol := range symbols {
+			fmt.Fprintf(&b, "  %s\n", symbol)
+		}
+	}
+	fmt.Fprintf(
+		&b,
+		"Symbols which are intentionally unresolvable can be skipped via '# gazelle:%s' "+
+			"(%d used symbols were skipped this way).",
+		ScalaIgnoreImports,
+		u.ignored,
+	)
+	return errors.New(b.String())
+}
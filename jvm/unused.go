@@ -0,0 +1,104 @@
+package jvm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/emirpasic/gods/sets/treeset"
+)
+
+// UnusedArtifacts records which maven install artifacts were chosen as a dep or runtime dep of
+// any rule during the run, so that the artifacts which never were can be reported once every
+// rule has been resolved. All methods are no-ops on a nil *UnusedArtifacts, so callers may
+// record to it unconditionally.
+type UnusedArtifacts struct {
+	// The labels chosen as deps, keyed by the artifact labels of the maven install of the
+	// package choosing them. These are shared by the copies of a maven install which merge
+	// in a JavaPackageIndexFile, unlike the maven install itself.
+	usedLabels map[*treeset.Set]*treeset.Set
+	// The configs of every package with resolved rules, so that artifacts they exclude are
+	// not reported as unused.
+	configs map[*JvmConfig]bool
+}
+
+func NewUnusedArtifacts() *UnusedArtifacts {
+	return &UnusedArtifacts{
+		usedLabels: make(map[*treeset.Set]*treeset.Set),
+		configs:    make(map[*JvmConfig]bool),
+	}
+}
+
+// RecordDeps records the deps resolved for the rule from as used.
+func (u *UnusedArtifacts) RecordDeps(c *config.Config, from label.Label, deps ...*treeset.Set) {
+	if u == nil {
+		return
+	}
+	u.recordDeps(JvmConfigForConfig(c, from.Pkg), deps...)
+}
+
+func (u *UnusedArtifacts) recordDeps(jvmConfig *JvmConfig, deps ...*treeset.Set) {
+	if jvmConfig.MavenInstall == nil {
+		return
+	}
+
+	u.configs[jvmConfig] = true
+	artifactLabels := jvmConfig.MavenInstall.ArtifactLabels
+	usedLabels, exists := u.usedLabels[artifactLabels]
+	if !exists {
+		usedLabels = treeset.NewWithStringComparator()
+		u.usedLabels[artifactLabels] = usedLabels
+	}
+	for _, depSet := range deps {
+		usedLabels.Add(depSet.Values()...)
+	}
+}
+
+// Labels returns the sorted artifact labels of every maven install in use which were never
+// recorded as a dep. Artifacts excluded by any package using the maven install are skipped,
+// since they could never have been chosen there.
+func (u *UnusedArtifacts) Labels() []string {
+	if u == nil {
+		return nil
+	}
+
+	unused := treeset.NewWithStringComparator()
+	for artifactLabels, usedLabels := range u.usedLabels {
+		for _, value := range artifactLabels.Values() {
+			artifactLabel := value.(string)
+			if !usedLabels.Contains(artifactLabel) && !u.isExcluded(artifactLabels, artifactLabel) {
+				unused.Add(artifactLabel)
+			}
+		}
+	}
+
+	labels := make([]string, 0, unused.Size())
+	for _, value := range unused.Values() {
+		labels = append(labels, value.(string))
+	}
+	return labels
+}
+
+func (u *UnusedArtifacts) isExcluded(artifactLabels *treeset.Set, artifactLabel string) bool {
+	for jvmConfig := range u.configs {
+		if jvmConfig.MavenInstall.ArtifactLabels == artifactLabels &&
+			jvmConfig.isExcludedArtifact(artifactLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints the unused artifact labels, one per line.
+func (u *UnusedArtifacts) Write(w io.Writer) {
+	if u == nil {
+		return
+	}
+
+	labels := u.Labels()
+	fmt.Fprintf(w, "Maven artifacts never used as a dep (%d):\n", len(labels))
+	for _, artifactLabel := range labels {
+		fmt.Fprintf(w, "  %s\n", artifactLabel)
+	}
+}
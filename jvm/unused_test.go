@@ -0,0 +1,98 @@
+package jvm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/emirpasic/gods/sets/treeset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnusedArtifactsReport(t *testing.T) {
+	thingLabel := "@maven//:com_example_thing"
+	unusedLabel := "@maven//:com_example_unused"
+	excludedLabel := "@maven//:com_example_excluded"
+	runtimeLabel := "@maven//:com_example_runtime"
+
+	jvmConfig := NewJvmConfig()
+	jvmConfig.MavenInstall = NewMavenInstallData(
+		map[string][]string{"com.example.thing": {thingLabel}},
+		[]string{thingLabel, unusedLabel, excludedLabel, runtimeLabel},
+	)
+	jvmConfig.addExcludedArtifacts(treeset.NewWithStringComparator(excludedLabel))
+	c := testConfig(jvmConfig)
+
+	usedSymbols := NewUsedSymbols()
+	usedSymbols.Symbols.Add("com.example.thing.Thing")
+	from := label.New("", testPkg, "example")
+	deps := ResolveJvmSymbols(
+		c,
+		testRuleIndex(c, nil),
+		from,
+		"scala",
+		usedSymbols,
+		ResolveOptions{},
+	)
+
+	unused := NewUnusedArtifacts()
+	unused.RecordDeps(c, from, deps, treeset.NewWithStringComparator(runtimeLabel))
+	require.Equal(t, []string{unusedLabel}, unused.Labels())
+
+	var out bytes.Buffer
+	unused.Write(&out)
+	require.Equal(t, "Maven artifacts never used as a dep (1):\n  "+unusedLabel+"\n", out.String())
+
+	var nilUnused *UnusedArtifacts
+	nilUnused.RecordDeps(c, from, deps)
+	require.Nil(t, nilUnused.Labels())
+}
+
+func TestUnusedArtifactsAcrossPackageIndexes(t *testing.T) {
+	thingLabel := "@maven//:com_example_thing"
+	indexedLabel := "@maven//:com_example_indexed"
+	mavenInstall := NewMavenInstallData(
+		map[string][]string{"com.example.thing": {thingLabel}},
+		[]string{thingLabel, indexedLabel},
+	)
+
+	rootConfig := NewJvmConfig()
+	rootConfig.MavenInstall = mavenInstall
+	rootC := testConfig(rootConfig)
+
+	indexedConfig := NewJvmConfig()
+	indexedConfig.MavenInstall = mavenInstall.WithPackageIndex(
+		map[string][]string{"com.example.indexed": {indexedLabel}},
+		false,
+	)
+	indexedC := testConfig(indexedConfig)
+
+	rootSymbols := NewUsedSymbols()
+	rootSymbols.Symbols.Add("com.example.thing.Thing")
+	rootFrom := label.New("", testPkg, "root")
+	rootDeps := ResolveJvmSymbols(
+		rootC,
+		testRuleIndex(rootC, nil),
+		rootFrom,
+		"scala",
+		rootSymbols,
+		ResolveOptions{},
+	)
+
+	indexedSymbols := NewUsedSymbols()
+	indexedSymbols.Symbols.Add("com.example.indexed.Indexed")
+	indexedFrom := label.New("", testPkg, "indexed")
+	indexedDeps := ResolveJvmSymbols(
+		indexedC,
+		testRuleIndex(indexedC, nil),
+		indexedFrom,
+		"scala",
+		indexedSymbols,
+		ResolveOptions{},
+	)
+
+	unused := NewUnusedArtifacts()
+	unused.RecordDeps(rootC, rootFrom, rootDeps)
+	unused.RecordDeps(indexedC, indexedFrom, indexedDeps)
+	require.Empty(t, unused.Labels())
+}
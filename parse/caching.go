@@ -9,8 +9,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// The version of the parsing cache's schema, which must be bumped whenever ParsingCache or
+// any language's ParseResult changes shape. Caches written with a different version are
+// regenerated rather than decoded, independently of whether the gazelle binary changed.
+const cacheFormatVersion = 4
+
 var computedGazelleChecksum *string = nil
 
 // Gazelle does not run through Bazel, so we roll our own cache fingerprinting. This is
@@ -44,25 +51,50 @@ func gazelleChecksum() string {
 	return *computedGazelleChecksum
 }
 
+// FileStat records the size and modification time a source file had when it was last
+// hashed, along with that hash, so that unchanged files can be looked up in the parsing
+// cache without being read.
+type FileStat struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+func (fs FileStat) matches(info os.FileInfo) bool {
+	return fs.Size == info.Size() && fs.ModTime == info.ModTime().UnixNano()
+}
+
 type untypedParsingCache struct {
+	CacheFormatVersion    int                     `json:"cache_format_version"`
 	GazelleBinaryChecksum string                  `json:"gazelle_binary_checksum"`
 	Cache                 *map[string]interface{} `json:"parse_cache"`
+	FileStats             map[string]FileStat     `json:"file_stats,omitempty"`
 }
 
 type ParsingCache[ParseResult any] struct {
+	CacheFormatVersion    int                      `json:"cache_format_version"`
 	GazelleBinaryChecksum string                   `json:"gazelle_binary_checksum"`
 	Cache                 *map[string]*ParseResult `json:"parse_cache"`
+	// Keyed by source file path. Only populated when file stats are in use.
+	FileStats map[string]FileStat `json:"file_stats,omitempty"`
 }
 
 // Implemented by language-specific parsers
 type CacheableParser[ParseResult any] interface {
 	Parse(filePath string, sourceString string) (*ParseResult, []error)
 	UnmarshalParsingCache(*map[string]*ParseResult, *map[string]interface{})
+	// CacheFingerprint describes any options of the parser which change its parse results,
+	// and is empty for the default options. It is folded into the cache's checksum, so
+	// that results parsed with different options are regenerated rather than reused.
+	CacheFingerprint() string
 }
 
 // Parent interface implemented by the cached/uncached wrapper types here.
 type Parser[ParseResult any] interface {
 	ParseFile(filePath string) (*ParseResult, []error)
+	// ParseSource parses source code which is already in memory. filePath is only used
+	// to identify the source in parse results and errors, and need not exist on disk.
+	ParseSource(filePath string, source string) (*ParseResult, []error)
 	WriteParsingCache()
 }
 
@@ -72,18 +104,61 @@ type CachingParser[ParseResult any] struct {
 	parser           CacheableParser[ParseResult]
 	parsingCache     ParsingCache[ParseResult]
 	parsingCacheFile string
+
+	// When set, only cache entries hit or written during this run are persisted.
+	pruneStaleEntries bool
+	touchedHashes     map[string]bool
+
+	// When set, parsingCacheFile is a directory and the cache is split across shard files
+	// within it, keyed by the leading characters of each entry's hash. Only shards which
+	// have changed are rewritten.
+	sharded     bool
+	dirtyShards map[string]bool
+	// The extension of shard files, which are gzipped if the directory has a .gz extension.
+	shardExtension string
+
+	// Compression settings used when writing .gz cache files.
+	gzipLevel    int
+	parallelGzip bool
+
+	// When set, ParseFile trusts a source file's size and modification time to tell
+	// whether it has changed since it was last parsed, only reading and hashing it if
+	// they differ from those recorded in the cache.
+	useFileStats bool
+
+	// Records cache hits and misses, if non-nil.
+	stats *ParseStats
+
+	// When set, results which came with parse errors are cached like any other, rather than
+	// the source being parsed again on every run. Their errors are not cached, so are only
+	// returned when the source is actually parsed.
+	cachePartialResults bool
 }
 
-func loadParsingCache[ParseResult any](
-	parser CacheableParser[ParseResult],
-	parsingCacheFile string,
-) ParsingCache[ParseResult] {
-	cacheMap := make(map[string]*ParseResult, 0)
-	parsingCache := ParsingCache[ParseResult]{
-		GazelleBinaryChecksum: gazelleChecksum(),
-		Cache:                 &cacheMap,
+const (
+	shardPrefixLength  = 2
+	shardFileExtension = ".json"
+)
+
+// Returns the extension of the shard files within the given sharded cache directory.
+func shardExtensionForDir(parsingCacheDir string) string {
+	if filepath.Ext(parsingCacheDir) == ".gz" {
+		return shardFileExtension + ".gz"
 	}
+	return shardFileExtension
+}
+
+func shardForHash(hash string) string {
+	return hash[:shardPrefixLength]
+}
 
+// Reads a single parsing cache file into parsingCache, returning false if it could not be
+// used, e.g. because it is corrupt or was generated by a different gazelle binary.
+func readParsingCacheFile[ParseResult any](
+	parser CacheableParser[ParseResult],
+	parsingCacheFile string,
+	parsingCache ParsingCache[ParseResult],
+) bool {
 	var cacheReader io.Reader
 
 	cacheFile, err := os.Open(parsingCacheFile)
@@ -93,7 +168,7 @@ func loadParsingCache[ParseResult any](
 				"WARN: parsing cache file '%s' does not exist. It will be created.\n",
 				parsingCacheFile,
 			)
-			return parsingCache
+			return false
 
 		} else {
 			log.Fatalf("Error opening parsing cache file %s:\n%s\n", parsingCacheFile, err)
@@ -102,10 +177,21 @@ func loadParsingCache[ParseResult any](
 	cacheReader = cacheFile
 	defer cacheFile.Close()
 
+	// A corrupt cache file, e.g. from a gazelle process which crashed mid-write before
+	// writes were atomic, is treated as a cache miss rather than a fatal error.
+	warnCorruptCache := func(err interface{}) {
+		log.Printf(
+			"WARN: Unable to parse parsing cache file %s, it will be regenerated:\n%s\n",
+			parsingCacheFile,
+			err,
+		)
+	}
+
 	if filepath.Ext(parsingCacheFile) == ".gz" {
 		gzipReader, err := gzip.NewReader(cacheReader)
 		if err != nil {
-			log.Fatalf("Error decoding gzipped cache file %s:\n%s\n", parsingCacheFile, err)
+			warnCorruptCache(err)
+			return false
 		}
 		cacheReader = gzipReader
 		defer gzipReader.Close()
@@ -114,95 +200,491 @@ func loadParsingCache[ParseResult any](
 	var untypedCache untypedParsingCache
 	err = json.NewDecoder(cacheReader).Decode(&untypedCache)
 	if err != nil {
-		log.Fatalf("Unable to parse parsing cache file %s:\n%s\n", parsingCacheFile, err)
+		warnCorruptCache(err)
+		return false
 	}
 
-	if parsingCache.GazelleBinaryChecksum != untypedCache.GazelleBinaryChecksum {
+	checksum := parsingCache.GazelleBinaryChecksum
+	if untypedCache.CacheFormatVersion != cacheFormatVersion {
+		// Caches written before the format was versioned decode as version 0.
 		log.Printf(
-			"WARN: Computed Gazelle binary checksum %s does not match cache file checksum "+
+			"WARN: Parsing cache format version %d does not match cache file version %d "+
+				"from %s. The cache file will be regenerated.",
+			cacheFormatVersion,
+			untypedCache.CacheFormatVersion,
+			parsingCacheFile,
+		)
+		return false
+
+	} else if checksum != untypedCache.GazelleBinaryChecksum {
+		log.Printf(
+			"WARN: Gazelle binary checksum or cache version %s does not match cache file checksum "+
 				"%s from %s. The cache file will be regenerated.",
-			parsingCache.GazelleBinaryChecksum,
+			checksum,
 			untypedCache.GazelleBinaryChecksum,
 			parsingCacheFile,
 		)
+		return false
+
+	} else if untypedCache.Cache != nil {
+		// Language parsers unmarshal cache entries with unchecked type assertions, so
+		// entries which are valid json but not the expected shape will panic.
+		fileCacheMap := make(map[string]*ParseResult, len(*untypedCache.Cache))
+		unmarshalled := func() (ok bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					warnCorruptCache(r)
+					ok = false
+				}
+			}()
+			parser.UnmarshalParsingCache(&fileCacheMap, untypedCache.Cache)
+			return true
+		}()
+		if !unmarshalled {
+			return false
+		}
 
-	} else {
-		parser.UnmarshalParsingCache(parsingCache.Cache, untypedCache.Cache)
+		for hash, parseResult := range fileCacheMap {
+			(*parsingCache.Cache)[hash] = parseResult
+		}
+		for path, fileStat := range untypedCache.FileStats {
+			parsingCache.FileStats[path] = fileStat
+		}
+	}
+
+	return true
+}
+
+func newParsingCache[ParseResult any](checksum string) ParsingCache[ParseResult] {
+	cacheMap := make(map[string]*ParseResult, 0)
+	return ParsingCache[ParseResult]{
+		CacheFormatVersion:    cacheFormatVersion,
+		GazelleBinaryChecksum: checksum,
+		Cache:                 &cacheMap,
+		FileStats:             make(map[string]FileStat),
 	}
+}
 
+func loadParsingCache[ParseResult any](
+	parser CacheableParser[ParseResult],
+	parsingCacheFile string,
+	checksum string,
+) ParsingCache[ParseResult] {
+	parsingCache := newParsingCache[ParseResult](checksum)
+	readParsingCacheFile(parser, parsingCacheFile, parsingCache)
 	return parsingCache
 }
 
+// Loads and merges all the shard files in parsingCacheDir, returning the merged cache
+// along with any shards which could not be used and so must be rewritten.
+func loadShardedParsingCache[ParseResult any](
+	parser CacheableParser[ParseResult],
+	parsingCacheDir string,
+	shardExtension string,
+	checksum string,
+) (ParsingCache[ParseResult], map[string]bool) {
+	parsingCache := newParsingCache[ParseResult](checksum)
+	dirtyShards := make(map[string]bool)
+
+	entries, err := os.ReadDir(parsingCacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf(
+				"WARN: parsing cache directory '%s' does not exist. It will be created.\n",
+				parsingCacheDir,
+			)
+			return parsingCache, dirtyShards
+
+		} else {
+			log.Fatalf("Error reading parsing cache directory %s:\n%s\n", parsingCacheDir, err)
+		}
+	}
+
+	for _, entry := range entries {
+		shard, isShard := strings.CutSuffix(entry.Name(), shardExtension)
+		if entry.IsDir() || !isShard {
+			continue
+		}
+
+		shardFile := filepath.Join(parsingCacheDir, entry.Name())
+		if !readParsingCacheFile(parser, shardFile, parsingCache) {
+			dirtyShards[shard] = true
+		}
+	}
+
+	return parsingCache, dirtyShards
+}
+
+// CachingParserOptions configures how a CachingParser reads and writes its cache.
+type CachingParserOptions struct {
+	// If set, entries for source which was not parsed during this run are dropped when the
+	// cache is written, rather than accumulating indefinitely.
+	PruneStaleEntries bool
+	// Any of the compress/gzip levels, used when writing .gz cache files. Note the zero
+	// value is gzip.NoCompression, so callers writing .gz caches should set this, e.g. to
+	// gzip.DefaultCompression.
+	GzipLevel int
+	// If set, .gz cache files are compressed across multiple CPUs.
+	ParallelGzip bool
+	// If set, files whose size and modification time are unchanged since they were last
+	// parsed are not reread. This is only safe where modification times are reliable.
+	UseFileStats bool
+	// If non-nil, cache hits and misses are counted in Stats.
+	Stats *ParseStats
+	// If non-empty, CacheVersion is used to fingerprint the cache in place of the gazelle
+	// binary's checksum, so that the cache survives rebuilds of gazelle which don't change
+	// parsing. Either is combined with the parser's CacheFingerprint.
+	CacheVersion string
+	// If set, best-effort results of source which failed to fully parse are cached too,
+	// although their errors are then only returned on a cache miss.
+	CachePartialResults bool
+}
+
+// NewCachingParser creates a parser which caches parse results in parsingCacheFile. If
+// parsingCacheFile is an existing directory or ends with a path separator, the cache is
+// sharded across multiple files within that directory, which are gzipped like a single
+// cache file if the directory has a .gz extension.
 func NewCachingParser[ParseResult any](
 	parser CacheableParser[ParseResult],
 	parsingCacheFile string,
+	opts CachingParserOptions,
 ) CachingParser[ParseResult] {
-	return CachingParser[ParseResult]{
-		parser:           parser,
-		parsingCache:     loadParsingCache(parser, parsingCacheFile),
-		parsingCacheFile: parsingCacheFile,
+	sharded := strings.HasSuffix(parsingCacheFile, string(os.PathSeparator))
+	if info, err := os.Stat(parsingCacheFile); err == nil && info.IsDir() {
+		sharded = true
 	}
+	parsingCacheFile = filepath.Clean(parsingCacheFile)
+
+	checksum := opts.CacheVersion
+	if checksum == "" {
+		checksum = gazelleChecksum()
+	}
+	if fingerprint := parser.CacheFingerprint(); fingerprint != "" {
+		checksum += "+" + fingerprint
+	}
+
+	cachingParser := CachingParser[ParseResult]{
+		parser:              parser,
+		parsingCacheFile:    parsingCacheFile,
+		pruneStaleEntries:   opts.PruneStaleEntries,
+		touchedHashes:       make(map[string]bool),
+		sharded:             sharded,
+		dirtyShards:         make(map[string]bool),
+		gzipLevel:           opts.GzipLevel,
+		parallelGzip:        opts.ParallelGzip,
+		useFileStats:        opts.UseFileStats,
+		stats:               opts.Stats,
+		cachePartialResults: opts.CachePartialResults,
+	}
+
+	if sharded {
+		cachingParser.shardExtension = shardExtensionForDir(parsingCacheFile)
+		cachingParser.parsingCache, cachingParser.dirtyShards = loadShardedParsingCache(
+			parser,
+			parsingCacheFile,
+			cachingParser.shardExtension,
+			checksum,
+		)
+	} else {
+		cachingParser.parsingCache = loadParsingCache(parser, parsingCacheFile, checksum)
+	}
+
+	return cachingParser
 }
 
 func (cp *CachingParser[ParseResult]) ParseFile(filePath string) (*ParseResult, []error) {
+	var fileInfo os.FileInfo
+	if cp.useFileStats {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			log.Fatalf("Error reading source file %s:\n%s\n", filePath, err)
+		}
+		fileInfo = info
+
+		if fileStat, exists := cp.parsingCache.FileStats[filePath]; exists &&
+			fileStat.matches(fileInfo) {
+			if cachedParse, exists := (*cp.parsingCache.Cache)[fileStat.Hash]; exists {
+				cp.touchedHashes[fileStat.Hash] = true
+				cp.stats.RecordCacheHit()
+				return cachedParse, nil
+			}
+		}
+	}
+
 	fileBytes, err := os.ReadFile(filePath)
 	if err != nil {
 		log.Fatalf("Error reading source file %s:\n%s\n", filePath, err)
 	}
 
-	hashBytes := sha256.Sum256(fileBytes)
-	hash := hex.EncodeToString(hashBytes[:])
+	hash := hashSource(string(fileBytes))
+	parseResult, errs := cp.parseSourceWithHash(filePath, string(fileBytes), hash)
+
+	if fileInfo != nil {
+		if _, cached := (*cp.parsingCache.Cache)[hash]; cached {
+			cp.recordFileStat(filePath, FileStat{
+				Size:    fileInfo.Size(),
+				ModTime: fileInfo.ModTime().UnixNano(),
+				Hash:    hash,
+			})
+		}
+	}
+
+	return parseResult, errs
+}
+
+// Records the stat of a freshly hashed file, marking the shards holding both its old and
+// new stat as dirty.
+func (cp *CachingParser[ParseResult]) recordFileStat(filePath string, fileStat FileStat) {
+	if oldStat, exists := cp.parsingCache.FileStats[filePath]; exists {
+		if oldStat == fileStat {
+			return
+		}
+		cp.dirtyShards[shardForHash(oldStat.Hash)] = true
+	}
+
+	cp.parsingCache.FileStats[filePath] = fileStat
+	cp.dirtyShards[shardForHash(fileStat.Hash)] = true
+}
+
+func hashSource(source string) string {
+	hashBytes := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(hashBytes[:])
+}
+
+func (cp *CachingParser[ParseResult]) ParseSource(
+	filePath string,
+	source string,
+) (*ParseResult, []error) {
+	return cp.parseSourceWithHash(filePath, source, hashSource(source))
+}
+
+func (cp *CachingParser[ParseResult]) parseSourceWithHash(
+	filePath string,
+	source string,
+	hash string,
+) (*ParseResult, []error) {
+	cp.touchedHashes[hash] = true
 
 	if cachedParse, exists := (*cp.parsingCache.Cache)[hash]; exists {
-		// file has not changed, return cached result
+		// source has not changed, return cached result
+		cp.stats.RecordCacheHit()
 		return cachedParse, nil
 	}
+	cp.stats.RecordCacheMiss()
 
-	sourceString := string(fileBytes)
-	parseResult, errs := cp.parser.Parse(filePath, sourceString)
-	if errs == nil || len(errs) == 0 {
+	parseResult, errs := cp.parser.Parse(filePath, source)
+	if errs == nil || len(errs) == 0 || cp.cachePartialResults {
 		(*cp.parsingCache.Cache)[hash] = parseResult
+		cp.dirtyShards[shardForHash(hash)] = true
 	}
 
 	return parseResult, errs
 }
 
-func (cp *CachingParser[ParseResult]) WriteParsingCache() {
-	cacheFileDir := filepath.Dir(cp.parsingCacheFile)
-	if _, err := os.Stat(cacheFileDir); os.IsNotExist(err) {
-		err = os.MkdirAll(cacheFileDir, 0755)
-		if err != nil {
-			log.Fatalf("Error creating parent directory of parsing cache file:\n%s\n", err)
+// Locks older than this are assumed to have been left behind by a gazelle process which
+// exited without cleaning up after itself.
+const staleLockAge = 10 * time.Minute
+
+// Takes a lock on the parsing cache file for writing, returning false if another process
+// already holds it.
+func (cp *CachingParser[ParseResult]) lockParsingCache() bool {
+	lockFile := cp.parsingCacheFile + ".lock"
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return true
+		} else if !os.IsExist(err) {
+			log.Fatalf("Error creating parsing cache lock file %s:\n%s\n", lockFile, err)
+		}
+
+		info, err := os.Stat(lockFile)
+		if err != nil || time.Since(info.ModTime()) < staleLockAge {
+			return false
 		}
+		log.Printf("WARN: Removing stale parsing cache lock file %s\n", lockFile)
+		os.Remove(lockFile)
 	}
 
-	var cacheWriter io.Writer
+	return false
+}
+
+func (cp *CachingParser[ParseResult]) unlockParsingCache() {
+	os.Remove(cp.parsingCacheFile + ".lock")
+}
 
-	cacheFile, err := os.Create(cp.parsingCacheFile)
+// Writes the given cache to a temporary file alongside parsingCacheFile and then
+// atomically renames it into place, so that the cache file is never left partially
+// written.
+func (cp *CachingParser[ParseResult]) writeParsingCacheFile(
+	parsingCacheFile string,
+	parsingCache ParsingCache[ParseResult],
+) {
+	cacheFileDir := filepath.Dir(parsingCacheFile)
+	tempFile, err := os.CreateTemp(cacheFileDir, filepath.Base(parsingCacheFile)+".tmp-*")
 	if err != nil {
 		log.Fatalf(
-			"Error opening parsing cache file %s for writing:\n%s\n",
-			cp.parsingCacheFile,
+			"Error opening temporary parsing cache file in %s for writing:\n%s\n",
+			cacheFileDir,
 			err,
 		)
 	}
-	cacheWriter = cacheFile
-	defer cacheFile.Close()
+	tempFilePath := tempFile.Name()
+	defer os.Remove(tempFilePath)
+
+	// CreateTemp restricts permissions to the current user, match os.Create instead.
+	if err = tempFile.Chmod(0644); err != nil {
+		log.Fatalf("Error setting permissions on %s:\n%s\n", tempFilePath, err)
+	}
 
-	if filepath.Ext(cp.parsingCacheFile) == ".gz" {
-		gzipWriter := gzip.NewWriter(cacheWriter)
+	var cacheWriter io.Writer = tempFile
+	var gzipWriter io.WriteCloser
+
+	if filepath.Ext(parsingCacheFile) == ".gz" {
+		gzipWriter, err = newGzipWriter(cacheWriter, cp.gzipLevel, cp.parallelGzip)
 		if err != nil {
-			log.Fatalf("Error decoding gzipped cache file %s:\n%s\n", cp.parsingCacheFile, err)
+			log.Fatalf("Error compressing parsing cache file %s:\n%s\n", parsingCacheFile, err)
 		}
 		cacheWriter = gzipWriter
-		defer gzipWriter.Close()
 	}
 
 	jsonEncoder := json.NewEncoder(cacheWriter)
 	jsonEncoder.SetIndent("", "    ")
-	err = jsonEncoder.Encode(cp.parsingCache)
+	err = jsonEncoder.Encode(parsingCache)
+	if err == nil && gzipWriter != nil {
+		err = gzipWriter.Close()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		log.Fatal("Error writing parsing cache to disk:\n%s\n", err)
+		log.Fatalf("Error writing parsing cache to disk:\n%s\n", err)
+	}
+
+	err = os.Rename(tempFilePath, parsingCacheFile)
+	if err != nil {
+		log.Fatalf(
+			"Error moving parsing cache into place at %s:\n%s\n",
+			parsingCacheFile,
+			err,
+		)
+	}
+}
+
+// Returns the file stats which point at entries in the given cache, so that stats for
+// pruned entries are dropped along with them.
+func (cp *CachingParser[ParseResult]) fileStatsToWrite(
+	cache map[string]*ParseResult,
+) map[string]FileStat {
+	fileStats := make(map[string]FileStat, len(cp.parsingCache.FileStats))
+	for path, fileStat := range cp.parsingCache.FileStats {
+		if _, exists := cache[fileStat.Hash]; exists {
+			fileStats[path] = fileStat
+		}
+	}
+	return fileStats
+}
+
+// Returns the cache entries which should be persisted, marking any shards affected by
+// pruning as dirty.
+func (cp *CachingParser[ParseResult]) cacheToWrite() map[string]*ParseResult {
+	if !cp.pruneStaleEntries {
+		return *cp.parsingCache.Cache
+	}
+
+	prunedCache := make(map[string]*ParseResult, len(cp.touchedHashes))
+	for hash, parseResult := range *cp.parsingCache.Cache {
+		if cp.touchedHashes[hash] {
+			prunedCache[hash] = parseResult
+		} else {
+			cp.dirtyShards[shardForHash(hash)] = true
+		}
+	}
+	return prunedCache
+}
+
+// Rewrites only the dirty shards of a sharded cache, removing any left empty. File stats
+// are stored in the shard of the hash they point at.
+func (cp *CachingParser[ParseResult]) writeShards(
+	cache map[string]*ParseResult,
+	fileStats map[string]FileStat,
+) {
+	shards := make(map[string]map[string]*ParseResult)
+	for hash, parseResult := range cache {
+		shard := shardForHash(hash)
+		if _, exists := shards[shard]; !exists {
+			shards[shard] = make(map[string]*ParseResult)
+		}
+		shards[shard][hash] = parseResult
+	}
+
+	shardFileStats := make(map[string]map[string]FileStat)
+	for path, fileStat := range fileStats {
+		shard := shardForHash(fileStat.Hash)
+		if _, exists := shardFileStats[shard]; !exists {
+			shardFileStats[shard] = make(map[string]FileStat)
+		}
+		shardFileStats[shard][path] = fileStat
+	}
+
+	for shard := range cp.dirtyShards {
+		shardFile := filepath.Join(cp.parsingCacheFile, shard+cp.shardExtension)
+
+		shardCache, exists := shards[shard]
+		if !exists {
+			if err := os.Remove(shardFile); err != nil && !os.IsNotExist(err) {
+				log.Fatalf("Error removing empty parsing cache shard %s:\n%s\n", shardFile, err)
+			}
+			continue
+		}
+
+		cp.writeParsingCacheFile(shardFile, ParsingCache[ParseResult]{
+			CacheFormatVersion:    cp.parsingCache.CacheFormatVersion,
+			GazelleBinaryChecksum: cp.parsingCache.GazelleBinaryChecksum,
+			Cache:                 &shardCache,
+			FileStats:             shardFileStats[shard],
+		})
+	}
+
+	cp.dirtyShards = make(map[string]bool)
+}
+
+// WriteParsingCache persists the parsing cache to disk. If another gazelle process is
+// writing the cache at the same time, we skip writing rather than clobber its results.
+func (cp *CachingParser[ParseResult]) WriteParsingCache() {
+	cacheFileDir := filepath.Dir(cp.parsingCacheFile)
+	if cp.sharded {
+		cacheFileDir = cp.parsingCacheFile
+	}
+	if _, err := os.Stat(cacheFileDir); os.IsNotExist(err) {
+		err = os.MkdirAll(cacheFileDir, 0755)
+		if err != nil {
+			log.Fatalf("Error creating parent directory of parsing cache file:\n%s\n", err)
+		}
+	}
+
+	if !cp.lockParsingCache() {
+		log.Printf(
+			"WARN: parsing cache file %s is being written by another process, skipping.\n",
+			cp.parsingCacheFile,
+		)
+		return
+	}
+	defer cp.unlockParsingCache()
+
+	cache := cp.cacheToWrite()
+	fileStats := cp.fileStatsToWrite(cache)
+
+	if cp.sharded {
+		cp.writeShards(cache, fileStats)
+	} else {
+		cp.writeParsingCacheFile(cp.parsingCacheFile, ParsingCache[ParseResult]{
+			CacheFormatVersion:    cp.parsingCache.CacheFormatVersion,
+			GazelleBinaryChecksum: cp.parsingCache.GazelleBinaryChecksum,
+			Cache:                 &cache,
+			FileStats:             fileStats,
+		})
 	}
 }
 
@@ -226,8 +708,14 @@ func (up *UncachedParser[ParseResult]) ParseFile(filePath string) (*ParseResult,
 		log.Fatalf("Error reading source file %s:\n%s\n", filePath, err)
 	}
 
-	sourceString := string(fileBytes)
-	return up.parser.Parse(filePath, sourceString)
+	return up.ParseSource(filePath, string(fileBytes))
+}
+
+func (up *UncachedParser[ParseResult]) ParseSource(
+	filePath string,
+	source string,
+) (*ParseResult, []error) {
+	return up.parser.Parse(filePath, source)
 }
 
 func (up *UncachedParser[ParseResult]) WriteParsingCache() {
@@ -0,0 +1,604 @@
+package parse
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testParseResult struct {
+	Source string
+}
+
+// testParser records how many times it was actually asked to parse.
+type testParser struct {
+	parseCount  int
+	fingerprint string
+}
+
+func (tp *testParser) Parse(filePath string, sourceString string) (*testParseResult, []error) {
+	tp.parseCount++
+	return &testParseResult{Source: sourceString}, nil
+}
+
+func (*testParser) UnmarshalParsingCache(
+	cacheMap *map[string]*testParseResult,
+	interfaceMap *map[string]interface{},
+) {
+	for hash, data := range *interfaceMap {
+		(*cacheMap)[hash] = &testParseResult{
+			Source: data.(map[string]interface{})["Source"].(string),
+		}
+	}
+}
+
+func (tp *testParser) CacheFingerprint() string {
+	return tp.fingerprint
+}
+
+func newTestCachingParser(
+	parser *testParser,
+	parsingCacheFile string,
+	pruneStaleEntries bool,
+) CachingParser[testParseResult] {
+	return NewCachingParser[testParseResult](
+		parser,
+		parsingCacheFile,
+		CachingParserOptions{
+			PruneStaleEntries: pruneStaleEntries,
+			GzipLevel:         gzip.DefaultCompression,
+		},
+	)
+}
+
+func TestCachingParserParseSource(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+	parser := &testParser{}
+	cachingParser := newTestCachingParser(parser, cacheFile, true)
+
+	result, errs := cachingParser.ParseSource("not/on/disk/A.scala", "object A")
+	require.Empty(t, errs)
+	require.Equal(t, "object A", result.Source)
+	require.Equal(t, 1, parser.parseCount)
+
+	// The same source under a different path is served from the cache.
+	result, errs = cachingParser.ParseSource("not/on/disk/B.scala", "object A")
+	require.Empty(t, errs)
+	require.Equal(t, "object A", result.Source)
+	require.Equal(t, 1, parser.parseCount)
+
+	_, errs = cachingParser.ParseSource("not/on/disk/A.scala", "object B")
+	require.Empty(t, errs)
+	require.Equal(t, 2, parser.parseCount)
+
+	// Cached results persist across parser instances via the cache file.
+	cachingParser.WriteParsingCache()
+
+	reloadedParser := &testParser{}
+	reloadedCachingParser := newTestCachingParser(reloadedParser, cacheFile, true)
+
+	result, errs = reloadedCachingParser.ParseSource("not/on/disk/A.scala", "object B")
+	require.Empty(t, errs)
+	require.Equal(t, "object B", result.Source)
+	require.Equal(t, 0, reloadedParser.parseCount)
+}
+
+func TestCachingParserCountsCacheHits(t *testing.T) {
+	stats := &ParseStats{}
+	cachingParser := NewCachingParser[testParseResult](
+		&testParser{},
+		filepath.Join(t.TempDir(), "cache.json"),
+		CachingParserOptions{
+			PruneStaleEntries: true,
+			GzipLevel:         gzip.DefaultCompression,
+			Stats:             stats,
+		},
+	)
+
+	for _, source := range []string{"object A", "object B", "object A", "object A"} {
+		_, errs := cachingParser.ParseSource("A.scala", source)
+		require.Empty(t, errs)
+	}
+	require.Equal(t, 2, stats.CacheHits)
+	require.Equal(t, 2, stats.CacheMisses)
+
+	var b strings.Builder
+	stats.Write(&b)
+	require.Contains(t, b.String(), "cache hits:       2 (50.0%)\n")
+}
+
+func TestUncachedParserParseSource(t *testing.T) {
+	parser := &testParser{}
+	uncachedParser := NewUncachedParser[testParseResult](parser)
+
+	for i := 1; i <= 2; i++ {
+		result, errs := uncachedParser.ParseSource("not/on/disk/A.scala", "object A")
+		require.Empty(t, errs)
+		require.Equal(t, "object A", result.Source)
+		require.Equal(t, i, parser.parseCount)
+	}
+}
+
+func TestCorruptParsingCacheIsRegenerated(t *testing.T) {
+	for _, cacheFileName := range []string{"cache.json", "cache.json.gz"} {
+		t.Run(cacheFileName, func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), cacheFileName)
+			require.NoError(t, os.WriteFile(cacheFile, []byte(`{"gazelle_binary_checksum": "`), 0644))
+
+			parser := &testParser{}
+			cachingParser := newTestCachingParser(parser, cacheFile, true)
+
+			_, errs := cachingParser.ParseSource("A.scala", "object A")
+			require.Empty(t, errs)
+			require.Equal(t, 1, parser.parseCount)
+
+			cachingParser.WriteParsingCache()
+
+			reloadedParser := &testParser{}
+			reloadedCachingParser := newTestCachingParser(reloadedParser, cacheFile, true)
+			_, errs = reloadedCachingParser.ParseSource("A.scala", "object A")
+			require.Empty(t, errs)
+			require.Equal(t, 0, reloadedParser.parseCount)
+
+			// Only the cache file itself should be left behind.
+			entries, err := os.ReadDir(filepath.Dir(cacheFile))
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			require.Equal(t, cacheFileName, entries[0].Name())
+		})
+	}
+}
+
+func TestMalformedParsingCacheEntriesAreRegenerated(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	require.NoError(t, os.WriteFile(
+		cacheFile,
+		[]byte(fmt.Sprintf(
+			`{"cache_format_version": %d, "gazelle_binary_checksum": "%s", `+
+				`"parse_cache": {"hash": 5}}`,
+			cacheFormatVersion,
+			gazelleChecksum(),
+		)),
+		0644,
+	))
+
+	parser := &testParser{}
+	cachingParser := newTestCachingParser(parser, cacheFile, true)
+	require.Empty(t, *cachingParser.parsingCache.Cache)
+}
+
+func TestParsingCacheFormatVersionMismatchIsRegenerated(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+	cachingParser := newTestCachingParser(&testParser{}, cacheFile, true)
+	_, errs := cachingParser.ParseSource("A.scala", "object A")
+	require.Empty(t, errs)
+	cachingParser.WriteParsingCache()
+
+	cacheBytes, err := os.ReadFile(cacheFile)
+	require.NoError(t, err)
+	versionField := fmt.Sprintf(`"cache_format_version": %d`, cacheFormatVersion)
+	require.Contains(t, string(cacheBytes), versionField)
+
+	// A cache from a different format version is not decoded, even though it was written
+	// by the same gazelle binary.
+	staleVersionField := fmt.Sprintf(`"cache_format_version": %d`, cacheFormatVersion+1)
+	staleCache := strings.Replace(string(cacheBytes), versionField, staleVersionField, 1)
+	require.NoError(t, os.WriteFile(cacheFile, []byte(staleCache), 0644))
+
+	reloadedParser := &testParser{}
+	reloadedCachingParser := newTestCachingParser(reloadedParser, cacheFile, true)
+	require.Empty(t, *reloadedCachingParser.parsingCache.Cache)
+
+	_, errs = reloadedCachingParser.ParseSource("A.scala", "object A")
+	require.Empty(t, errs)
+	require.Equal(t, 1, reloadedParser.parseCount)
+}
+
+func TestParsingCacheWriteSkippedWhileLocked(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	lockFile := cacheFile + ".lock"
+	require.NoError(t, os.WriteFile(lockFile, nil, 0644))
+
+	cachingParser := newTestCachingParser(&testParser{}, cacheFile, true)
+	cachingParser.ParseSource("A.scala", "object A")
+	cachingParser.WriteParsingCache()
+
+	_, err := os.Stat(cacheFile)
+	require.True(t, os.IsNotExist(err))
+
+	// Stale locks left behind by a crashed process are ignored.
+	staleTime := time.Now().Add(-2 * staleLockAge)
+	require.NoError(t, os.Chtimes(lockFile, staleTime, staleTime))
+
+	cachingParser.WriteParsingCache()
+	_, err = os.Stat(cacheFile)
+	require.NoError(t, err)
+	_, err = os.Stat(lockFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestParsingCachePrunesStaleEntries(t *testing.T) {
+	for _, pruneStaleEntries := range []bool{true, false} {
+		t.Run(fmt.Sprintf("pruneStaleEntries=%t", pruneStaleEntries), func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+			firstRun := newTestCachingParser(&testParser{}, cacheFile, pruneStaleEntries)
+			firstRun.ParseSource("A.scala", "object A")
+			firstRun.ParseSource("B.scala", "object B")
+			firstRun.WriteParsingCache()
+
+			// B.scala has since changed, so its old entry is stale. A.scala is unchanged and
+			// served from the cache, which still counts as using the entry.
+			secondRunParser := &testParser{}
+			secondRun := newTestCachingParser(secondRunParser, cacheFile, pruneStaleEntries)
+			secondRun.ParseSource("A.scala", "object A")
+			secondRun.ParseSource("B.scala", "object B2")
+			secondRun.WriteParsingCache()
+			require.Equal(t, 1, secondRunParser.parseCount)
+
+			thirdRun := newTestCachingParser(&testParser{}, cacheFile, pruneStaleEntries)
+			cachedSources := make([]string, 0)
+			for _, parseResult := range *thirdRun.parsingCache.Cache {
+				cachedSources = append(cachedSources, parseResult.Source)
+			}
+
+			if pruneStaleEntries {
+				require.ElementsMatch(t, []string{"object A", "object B2"}, cachedSources)
+			} else {
+				require.ElementsMatch(t, []string{"object A", "object B", "object B2"}, cachedSources)
+			}
+		})
+	}
+}
+
+func testShardFile(cacheDir string, source string) string {
+	hashBytes := sha256.Sum256([]byte(source))
+	shard := shardForHash(hex.EncodeToString(hashBytes[:]))
+	return filepath.Join(cacheDir, shard+shardExtensionForDir(cacheDir))
+}
+
+func TestShardedParsingCacheRoundTrips(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	sources := []string{"object A", "object B", "object C", "object D"}
+
+	cachingParser := newTestCachingParser(&testParser{}, cacheDir+"/", true)
+	for _, source := range sources {
+		cachingParser.ParseSource("A.scala", source)
+	}
+	cachingParser.WriteParsingCache()
+
+	for _, source := range sources {
+		_, err := os.Stat(testShardFile(cacheDir, source))
+		require.NoError(t, err)
+	}
+
+	// An existing directory is sharded even without a trailing separator.
+	reloadedParser := &testParser{}
+	reloadedCachingParser := newTestCachingParser(reloadedParser, cacheDir, true)
+	require.Len(t, *reloadedCachingParser.parsingCache.Cache, len(sources))
+	for _, source := range sources {
+		result, errs := reloadedCachingParser.ParseSource("A.scala", source)
+		require.Empty(t, errs)
+		require.Equal(t, source, result.Source)
+	}
+	require.Equal(t, 0, reloadedParser.parseCount)
+}
+
+func TestGzippedShardedParsingCacheRoundTrips(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "cache.gz")
+	sources := []string{"object A", "object B"}
+
+	cachingParser := NewCachingParser[testParseResult](
+		&testParser{},
+		cacheDir+"/",
+		CachingParserOptions{
+			PruneStaleEntries: true,
+			GzipLevel:         gzip.BestSpeed,
+			ParallelGzip:      true,
+		},
+	)
+	for _, source := range sources {
+		cachingParser.ParseSource("A.scala", source)
+	}
+	cachingParser.WriteParsingCache()
+
+	for _, source := range sources {
+		shardFile := testShardFile(cacheDir, source)
+		require.True(t, strings.HasSuffix(shardFile, ".json.gz"))
+
+		file, err := os.Open(shardFile)
+		require.NoError(t, err)
+		gzipReader, err := gzip.NewReader(file)
+		require.NoError(t, err)
+		shardBytes, err := io.ReadAll(gzipReader)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		require.Contains(t, string(shardBytes), source)
+	}
+
+	reloadedParser := &testParser{}
+	reloadedCachingParser := newTestCachingParser(reloadedParser, cacheDir, true)
+	require.Len(t, *reloadedCachingParser.parsingCache.Cache, len(sources))
+	for _, source := range sources {
+		_, errs := reloadedCachingParser.ParseSource("A.scala", source)
+		require.Empty(t, errs)
+	}
+	require.Equal(t, 0, reloadedParser.parseCount)
+}
+
+func TestShardedParsingCacheOnlyRewritesChangedShards(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	sources := []string{"object A", "object B", "object C"}
+
+	firstRun := newTestCachingParser(&testParser{}, cacheDir+"/", true)
+	for _, source := range sources {
+		firstRun.ParseSource("A.scala", source)
+	}
+	firstRun.WriteParsingCache()
+
+	existingShards := make(map[string]bool)
+	for _, source := range sources {
+		existingShards[testShardFile(cacheDir, source)] = true
+	}
+
+	// Pick a new source which lands in a shard of its own.
+	newSource := ""
+	for i := 0; newSource == ""; i++ {
+		candidate := fmt.Sprintf("object New%d", i)
+		if !existingShards[testShardFile(cacheDir, candidate)] {
+			newSource = candidate
+		}
+	}
+
+	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for shardFile := range existingShards {
+		require.NoError(t, os.Chtimes(shardFile, oldTime, oldTime))
+	}
+
+	secondRun := newTestCachingParser(&testParser{}, cacheDir+"/", true)
+	for _, source := range sources {
+		secondRun.ParseSource("A.scala", source)
+	}
+	secondRun.ParseSource("New.scala", newSource)
+	secondRun.WriteParsingCache()
+
+	for shardFile := range existingShards {
+		info, err := os.Stat(shardFile)
+		require.NoError(t, err)
+		require.True(t, info.ModTime().Equal(oldTime), "%s was rewritten", shardFile)
+	}
+
+	_, err := os.Stat(testShardFile(cacheDir, newSource))
+	require.NoError(t, err)
+
+	// Shards left empty by pruning are removed.
+	thirdRun := newTestCachingParser(&testParser{}, cacheDir+"/", true)
+	for _, source := range sources {
+		thirdRun.ParseSource("A.scala", source)
+	}
+	thirdRun.WriteParsingCache()
+
+	_, err = os.Stat(testShardFile(cacheDir, newSource))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFileStatsSkipReadingUnchangedFiles(t *testing.T) {
+	for _, cacheFileName := range []string{"cache.json", "shards" + string(os.PathSeparator)} {
+		t.Run(cacheFileName, func(t *testing.T) {
+			tempDir := t.TempDir()
+			cacheFile := filepath.Join(tempDir, cacheFileName)
+			srcFile := filepath.Join(tempDir, "A.scala")
+			require.NoError(t, os.WriteFile(srcFile, []byte("object A"), 0644))
+
+			newStatCachingParser := func(parser *testParser) CachingParser[testParseResult] {
+				return NewCachingParser[testParseResult](
+					parser,
+					cacheFile,
+					CachingParserOptions{
+						PruneStaleEntries: true,
+						GzipLevel:         gzip.DefaultCompression,
+						UseFileStats:      true,
+					},
+				)
+			}
+
+			parser := &testParser{}
+			cachingParser := newStatCachingParser(parser)
+			_, errs := cachingParser.ParseFile(srcFile)
+			require.Empty(t, errs)
+			require.Equal(t, 1, parser.parseCount)
+			require.Contains(t, cachingParser.parsingCache.FileStats, srcFile)
+			cachingParser.WriteParsingCache()
+
+			// With an unchanged stat the file is served from the cache without being read,
+			// which we observe by changing its content while preserving its stat.
+			info, err := os.Stat(srcFile)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(srcFile, []byte("object C"), 0644))
+			require.NoError(t, os.Chtimes(srcFile, info.ModTime(), info.ModTime()))
+
+			reloadedParser := &testParser{}
+			reloadedCachingParser := newStatCachingParser(reloadedParser)
+			result, errs := reloadedCachingParser.ParseFile(srcFile)
+			require.Empty(t, errs)
+			require.Equal(t, "object A", result.Source)
+			require.Equal(t, 0, reloadedParser.parseCount)
+
+			// Without file stats, the file is read and the change noticed.
+			noStatsParser := &testParser{}
+			noStatsCachingParser := newTestCachingParser(noStatsParser, cacheFile, true)
+			result, errs = noStatsCachingParser.ParseFile(srcFile)
+			require.Empty(t, errs)
+			require.Equal(t, "object C", result.Source)
+			require.Equal(t, 1, noStatsParser.parseCount)
+		})
+	}
+}
+
+func TestFileStatsFallBackToHashing(t *testing.T) {
+	tempDir := t.TempDir()
+	cacheFile := filepath.Join(tempDir, "cache.json")
+	srcFile := filepath.Join(tempDir, "A.scala")
+	require.NoError(t, os.WriteFile(srcFile, []byte("object A"), 0644))
+
+	parser := &testParser{}
+	cachingParser := NewCachingParser[testParseResult](
+		parser,
+		cacheFile,
+		CachingParserOptions{
+			PruneStaleEntries: true,
+			GzipLevel:         gzip.DefaultCompression,
+			UseFileStats:      true,
+		},
+	)
+	_, errs := cachingParser.ParseFile(srcFile)
+	require.Empty(t, errs)
+
+	// A changed stat means the file is reread, and its new content parsed.
+	require.NoError(t, os.WriteFile(srcFile, []byte("object B"), 0644))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(srcFile, later, later))
+
+	result, errs := cachingParser.ParseFile(srcFile)
+	require.Empty(t, errs)
+	require.Equal(t, "object B", result.Source)
+	require.Equal(t, 2, parser.parseCount)
+	require.Equal(t, hashSource("object B"), cachingParser.parsingCache.FileStats[srcFile].Hash)
+
+	// A touched but otherwise unchanged file is rehashed and found in the cache.
+	require.NoError(t, os.Chtimes(srcFile, later.Add(time.Hour), later.Add(time.Hour)))
+	result, errs = cachingParser.ParseFile(srcFile)
+	require.Empty(t, errs)
+	require.Equal(t, "object B", result.Source)
+	require.Equal(t, 2, parser.parseCount)
+}
+
+func TestParsingCacheVersionReplacesBinaryChecksum(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	newVersionedParser := func(
+		parser *testParser,
+		cacheVersion string,
+	) CachingParser[testParseResult] {
+		return NewCachingParser[testParseResult](
+			parser,
+			cacheFile,
+			CachingParserOptions{
+				PruneStaleEntries: true,
+				GzipLevel:         gzip.DefaultCompression,
+				CacheVersion:      cacheVersion,
+			},
+		)
+	}
+
+	cachingParser := newVersionedParser(&testParser{}, "v1")
+	_, errs := cachingParser.ParseSource("A.scala", "object A")
+	require.Empty(t, errs)
+	cachingParser.WriteParsingCache()
+
+	cacheBytes, err := os.ReadFile(cacheFile)
+	require.NoError(t, err)
+	require.Contains(t, string(cacheBytes), `"gazelle_binary_checksum": "v1"`)
+
+	// The same version reuses the cache, whatever binary wrote it.
+	reloadedParser := &testParser{}
+	reloadedCachingParser := newVersionedParser(reloadedParser, "v1")
+	_, errs = reloadedCachingParser.ParseSource("A.scala", "object A")
+	require.Empty(t, errs)
+	require.Equal(t, 0, reloadedParser.parseCount)
+
+	// A different version, or falling back to the binary checksum, regenerates it.
+	for _, cacheVersion := range []string{"v2", ""} {
+		reloadedParser = &testParser{}
+		reloadedCachingParser = newVersionedParser(reloadedParser, cacheVersion)
+		require.Empty(t, *reloadedCachingParser.parsingCache.Cache)
+	}
+}
+
+// erroringParser returns a best-effort result along with an error for every source.
+type erroringParser struct {
+	testParser
+}
+
+func (ep *erroringParser) Parse(filePath string, sourceString string) (*testParseResult, []error) {
+	result, _ := ep.testParser.Parse(filePath, sourceString)
+	return result, []error{fmt.Errorf("%s: could not fully parse", filePath)}
+}
+
+func TestParserFingerprintIsPartOfChecksum(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	newFingerprintedParser := func(parser *testParser) CachingParser[testParseResult] {
+		return NewCachingParser[testParseResult](
+			parser,
+			cacheFile,
+			CachingParserOptions{
+				PruneStaleEntries: true,
+				GzipLevel:         gzip.DefaultCompression,
+				CacheVersion:      "v1",
+			},
+		)
+	}
+
+	cachingParser := newFingerprintedParser(&testParser{fingerprint: "exports=def"})
+	_, errs := cachingParser.ParseSource("A.scala", "object A")
+	require.Empty(t, errs)
+	cachingParser.WriteParsingCache()
+
+	cacheBytes, err := os.ReadFile(cacheFile)
+	require.NoError(t, err)
+	require.Contains(t, string(cacheBytes), `"gazelle_binary_checksum": "v1+exports=def"`)
+
+	// The same parser options reuse the cache.
+	reloadedParser := &testParser{fingerprint: "exports=def"}
+	reloadedCachingParser := newFingerprintedParser(reloadedParser)
+	_, errs = reloadedCachingParser.ParseSource("A.scala", "object A")
+	require.Empty(t, errs)
+	require.Equal(t, 0, reloadedParser.parseCount)
+
+	// Different options, including the defaults, regenerate it.
+	for _, fingerprint := range []string{"exports=class", ""} {
+		reloadedCachingParser = newFingerprintedParser(&testParser{fingerprint: fingerprint})
+		require.Empty(t, *reloadedCachingParser.parsingCache.Cache)
+	}
+}
+
+func TestCachePartialResults(t *testing.T) {
+	for _, cachePartialResults := range []bool{false, true} {
+		parser := &erroringParser{}
+		cachingParser := NewCachingParser[testParseResult](
+			parser,
+			filepath.Join(t.TempDir(), "cache.json"),
+			CachingParserOptions{
+				PruneStaleEntries:   true,
+				GzipLevel:           gzip.DefaultCompression,
+				CachePartialResults: cachePartialResults,
+			},
+		)
+
+		result, errs := cachingParser.ParseSource("A.scala", "object A")
+		require.Equal(t, "object A", result.Source)
+		require.EqualError(t, errors.Join(errs...), "A.scala: could not fully parse")
+
+		result, errs = cachingParser.ParseSource("A.scala", "object A")
+		require.Equal(t, "object A", result.Source)
+		if cachePartialResults {
+			// The errors are only reported when the source is actually parsed.
+			require.Empty(t, errs)
+			require.Equal(t, 1, parser.parseCount)
+		} else {
+			require.Len(t, errs, 1)
+			require.Equal(t, 2, parser.parseCount)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package parse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Size of the chunks compressed concurrently by a parallelGzipWriter.
+const parallelGzipChunkSize = 1 << 20
+
+// parallelGzipWriter buffers everything written to it and, on Close, compresses the
+// buffered data in fixed size chunks across all available CPUs. Each chunk is written as
+// a separate gzip member; the gzip format allows members to be concatenated, and both
+// gzip.Reader and the gzip command line tool decompress such streams transparently.
+type parallelGzipWriter struct {
+	writer    io.Writer
+	level     int
+	chunkSize int
+	buffer    bytes.Buffer
+}
+
+func newParallelGzipWriter(writer io.Writer, level int) *parallelGzipWriter {
+	return &parallelGzipWriter{
+		writer:    writer,
+		level:     level,
+		chunkSize: parallelGzipChunkSize,
+	}
+}
+
+func (pw *parallelGzipWriter) Write(data []byte) (int, error) {
+	return pw.buffer.Write(data)
+}
+
+func (pw *parallelGzipWriter) Close() error {
+	data := pw.buffer.Bytes()
+	chunkCount := (len(data) + pw.chunkSize - 1) / pw.chunkSize
+	if chunkCount == 0 {
+		// Always write at least one member so the output is a valid gzip stream.
+		chunkCount = 1
+	}
+
+	compressedChunks := make([]bytes.Buffer, chunkCount)
+	errs := make([]error, chunkCount)
+
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i := 0; i < chunkCount; i++ {
+		start := i * pw.chunkSize
+		end := min(start+pw.chunkSize, len(data))
+
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, chunk []byte) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			gzipWriter, err := gzip.NewWriterLevel(&compressedChunks[i], pw.level)
+			if err == nil {
+				_, err = gzipWriter.Write(chunk)
+			}
+			if err == nil {
+				err = gzipWriter.Close()
+			}
+			errs[i] = err
+		}(i, data[start:end])
+	}
+	wg.Wait()
+
+	for i := range compressedChunks {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if _, err := compressedChunks[i].WriteTo(pw.writer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns a writer which gzips to writer at the given compression level, optionally
+// compressing in parallel.
+func newGzipWriter(writer io.Writer, level int, parallel bool) (io.WriteCloser, error) {
+	// Validate the level up front, so that both writers fail the same way.
+	gzipWriter, err := gzip.NewWriterLevel(writer, level)
+	if err != nil {
+		return nil, err
+	}
+
+	if parallel {
+		return newParallelGzipWriter(writer, level), nil
+	}
+	return gzipWriter, nil
+}
@@ -0,0 +1,81 @@
+package parse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelGzipIsReadableByStandardReader(t *testing.T) {
+	data := []byte(strings.Repeat("object A { def a = 1 }\n", 1000))
+
+	for _, chunkSize := range []int{len(data) + 1, len(data), 1000, 7} {
+		t.Run(fmt.Sprintf("chunkSize=%d", chunkSize), func(t *testing.T) {
+			var compressed bytes.Buffer
+			writer := newParallelGzipWriter(&compressed, gzip.BestSpeed)
+			writer.chunkSize = chunkSize
+
+			_, err := writer.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			reader, err := gzip.NewReader(&compressed)
+			require.NoError(t, err)
+			decompressed, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, data, decompressed)
+		})
+	}
+}
+
+func TestParallelGzipEmptyInput(t *testing.T) {
+	var compressed bytes.Buffer
+	require.NoError(t, newParallelGzipWriter(&compressed, gzip.DefaultCompression).Close())
+
+	reader, err := gzip.NewReader(&compressed)
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Empty(t, decompressed)
+}
+
+func TestInvalidGzipLevel(t *testing.T) {
+	for _, parallel := range []bool{true, false} {
+		_, err := newGzipWriter(io.Discard, 42, parallel)
+		require.Error(t, err)
+	}
+}
+
+func TestGzippedParsingCacheRoundTrips(t *testing.T) {
+	for _, parallelGzip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("parallelGzip=%t", parallelGzip), func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json.gz")
+
+			cachingParser := NewCachingParser[testParseResult](
+				&testParser{},
+				cacheFile,
+				CachingParserOptions{
+					PruneStaleEntries: true,
+					GzipLevel:         gzip.BestCompression,
+					ParallelGzip:      parallelGzip,
+				},
+			)
+			cachingParser.ParseSource("A.scala", "object A")
+			cachingParser.WriteParsingCache()
+
+			// The cache is readable regardless of how it was compressed.
+			reloadedParser := &testParser{}
+			reloadedCachingParser := newTestCachingParser(reloadedParser, cacheFile, true)
+			result, errs := reloadedCachingParser.ParseSource("A.scala", "object A")
+			require.Empty(t, errs)
+			require.Equal(t, "object A", result.Source)
+			require.Equal(t, 0, reloadedParser.parseCount)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package parse
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// ParseStats accumulates counts and timings of the work done while parsing, to help tell
+// whether the parsing cache is effective and where time goes in large runs. All methods
+// are no-ops on a nil *ParseStats, so parsers may record to it unconditionally.
+type ParseStats struct {
+	// Files actually parsed with tree-sitter, i.e. not served from the parsing cache.
+	FilesParsed int
+	CacheHits   int
+	CacheMisses int
+	// Syntax tree nodes walked while reading symbols from parsed files.
+	NodesVisited   int
+	TreeSitterTime time.Duration
+	WalkingTime    time.Duration
+}
+
+func (s *ParseStats) RecordCacheHit() {
+	if s != nil {
+		s.CacheHits++
+	}
+}
+
+func (s *ParseStats) RecordCacheMiss() {
+	if s != nil {
+		s.CacheMisses++
+	}
+}
+
+func (s *ParseStats) RecordNodeVisit() {
+	if s != nil {
+		s.NodesVisited++
+	}
+}
+
+// RecordParse records a single file parsed with tree-sitter, along with the time spent
+// building its syntax tree and then walking it for symbols.
+func (s *ParseStats) RecordParse(treeSitterTime time.Duration, walkingTime time.Duration) {
+	if s != nil {
+		s.FilesParsed++
+		s.TreeSitterTime += treeSitterTime
+		s.WalkingTime += walkingTime
+	}
+}
+
+// Write prints a human readable summary of the stats to w.
+func (s *ParseStats) Write(w io.Writer) {
+	if s == nil {
+		return
+	}
+
+	hitRate := 0.0
+	if lookups := s.CacheHits + s.CacheMisses; lookups > 0 {
+		hitRate = 100 * float64(s.CacheHits) / float64(lookups)
+	}
+
+	fmt.Fprintf(w, "Parsing stats:\n")
+	fmt.Fprintf(w, "  files parsed:     %d\n", s.FilesParsed)
+	fmt.Fprintf(w, "  cache hits:       %d (%.1f%%)\n", s.CacheHits, hitRate)
+	fmt.Fprintf(w, "  cache misses:     %d\n", s.CacheMisses)
+	fmt.Fprintf(w, "  nodes visited:    %d\n", s.NodesVisited)
+	fmt.Fprintf(w, "  tree-sitter time: %s\n", s.TreeSitterTime)
+	fmt.Fprintf(w, "  walking time:     %s\n", s.WalkingTime)
+}
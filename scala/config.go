@@ -1,13 +1,17 @@
 package scala
 
 import (
+	"compress/gzip"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 
@@ -18,6 +22,47 @@ import (
 )
 
 const (
+	// ScalaDefaultVisibility sets the visibility of generated rules, overriding
+	// DEFAULT_VISIBILITY for the package and its sub-packages. An empty value omits the
+	// visibility attribute from generated rules entirely, leaving it to the package's
+	// default_visibility.
+	//
+	// Accepted values are a comma-delimited list of labels.
+	//
+	// Defaults to DEFAULT_VISIBILITY.
+	ScalaDefaultVisibility = "scala_default_visibility"
+
+	// ScalaExcludeFile omits matching source files from the package's generated rules, so
+	// that they are neither included in srcs nor parsed for deps, e.g. to keep a known-broken
+	// file from blocking the rest of the package during a migration. Patterns are matched
+	// against paths relative to the package directory, with '*' matching any run of
+	// characters other than '/'. Unlike most directives, this applies only to the package
+	// it is set in and not to its sub-packages. Can be repeated.
+	//
+	// Accepted values are a comma-delimited list of glob patterns.
+	ScalaExcludeFile = "scala_exclude_file"
+
+	// ScalaExportedKinds restricts which kinds of definitions the parser exports as
+	// resolvable symbols, e.g. to stop type aliases or given instances from being exported
+	// when they are never imported by their fully qualified name. As the parser and its
+	// cache are shared across the whole repo, this may only be set in the root BUILD file.
+	//
+	// Accepted values are a comma-delimited list of DEFINITION_KINDS values.
+	//
+	// Defaults to all kinds.
+	ScalaExportedKinds = "scala_exported_kinds"
+
+	// If ScalaGenerateBinaries is set to true, the Scala language plugin will generate a
+	// scala_binary rule for each top-level object in a library's sources which extends App
+	// or defines a `main(args: Array[String])` method. Binaries are named after their main
+	// object, set it as their main_class, and are resolved using the same dependencies as
+	// their library along with the library itself.
+	//
+	// Accepted values are true or false.
+	//
+	// Defaults to false.
+	ScalaGenerateBinaries = "scala_generate_binaries"
+
 	// By default, the scala language plugin generates one target per source directory,
 	// and will not aggregate source files from sub-directories. Setting
 	// ScalaInferRecursiveModules to true will have the plugin recurse into those sub-
@@ -35,6 +80,50 @@ const (
 	// Defaults to false.
 	ScalaInferRecursiveModules = "scala_infer_recursive_modules"
 
+	// If ScalaSkipGeneration is set to true, the Scala language plugin generates no rules
+	// for the package or its descendants, leaving any existing rules untouched. Unlike
+	// '# gazelle:exclude', source files are still visible to other languages, and are still
+	// parsed so that existing Scala rules in the package are indexed and may be resolved as
+	// deps of rules elsewhere.
+	//
+	// Accepted values are true or false.
+	//
+	// Defaults to false.
+	ScalaSkipGeneration = "scala_skip_generation"
+
+	// ScalaSourceLayout sets the directory prefixes which mark source files as library or test
+	// code regardless of their filename, matched against paths relative to the package
+	// directory. Files under neither prefix fall back to the ScalaTestFileSuffixes check. The
+	// value "none" disables prefix-based detection entirely, so that only the suffix check is
+	// used, and "maven" restores the default.
+	//
+	// Accepted values are "none", "maven", or a main prefix and a test prefix separated by
+	// whitespace, e.g. "src/main/ src/test/".
+	//
+	// Defaults to "maven", i.e. MAVEN_LAYOUT_MAIN_PREFIX and MAVEN_LAYOUT_TEST_PREFIX.
+	ScalaSourceLayout = "scala_source_layout"
+
+	// ScalaSrcs lists the source files of the package explicitly, relative to the package
+	// directory, in place of globbing the directory for them. Files not in the list are left
+	// out of the package's generated rules, which helps generated rules coexist with hand-
+	// maintained ones during incremental adoption. Listed files which don't exist are skipped
+	// with a warning. Like ScalaExcludeFile, this applies only to the package it is set in and
+	// not to its sub-packages. Can be repeated.
+	//
+	// Accepted values are a comma-delimited list of file paths.
+	ScalaSrcs = "scala_srcs"
+
+	// ScalaTestFileGlobs marks source files as test code if their path relative to the
+	// package directory matches any of the given glob patterns, e.g. "**/integration/*.scala"
+	// for repos which identify tests by directory or prefix rather than by suffix. Files are
+	// tests if either these globs or ScalaTestFileSuffixes match. In patterns, '*' matches any
+	// run of characters other than '/', and a '**' segment matches any number of directories.
+	//
+	// Accepted values are a comma-delimited list of glob patterns.
+	//
+	// Defaults to no patterns.
+	ScalaTestFileGlobs = "scala_test_file_globs"
+
 	// ScalaTestFileSuffixes indicates within a test directory which files are test
 	// classes vs utility classes, based on their basename. It should be set up to match
 	// the value used for the test rules' suffixes attribute if applicable, with the
@@ -56,6 +145,14 @@ const (
 	// Defaults to "scalatest".
 	ScalaTestFramework = "scala_test_framework"
 
+	// If ScalaWarnDuplicateExportedSymbols is set to true, the Scala language plugin will
+	// output a warning when several source files of a single generated rule export the
+	// same fully qualified symbol. Such collisions otherwise only surface later as
+	// confusing compile or resolve errors.
+	//
+	// Defaults to true.
+	ScalaWarnDuplicateExportedSymbols = "scala_warn_duplicate_exported_symbols"
+
 	// If ScalaWarnTestRuleMismatch is set to true, the Scala language plugin will output
 	// a warning when an existing non-test rule would contain source files matching the
 	// configured test file suffixes. This can help avoid human error when unit tests are
@@ -105,18 +202,36 @@ func (t scalaTestFrameworkType) String() string {
 
 // ScalaConfig represents a config extension for a specific Bazel package.
 type ScalaConfig struct {
+	// Not inherited by child configs, see ScalaExcludeFile.
+	ExcludedFiles         []string
+	GenerateBinaries      bool
 	InferRecursiveModules bool
-	ScalaTestFileSuffixes *[]string
-	ScalaTestKind         string
-	WarnTestRuleMismatch  bool
+	// Empty when prefix-based detection is disabled, see ScalaSourceLayout.
+	MainSourcePrefix             string
+	ScalaTestFileGlobs           []string
+	SkipGeneration               bool
+	ScalaTestFileSuffixes        *[]string
+	ScalaTestKind                string
+	TestSourcePrefix             string
+	Visibility                   []string
+	WarnDuplicateExportedSymbols bool
+	WarnTestRuleMismatch         bool
+	// Not inherited by child configs, see ScalaSrcs.
+	Srcs []string
 }
 
 func NewScalaConfig() *ScalaConfig {
 	return &ScalaConfig{
-		InferRecursiveModules: false,
-		ScalaTestFileSuffixes: &DEFAULT_SCALA_TEST_FILE_SUFFIXES,
-		ScalaTestKind:         SCALA_TEST_KIND,
-		WarnTestRuleMismatch:  true,
+		GenerateBinaries:             false,
+		InferRecursiveModules:        false,
+		MainSourcePrefix:             MAVEN_LAYOUT_MAIN_PREFIX,
+		ScalaTestFileSuffixes:        &DEFAULT_SCALA_TEST_FILE_SUFFIXES,
+		ScalaTestKind:                SCALA_TEST_KIND,
+		SkipGeneration:               false,
+		TestSourcePrefix:             MAVEN_LAYOUT_TEST_PREFIX,
+		Visibility:                   DEFAULT_VISIBILITY,
+		WarnDuplicateExportedSymbols: true,
+		WarnTestRuleMismatch:         true,
 	}
 }
 
@@ -124,54 +239,140 @@ func NewScalaConfig() *ScalaConfig {
 // current ScalaConfig.
 func (c *ScalaConfig) NewChild() *ScalaConfig {
 	return &ScalaConfig{
-		InferRecursiveModules: c.InferRecursiveModules,
-		ScalaTestFileSuffixes: c.ScalaTestFileSuffixes,
-		ScalaTestKind:         c.ScalaTestKind,
-		WarnTestRuleMismatch:  c.WarnTestRuleMismatch,
+		GenerateBinaries:             c.GenerateBinaries,
+		InferRecursiveModules:        c.InferRecursiveModules,
+		MainSourcePrefix:             c.MainSourcePrefix,
+		ScalaTestFileGlobs:           c.ScalaTestFileGlobs,
+		ScalaTestFileSuffixes:        c.ScalaTestFileSuffixes,
+		ScalaTestKind:                c.ScalaTestKind,
+		SkipGeneration:               c.SkipGeneration,
+		TestSourcePrefix:             c.TestSourcePrefix,
+		Visibility:                   c.Visibility,
+		WarnDuplicateExportedSymbols: c.WarnDuplicateExportedSymbols,
+		WarnTestRuleMismatch:         c.WarnTestRuleMismatch,
 	}
 }
 
+// SetVisibility sets the configured visibility on the given generated rule, if any.
+func (c *ScalaConfig) SetVisibility(r *rule.Rule) {
+	if len(c.Visibility) != 0 {
+		r.SetAttr("visibility", c.Visibility)
+	}
+}
+
+// IsExcludedFile returns whether the given path, relative to the package directory, matches
+// any of the patterns given by ScalaExcludeFile.
+func (c *ScalaConfig) IsExcludedFile(relPath string) bool {
+	for _, pattern := range c.ExcludedFiles {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTestSource returns whether the given source file, relative to the package directory,
+// contains test code. Any configured source layout takes precedence over inferring library
+// vs test code based on the file's suffix.
+func (c *ScalaConfig) IsTestSource(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	if c.TestSourcePrefix != "" && strings.HasPrefix(relPath, c.TestSourcePrefix) {
+		return true
+	} else if c.MainSourcePrefix != "" && strings.HasPrefix(relPath, c.MainSourcePrefix) {
+		return false
+	}
+	return c.IsScalaTestFile(relPath)
+}
+
+// IsScalaTestFile returns whether the given source file, relative to the package directory,
+// matches any of the configured test file suffixes or globs.
 func (c *ScalaConfig) IsScalaTestFile(filename string) bool {
 	for _, suffix := range *c.ScalaTestFileSuffixes {
 		if strings.HasSuffix(filename, suffix) {
 			return true
 		}
 	}
+	for _, pattern := range c.ScalaTestFileGlobs {
+		if matchPathGlob(pattern, filepath.ToSlash(filename)) {
+			return true
+		}
+	}
 	return false
 }
 
-// Resolves aliases and kind mappings and returns whether the given kind is a variant of
-// kindToCheckAgainst. Assumes only one layer of indirection in alias/kind mapping.
-func isKind(c *config.Config, kind string, kindToCheckAgainst string) bool {
-	aliases := []string{kind}
-	if from, exists := c.AliasMap[kind]; exists {
-		aliases = append(aliases, from)
-	}
+// Matches a slash-separated path against a glob pattern segment by segment using path.Match,
+// with the addition that a '**' segment matches zero or more whole path segments.
+func matchPathGlob(pattern string, relPath string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
 
-	mappedKinds := []string{kindToCheckAgainst}
-	if mappedKind, exists := c.KindMap[kindToCheckAgainst]; exists {
-		mappedKinds = append(mappedKinds, mappedKind.KindName)
+func matchGlobSegments(patternSegments []string, pathSegments []string) bool {
+	if len(patternSegments) == 0 {
+		return len(pathSegments) == 0
 	}
 
-	for _, alias := range aliases {
-		for _, mappedKind := range mappedKinds {
-			if alias == mappedKind {
+	if patternSegments[0] == "**" {
+		for i := 0; i <= len(pathSegments); i++ {
+			if matchGlobSegments(patternSegments[1:], pathSegments[i:]) {
 				return true
 			}
 		}
+		return false
 	}
 
-	return false
+	if len(pathSegments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(patternSegments[0], pathSegments[0]); !matched {
+		return false
+	}
+	return matchGlobSegments(patternSegments[1:], pathSegments[1:])
+}
+
+// Normalizes a directory prefix given to ScalaSourceLayout so that it only matches whole
+// path segments, e.g. "src/test" matches "src/test/Foo.scala" but not "src/testing/Foo.scala".
+func sourceLayoutPrefix(prefix string) string {
+	return strings.TrimSuffix(filepath.ToSlash(prefix), "/") + "/"
+}
+
+// Returns the given kind along with every kind reachable from it by repeatedly following
+// the given mapping, stopping at any cycle.
+func kindChain(kind string, next func(string) (string, bool)) *treeset.Set {
+	chain := treeset.NewWithStringComparator()
+	for {
+		chain.Add(kind)
+		nextKind, exists := next(kind)
+		if !exists || chain.Contains(nextKind) {
+			return chain
+		}
+		kind = nextKind
+	}
+}
+
+// Resolves aliases and kind mappings and returns whether the given kind is a variant of
+// kindToCheckAgainst. Both are followed transitively, so e.g. a macro aliased to another
+// macro which is in turn aliased to kindToCheckAgainst is still recognized.
+func isKind(c *config.Config, kind string, kindToCheckAgainst string) bool {
+	aliases := kindChain(kind, func(k string) (string, bool) {
+		from, exists := c.AliasMap[k]
+		return from, exists
+	})
+	mappedKinds := kindChain(kindToCheckAgainst, func(k string) (string, bool) {
+		mappedKind, exists := c.KindMap[k]
+		return mappedKind.KindName, exists
+	})
+
+	return !aliases.Intersection(mappedKinds).Empty()
 }
 
 // Resolves aliases and kind mappings and returns whether the given kind is a macro kind
-// or not. Assumes only one layer of indirection in alias/kind mapping.
+// or not.
 func (c *ScalaConfig) IsScalaMacroKind(generalConfig *config.Config, kind string) bool {
 	return isKind(generalConfig, kind, SCALA_MACRO_KIND)
 }
 
 // Resolves aliases and kind mappings and returns whether the given kind is a test kind
-// or not. Assumes only one layer of indirection in alias/kind mapping.
+// or not.
 func (c *ScalaConfig) IsScalaTestKind(generalConfig *config.Config, kind string) bool {
 	return isKind(generalConfig, kind, c.ScalaTestKind)
 }
@@ -208,20 +409,39 @@ type ScalaConfigurer struct {
 
 	lang                      *scalaLang
 	unparsedCrossResolveLangs string
-
-	CrossResolveLangs  *treeset.Set
-	ParsingCacheFile   string
-	RulesScalaRepoName string
+	// Shared with the parser, which is created once the root package is configured.
+	exportedKinds *treeset.Set
+
+	CrossResolveLangs        *treeset.Set
+	FailOnParseError         bool
+	ParsingCacheFile         string
+	ParsingCacheGzipLevel    int
+	ParsingCacheParallelGzip bool
+	ParsingCacheUseFileStats bool
+	ParsingCacheVersion      string
+	PrintParsingStats        bool
+	RetainStaleCache         bool
+	RulesScalaRepoName       string
+	TrackSourcePositions     bool
 }
 
 func NewScalaConfigurer(lang *scalaLang) *ScalaConfigurer {
 	return &ScalaConfigurer{
 		JvmConfigurer:     jvm.NewJvmConfigurer(),
 		lang:              lang,
+		exportedKinds:     allDefinitionKinds(),
 		CrossResolveLangs: treeset.NewWithStringComparator(),
 	}
 }
 
+func allDefinitionKinds() *treeset.Set {
+	kinds := treeset.NewWithStringComparator()
+	for _, kind := range DEFINITION_KINDS {
+		kinds.Add(kind)
+	}
+	return kinds
+}
+
 func (sc *ScalaConfigurer) getOrInitScalaConfigs(c *config.Config) *ScalaConfigs {
 	if _, exists := c.Exts[LANGUAGE_NAME]; !exists {
 		scalaConfigs := ScalaConfigs{
@@ -245,13 +465,78 @@ func (sc *ScalaConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config
 			"list of strings.",
 	)
 
+	fs.BoolVar(
+		&sc.FailOnParseError,
+		"scala_fail_on_parse_error",
+		false,
+		"When specified, fail the run if tree-sitter could not fully parse any scala "+
+			"file, rather than continuing with a best-effort recovery of its symbols.",
+	)
+
 	fs.StringVar(
 		&sc.ParsingCacheFile,
 		"scala_parsing_cache_file",
 		"",
 		"When specified, symbol parsing will generate and update a json file on disk "+
 			"at the given location. Specify a .gz file extension to enable gzipping of the "+
-			"json cache file.",
+			"json cache file. Specify a directory, or a path ending in a path separator, to "+
+			"shard the cache across multiple files in that directory, which are gzipped if the "+
+			"directory has a .gz extension.",
+	)
+
+	fs.IntVar(
+		&sc.ParsingCacheGzipLevel,
+		"scala_parsing_cache_gzip_level",
+		gzip.DefaultCompression,
+		"The compress/gzip compression level used when writing a .gz parsing cache file, "+
+			"from 1 (fastest) to 9 (smallest). -1 uses the default level, 0 disables "+
+			"compression and -2 uses Huffman-only compression.",
+	)
+
+	fs.BoolVar(
+		&sc.ParsingCacheParallelGzip,
+		"scala_parsing_cache_parallel_gzip",
+		false,
+		"When specified, a .gz parsing cache file is compressed in chunks across all "+
+			"available CPUs. The result is slightly larger but still a standard gzip file.",
+	)
+
+	fs.BoolVar(
+		&sc.ParsingCacheUseFileStats,
+		"scala_parsing_cache_use_file_stats",
+		false,
+		"When specified, the parsing cache also records the size and modification time of "+
+			"each parsed file, and files for which both are unchanged are not reread or "+
+			"rehashed. Only use this where modification times are reliable, which is not "+
+			"the case in all build sandboxes.",
+	)
+
+	fs.StringVar(
+		&sc.ParsingCacheVersion,
+		"scala_parsing_cache_version",
+		"",
+		"When specified, the parsing cache is fingerprinted with the given version string "+
+			"rather than a checksum of the gazelle binary, so that the cache is kept across "+
+			"rebuilds of gazelle. Only use this if the parsing logic is unchanged between "+
+			"those builds, and change the version whenever it does change.",
+	)
+
+	fs.BoolVar(
+		&sc.PrintParsingStats,
+		"scala_print_parsing_stats",
+		false,
+		"When specified, print a summary of the files parsed, parsing cache hits and "+
+			"misses, syntax tree nodes visited and time spent parsing to stderr once rules "+
+			"have been generated.",
+	)
+
+	fs.BoolVar(
+		&sc.RetainStaleCache,
+		"scala_retain_stale_parsing_cache_entries",
+		false,
+		"By default, entries in the parsing cache for source files which were not parsed "+
+			"during a run are dropped when the cache is written. When specified, they are "+
+			"retained instead, which is useful when running gazelle on a subset of the repo.",
 	)
 
 	fs.StringVar(
@@ -264,6 +549,15 @@ func (sc *ScalaConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *config
 			"'rules_scala'. See https://github.com/bazelbuild/rules_scala/pull/1696 "+
 			"for details.",
 	)
+
+	fs.BoolVar(
+		&sc.TrackSourcePositions,
+		"scala_track_source_positions",
+		false,
+		"When specified, the parser records the line and column of each import and fully "+
+			"qualified usage so that resolve errors can point at the offending source lines. "+
+			"This makes parse results (and the parsing cache, if enabled) larger.",
+	)
 }
 
 func (sc *ScalaConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
@@ -273,16 +567,56 @@ func (sc *ScalaConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error
 		}
 	}
 
-	// TODO: wire up parser debug params
-	parser := NewParser(false, false, false)
-	if sc.ParsingCacheFile != "" {
-		if !filepath.IsAbs(sc.ParsingCacheFile) {
-			sc.ParsingCacheFile = filepath.Join(c.RepoRoot, sc.ParsingCacheFile)
+	if sc.ParsingCacheGzipLevel < gzip.HuffmanOnly ||
+		sc.ParsingCacheGzipLevel > gzip.BestCompression {
+		return fmt.Errorf(
+			"invalid -scala_parsing_cache_gzip_level %d, must be between %d and %d",
+			sc.ParsingCacheGzipLevel,
+			gzip.HuffmanOnly,
+			gzip.BestCompression,
+		)
+	}
+
+	if sc.PrintParsingStats {
+		sc.lang.parsingStats = &parse.ParseStats{}
+	}
+
+	if sc.ParsingCacheFile != "" && !filepath.IsAbs(sc.ParsingCacheFile) {
+		// Join cleans the path, so preserve a trailing separator requesting a sharded cache.
+		sharded := strings.HasSuffix(sc.ParsingCacheFile, string(os.PathSeparator))
+		sc.ParsingCacheFile = filepath.Join(c.RepoRoot, sc.ParsingCacheFile)
+		if sharded {
+			sc.ParsingCacheFile += string(os.PathSeparator)
 		}
+	}
 
+	return sc.JvmConfigurer.CheckFlags(fs, c)
+}
+
+// initParser creates the parser shared by every package. This happens once the root BUILD
+// file has been configured rather than in CheckFlags, as ScalaExportedKinds changes the
+// parse results, and so the fingerprint of the parsing cache.
+func (sc *ScalaConfigurer) initParser() {
+	// TODO: wire up parser debug params
+	parser := NewParser(
+		ParserOptions{
+			TrackPositions: sc.TrackSourcePositions,
+			ExportedKinds:  sc.exportedKinds,
+			Stats:          sc.lang.parsingStats,
+		},
+	)
+	if sc.ParsingCacheFile != "" {
 		wrappedParser := parse.NewCachingParser[ParseResult](
 			parser,
 			sc.ParsingCacheFile,
+			parse.CachingParserOptions{
+				PruneStaleEntries: !sc.RetainStaleCache,
+				GzipLevel:         sc.ParsingCacheGzipLevel,
+				ParallelGzip:      sc.ParsingCacheParallelGzip,
+				UseFileStats:      sc.ParsingCacheUseFileStats,
+				Stats:             sc.lang.parsingStats,
+				CacheVersion:      sc.ParsingCacheVersion,
+			},
 		)
 		sc.lang.parser = &wrappedParser
 
@@ -290,16 +624,23 @@ func (sc *ScalaConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error
 		wrappedParser := parse.NewUncachedParser[ParseResult](parser)
 		sc.lang.parser = &wrappedParser
 	}
-
-	return sc.JvmConfigurer.CheckFlags(fs, c)
 }
 
 func (sc *ScalaConfigurer) KnownDirectives() []string {
 	return append(
 		sc.JvmConfigurer.KnownDirectives(),
+		ScalaDefaultVisibility,
+		ScalaExcludeFile,
+		ScalaExportedKinds,
+		ScalaGenerateBinaries,
 		ScalaInferRecursiveModules,
+		ScalaSkipGeneration,
+		ScalaSourceLayout,
+		ScalaSrcs,
+		ScalaTestFileGlobs,
 		ScalaTestFileSuffixes,
 		ScalaTestFramework,
+		ScalaWarnDuplicateExportedSymbols,
 		ScalaWarnTestRuleMismatch,
 	)
 }
@@ -318,6 +659,84 @@ func (sc *ScalaConfigurer) Configure(c *config.Config, rel string, f *rule.File)
 	if f != nil {
 		for _, d := range f.Directives {
 			switch d.Key {
+			case ScalaDefaultVisibility:
+				visibility := []string{}
+				for _, value := range strings.Split(d.Value, ",") {
+					value = strings.TrimSpace(value)
+					if value == "" {
+						continue
+					}
+					if _, err := label.Parse(value); err != nil {
+						log.Fatalf(
+							"Invalid label for %s directive in '%s': %s\n",
+							ScalaDefaultVisibility,
+							rel,
+							err,
+						)
+					}
+					visibility = append(visibility, value)
+				}
+
+				scalaConfig.Visibility = visibility
+
+			case ScalaExcludeFile:
+				for _, pattern := range strings.Split(d.Value, ",") {
+					pattern = strings.TrimSpace(pattern)
+					if pattern == "" {
+						continue
+					}
+					if _, err := path.Match(pattern, ""); err != nil {
+						log.Fatalf(
+							"Invalid glob pattern for %s directive in '%s': '%s'\n",
+							ScalaExcludeFile,
+							rel,
+							pattern,
+						)
+					}
+					scalaConfig.ExcludedFiles = append(scalaConfig.ExcludedFiles, pattern)
+				}
+
+			case ScalaExportedKinds:
+				if rel != "" {
+					log.Fatalf(
+						"The %s directive may only be set in the root BUILD file, found in '%s'\n",
+						ScalaExportedKinds,
+						rel,
+					)
+				}
+
+				validKinds := allDefinitionKinds()
+				sc.exportedKinds.Clear()
+				for _, kind := range strings.Split(d.Value, ",") {
+					kind = strings.TrimSpace(kind)
+					if kind == "" {
+						continue
+					}
+					if !validKinds.Contains(kind) {
+						log.Fatalf(
+							"Invalid kind for %s directive: '%s'. Accepted values are: %v\n",
+							ScalaExportedKinds,
+							kind,
+							validKinds.Values(),
+						)
+					}
+					sc.exportedKinds.Add(kind)
+				}
+
+			case ScalaGenerateBinaries:
+				switch d.Value {
+				case "true":
+					scalaConfig.GenerateBinaries = true
+				case "false":
+					scalaConfig.GenerateBinaries = false
+				default:
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 'true' or 'false' but got '%v'\n",
+						ScalaGenerateBinaries,
+						d.Value,
+					)
+				}
+
 			case ScalaInferRecursiveModules:
 				switch d.Value {
 				case "true":
@@ -332,6 +751,79 @@ func (sc *ScalaConfigurer) Configure(c *config.Config, rel string, f *rule.File)
 					)
 				}
 
+			case ScalaSkipGeneration:
+				switch d.Value {
+				case "true":
+					scalaConfig.SkipGeneration = true
+				case "false":
+					scalaConfig.SkipGeneration = false
+				default:
+					log.Fatalf(
+						"Invalid config for %s directive. Expected 'true' or 'false' but got '%v'\n",
+						ScalaSkipGeneration,
+						d.Value,
+					)
+				}
+
+			case ScalaSourceLayout:
+				prefixes := strings.Fields(d.Value)
+				if len(prefixes) == 1 && prefixes[0] == "none" {
+					scalaConfig.MainSourcePrefix = ""
+					scalaConfig.TestSourcePrefix = ""
+				} else if len(prefixes) == 1 && prefixes[0] == "maven" {
+					scalaConfig.MainSourcePrefix = MAVEN_LAYOUT_MAIN_PREFIX
+					scalaConfig.TestSourcePrefix = MAVEN_LAYOUT_TEST_PREFIX
+				} else if len(prefixes) == 2 {
+					scalaConfig.MainSourcePrefix = sourceLayoutPrefix(prefixes[0])
+					scalaConfig.TestSourcePrefix = sourceLayoutPrefix(prefixes[1])
+				} else {
+					log.Fatalf(
+						"Invalid config for %s directive in '%s'. Expected 'none', 'maven' or "+
+							"'<main_prefix> <test_prefix>' but got '%v'\n",
+						ScalaSourceLayout,
+						rel,
+						d.Value,
+					)
+				}
+
+			case ScalaSrcs:
+				for _, src := range strings.Split(d.Value, ",") {
+					src = strings.TrimSpace(src)
+					if src == "" {
+						continue
+					}
+					if !filepath.IsLocal(src) {
+						log.Fatalf(
+							"Invalid path for %s directive in '%s', paths must be relative to the "+
+								"package directory and within it: '%s'\n",
+							ScalaSrcs,
+							rel,
+							src,
+						)
+					}
+					scalaConfig.Srcs = append(scalaConfig.Srcs, filepath.Clean(src))
+				}
+
+			case ScalaTestFileGlobs:
+				var patterns []string
+				for _, pattern := range strings.Split(d.Value, ",") {
+					pattern = strings.TrimSpace(pattern)
+					if pattern == "" {
+						continue
+					}
+					if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+						log.Fatalf(
+							"Invalid glob pattern for %s directive in '%s': '%s'\n",
+							ScalaTestFileGlobs,
+							rel,
+							pattern,
+						)
+					}
+					patterns = append(patterns, pattern)
+				}
+
+				scalaConfig.ScalaTestFileGlobs = patterns
+
 			case ScalaTestFileSuffixes:
 				newSuffixes := strings.Split(d.Value, ",")
 
@@ -349,6 +841,13 @@ func (sc *ScalaConfigurer) Configure(c *config.Config, rel string, f *rule.File)
 				kind := ScalaTestFrameworkType(d.Value).Kind()
 				scalaConfig.ScalaTestKind = kind
 
+			case ScalaWarnDuplicateExportedSymbols:
+				if strings.ToLower(d.Value) == "false" {
+					scalaConfig.WarnDuplicateExportedSymbols = false
+				} else {
+					scalaConfig.WarnDuplicateExportedSymbols = true
+				}
+
 			case ScalaWarnTestRuleMismatch:
 				if strings.ToLower(d.Value) == "false" {
 					scalaConfig.WarnTestRuleMismatch = false
@@ -358,4 +857,9 @@ func (sc *ScalaConfigurer) Configure(c *config.Config, rel string, f *rule.File)
 			}
 		}
 	}
+	// ScalaExportedKinds may only be set in the root package, so the parser can be created
+	// as soon as its directives have been read.
+	if rel == "" && sc.lang != nil {
+		sc.initParser()
+	}
 }
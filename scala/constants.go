@@ -1,18 +1,14 @@
 package scala
 
-import (
-	"fmt"
-	"path/filepath"
-)
-
 const (
 	LANGUAGE_NAME = "scala"
 
 	JAVA_EXT  = ".java"
 	SCALA_EXT = ".scala"
 
-	SCALA_LIB_KIND   = "scala_library"
-	SCALA_MACRO_KIND = "scala_macro_library"
+	SCALA_BINARY_KIND = "scala_binary"
+	SCALA_LIB_KIND    = "scala_library"
+	SCALA_MACRO_KIND  = "scala_macro_library"
 
 	SCALA_JUNIT_TEST_KIND = "scala_junit_test"
 	SCALA_TEST_KIND       = "scala_test"
@@ -35,6 +31,7 @@ var (
 	}
 
 	// https://maven.apache.org/guides/introduction/introduction-to-the-standard-directory-layout.html
-	MAVEN_LAYOUT_MAIN_PREFIX = fmt.Sprintf("%s%c", filepath.Join("src", "main"), filepath.Separator)
-	MAVEN_LAYOUT_TEST_PREFIX = fmt.Sprintf("%s%c", filepath.Join("src", "test"), filepath.Separator)
+	// Slash-separated, see ScalaSourceLayout.
+	MAVEN_LAYOUT_MAIN_PREFIX = "src/main/"
+	MAVEN_LAYOUT_TEST_PREFIX = "src/test/"
 )
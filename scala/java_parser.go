@@ -0,0 +1,128 @@
+package scala
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	sitter "github.com/smacker/go-tree-sitter"
+	"github.com/smacker/go-tree-sitter/java"
+)
+
+// Java tree-sitter grammar:
+// https://github.com/tree-sitter/tree-sitter-java/blob/master/src/node-types.json
+
+var JAVA_LANG = java.GetLanguage()
+
+// Parses a Java source file included in a mixed Scala/Java target. Only the package and
+// imports are read, which is enough to resolve the file's deps; unlike Scala files, the
+// symbols the file defines are not exported beyond its package.
+func (p *treeSitterParser) parseJava(filePath string, sourceCode []byte) (*ParseResult, []error) {
+	result := EmptyParseResult(filePath)
+	errs := make([]error, 0)
+
+	treeSitterStart := time.Now()
+	tree, err := p.javaParser.ParseCtx(context.Background(), nil, sourceCode)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	walkingStart := time.Now()
+	defer func() {
+		p.stats.RecordParse(walkingStart.Sub(treeSitterStart), time.Since(walkingStart))
+	}()
+
+	if tree == nil {
+		return result, errs
+	}
+
+	rootNode := tree.RootNode()
+	result.HasErrors = rootNode.HasError()
+
+	if p.debug {
+		fmt.Fprintf(os.Stderr, "%+v\n", rootNode)
+	}
+
+	for i := 0; i < int(rootNode.NamedChildCount()); i++ {
+		nodeI := rootNode.NamedChild(i)
+		p.stats.RecordNodeVisit()
+
+		switch nodeI.Type() {
+		case "package_declaration":
+			pkg, err := readJavaPackageDeclaration(nodeI, sourceCode)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			result.Package = pkg
+			result.Packages.Add(pkg)
+
+		case "import_declaration":
+			importedSymbol, err := readJavaImportDeclaration(nodeI, sourceCode)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			result.Imports.Add(importedSymbol)
+
+			if p.trackPositions {
+				result.addImportPosition(importedSymbol, nodePosition(nodeI))
+			}
+		}
+	}
+
+	return result, errs
+}
+
+// Reads a possibly qualified name, e.g. `com.example.Foo`.
+func readJavaName(node *sitter.Node, sourceCode []byte) (string, bool) {
+	if node == nil || (node.Type() != "identifier" && node.Type() != "scoped_identifier") {
+		return "", false
+	}
+	// Names may be split across lines or contain comments, so we rebuild them from their
+	// identifiers rather than using the node's content directly.
+	if node.Type() == "identifier" {
+		return node.Content(sourceCode), true
+	}
+
+	scope, ok := readJavaName(node.ChildByFieldName("scope"), sourceCode)
+	name := node.ChildByFieldName("name")
+	if !ok || name == nil {
+		return "", false
+	}
+	return scope + "." + name.Content(sourceCode), true
+}
+
+func readJavaPackageDeclaration(node *sitter.Node, sourceCode []byte) (string, error) {
+	for c := 0; c < int(node.NamedChildCount()); c++ {
+		if pkg, ok := readJavaName(node.NamedChild(c), sourceCode); ok {
+			return pkg, nil
+		}
+	}
+	return "", wrongNodeTypeError(node, sourceCode, "package_declaration")
+}
+
+// Reads a single Java import, e.g. `import com.example.Foo;`. Static imports are read as
+// imports of the named member, and wildcard imports use the Scala `._` suffix so that both
+// languages' imports are resolved alike.
+func readJavaImportDeclaration(node *sitter.Node, sourceCode []byte) (string, error) {
+	var importBuilder strings.Builder
+
+	for c := 0; c < int(node.NamedChildCount()); c++ {
+		nodeC := node.NamedChild(c)
+
+		if name, ok := readJavaName(nodeC, sourceCode); ok {
+			importBuilder.WriteString(name)
+		} else if nodeC.Type() == "asterisk" {
+			importBuilder.WriteString("._")
+		} else if nodeC.Type() != "line_comment" && nodeC.Type() != "block_comment" {
+			return "", unexpectedChildError(node, nodeC, sourceCode)
+		}
+	}
+
+	if importBuilder.Len() == 0 {
+		return "", wrongNodeTypeError(node, sourceCode, "import_declaration")
+	}
+	return importBuilder.String(), nil
+}
@@ -1,11 +1,14 @@
 package scala
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
@@ -26,7 +29,11 @@ type scalaLang struct {
 	language.FinishableLanguage
 
 	parser                     parse.Parser[ParseResult]
+	parsingStats               *parse.ParseStats
+	exportsIndex               *jvm.ExportsIndex
 	seenScalaPackages          *treeset.Set
+	unparsedFiles              *treeset.Set
+	macroFiles                 *treeset.Set
 	currentExportedSymbols     *treeset.Set
 	currentTestExportedSymbols *treeset.Set
 }
@@ -34,8 +41,12 @@ type scalaLang struct {
 // NewLanguage is called by Gazelle to install this language extension in a binary.
 func NewLanguage() language.Language {
 	lang := scalaLang{
-		parser:                     nil, // populated during ScalaConfigurer's CheckFlags
+		parser:                     nil, // populated when ScalaConfigurer configures the root
+		parsingStats:               nil, // populated during ScalaConfigurer's CheckFlags
+		exportsIndex:               jvm.NewExportsIndex(),
 		seenScalaPackages:          treeset.NewWithStringComparator(),
+		unparsedFiles:              treeset.NewWithStringComparator(),
+		macroFiles:                 treeset.NewWithStringComparator(),
 		currentExportedSymbols:     nil,
 		currentTestExportedSymbols: nil,
 	}
@@ -70,6 +81,18 @@ func (l *scalaLang) Name() string {
 // dependency resolution. See rule.Merge.
 func (*scalaLang) Kinds() map[string]rule.KindInfo {
 	return map[string]rule.KindInfo{
+		SCALA_BINARY_KIND: {
+			NonEmptyAttrs: map[string]bool{
+				"main_class": true,
+			},
+			MergeableAttrs: map[string]bool{
+				"main_class": true,
+			},
+			ResolveAttrs: map[string]bool{
+				"deps":         true,
+				"runtime_deps": true,
+			},
+		},
 		SCALA_LIB_KIND: {
 			MatchAny: true,
 			NonEmptyAttrs: map[string]bool{
@@ -79,7 +102,8 @@ func (*scalaLang) Kinds() map[string]rule.KindInfo {
 				"srcs": true,
 			},
 			ResolveAttrs: map[string]bool{
-				"deps": true,
+				"deps":         true,
+				"runtime_deps": true,
 			},
 		},
 		SCALA_MACRO_KIND: {
@@ -91,7 +115,8 @@ func (*scalaLang) Kinds() map[string]rule.KindInfo {
 				"srcs": true,
 			},
 			ResolveAttrs: map[string]bool{
-				"deps": true,
+				"deps":         true,
+				"runtime_deps": true,
 			},
 		},
 		SCALA_JUNIT_TEST_KIND: {
@@ -104,7 +129,8 @@ func (*scalaLang) Kinds() map[string]rule.KindInfo {
 				"suffixes": true,
 			},
 			ResolveAttrs: map[string]bool{
-				"deps": true,
+				"deps":         true,
+				"runtime_deps": true,
 			},
 		},
 		SCALA_TEST_KIND: {
@@ -116,7 +142,8 @@ func (*scalaLang) Kinds() map[string]rule.KindInfo {
 				"srcs": true,
 			},
 			ResolveAttrs: map[string]bool{
-				"deps": true,
+				"deps":         true,
+				"runtime_deps": true,
 			},
 		},
 	}
@@ -132,6 +159,12 @@ func (l *scalaLang) Loads() []rule.LoadInfo {
 	)
 
 	return []rule.LoadInfo{
+		{
+			Name: scalaLoadPath,
+			Symbols: []string{
+				SCALA_BINARY_KIND,
+			},
+		},
 		{
 			Name: scalaLoadPath,
 			Symbols: []string{
@@ -196,16 +229,14 @@ func (s *srcFiles) hasTests() bool {
 }
 
 func (s *srcFiles) maybeAddSrc(scalaConfig *ScalaConfig, path string) {
+	if scalaConfig.IsExcludedFile(filepath.ToSlash(path)) {
+		return
+	}
+
 	pathExt := filepath.Ext(path)
 
 	if pathExt == SCALA_EXT {
-		// Any inferred maven directory layout takes precedence over inferring library vs
-		// test code based on file suffix.
-		if strings.HasPrefix(path, MAVEN_LAYOUT_TEST_PREFIX) {
-			*s.scalaTestSrcs = append(*s.scalaTestSrcs, path)
-		} else if strings.HasPrefix(path, MAVEN_LAYOUT_MAIN_PREFIX) {
-			*s.scalaSrcs = append(*s.scalaSrcs, path)
-		} else if scalaConfig.IsScalaTestFile(path) {
+		if scalaConfig.IsTestSource(path) {
 			*s.scalaTestSrcs = append(*s.scalaTestSrcs, path)
 		} else {
 			*s.scalaSrcs = append(*s.scalaSrcs, path)
@@ -222,6 +253,71 @@ func (s *srcFiles) addAll(otherSrcs *srcFiles) {
 	*s.javaSrcs = append(*s.javaSrcs, *otherSrcs.javaSrcs...)
 }
 
+// exportedSymbolSources tracks which source files of a single target define each
+// exported symbol, so that we can warn about symbols defined by several of them.
+type exportedSymbolSources map[string][]string
+
+func (s exportedSymbolSources) add(path string, definedSymbols *treeset.Set) {
+	symbolsIter := definedSymbols.Iterator()
+	for symbolsIter.Next() {
+		symbol := symbolsIter.Value().(string)
+		s[symbol] = append(s[symbol], path)
+	}
+}
+
+// Returns the symbols defined by more than one source file, in sorted order.
+func (s exportedSymbolSources) duplicates() []string {
+	duplicates := treeset.NewWithStringComparator()
+	for symbol, paths := range s {
+		if len(paths) > 1 {
+			duplicates.Add(symbol)
+		}
+	}
+
+	duplicateSymbols := make([]string, 0, duplicates.Size())
+	for _, symbol := range duplicates.Values() {
+		duplicateSymbols = append(duplicateSymbols, symbol.(string))
+	}
+	return duplicateSymbols
+}
+
+func (s exportedSymbolSources) warnDuplicates(pkg string, ruleName string) {
+	duplicates := s.duplicates()
+	if len(duplicates) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		"WARN: Rule '%s:%s' contains multiple source files exporting the same symbols. "+
+			"This will likely fail to compile, or lead to confusing resolve errors for rules "+
+			"depending on it. Set '# gazelle:%s false' in its build file to make this "+
+			"warning go away.\n",
+		pkg,
+		ruleName,
+		ScalaWarnDuplicateExportedSymbols,
+	)
+	for _, symbol := range duplicates {
+		fmt.Fprintf(&b, "  %s: %s\n", symbol, strings.Join(s[symbol], ", "))
+	}
+	log.Print(b.String())
+}
+
+// Returns the labels currently listed in the given deps attribute of the named rule in f, if
+// it exists.
+func existingRuleDeps(f *rule.File, ruleName string, attr string) *treeset.Set {
+	existingDeps := treeset.NewWithStringComparator()
+	for _, existingRule := range f.Rules {
+		if existingRule.Name() == ruleName {
+			for _, dep := range existingRule.AttrStrings(attr) {
+				existingDeps.Add(dep)
+			}
+		}
+	}
+	return existingDeps
+}
+
 // isBazelPackage determines if the directory is a Bazel package by probing for
 // the existence of a known BUILD file name.
 func isBazelPackage(dir string) bool {
@@ -235,6 +331,30 @@ func isBazelPackage(dir string) bool {
 	return false
 }
 
+// Returns the source files listed via ScalaSrcs for the package in dir, in sorted order,
+// warning about and skipping any which don't exist.
+func listedSrcs(scalaConfig *ScalaConfig, dir string, rel string) *srcFiles {
+	srcs := emptySrcFiles()
+
+	listed := slices.Clone(scalaConfig.Srcs)
+	slices.Sort(listed)
+	for _, src := range slices.Compact(listed) {
+		if info, err := os.Stat(filepath.Join(dir, src)); err != nil || info.IsDir() {
+			log.Printf(
+				"WARN: Source file '%s' listed by '# gazelle:%s' in '%s' does not exist, "+
+					"skipping it\n",
+				src,
+				ScalaSrcs,
+				rel,
+			)
+			continue
+		}
+		srcs.maybeAddSrc(scalaConfig, src)
+	}
+
+	return srcs
+}
+
 // Simplified implementation taken from rules_python:
 // https://github.com/bazel-contrib/rules_python/blob/02198f622ee1b496111bef6b880ea35e0d24b600/gazelle/python/generate.go#L149
 func crawlAndFilterSubdirSrcs(
@@ -296,39 +416,75 @@ func crawlAndFilterSubdirSrcs(
 	return srcs
 }
 
-func (l *scalaLang) parseFile(absPath string, isTest bool) (*treeset.Set, *treeset.Set) {
+// UsedSymbolsForParseResult returns the symbols the given parsed file depends on, to be
+// resolved to its deps.
+func UsedSymbolsForParseResult(parseResult *ParseResult, isTest bool) *jvm.UsedSymbols {
+	deps := jvm.NewUsedSymbols()
+	deps.Symbols = deps.Symbols.Union(parseResult.FullyQualifiedNames)
+	deps.Symbols = deps.Symbols.Union(parseResult.Imports)
+	if isTest {
+		deps.Symbols = deps.Symbols.Union(parseResult.Packages)
+		deps.IsTest = true
+	}
+
+	relativeImportsIter := parseResult.RelativeImports.Iterator()
+	for relativeImportsIter.Next() {
+		relativeImport := relativeImportsIter.Value().(string)
+		deps.AddRelativeSymbol(relativeImport, parseResult.Package)
+	}
+	for _, absoluteImport := range parseResult.AbsoluteImports.Values() {
+		deps.AddAbsoluteSymbol(absoluteImport.(string))
+	}
+
+	for _, symbolPositions := range []map[string][]SourcePosition{
+		parseResult.ImportPositions,
+		parseResult.UsagePositions,
+	} {
+		for symbol, positions := range symbolPositions {
+			for _, position := range positions {
+				deps.AddSymbolSource(symbol, fmt.Sprintf("%s:%d", parseResult.File, position.Line))
+			}
+		}
+	}
+
+	return deps
+}
+
+// parseFile returns the symbols used by the given file, the symbols it exports to the
+// rule index, the subset of those which are defined by the file itself rather than
+// being packages it declares, and the fully qualified names of its main objects.
+func (l *scalaLang) parseFile(
+	absPath string,
+	isTest bool,
+) (*jvm.UsedSymbols, *treeset.Set, *treeset.Set, *treeset.Set) {
 	parseResult, errs := l.parser.ParseFile(absPath)
 
-	if errs != nil && len(errs) != 0 {
+	// Parse errors are not fatal: we continue with whatever symbols could be recovered,
+	// unless configured to fail via -scala_fail_on_parse_error.
+	if len(errs) != 0 {
 		var b strings.Builder
 		fmt.Fprintf(
 			&b,
-			"ERROR: failed parsing scala file %s\n",
+			"WARN: errors parsing source file %s, its symbols may be incomplete:\n",
 			absPath,
 		)
 		for _, err := range errs {
-			fmt.Fprintf(&b, "%s\n", err)
+			fmt.Fprintf(&b, "%s\n", DisplayError(err))
 		}
-		log.Fatalf(b.String())
+		log.Print(b.String())
 	}
 
-	deps := treeset.NewWithStringComparator()
-	deps = deps.Union(parseResult.FullyQualifiedNames)
-	deps = deps.Union(parseResult.Imports)
-	if isTest {
-		deps.Add(parseResult.Package)
+	if parseResult.HasErrors || len(errs) != 0 {
+		l.unparsedFiles.Add(absPath)
+	}
+	if parseResult.HasMacro {
+		l.macroFiles.Add(absPath)
 	}
 
-	exportedSymbols := treeset.NewWithStringComparator()
+	deps := UsedSymbolsForParseResult(parseResult, isTest)
 
-	// TODO(jacob): Have our parsers just spit out fully qualified names so we don't
-	//		have to recreate them here.
-	symbolsIter := parseResult.ExportedSymbols.Iterator()
-	for symbolsIter.Next() {
-		symbol := symbolsIter.Value().(string)
-		fullyQualifiedSymbol := fmt.Sprintf("%s.%s", parseResult.Package, symbol)
-		exportedSymbols.Add(fullyQualifiedSymbol)
-	}
+	definedSymbols := parseResult.QualifiedExportedSymbols()
+	exportedSymbols := definedSymbols.Union(treeset.NewWithStringComparator())
 
 	// HACK(jacob): Generally we don't want to index the package of test targets: a
 	//		common pattern in jvm repos is to split source code and tests into separate
@@ -368,12 +524,67 @@ func (l *scalaLang) parseFile(absPath string, isTest bool) (*treeset.Set, *trees
 	//		where Gazelle silently not indexing test rules makes it seem like it isn't
 	//		working correctly. It seems reasonable to go with the hacky approach here and
 	//		revisit if it causes issues in practice.
-	if !isTest || !l.seenScalaPackages.Contains(parseResult.Package) {
-		exportedSymbols.Add(parseResult.Package)
+	//
+	//		Files may declare several packages via braced package clauses (commonly seen in
+	//		generated sources packed into srcjars), so we apply this per declared package.
+	packagesIter := parseResult.Packages.Iterator()
+	for packagesIter.Next() {
+		pkg := packagesIter.Value().(string)
+		if !isTest || !l.seenScalaPackages.Contains(pkg) {
+			exportedSymbols.Add(pkg)
+		}
+	}
+	l.seenScalaPackages.Add(parseResult.Packages.Values()...)
+
+	return deps, exportedSymbols, definedSymbols, parseResult.QualifiedMainObjects()
+}
+
+// Returns a scala_binary rule for each of the given main objects of the named library,
+// along with the symbols each should resolve: those used by the library, plus the main
+// object itself so that the library is included in its deps. Binaries are named after
+// their main object, and are skipped if that name is already taken by another generated
+// rule.
+func generateBinaries(
+	scalaConfig *ScalaConfig,
+	f *rule.File,
+	pkg string,
+	takenNames *treeset.Set,
+	mainObjects *treeset.Set,
+	libraryDeps *jvm.UsedSymbols,
+) ([]*rule.Rule, []interface{}) {
+	binaryRules := make([]*rule.Rule, 0, mainObjects.Size())
+	binaryImports := make([]interface{}, 0, mainObjects.Size())
+
+	for _, value := range mainObjects.Values() {
+		mainClass := value.(string)
+		binaryName := mainClass[strings.LastIndex(mainClass, ".")+1:]
+		if takenNames.Contains(binaryName) {
+			log.Printf(
+				"WARN: Not generating a %s for main object '%s' in package '%s', as another "+
+					"generated rule is already named '%s'.\n",
+				SCALA_BINARY_KIND,
+				mainClass,
+				pkg,
+				binaryName,
+			)
+			continue
+		}
+		takenNames.Add(binaryName)
+
+		binaryRule := rule.NewRule(SCALA_BINARY_KIND, binaryName)
+		binaryRule.SetAttr("main_class", mainClass)
+		scalaConfig.SetVisibility(binaryRule)
+
+		binaryDeps := libraryDeps.Union(jvm.NewUsedSymbols())
+		binaryDeps.Symbols.Add(mainClass)
+		binaryDeps.ExistingDeps = existingRuleDeps(f, binaryName, "deps")
+		binaryDeps.ExistingRuntimeDeps = existingRuleDeps(f, binaryName, "runtime_deps")
+
+		binaryRules = append(binaryRules, binaryRule)
+		binaryImports = append(binaryImports, binaryDeps)
 	}
-	l.seenScalaPackages.Add(parseResult.Package)
 
-	return deps, exportedSymbols
+	return binaryRules, binaryImports
 }
 
 // GenerateRules extracts build metadata from source files in a directory.
@@ -398,9 +609,18 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 		return language.GenerateResult{}
 	}
 
+	if args.File == nil && scalaConfig.SkipGeneration {
+		// Without a build file there are no existing rules to index either.
+		return language.GenerateResult{}
+	}
+
 	srcs := emptySrcFiles()
-	for _, filename := range args.RegularFiles {
-		srcs.maybeAddSrc(scalaConfig, filename)
+	if len(scalaConfig.Srcs) != 0 {
+		srcs = listedSrcs(scalaConfig, args.Dir, args.Rel)
+	} else {
+		for _, filename := range args.RegularFiles {
+			srcs.maybeAddSrc(scalaConfig, filename)
+		}
 	}
 
 	if srcs.hasScalaFiles() && args.File == nil && !scalaConfig.InferRecursiveModules {
@@ -415,7 +635,7 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 			ScalaInferRecursiveModules,
 		)
 
-	} else if args.File != nil && scalaConfig.InferRecursiveModules {
+	} else if args.File != nil && scalaConfig.InferRecursiveModules && len(scalaConfig.Srcs) == 0 {
 		recursiveSrcs := crawlAndFilterSubdirSrcs(scalaConfig, args.Dir, args.Subdirs)
 		srcs.addAll(recursiveSrcs)
 
@@ -427,10 +647,12 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 
 	ruleName := filepath.Base(args.Rel)
 	ruleKind := SCALA_LIB_KIND
+	var existingRule *rule.Rule = nil
 	var existingKind *string = nil
-	for _, existingRule := range args.File.Rules {
-		if existingRule.Name() == ruleName {
-			kind := existingRule.Kind()
+	for _, r := range args.File.Rules {
+		if r.Name() == ruleName {
+			kind := r.Kind()
+			existingRule = r
 			existingKind = &kind
 			if scalaConfig.IsScalaMacroKind(args.Config, kind) {
 				ruleKind = SCALA_MACRO_KIND
@@ -446,7 +668,7 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 		if existingKind == nil || scalaConfig.IsScalaTestKind(args.Config, *existingKind) {
 			ruleKind = scalaConfig.ScalaTestKind
 
-		} else if scalaConfig.WarnTestRuleMismatch {
+		} else if scalaConfig.WarnTestRuleMismatch && !scalaConfig.SkipGeneration {
 			log.Printf(
 				"WARN: Package '%s' contains a conflicting rule of kind '%s', "+
 					"but appears to also contain test files. If you are adding a "+
@@ -475,7 +697,8 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 	//		we could identify the correct existing rule to match against and generate our
 	//		rules to match the existing naming rather than force users to conform to our
 	//		naming convention.
-	if existingKind != nil && !isKind(args.Config, *existingKind, ruleKind) {
+	if existingKind != nil && !isKind(args.Config, *existingKind, ruleKind) &&
+		!scalaConfig.SkipGeneration {
 		log.Fatalf(
 			"Attempting to generate rule '%s' in package '%s' of kind '%s', but another "+
 				"rule of kind '%s' already exists with that name. If it should stay a separate "+
@@ -493,68 +716,235 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 	l.currentTestExportedSymbols = treeset.NewWithStringComparator()
 
 	scalaRule := rule.NewRule(ruleKind, ruleName)
-	scalaRule.SetAttr("visibility", DEFAULT_VISIBILITY)
+	scalaConfig.SetVisibility(scalaRule)
 
-	deps := treeset.NewWithStringComparator()
+	deps := jvm.NewUsedSymbols()
+	mainObjects := treeset.NewWithStringComparator()
 
 	// If we are inferring recursive modules and have both source and test files, we assume
 	// we are generating two rules: one library and one test.
 	if scalaConfig.InferRecursiveModules && srcs.hasScalaSrcs() && srcs.hasTests() {
-		testDeps := treeset.NewWithStringComparator()
+		testDeps := jvm.NewUsedSymbols()
+		symbolSources := exportedSymbolSources{}
+		testSymbolSources := exportedSymbolSources{}
+		targetSymbols := treeset.NewWithStringComparator()
+		testTargetSymbols := treeset.NewWithStringComparator()
 
 		for _, path := range *srcs.scalaSrcs {
-			newDeps, exportedSymbols := l.parseFile(filepath.Join(args.Dir, path), false)
+			newDeps, exportedSymbols, definedSymbols, newMainObjects := l.parseFile(
+				filepath.Join(args.Dir, path),
+				false,
+			)
+			deps = deps.Union(newDeps)
+			l.currentExportedSymbols = l.currentExportedSymbols.Union(exportedSymbols)
+			symbolSources.add(path, definedSymbols)
+			targetSymbols = targetSymbols.Union(definedSymbols)
+			mainObjects = mainObjects.Union(newMainObjects)
+		}
+		for _, path := range *srcs.javaSrcs {
+			newDeps, exportedSymbols, definedSymbols, _ := l.parseFile(
+				filepath.Join(args.Dir, path),
+				false,
+			)
 			deps = deps.Union(newDeps)
 			l.currentExportedSymbols = l.currentExportedSymbols.Union(exportedSymbols)
+			targetSymbols = targetSymbols.Union(definedSymbols)
 		}
 		for _, path := range *srcs.scalaTestSrcs {
-			newDeps, exportedSymbols := l.parseFile(filepath.Join(args.Dir, path), true)
+			newDeps, exportedSymbols, definedSymbols, _ := l.parseFile(
+				filepath.Join(args.Dir, path),
+				true,
+			)
 			testDeps = testDeps.Union(newDeps)
 			l.currentTestExportedSymbols = l.currentTestExportedSymbols.Union(exportedSymbols)
+			testSymbolSources.add(path, definedSymbols)
+			testTargetSymbols = testTargetSymbols.Union(definedSymbols)
+		}
+
+		// References between the files of a single target need no dep, so don't try to
+		// resolve them. The test rule still depends on the library for its symbols.
+		deps = deps.Without(targetSymbols)
+		testDeps = testDeps.Without(testTargetSymbols)
+
+		if scalaConfig.WarnDuplicateExportedSymbols {
+			symbolSources.warnDuplicates(args.Rel, ruleName)
+			testSymbolSources.warnDuplicates(args.Rel, ruleName+"-tests")
+		}
+
+		if scalaConfig.SkipGeneration {
+			// The sources are still parsed above, so that existing rules are indexed.
+			return language.GenerateResult{}
 		}
 
+		l.maybePromoteToMacroKind(args, scalaRule, existingRule, *srcs.scalaSrcs)
+
+		deps.ExistingDeps = existingRuleDeps(args.File, ruleName, "deps")
+		deps.ExistingRuntimeDeps = existingRuleDeps(args.File, ruleName, "runtime_deps")
+		testDeps.ExistingDeps = existingRuleDeps(args.File, ruleName+"-tests", "deps")
+		testDeps.ExistingRuntimeDeps = existingRuleDeps(
+			args.File,
+			ruleName+"-tests",
+			"runtime_deps",
+		)
+
 		scalaRule.SetAttr("srcs", srcs.allSrcs(false))
 
 		scalaTestRule := rule.NewRule(scalaConfig.ScalaTestKind, ruleName+"-tests")
 		scalaTestRule.SetAttr("srcs", *srcs.scalaTestSrcs)
-		scalaTestRule.SetAttr("visibility", DEFAULT_VISIBILITY)
+		scalaConfig.SetVisibility(scalaTestRule)
 
 		if scalaConfig.ScalaTestKind == SCALA_JUNIT_TEST_KIND {
 			scalaTestRule.SetAttr("suffixes", *scalaConfig.ScalaTestFileSuffixes)
 		}
 
+		gen := []*rule.Rule{scalaRule, scalaTestRule}
+		imports := []interface{}{deps, testDeps}
+
+		if scalaConfig.GenerateBinaries {
+			binaryRules, binaryImports := generateBinaries(
+				scalaConfig,
+				args.File,
+				args.Rel,
+				treeset.NewWithStringComparator(ruleName, ruleName+"-tests"),
+				mainObjects,
+				deps,
+			)
+			gen = append(gen, binaryRules...)
+			imports = append(imports, binaryImports...)
+		}
+
 		return language.GenerateResult{
-			Gen:     []*rule.Rule{scalaRule, scalaTestRule},
-			Imports: []interface{}{deps, testDeps},
+			Gen:     gen,
+			Imports: imports,
 		}
 
 		// If not, we only have scalaRule to update and return. It may still be either a
 		// a library or a test.
 	} else {
 		isTest := ruleKind == scalaConfig.ScalaTestKind
+		symbolSources := exportedSymbolSources{}
+		targetSymbols := treeset.NewWithStringComparator()
 
 		for _, path := range *srcs.scalaSrcs {
-			newDeps, exportedSymbols := l.parseFile(filepath.Join(args.Dir, path), isTest)
+			newDeps, exportedSymbols, definedSymbols, newMainObjects := l.parseFile(
+				filepath.Join(args.Dir, path),
+				isTest,
+			)
 			deps = deps.Union(newDeps)
 			l.currentExportedSymbols = l.currentExportedSymbols.Union(exportedSymbols)
+			symbolSources.add(path, definedSymbols)
+			targetSymbols = targetSymbols.Union(definedSymbols)
+			mainObjects = mainObjects.Union(newMainObjects)
+		}
+		for _, path := range *srcs.javaSrcs {
+			newDeps, exportedSymbols, definedSymbols, _ := l.parseFile(
+				filepath.Join(args.Dir, path),
+				isTest,
+			)
+			deps = deps.Union(newDeps)
+			l.currentExportedSymbols = l.currentExportedSymbols.Union(exportedSymbols)
+			targetSymbols = targetSymbols.Union(definedSymbols)
 		}
 		for _, path := range *srcs.scalaTestSrcs {
-			newDeps, exportedSymbols := l.parseFile(filepath.Join(args.Dir, path), isTest)
+			newDeps, exportedSymbols, definedSymbols, _ := l.parseFile(
+				filepath.Join(args.Dir, path),
+				isTest,
+			)
 			deps = deps.Union(newDeps)
 			l.currentExportedSymbols = l.currentExportedSymbols.Union(exportedSymbols)
+			symbolSources.add(path, definedSymbols)
+			targetSymbols = targetSymbols.Union(definedSymbols)
 		}
 
+		// References between the files of a single target need no dep, so don't try to
+		// resolve them.
+		deps = deps.Without(targetSymbols)
+
+		if scalaConfig.WarnDuplicateExportedSymbols {
+			symbolSources.warnDuplicates(args.Rel, ruleName)
+		}
+
+		if scalaConfig.SkipGeneration {
+			// The sources are still parsed above, so that existing rules are indexed.
+			return language.GenerateResult{}
+		}
+
+		l.maybePromoteToMacroKind(args, scalaRule, existingRule, *srcs.scalaSrcs)
+
+		deps.ExistingDeps = existingRuleDeps(args.File, ruleName, "deps")
+		deps.ExistingRuntimeDeps = existingRuleDeps(args.File, ruleName, "runtime_deps")
+
 		scalaRule.SetAttr("srcs", srcs.allSrcs(true))
 
 		if ruleKind == SCALA_JUNIT_TEST_KIND {
 			scalaRule.SetAttr("suffixes", *scalaConfig.ScalaTestFileSuffixes)
 		}
 
+		gen := []*rule.Rule{scalaRule}
+		imports := []interface{}{deps}
+
+		if scalaConfig.GenerateBinaries && !isTest {
+			binaryRules, binaryImports := generateBinaries(
+				scalaConfig,
+				args.File,
+				args.Rel,
+				treeset.NewWithStringComparator(ruleName),
+				mainObjects,
+				deps,
+			)
+			gen = append(gen, binaryRules...)
+			imports = append(imports, binaryImports...)
+		}
+
 		return language.GenerateResult{
-			Gen:     []*rule.Rule{scalaRule},
-			Imports: []interface{}{deps},
+			Gen:     gen,
+			Imports: imports,
+		}
+	}
+}
+
+// Promotes the given library rule to a scala_macro_library if any of its Scala sources define
+// macros, as they otherwise fail to compile. Existing rules of any other kind, e.g. a macro
+// wrapping scala_library mapped via '# gazelle:map_kind', are left alone with a warning.
+func (l *scalaLang) maybePromoteToMacroKind(
+	args language.GenerateArgs,
+	scalaRule *rule.Rule,
+	existingRule *rule.Rule,
+	srcs []string,
+) {
+	if scalaRule.Kind() != SCALA_LIB_KIND {
+		return
+	}
+
+	hasMacro := false
+	for _, path := range srcs {
+		if l.macroFiles.Contains(filepath.Join(args.Dir, path)) {
+			hasMacro = true
+			break
 		}
 	}
+	if !hasMacro {
+		return
+	}
+
+	if existingRule != nil && existingRule.Kind() != SCALA_LIB_KIND {
+		log.Printf(
+			"WARN: Rule '%s:%s' of kind '%s' contains macro definitions, which must be "+
+				"compiled by a %s. Either change its kind or, if it wraps one, add a "+
+				"'# gazelle:alias_kind' directive for it.",
+			args.Rel,
+			scalaRule.Name(),
+			existingRule.Kind(),
+			SCALA_MACRO_KIND,
+		)
+		return
+	}
+
+	scalaRule.SetKind(SCALA_MACRO_KIND)
+	if existingRule != nil {
+		// Gazelle only merges generated rules into existing rules of the same kind.
+		existingRule.SetKind(SCALA_MACRO_KIND)
+	}
 }
 
 // DoneGeneratingRules is called when all calls to GenerateRules have been
@@ -565,6 +955,41 @@ func (l *scalaLang) GenerateRules(args language.GenerateArgs) language.GenerateR
 // after this method has been called.
 func (l *scalaLang) DoneGeneratingRules() {
 	l.parser.WriteParsingCache()
+	l.parsingStats.Write(os.Stderr)
+
+	if err := l.checkUnparsedFiles(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// AfterResolvingDeps is called once all calls to Resolve have been completed.
+func (l *scalaLang) AfterResolvingDeps(ctx context.Context) {
+	if err := l.FinishResolveTrace(); err != nil {
+		log.Fatal(err)
+	}
+	if err := l.UnresolvedSymbols.Error(); err != nil {
+		log.Fatal(err)
+	}
+	l.UnusedArtifacts.Write(os.Stderr)
+}
+
+// Returns an error listing any files tree-sitter could not fully parse, if we have been
+// configured to treat those as failures.
+func (l *scalaLang) checkUnparsedFiles() error {
+	if !l.FailOnParseError || l.unparsedFiles.Empty() {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(
+		&b,
+		"ERROR: tree-sitter could not fully parse the following scala files, and "+
+			"-scala_fail_on_parse_error is set:\n",
+	)
+	for _, file := range l.unparsedFiles.Values() {
+		fmt.Fprintf(&b, "%s\n", file)
+	}
+	return errors.New(b.String())
 }
 
 // Imports returns a list of ImportSpecs that can be used to import
@@ -580,6 +1005,10 @@ func (l *scalaLang) DoneGeneratingRules() {
 func (l *scalaLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
 	scalaConfig := ScalaConfigForConfig(c, f.Pkg)
 
+	// Facade targets may not have any sources of their own, so we record their exports
+	// regardless of whether the rule itself is indexed.
+	l.exportsIndex.AddRule(r, f.Pkg)
+
 	ruleKind := r.Kind()
 	// TODO(jacob): Ban deps on test rules?
 	if !(ruleKind == SCALA_LIB_KIND ||
@@ -639,18 +1068,24 @@ func (l *scalaLang) Resolve(
 	from label.Label,
 ) {
 	switch r.Kind() {
-	case SCALA_LIB_KIND,
+	case SCALA_BINARY_KIND,
+		SCALA_LIB_KIND,
 		SCALA_MACRO_KIND,
 		SCALA_JUNIT_TEST_KIND,
 		SCALA_TEST_KIND:
 
-		usedSymbols := imports.(*treeset.Set)
+		usedSymbols := imports.(*jvm.UsedSymbols)
 		deps := jvm.ResolveJvmSymbols(
 			c,
 			ruleIndex,
 			from,
 			LANGUAGE_NAME,
 			usedSymbols,
+			jvm.ResolveOptions{
+				ExportsIndex: l.exportsIndex,
+				Trace:        l.ResolveTrace,
+				Unresolved:   l.UnresolvedSymbols,
+			},
 		)
 
 		if deps.Empty() {
@@ -659,6 +1094,14 @@ func (l *scalaLang) Resolve(
 			r.SetAttr("deps", deps.Values())
 		}
 
+		runtimeDeps := jvm.ResolveRuntimeDeps(c, from, deps, usedSymbols)
+		if runtimeDeps.Empty() {
+			r.DelAttr("runtime_deps")
+		} else {
+			r.SetAttr("runtime_deps", runtimeDeps.Values())
+		}
+		l.UnusedArtifacts.RecordDeps(c, from, deps, runtimeDeps)
+
 	default:
 		return
 	}
@@ -713,5 +1156,8 @@ func (l *scalaLang) CrossResolve(
 // language.Language interface methods we don't care about but must implement
 func (*scalaLang) Fix(c *config.Config, f *rule.File) {}
 
+// language.LifecycleManager interface methods we don't care about but must implement
+func (*scalaLang) Before(ctx context.Context) {}
+
 // resolve.Resolver interface methods we don't care about but must implement
 func (*scalaLang) Embeds(r *rule.Rule, from label.Label) []label.Label { return nil }
@@ -0,0 +1,587 @@
+package scala
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	"github.com/emirpasic/gods/sets/treeset"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foursquare/scala-gazelle/jvm"
+	"github.com/foursquare/scala-gazelle/parse"
+)
+
+// testLanguage returns a config for a temporary repo with an empty maven install, with its
+// root package configured, along with the configurer and a language using an uncached parser.
+func testLanguage(t *testing.T) (*config.Config, *ScalaConfigurer, *scalaLang) {
+	c := config.New()
+	c.RepoRoot = t.TempDir()
+	require.NoError(t, os.WriteFile(
+		filepath.Join(c.RepoRoot, "maven_install.json"),
+		[]byte(`{"artifacts": {}, "packages": {}}`),
+		0644,
+	))
+
+	configurer := NewScalaConfigurer(nil)
+	configurer.Configure(c, "", nil)
+
+	lang := NewLanguage().(*scalaLang)
+	parser := parse.NewUncachedParser[ParseResult](NewParser(ParserOptions{}))
+	lang.parser = &parser
+	return c, configurer, lang
+}
+
+func TestFailOnParseError(t *testing.T) {
+	srcDir := t.TempDir()
+
+	parseablePath := filepath.Join(srcDir, "Parseable.scala")
+	require.NoError(t, os.WriteFile(parseablePath, []byte("package com.example\n\nobject Parseable\n"), 0644))
+
+	unparseablePath := filepath.Join(srcDir, "Unparseable.scala")
+	require.NoError(t, os.WriteFile(unparseablePath, []byte("package com.example\n\nobject { def }}}\n"), 0644))
+
+	newTestLang := func(failOnParseError bool) *scalaLang {
+		_, _, lang := testLanguage(t)
+		lang.FailOnParseError = failOnParseError
+		return lang
+	}
+
+	lang := newTestLang(true)
+	lang.parseFile(parseablePath, false)
+	require.NoError(t, lang.checkUnparsedFiles())
+
+	lang.parseFile(unparseablePath, false)
+	require.ErrorContains(t, lang.checkUnparsedFiles(), unparseablePath)
+
+	lang = newTestLang(false)
+	lang.parseFile(unparseablePath, false)
+	require.NoError(t, lang.checkUnparsedFiles())
+}
+
+func TestParseErrorsAreNotFatal(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "Unexpected.scala")
+	require.NoError(t, os.WriteFile(srcPath, []byte(`package com.example
+
+import com.example.implicits.{given Ordering as ord}
+
+object Example
+`), 0644))
+
+	_, _, lang := testLanguage(t)
+	lang.FailOnParseError = true
+
+	_, exportedSymbols, _, _ := lang.parseFile(srcPath, false)
+	require.True(t, exportedSymbols.Contains("com.example.Example"))
+	require.ErrorContains(t, lang.checkUnparsedFiles(), srcPath)
+}
+
+func TestDuplicateExportedSymbols(t *testing.T) {
+	srcDir := t.TempDir()
+	srcs := map[string]string{
+		"A.scala": "package com.example\n\nobject Foo\n",
+		"B.scala": "package com.example\n\nobject Foo\nobject Bar\n",
+		"C.scala": "package com.example\n\nclass Baz\n",
+	}
+
+	_, _, lang := testLanguage(t)
+
+	symbolSources := exportedSymbolSources{}
+	for _, path := range []string{"A.scala", "B.scala", "C.scala"} {
+		absPath := filepath.Join(srcDir, path)
+		require.NoError(t, os.WriteFile(absPath, []byte(srcs[path]), 0644))
+
+		_, exportedSymbols, definedSymbols, _ := lang.parseFile(absPath, false)
+		require.False(t, definedSymbols.Contains("com.example"))
+		require.True(t, exportedSymbols.Contains("com.example"))
+		symbolSources.add(path, definedSymbols)
+	}
+
+	// Every file declares the same package, but only Foo is actually defined twice.
+	require.Equal(t, []string{"com.example.Foo"}, symbolSources.duplicates())
+	require.Equal(t, []string{"A.scala", "B.scala"}, symbolSources["com.example.Foo"])
+}
+
+func TestGenerateBinaries(t *testing.T) {
+	f := rule.EmptyFile("example/BUILD", "example")
+	existingBinary := rule.NewRule(SCALA_BINARY_KIND, "Tool")
+	existingBinary.SetAttr("deps", []string{"//other"})
+	existingBinary.Insert(f)
+
+	libraryDeps := jvm.NewUsedSymbols()
+	libraryDeps.Symbols.Add("com.other.Thing")
+	libraryDeps.ExistingDeps.Add("//library-only")
+
+	mainObjects := treeset.NewWithStringComparator(
+		"com.example.Tool",
+		"com.example.example",
+		"com.example.sub.Script",
+	)
+	binaryRules, binaryImports := generateBinaries(
+		NewScalaConfig(),
+		f,
+		"example",
+		treeset.NewWithStringComparator("example"),
+		mainObjects,
+		libraryDeps,
+	)
+
+	// The object sharing the library's name is skipped rather than clobbering it.
+	require.Len(t, binaryRules, 2)
+	require.Equal(t, "Tool", binaryRules[0].Name())
+	require.Equal(t, "com.example.Tool", binaryRules[0].AttrString("main_class"))
+	require.Equal(t, "Script", binaryRules[1].Name())
+	require.Equal(t, "com.example.sub.Script", binaryRules[1].AttrString("main_class"))
+
+	toolDeps := binaryImports[0].(*jvm.UsedSymbols)
+	require.Equal(
+		t,
+		[]interface{}{"com.example.Tool", "com.other.Thing"},
+		toolDeps.Symbols.Values(),
+	)
+	require.Equal(t, []interface{}{"//other"}, toolDeps.ExistingDeps.Values())
+
+	// The library's own symbols are left untouched.
+	require.Equal(t, []interface{}{"com.other.Thing"}, libraryDeps.Symbols.Values())
+}
+
+func TestDefaultVisibilityDirective(t *testing.T) {
+	loadBuildFile := func(pkg string, content string) *rule.File {
+		f, err := rule.LoadData(filepath.Join(pkg, "BUILD"), pkg, []byte(content))
+		require.NoError(t, err)
+		return f
+	}
+
+	c, configurer, _ := testLanguage(t)
+
+	configurer.Configure(c, "team", loadBuildFile(
+		"team",
+		"# gazelle:scala_default_visibility //team:__subpackages__, //other:__pkg__\n",
+	))
+	configurer.Configure(c, "team/sub", nil)
+	configurer.Configure(c, "team/sub/private", loadBuildFile(
+		"team/sub/private",
+		"# gazelle:scala_default_visibility\n",
+	))
+
+	visibilityForPackage := func(pkg string) []string {
+		r := rule.NewRule(SCALA_LIB_KIND, "example")
+		ScalaConfigForConfig(c, pkg).SetVisibility(r)
+		return r.AttrStrings("visibility")
+	}
+
+	require.Equal(t, DEFAULT_VISIBILITY, visibilityForPackage(""))
+	for _, pkg := range []string{"team", "team/sub"} {
+		require.Equal(
+			t,
+			[]string{"//team:__subpackages__", "//other:__pkg__"},
+			visibilityForPackage(pkg),
+		)
+	}
+	require.Nil(t, visibilityForPackage("team/sub/private"))
+}
+
+func TestExcludeFileDirective(t *testing.T) {
+	c, configurer, lang := testLanguage(t)
+
+	pkgDir := filepath.Join(c.RepoRoot, "example")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	srcs := map[string]string{
+		"Good.scala":      "package com.example\n\nobject Good\n",
+		"Broken.scala":    "package com.example\n\nobject { def }}}\n",
+		"BrokenToo.scala": "package com.example\n\nobject { def }}}\n",
+	}
+	for name, content := range srcs {
+		require.NoError(t, os.WriteFile(filepath.Join(pkgDir, name), []byte(content), 0644))
+	}
+
+	f, err := rule.LoadData(
+		"example/BUILD",
+		"example",
+		[]byte("# gazelle:scala_exclude_file Broken*.scala\n"),
+	)
+	require.NoError(t, err)
+
+	configurer.Configure(c, "example", f)
+	configurer.Configure(c, "example/sub", nil)
+
+	// Exclusions only apply to the package which sets them.
+	require.True(t, ScalaConfigForConfig(c, "example").IsExcludedFile("BrokenToo.scala"))
+	require.False(t, ScalaConfigForConfig(c, "example/sub").IsExcludedFile("BrokenToo.scala"))
+
+	lang.FailOnParseError = true
+
+	result := lang.GenerateRules(language.GenerateArgs{
+		Config:       c,
+		Dir:          pkgDir,
+		Rel:          "example",
+		File:         f,
+		RegularFiles: []string{"BUILD", "Broken.scala", "BrokenToo.scala", "Good.scala"},
+	})
+	require.Len(t, result.Gen, 1)
+	require.Equal(t, []string{"Good.scala"}, result.Gen[0].AttrStrings("srcs"))
+	require.NoError(t, lang.checkUnparsedFiles())
+}
+
+func TestSrcsDirective(t *testing.T) {
+	c, configurer, lang := testLanguage(t)
+
+	pkgDir := filepath.Join(c.RepoRoot, "example")
+	require.NoError(t, os.MkdirAll(filepath.Join(pkgDir, "gen"), 0755))
+	srcs := map[string]string{
+		"Listed.scala":     "package com.example\n\nobject Listed\n",
+		"gen/Gen.scala":    "package com.example\n\nobject Gen\n",
+		"Unlisted.scala":   "package com.example\n\nobject { def }}}\n",
+		"ListedSpec.scala": "package com.example\n\nclass ListedSpec\n",
+	}
+	for name, content := range srcs {
+		require.NoError(t, os.WriteFile(filepath.Join(pkgDir, name), []byte(content), 0644))
+	}
+
+	f, err := rule.LoadData(
+		"example/BUILD",
+		"example",
+		[]byte("# gazelle:scala_srcs Listed.scala, gen/Gen.scala\n# gazelle:scala_srcs Missing.scala\n"),
+	)
+	require.NoError(t, err)
+
+	configurer.Configure(c, "example", f)
+	configurer.Configure(c, "example/sub", nil)
+
+	// The list only applies to the package which sets it.
+	require.Equal(
+		t,
+		[]string{"Listed.scala", "gen/Gen.scala", "Missing.scala"},
+		ScalaConfigForConfig(c, "example").Srcs,
+	)
+	require.Empty(t, ScalaConfigForConfig(c, "example/sub").Srcs)
+
+	lang.FailOnParseError = true
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	result := lang.GenerateRules(language.GenerateArgs{
+		Config:       c,
+		Dir:          pkgDir,
+		Rel:          "example",
+		File:         f,
+		RegularFiles: []string{"BUILD", "Listed.scala", "ListedSpec.scala", "Unlisted.scala"},
+	})
+	require.Len(t, result.Gen, 1)
+	require.Equal(t, []string{"Listed.scala", "gen/Gen.scala"}, result.Gen[0].AttrStrings("srcs"))
+	require.NoError(t, lang.checkUnparsedFiles())
+	require.Contains(
+		t,
+		logs.String(),
+		"Source file 'Missing.scala' listed by '# gazelle:scala_srcs' in 'example' does not exist",
+	)
+}
+
+func TestScala3MainMethodsGenerateBinaries(t *testing.T) {
+	c, configurer, lang := testLanguage(t)
+
+	pkgDir := filepath.Join(c.RepoRoot, "tools")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(pkgDir, "Tools.scala"),
+		[]byte("package com.example.tools\n\n@main def greet(name: String): Unit = ()\n"),
+		0644,
+	))
+	f, err := rule.LoadData(
+		"tools/BUILD",
+		"tools",
+		[]byte("# gazelle:scala_generate_binaries true\n"),
+	)
+	require.NoError(t, err)
+	configurer.Configure(c, "tools", f)
+
+	result := lang.GenerateRules(language.GenerateArgs{
+		Config:       c,
+		Dir:          pkgDir,
+		Rel:          "tools",
+		File:         f,
+		RegularFiles: []string{"Tools.scala"},
+	})
+	require.Len(t, result.Gen, 2)
+	require.Equal(t, SCALA_LIB_KIND, result.Gen[0].Kind())
+	require.Equal(t, SCALA_BINARY_KIND, result.Gen[1].Kind())
+	require.Equal(t, "greet", result.Gen[1].Name())
+	require.Equal(t, "com.example.tools.greet", result.Gen[1].AttrString("main_class"))
+}
+
+func TestSkipGenerationStillIndexesExistingRules(t *testing.T) {
+	c, configurer, lang := testLanguage(t)
+
+	legacyFile, err := rule.LoadData(
+		"legacy/BUILD",
+		"legacy",
+		[]byte("# gazelle:scala_skip_generation true\n"),
+	)
+	require.NoError(t, err)
+	configurer.Configure(c, "legacy", legacyFile)
+
+	pkgDir := filepath.Join(c.RepoRoot, "legacy", "sub")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(pkgDir, "Old.scala"),
+		[]byte("package com.example.legacy\n\nobject Old\n"),
+		0644,
+	))
+
+	// Sources without a build file are skipped rather than failing the run.
+	configurer.Configure(c, "legacy/sub", nil)
+	result := lang.GenerateRules(language.GenerateArgs{
+		Config:       c,
+		Dir:          pkgDir,
+		Rel:          "legacy/sub",
+		RegularFiles: []string{"Old.scala"},
+	})
+	require.Empty(t, result.Gen)
+
+	// The setting is inherited, and existing rules are left alone but still indexed.
+	f, err := rule.LoadData(
+		"legacy/sub/BUILD",
+		"legacy/sub",
+		[]byte("scala_library(\n    name = \"sub\",\n    srcs = [\"Old.scala\"],\n)\n"),
+	)
+	require.NoError(t, err)
+	configurer.Configure(c, "legacy/sub", f)
+	require.True(t, ScalaConfigForConfig(c, "legacy/sub").SkipGeneration)
+
+	result = lang.GenerateRules(language.GenerateArgs{
+		Config:       c,
+		Dir:          pkgDir,
+		Rel:          "legacy/sub",
+		File:         f,
+		RegularFiles: []string{"Old.scala"},
+	})
+	require.Empty(t, result.Gen)
+	require.Empty(t, result.Imports)
+	require.Contains(
+		t,
+		lang.Imports(c, f.Rules[0], f),
+		resolve.ImportSpec{Lang: LANGUAGE_NAME, Imp: "com.example.legacy.Old"},
+	)
+}
+
+func TestMacroLibrariesArePromoted(t *testing.T) {
+	c, configurer, lang := testLanguage(t)
+
+	generate := func(pkg string, f *rule.File, srcs map[string]string) *rule.Rule {
+		pkgDir := filepath.Join(c.RepoRoot, pkg)
+		require.NoError(t, os.MkdirAll(pkgDir, 0755))
+		regularFiles := []string{}
+		for name, content := range srcs {
+			require.NoError(t, os.WriteFile(filepath.Join(pkgDir, name), []byte(content), 0644))
+			regularFiles = append(regularFiles, name)
+		}
+		configurer.Configure(c, pkg, f)
+
+		result := lang.GenerateRules(language.GenerateArgs{
+			Config:       c,
+			Dir:          pkgDir,
+			Rel:          pkg,
+			File:         f,
+			RegularFiles: regularFiles,
+		})
+		require.Len(t, result.Gen, 1)
+		return result.Gen[0]
+	}
+
+	macroSrcs := map[string]string{
+		"Macros.scala": "package com.example\n\nobject Macros {\n" +
+			"  def debug(x: Any): Unit = macro Impl.debug\n}\n",
+		"Plain.scala": "package com.example\n\nobject Plain\n",
+	}
+
+	f := rule.EmptyFile("macros/BUILD", "macros")
+	require.Equal(t, SCALA_MACRO_KIND, generate("macros", f, macroSrcs).Kind())
+
+	// Existing libraries are updated to match, so that the generated rule merges into them.
+	f = rule.EmptyFile("existing/BUILD", "existing")
+	existingRule := rule.NewRule(SCALA_LIB_KIND, "existing")
+	existingRule.Insert(f)
+	require.Equal(t, SCALA_MACRO_KIND, generate("existing", f, macroSrcs).Kind())
+	require.Equal(t, SCALA_MACRO_KIND, existingRule.Kind())
+
+	f = rule.EmptyFile("plain/BUILD", "plain")
+	plainSrcs := map[string]string{"Plain.scala": macroSrcs["Plain.scala"]}
+	require.Equal(t, SCALA_LIB_KIND, generate("plain", f, plainSrcs).Kind())
+
+	// Macros in test sources don't affect the kind of test rules.
+	f = rule.EmptyFile("tests/BUILD", "tests")
+	testSrcs := map[string]string{"MacrosTest.scala": macroSrcs["Macros.scala"]}
+	require.Equal(t, SCALA_TEST_KIND, generate("tests", f, testSrcs).Kind())
+}
+
+func TestIntraTargetReferencesAreNotResolved(t *testing.T) {
+	c, configurer, lang := testLanguage(t)
+
+	pkgDir := filepath.Join(c.RepoRoot, "example")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	srcs := map[string]string{
+		"A.scala": "package com.example\n\nobject A {\n  def helper(): Int = 1\n}\n",
+		"B.scala": "package com.example\n\nimport com.example.A\nimport com.other.Thing\n\n" +
+			"object B {\n  def use(): Int = com.example.A.helper()\n}\n",
+	}
+	for name, content := range srcs {
+		require.NoError(t, os.WriteFile(filepath.Join(pkgDir, name), []byte(content), 0644))
+	}
+
+	f := rule.EmptyFile("example/BUILD", "example")
+	configurer.Configure(c, "example", f)
+
+	result := lang.GenerateRules(language.GenerateArgs{
+		Config:       c,
+		Dir:          pkgDir,
+		Rel:          "example",
+		File:         f,
+		RegularFiles: []string{"A.scala", "B.scala"},
+	})
+	require.Len(t, result.Imports, 1)
+	require.Equal(
+		t,
+		[]interface{}{"com.other.Thing"},
+		result.Imports[0].(*jvm.UsedSymbols).Symbols.Values(),
+	)
+}
+
+func TestSourceLayoutDirective(t *testing.T) {
+	c, configurer, _ := testLanguage(t)
+
+	configure := func(rel string, value string) *ScalaConfig {
+		f, err := rule.LoadData(rel+"/BUILD", rel, []byte("# gazelle:scala_source_layout "+value+"\n"))
+		require.NoError(t, err)
+		configurer.Configure(c, rel, f)
+		return ScalaConfigForConfig(c, rel)
+	}
+
+	// By default the maven layout takes precedence over the test file suffixes.
+	rootConfig := ScalaConfigForConfig(c, "")
+	require.True(t, rootConfig.IsTestSource(filepath.Join("src", "test", "scala", "Util.scala")))
+	require.False(t, rootConfig.IsTestSource("src/main/scala/FooTest.scala"))
+	require.True(t, rootConfig.IsTestSource("FooTest.scala"))
+	require.False(t, rootConfig.IsTestSource("Foo.scala"))
+
+	custom := configure("custom", "app tests/")
+	require.True(t, custom.IsTestSource("tests/Util.scala"))
+	require.False(t, custom.IsTestSource("app/FooTest.scala"))
+	require.False(t, custom.IsTestSource("application/Foo.scala"))
+	require.True(t, custom.IsTestSource("application/FooTest.scala"))
+	require.False(t, custom.IsTestSource("src/test/scala/Util.scala"))
+
+	// Layouts are inherited by sub-packages.
+	configurer.Configure(c, "custom/sub", nil)
+	require.True(t, ScalaConfigForConfig(c, "custom/sub").IsTestSource("tests/Util.scala"))
+
+	flat := configure("custom/flat", "none")
+	require.False(t, flat.IsTestSource("tests/Util.scala"))
+	require.False(t, flat.IsTestSource("src/test/scala/Util.scala"))
+	require.True(t, flat.IsTestSource("src/main/scala/FooTest.scala"))
+
+	maven := configure("custom/flat/maven", "maven")
+	require.True(t, maven.IsTestSource("src/test/scala/Util.scala"))
+}
+
+func TestTestFileGlobsDirective(t *testing.T) {
+	c, configurer, _ := testLanguage(t)
+
+	f, err := rule.LoadData("BUILD", "", []byte(
+		"# gazelle:scala_source_layout none\n"+
+			"# gazelle:scala_test_file_globs **/integration/*.scala, spec/**, Check*.scala\n",
+	))
+	require.NoError(t, err)
+	configurer.Configure(c, "", f)
+
+	rootConfig := ScalaConfigForConfig(c, "")
+	require.True(t, rootConfig.IsTestSource("integration/Util.scala"))
+	require.True(t, rootConfig.IsTestSource(filepath.Join("a", "b", "integration", "Util.scala")))
+	require.False(t, rootConfig.IsTestSource("integration/nested/Util.scala"))
+	require.True(t, rootConfig.IsTestSource("spec/Util.scala"))
+	require.True(t, rootConfig.IsTestSource("spec/nested/Util.scala"))
+	require.False(t, rootConfig.IsTestSource("specs/Util.scala"))
+	require.True(t, rootConfig.IsTestSource("CheckFoo.scala"))
+	require.False(t, rootConfig.IsTestSource("sub/CheckFoo.scala"))
+
+	// Globs compose with the test file suffixes.
+	require.True(t, rootConfig.IsTestSource("FooTest.scala"))
+	require.False(t, rootConfig.IsTestSource("Foo.scala"))
+
+	// Globs are inherited by sub-packages.
+	configurer.Configure(c, "sub", nil)
+	require.True(t, ScalaConfigForConfig(c, "sub").IsTestSource("integration/Util.scala"))
+}
+
+func TestIsKindFollowsIndirectionTransitively(t *testing.T) {
+	c := config.New()
+	c.AliasMap = map[string]string{
+		// macro -> alias -> scala_test
+		"company_test":  "wrapped_test",
+		"wrapped_test":  SCALA_TEST_KIND,
+		"company_macro": "wrapped_macro",
+		"wrapped_macro": SCALA_MACRO_KIND,
+		// A cycle which never reaches a scala kind.
+		"cycle_a": "cycle_b",
+		"cycle_b": "cycle_a",
+		// An alias of a kind scala_test is mapped to.
+		"mapped_wrapper": "mapped_test",
+	}
+	c.KindMap = map[string]config.MappedKind{
+		SCALA_TEST_KIND: {FromKind: SCALA_TEST_KIND, KindName: "mapped_test"},
+	}
+
+	scalaConfig := NewScalaConfig()
+	require.True(t, scalaConfig.IsScalaTestKind(c, SCALA_TEST_KIND))
+	require.True(t, scalaConfig.IsScalaTestKind(c, "wrapped_test"))
+	require.True(t, scalaConfig.IsScalaTestKind(c, "company_test"))
+	require.True(t, scalaConfig.IsScalaTestKind(c, "mapped_test"))
+	require.True(t, scalaConfig.IsScalaTestKind(c, "mapped_wrapper"))
+	require.False(t, scalaConfig.IsScalaTestKind(c, "company_macro"))
+	require.False(t, scalaConfig.IsScalaTestKind(c, "cycle_a"))
+
+	require.True(t, scalaConfig.IsScalaMacroKind(c, "company_macro"))
+	require.False(t, scalaConfig.IsScalaMacroKind(c, "company_test"))
+	require.False(t, scalaConfig.IsScalaMacroKind(c, "cycle_b"))
+}
+
+func TestExportedKindsInvalidateParsingCache(t *testing.T) {
+	c, _, _ := testLanguage(t)
+	srcPath := filepath.Join(c.RepoRoot, "Example.scala")
+	require.NoError(t, os.WriteFile(
+		srcPath,
+		[]byte("package com.example\n\nobject Example\n\ntype Alias = Int\n"),
+		0644,
+	))
+
+	exportedSymbols := func(directives ...string) []interface{} {
+		lang := NewLanguage().(*scalaLang)
+		lang.ParsingCacheFile = "cache.json"
+		require.NoError(t, lang.CheckFlags(flag.NewFlagSet("test", flag.ContinueOnError), c))
+
+		f, err := rule.LoadData("BUILD", "", []byte(strings.Join(directives, "\n")))
+		require.NoError(t, err)
+		lang.Configure(c, "", f)
+
+		parseResult, errs := lang.parser.ParseFile(srcPath)
+		require.Empty(t, errs)
+		lang.parser.WriteParsingCache()
+		return parseResult.ExportedSymbols.Values()
+	}
+
+	require.Equal(t, []interface{}{"Alias", "Example"}, exportedSymbols())
+	// Cached results exporting every kind aren't reused once the kinds are restricted, or
+	// the other way around.
+	restricted := "# gazelle:" + ScalaExportedKinds + " object"
+	require.Equal(t, []interface{}{"Example"}, exportedSymbols(restricted))
+	require.Equal(t, []interface{}{"Example"}, exportedSymbols(restricted))
+	require.Equal(t, []interface{}{"Alias", "Example"}, exportedSymbols())
+}
@@ -2,16 +2,28 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/emirpasic/gods/sets/treeset"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/foursquare/scala-gazelle/jvm"
+	"github.com/foursquare/scala-gazelle/parse"
 	"github.com/foursquare/scala-gazelle/scala"
+	"github.com/foursquare/scala-gazelle/scala/parseresultpb"
 )
 
 // Container for file path arguments
@@ -33,18 +45,131 @@ func (filePaths *filePathsArg) Set(filePath string) error {
 	return nil
 }
 
+// Container for the parse result fields selected via -only
+type onlyFieldsArg []string
+
+func (fields *onlyFieldsArg) String() string {
+	return strings.Join(*fields, ",")
+}
+
+func (fields *onlyFieldsArg) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		if !slices.Contains(scala.PROJECTION_FIELDS, field) {
+			return fmt.Errorf(
+				"expected one of %s, found: %s",
+				strings.Join(scala.PROJECTION_FIELDS, ", "),
+				field,
+			)
+		}
+		if !slices.Contains(*fields, field) {
+			*fields = append(*fields, field)
+		}
+	}
+
+	return nil
+}
+
+func printSymbols(symbols *treeset.Set) {
+	for _, symbol := range symbols.Values() {
+		fmt.Println(symbol)
+	}
+}
+
+func protoStrings(values *treeset.Set) []string {
+	stringValues := make([]string, 0, values.Size())
+	for _, value := range values.Values() {
+		stringValues = append(stringValues, value.(string))
+	}
+	return stringValues
+}
+
+// Returns the parse result as the ParseResult message defined in
+// scala/parseresultpb/parse_result.proto. This lives in the parser binary rather than the
+// scala package so that only the binary, and not the Gazelle plugin, depends on protobuf.
+func parseResultProto(r *scala.ParseResult) *parseresultpb.ParseResult {
+	return &parseresultpb.ParseResult{
+		Source:              r.File,
+		Package:             r.Package,
+		Imports:             protoStrings(r.Imports),
+		FullyQualifiedNames: protoStrings(r.FullyQualifiedNames),
+		Symbols:             protoStrings(r.ExportedSymbols),
+		SchemaVersion:       scala.PARSE_RESULT_SCHEMA_VERSION,
+	}
+}
+
+// Parses every Scala and Java file under the given source roots and prints a report of the symbols
+// they use which would not resolve against the given maven install lockfile or the symbols
+// defined by the sources themselves.
+func reportCoverage(parser scala.Parser, sourceRoots []string, mavenInstallFile string) {
+	definedSymbols := treeset.NewWithStringComparator()
+	usedSymbolsBySource := make(map[string]*jvm.UsedSymbols)
+
+	for _, sourceRoot := range sourceRoots {
+		err := filepath.WalkDir(sourceRoot, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			} else if ext := filepath.Ext(path); ext != ".scala" && ext != ".java" {
+				return nil
+			}
+
+			fileBytes, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			parseResult, errs := parser.Parse(path, string(fileBytes))
+			if len(errs) != 0 {
+				fmt.Fprintf(
+					os.Stderr,
+					"WARN: errors parsing %s, its symbols may be incomplete:\n",
+					path,
+				)
+				for _, err := range errs {
+					fmt.Fprintln(os.Stderr, scala.DisplayError(err))
+				}
+			}
+
+			definedSymbols.Add(parseResult.Packages.Values()...)
+			definedSymbols.Add(parseResult.QualifiedExportedSymbols().Values()...)
+			usedSymbolsBySource[path] = scala.UsedSymbolsForParseResult(parseResult, false)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading source root %s:\n%s\n", sourceRoot, err)
+			os.Exit(1)
+		}
+	}
+
+	coverage := jvm.CheckSymbolCoverage(mavenInstallFile, definedSymbols, usedSymbolsBySource)
+	coverage.Write(os.Stdout)
+}
+
 func main() {
 	var filePaths filePathsArg
 	flag.Var(
 		&filePaths,
 		"file_path",
-		"Path or paths to the Scala file(s) or .srcjar to parse",
+		"Path or paths to the Scala or Java file(s) or .srcjar to parse, or '-' to read a "+
+			"single source file from stdin",
+	)
+	stdinName := flag.String(
+		"stdin_name",
+		"stdin.scala",
+		"The source path to report for source read from stdin with '-file_path -'. Its "+
+			"extension determines whether the source is parsed as Scala or Java",
 	)
 	outputDir := flag.String(
 		"output_dir",
 		"",
 		"Generate json files for parsed symbol information instead of printing to stdout",
 	)
+	outputFile := flag.String(
+		"output_file",
+		"",
+		"Write the parse results for all files to a single json file, as an object keyed by "+
+			"each file's source path (e.g. 'foo.srcjar!com/foo/Bar.scala' for srcjar entries), "+
+			"instead of printing to stdout",
+	)
 	verboseTreeSitterErrors := flag.Bool(
 		"verbose",
 		false,
@@ -60,13 +185,183 @@ func main() {
 		false,
 		"Error if the parser tries to examine the same AST node multiple times",
 	)
+	tolerateErrors := flag.Bool(
+		"tolerate_errors",
+		false,
+		"Print parse errors as warnings and output the parser's best-effort results for "+
+			"the affected files, rather than exiting. With -parsing_cache_file, these partial "+
+			"results are cached too, and their errors are then only reported when the file "+
+			"is actually parsed rather than served from the cache",
+	)
+	trackPositions := flag.Bool(
+		"track_positions",
+		false,
+		"Record the source position of each import and fully qualified usage in the parse results",
+	)
+	listSymbols := flag.Bool(
+		"list_symbols",
+		false,
+		"Print the package-qualified symbols exported by each file one per line, "+
+			"instead of the full json parse results",
+	)
+	listUsed := flag.Bool(
+		"list_used",
+		false,
+		"Print the symbols used by each file one per line, instead of the full json "+
+			"parse results. May be combined with -list_symbols",
+	)
+	format := flag.String(
+		"format",
+		"json",
+		"Output format for parse results, one of 'json', 'tsv' or 'proto'. The tsv format has "+
+			"one row per symbol with columns: file, package, kind (import|export|fqn), symbol. "+
+			"The proto format writes the ParseResult message of "+
+			"scala/parseresultpb/parse_result.proto, with each result prefixed by its varint "+
+			"size when written to stdout or -output_file",
+	)
+	var onlyFields onlyFieldsArg
+	flag.Var(
+		&onlyFields,
+		"only",
+		"Restrict the json parse results to the given fields, one or more of 'imports', "+
+			"'symbols' or 'package'. May be repeated or comma-separated. The source file is "+
+			"always included",
+	)
+	coverage := flag.Bool(
+		"coverage",
+		false,
+		"Instead of printing parse results, report the symbols used by the Scala and Java "+
+			"files under -source_root which would fail to resolve, or resolve ambiguously, "+
+			"against -maven_install_file and the symbols defined by those files. No BUILD "+
+			"files are read or written",
+	)
+	var sourceRoots filePathsArg
+	flag.Var(
+		&sourceRoots,
+		"source_root",
+		"Directory or directories to search for Scala and Java files to check with -coverage",
+	)
+	mavenInstallFile := flag.String(
+		"maven_install_file",
+		"maven_install.json",
+		"Path to the rules_jvm_external lockfile to resolve symbols against with -coverage",
+	)
+	parsingCacheFile := flag.String(
+		"parsing_cache_file",
+		"",
+		"Path to a parsing cache file in which to store the parse results of .srcjar entries, "+
+			"keyed by a hash of each entry's contents, so that entries which are unchanged "+
+			"across invocations are not parsed again. One cache may be shared by any number "+
+			"of srcjars. Specify a .gz file extension to enable gzipping of the cache file",
+	)
+	parsingCacheVersion := flag.String(
+		"parsing_cache_version",
+		"",
+		"Fingerprint the -parsing_cache_file with the given version string rather than a "+
+			"checksum of the parser binary, so that the cache is kept across rebuilds which "+
+			"don't change the parsing logic",
+	)
 	cpuprofile := flag.String(
 		"cpuprofile",
 		"",
 		"Generate a cpu profile while parsing and write it to the given file",
 	)
+	schemaVersion := flag.Bool(
+		"schema_version",
+		false,
+		"Print the schema version of the json parse results and exit. The version is also "+
+			"written as a top-level 'schema_version' field of each json parse result, and is "+
+			"incremented whenever existing fields are renamed, removed or change meaning",
+	)
+	printStats := flag.Bool(
+		"stats",
+		false,
+		"Print a summary of the files parsed, syntax tree nodes visited and time spent in "+
+			"tree-sitter vs walking syntax trees for symbols to stderr at exit",
+	)
 	flag.Parse()
 
+	if *schemaVersion {
+		fmt.Println(scala.PARSE_RESULT_SCHEMA_VERSION)
+		return
+	}
+
+	if stdinIndex := slices.Index(filePaths, "-"); stdinIndex != -1 &&
+		slices.Contains(filePaths[stdinIndex+1:], "-") {
+		fmt.Fprintf(os.Stderr, "-file_path - may only be given once\n")
+		os.Exit(1)
+	}
+
+	if *outputDir != "" && *outputFile != "" {
+		fmt.Fprintf(os.Stderr, "-output_dir and -output_file cannot be used together\n")
+		os.Exit(1)
+	}
+
+	listMode := *listSymbols || *listUsed
+	if listMode && (*outputDir != "" || *outputFile != "") {
+		fmt.Fprintf(
+			os.Stderr,
+			"-list_symbols and -list_used cannot be used with -output_dir or -output_file\n",
+		)
+		os.Exit(1)
+	}
+	if listMode && len(onlyFields) != 0 {
+		fmt.Fprintf(os.Stderr, "-list_symbols and -list_used cannot be used with -only\n")
+		os.Exit(1)
+	}
+
+	if *coverage {
+		if len(sourceRoots) == 0 {
+			fmt.Fprintf(os.Stderr, "-coverage requires at least one -source_root\n")
+			os.Exit(1)
+		}
+		if len(filePaths) != 0 || listMode || *outputDir != "" || *outputFile != "" ||
+			len(onlyFields) != 0 || *format != "json" {
+			fmt.Fprintf(
+				os.Stderr,
+				"-coverage cannot be used with -file_path, -list_symbols, -list_used, -only, "+
+					"-format, -output_dir or -output_file\n",
+			)
+			os.Exit(1)
+		}
+	} else if len(sourceRoots) != 0 {
+		fmt.Fprintf(os.Stderr, "-source_root can only be used with -coverage\n")
+		os.Exit(1)
+	}
+
+	tsvMode := false
+	protoMode := false
+	switch *format {
+	case "json":
+	case "proto":
+		protoMode = true
+		if listMode || len(onlyFields) != 0 {
+			fmt.Fprintf(
+				os.Stderr,
+				"-format=proto cannot be used with -list_symbols, -list_used or -only\n",
+			)
+			os.Exit(1)
+		}
+	case "tsv":
+		tsvMode = true
+		if listMode || *outputDir != "" || *outputFile != "" || len(onlyFields) != 0 {
+			fmt.Fprintf(
+				os.Stderr,
+				"-format=tsv cannot be used with -list_symbols, -list_used, -only, -output_dir "+
+					"or -output_file\n",
+			)
+			os.Exit(1)
+		}
+		fmt.Println(strings.Join([]string{"file", "package", "kind", "symbol"}, "\t"))
+	default:
+		fmt.Fprintf(
+			os.Stderr,
+			"Expected -format to be 'json', 'tsv' or 'proto', found: %s\n",
+			*format,
+		)
+		os.Exit(1)
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -77,22 +372,145 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	handleFile := func(sourceString string, filePath string) {
-		parser := scala.NewParser(*debug, *verboseTreeSitterErrors, *dedupeParsing)
+	var stats *parse.ParseStats
+	if *printStats {
+		stats = &parse.ParseStats{}
+		defer stats.Write(os.Stderr)
+	}
+	// Deferred calls don't run on os.Exit, so errors from here on exit through this to still
+	// print the stats gathered so far.
+	exit := func(code int) {
+		stats.Write(os.Stderr)
+		os.Exit(code)
+	}
 
-		parseResult, errs := parser.Parse(filePath, sourceString)
-		if len(errs) != 0 {
+	if *coverage {
+		parser := scala.NewParser(
+			scala.ParserOptions{
+				Debug:                   *debug,
+				VerboseTreeSitterErrors: *verboseTreeSitterErrors,
+				DedupeParsing:           *dedupeParsing,
+				TrackPositions:          *trackPositions,
+				Stats:                   stats,
+			},
+		)
+		reportCoverage(parser, sourceRoots, *mavenInstallFile)
+		return
+	}
+
+	// Parses srcjar entries through the parsing cache, if one is configured. Entries are
+	// never pruned from the cache, as other srcjars may share it.
+	var srcjarParser parse.Parser[scala.ParseResult]
+	if *parsingCacheFile != "" {
+		cachingParser := parse.NewCachingParser[scala.ParseResult](
+			scala.NewParser(
+				scala.ParserOptions{
+					Debug:                   *debug,
+					VerboseTreeSitterErrors: *verboseTreeSitterErrors,
+					DedupeParsing:           *dedupeParsing,
+					TrackPositions:          *trackPositions,
+					Stats:                   stats,
+				},
+			),
+			*parsingCacheFile,
+			parse.CachingParserOptions{
+				GzipLevel:           gzip.DefaultCompression,
+				Stats:               stats,
+				CacheVersion:        *parsingCacheVersion,
+				CachePartialResults: *tolerateErrors,
+			},
+		)
+		srcjarParser = &cachingParser
+	}
+
+	// Parse results keyed by source path, when writing them all to -output_file.
+	combinedOutput := make(map[string]interface{})
+	// Size-delimited proto parse results, when writing them all to -output_file.
+	var combinedProtoOutput bytes.Buffer
+
+	handleParseResult := func(parseResult *scala.ParseResult, errs []error, filePath string) {
+		if len(errs) != 0 && *tolerateErrors {
+			fmt.Fprintf(
+				os.Stderr,
+				"WARN: parse errors in %s, its symbols may be incomplete:\n",
+				filePath,
+			)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, scala.DisplayError(err))
+			}
+		} else if len(errs) != 0 {
 			fmt.Fprintf(os.Stderr, "Parse errors in %s:\n", filePath)
 			for _, err := range errs {
-				fmt.Fprintln(os.Stderr, err)
+				fmt.Fprintln(os.Stderr, scala.DisplayError(err))
 			}
-			os.Exit(1)
+			exit(1)
 		}
 
-		bytes, err := json.MarshalIndent(parseResult, "", "    ")
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error encoding json for %s:\n%s\n", filePath, err)
-			os.Exit(1)
+		if listMode {
+			if *listSymbols {
+				printSymbols(parseResult.QualifiedExportedSymbols())
+			}
+			if *listUsed {
+				printSymbols(parseResult.UsedSymbols())
+			}
+			return
+		}
+
+		if tsvMode {
+			for _, row := range parseResult.SymbolRows() {
+				fmt.Println(strings.Join(row, "\t"))
+			}
+			return
+		}
+
+		if protoMode && *outputDir == "" {
+			// Results are prefixed with their size so that a stream of several can be split
+			// apart again.
+			var protoOutput io.Writer = os.Stdout
+			if *outputFile != "" {
+				protoOutput = &combinedProtoOutput
+			}
+			if _, err := protodelim.MarshalTo(protoOutput, parseResultProto(parseResult)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding proto for %s:\n%s\n", filePath, err)
+				exit(1)
+			}
+			return
+		}
+
+		var output interface{} = scala.NewVersionedParseResult(parseResult)
+		if len(onlyFields) != 0 {
+			projection, err := parseResult.Project(onlyFields)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error projecting parse result for %s:\n%s\n", filePath, err)
+				exit(1)
+			}
+			projection["schema_version"] = json.RawMessage(
+				strconv.Itoa(scala.PARSE_RESULT_SCHEMA_VERSION),
+			)
+			output = projection
+		}
+
+		if *outputFile != "" {
+			combinedOutput[filePath] = output
+			return
+		}
+
+		var bytes []byte
+		if protoMode {
+			// Each file in -output_dir holds a single result, so needs no delimiting.
+			var err error
+			bytes, err = proto.Marshal(parseResultProto(parseResult))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding proto for %s:\n%s\n", filePath, err)
+				exit(1)
+			}
+		} else {
+			var err error
+			bytes, err = json.MarshalIndent(output, "", "    ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding json for %s:\n%s\n", filePath, err)
+				exit(1)
+			}
 		}
 
 		if *outputDir != "" {
@@ -100,14 +518,14 @@ func main() {
 			outputFile, err := os.Create(outputFilePath)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error opening %s for writing:\n%s\n", outputFilePath, err)
-				os.Exit(1)
+				exit(1)
 			}
 			defer outputFile.Close()
 
 			_, err = outputFile.Write(bytes)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error writing to %s:\n%s\n", outputFilePath, err)
-				os.Exit(1)
+				exit(1)
 			}
 
 		} else {
@@ -116,14 +534,38 @@ func main() {
 		}
 	}
 
+	handleFile := func(sourceString string, filePath string) {
+		parser := scala.NewParser(
+			scala.ParserOptions{
+				Debug:                   *debug,
+				VerboseTreeSitterErrors: *verboseTreeSitterErrors,
+				DedupeParsing:           *dedupeParsing,
+				TrackPositions:          *trackPositions,
+				Stats:                   stats,
+			},
+		)
+
+		parseResult, errs := parser.Parse(filePath, sourceString)
+		handleParseResult(parseResult, errs, filePath)
+	}
+
 	for _, filePath := range filePaths {
 		fileExt := filepath.Ext(filePath)
 
-		if fileExt == ".scala" {
+		if filePath == "-" {
+			stdinBytes, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading source from stdin:\n%s\n", err)
+				exit(1)
+			}
+
+			handleFile(string(stdinBytes), *stdinName)
+
+		} else if fileExt == ".scala" || fileExt == ".java" {
 			fileBytes, err := os.ReadFile(filePath)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error reading source file %s:\n%s\n", filePath, err)
-				os.Exit(1)
+				exit(1)
 			}
 			sourceString := string(fileBytes)
 
@@ -133,7 +575,7 @@ func main() {
 			srcjarReader, err := zip.OpenReader(filePath)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error opening %s for reading:\n%s\n", filePath, err)
-				os.Exit(1)
+				exit(1)
 			}
 			defer srcjarReader.Close()
 
@@ -147,23 +589,56 @@ func main() {
 				reader, err := srcFile.Open()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error opening zipped source file %s:\n%s\n", srcPath, err)
-					os.Exit(1)
+					exit(1)
 				}
 				defer reader.Close()
 
 				srcFileBytes, err := ioutil.ReadAll(reader)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error reading zipped source file %s:\n%s\n", srcPath, err)
-					os.Exit(1)
+					exit(1)
 				}
 				sourceString := string(srcFileBytes)
 
-				handleFile(sourceString, srcPath)
+				if srcjarParser != nil {
+					parseResult, errs := srcjarParser.ParseSource(srcPath, sourceString)
+					if parseResult.File != srcPath {
+						// Cached results record the path the entry was first parsed at,
+						// which may be in a different srcjar.
+						entryResult := *parseResult
+						entryResult.File = srcPath
+						parseResult = &entryResult
+					}
+					handleParseResult(parseResult, errs, srcPath)
+				} else {
+					handleFile(sourceString, srcPath)
+				}
 			}
 
 		} else {
-			fmt.Fprintf(os.Stderr, "Expected .scala file or .srcjar, found: %s\n", filePath)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Expected .scala or .java file or .srcjar, found: %s\n", filePath)
+			exit(1)
+		}
+	}
+
+	if srcjarParser != nil {
+		srcjarParser.WriteParsingCache()
+	}
+
+	if *outputFile != "" {
+		bytes := combinedProtoOutput.Bytes()
+		if !protoMode {
+			var err error
+			bytes, err = json.MarshalIndent(combinedOutput, "", "    ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding json for %s:\n%s\n", *outputFile, err)
+				exit(1)
+			}
+		}
+
+		if err := os.WriteFile(*outputFile, bytes, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to %s:\n%s\n", *outputFile, err)
+			exit(1)
 		}
 	}
 }
@@ -4,10 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/emirpasic/gods/sets/treeset"
 	sitter "github.com/smacker/go-tree-sitter"
@@ -25,43 +30,299 @@ import (
 type SymbolData struct {
 	FullyQualifiedNames *treeset.Set `json:"fully_qualified_names"`
 	ExportedSymbols     *treeset.Set `json:"symbols"`
+	// Symbols defined as both a class, trait or enum and an object in the same scope, i.e.
+	// companion pairs, whose object members are exported under their shared name. Like
+	// ExportedSymbols, these are relative to the file's package.
+	Companions *treeset.Set `json:"companions"`
+	// Where in the file each of FullyQualifiedNames was used. Like ImportPositions, only
+	// populated when the parser is created with position tracking enabled.
+	UsagePositions map[string][]SourcePosition `json:"usage_positions,omitempty"`
 }
 
 func EmptySymbolData() *SymbolData {
 	return &SymbolData{
 		FullyQualifiedNames: treeset.NewWithStringComparator(),
 		ExportedSymbols:     treeset.NewWithStringComparator(),
+		Companions:          treeset.NewWithStringComparator(),
 	}
 }
 
-func SingleNameData(name string) *SymbolData {
-	return &SymbolData{
-		FullyQualifiedNames: treeset.NewWithStringComparator(name),
-		ExportedSymbols:     treeset.NewWithStringComparator(),
-	}
-}
-
-func (s *SymbolData) Union(other *SymbolData) *SymbolData {
-	return &SymbolData{
-		FullyQualifiedNames: s.FullyQualifiedNames.Union(other.FullyQualifiedNames),
-		ExportedSymbols:     s.ExportedSymbols.Union(other.ExportedSymbols),
-	}
-}
+// PARSE_RESULT_SCHEMA_VERSION versions the json parse results emitted by the parser binary,
+// which are written with a top-level "schema_version" field. It must be incremented whenever
+// a field is renamed or removed or its meaning changes, but not when a field is added.
+// Results written before versioning have no such field, and should be treated as version 0.
+const PARSE_RESULT_SCHEMA_VERSION = 1
 
 type ParseResult struct {
 	File    string       `json:"source"`
 	Imports *treeset.Set `json:"imports"`
-	Package string       `json:"package"`
+	// The subset of Imports which are not anchored at the root of the file's package, and
+	// so may actually be relative to that package rather than absolute.
+	RelativeImports *treeset.Set `json:"relative_imports"`
+	// The subset of Imports explicitly anchored at the root with _root_, e.g.
+	// `import _root_.util.Helper`, which must never be resolved relative to the file's package.
+	AbsoluteImports *treeset.Set `json:"absolute_imports"`
+	Package         string       `json:"package"`
+	// All packages the file declares, including Package itself and any braced package
+	// declarations (e.g. `package foo { ... }`) or package objects nested within it.
+	Packages *treeset.Set `json:"packages"`
+	// Where in the file each of Imports appeared. Only populated when the parser is
+	// created with position tracking enabled, to keep the parsing cache compact otherwise.
+	ImportPositions map[string][]SourcePosition `json:"import_positions,omitempty"`
+	// Names introduced by renaming imports, e.g. `import foo.{Bar => Baz}`, mapped to the
+	// fully qualified symbol they refer to, here "Baz" to "foo.Bar".
+	ImportAliases map[string]string `json:"import_aliases,omitempty"`
+	// Whether tree-sitter produced any ERROR nodes for the file, in which case the parsed
+	// symbols are only a best-effort recovery and may be incomplete.
+	HasErrors bool `json:"has_errors"`
+	// Whether the file defines or implements any macros, i.e. contains a Scala 2
+	// `def f: T = macro impl` or a Scala 3 quote or splice such as `${ impl('x) }`, in which
+	// case it must be compiled by a scala_macro_library.
+	HasMacro bool `json:"has_macro,omitempty"`
+	// Top-level objects which may be run as a program, i.e. which extend App or define a
+	// `main(args: Array[String])` method, along with top-level Scala 3 `@main` methods,
+	// which run as a program class named after the method. Like ExportedSymbols, these are
+	// relative to Package.
+	MainObjects *treeset.Set `json:"main_objects"`
 	*SymbolData
-	// HasMain bool
+}
+
+// VersionedParseResult is a parse result as emitted by the parser binary, tagged with the
+// schema version of its json encoding.
+type VersionedParseResult struct {
+	SchemaVersion int `json:"schema_version"`
+	*ParseResult
+}
+
+func NewVersionedParseResult(parseResult *ParseResult) *VersionedParseResult {
+	return &VersionedParseResult{
+		SchemaVersion: PARSE_RESULT_SCHEMA_VERSION,
+		ParseResult:   parseResult,
+	}
 }
 
 func EmptyParseResult(file string) *ParseResult {
 	return &ParseResult{
-		File:       file,
-		Imports:    treeset.NewWithStringComparator(),
-		SymbolData: EmptySymbolData(),
+		File:            file,
+		Imports:         treeset.NewWithStringComparator(),
+		RelativeImports: treeset.NewWithStringComparator(),
+		AbsoluteImports: treeset.NewWithStringComparator(),
+		Packages:        treeset.NewWithStringComparator(),
+		MainObjects:     treeset.NewWithStringComparator(),
+		SymbolData:      EmptySymbolData(),
+	}
+}
+
+// SourcePosition is the location of a node within a source file. Line and Column are
+// 1-based, while Offset is the 0-based byte offset into the file.
+type SourcePosition struct {
+	Line   uint32 `json:"line"`
+	Column uint32 `json:"column"`
+	Offset uint32 `json:"offset"`
+}
+
+func nodePosition(node *sitter.Node) SourcePosition {
+	startPoint := node.StartPoint()
+	return SourcePosition{
+		Line:   startPoint.Row + 1,
+		Column: startPoint.Column + 1,
+		Offset: node.StartByte(),
+	}
+}
+
+func (r *ParseResult) addImportPosition(importedSymbol string, position SourcePosition) {
+	if r.ImportPositions == nil {
+		r.ImportPositions = make(map[string][]SourcePosition)
 	}
+	r.ImportPositions[importedSymbol] = append(r.ImportPositions[importedSymbol], position)
+}
+
+func (d *SymbolData) addUsagePosition(usedName string, position SourcePosition) {
+	if d.UsagePositions == nil {
+		d.UsagePositions = make(map[string][]SourcePosition)
+	}
+	d.UsagePositions[usedName] = append(d.UsagePositions[usedName], position)
+}
+
+func (r *ParseResult) addImportAliases(aliases map[string]string) {
+	if len(aliases) == 0 {
+		return
+	}
+	if r.ImportAliases == nil {
+		r.ImportAliases = make(map[string]string)
+	}
+	for alias, importedSymbol := range aliases {
+		r.ImportAliases[alias] = importedSymbol
+	}
+}
+
+// Rewrites any of the given names which are accessed through a renamed import, e.g.
+// `TUTimeoutException.apply` after `import com.twitter.util.{TimeoutException =>
+// TUTimeoutException}`, to the original symbol they refer to, so that usages of the alias
+// resolve to the same dependency as the import itself.
+func (r *ParseResult) resolveImportAliases(names *treeset.Set) *treeset.Set {
+	if len(r.ImportAliases) == 0 {
+		return names
+	}
+
+	resolved := treeset.NewWithStringComparator()
+	namesIter := names.Iterator()
+	for namesIter.Next() {
+		resolved.Add(r.resolveImportAlias(namesIter.Value().(string)))
+	}
+	return resolved
+}
+
+// Rewrites the names positions are recorded for as resolveImportAliases does.
+func (r *ParseResult) resolveImportAliasPositions(
+	positions map[string][]SourcePosition,
+) map[string][]SourcePosition {
+	if len(r.ImportAliases) == 0 || positions == nil {
+		return positions
+	}
+
+	resolved := make(map[string][]SourcePosition, len(positions))
+	for name, namePositions := range positions {
+		name = r.resolveImportAlias(name)
+		resolved[name] = append(resolved[name], namePositions...)
+	}
+	return resolved
+}
+
+func (r *ParseResult) resolveImportAlias(name string) string {
+	first, rest, hasRest := strings.Cut(name, ".")
+	if importedSymbol, isAlias := r.ImportAliases[first]; isAlias {
+		name = importedSymbol
+		if hasRest {
+			name += "." + rest
+		}
+	}
+	return name
+}
+
+// Returns the given symbol qualified by the given package, if there is one.
+func qualifySymbol(pkg string, symbol string) string {
+	if pkg == "" {
+		return symbol
+	}
+	return pkg + "." + symbol
+}
+
+// QualifiedExportedSymbols returns the fully qualified names of all symbols exported by
+// the parsed file.
+func (r *ParseResult) QualifiedExportedSymbols() *treeset.Set {
+	qualifiedSymbols := treeset.NewWithStringComparator()
+
+	symbolsIter := r.ExportedSymbols.Iterator()
+	for symbolsIter.Next() {
+		symbol := symbolsIter.Value().(string)
+		qualifiedSymbols.Add(qualifySymbol(r.Package, symbol))
+	}
+
+	return qualifiedSymbols
+}
+
+// QualifiedMainObjects returns the fully qualified names of all main objects defined by
+// the parsed file.
+func (r *ParseResult) QualifiedMainObjects() *treeset.Set {
+	qualifiedObjects := treeset.NewWithStringComparator()
+	for _, object := range r.MainObjects.Values() {
+		qualifiedObjects.Add(qualifySymbol(r.Package, object.(string)))
+	}
+	return qualifiedObjects
+}
+
+// UsedSymbols returns all symbols the parsed file refers to, whether via imports or
+// fully qualified names in code.
+func (r *ParseResult) UsedSymbols() *treeset.Set {
+	return r.Imports.Union(r.FullyQualifiedNames)
+}
+
+// The kinds of symbol reported by ParseResult.SymbolRows.
+const (
+	SYMBOL_KIND_IMPORT = "import"
+	SYMBOL_KIND_EXPORT = "export"
+	SYMBOL_KIND_FQN    = "fqn"
+)
+
+// SymbolRows flattens the parse result into one [file, package, kind, symbol] row per
+// symbol, for tabular output. Exported symbols are package-qualified.
+func (r *ParseResult) SymbolRows() [][]string {
+	rows := make([][]string, 0)
+
+	addRows := func(kind string, symbols *treeset.Set) {
+		for _, symbol := range symbols.Values() {
+			rows = append(rows, []string{r.File, r.Package, kind, symbol.(string)})
+		}
+	}
+
+	addRows(SYMBOL_KIND_IMPORT, r.Imports)
+	addRows(SYMBOL_KIND_EXPORT, r.QualifiedExportedSymbols())
+	addRows(SYMBOL_KIND_FQN, r.FullyQualifiedNames)
+
+	return rows
+}
+
+// The fields of a ParseResult which may be selected by ParseResult.Project.
+const (
+	PROJECTION_IMPORTS = "imports"
+	PROJECTION_PACKAGE = "package"
+	PROJECTION_SYMBOLS = "symbols"
+)
+
+var PROJECTION_FIELDS = []string{PROJECTION_IMPORTS, PROJECTION_PACKAGE, PROJECTION_SYMBOLS}
+
+// Project returns the json encoding of the parse result restricted to the given fields,
+// keyed by their json names. The source file is always included so that projected
+// results from several files can still be told apart.
+func (r *ParseResult) Project(fields []string) (map[string]json.RawMessage, error) {
+	for _, field := range fields {
+		if !slices.Contains(PROJECTION_FIELDS, field) {
+			return nil, fmt.Errorf(
+				"unknown parse result field '%s', expected one of: %s",
+				field,
+				strings.Join(PROJECTION_FIELDS, ", "),
+			)
+		}
+	}
+
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var allFields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &allFields); err != nil {
+		return nil, err
+	}
+
+	projection := map[string]json.RawMessage{
+		"source": allFields["source"],
+	}
+	for _, field := range fields {
+		projection[field] = allFields[field]
+	}
+	return projection, nil
+}
+
+// Reads positions keyed by symbol from a parse result in the parsing cache, where they are
+// omitted if they weren't tracked.
+func unmarshalPositions(positionsData interface{}) map[string][]SourcePosition {
+	if positionsData == nil {
+		return nil
+	}
+
+	positionsMap := make(map[string][]SourcePosition)
+	for symbol, positions := range positionsData.(map[string]interface{}) {
+		for _, position := range positions.([]interface{}) {
+			positionMap := position.(map[string]interface{})
+			positionsMap[symbol] = append(positionsMap[symbol], SourcePosition{
+				Line:   uint32(positionMap["line"].(float64)),
+				Column: uint32(positionMap["column"].(float64)),
+				Offset: uint32(positionMap["offset"].(float64)),
+			})
+		}
+	}
+	return positionsMap
 }
 
 // TODO(jacob): For some reason we get a nil pointer deference from the treeset library
@@ -79,31 +340,94 @@ func (*treeSitterParser) UnmarshalParsingCache(
 
 		file := parseResultMap["source"].(string)
 		imports := parseResultMap["imports"].([]interface{})
+		relativeImports := parseResultMap["relative_imports"].([]interface{})
+		absoluteImports := parseResultMap["absolute_imports"].([]interface{})
 		pkg := parseResultMap["package"].(string)
+		packages := parseResultMap["packages"].([]interface{})
+		hasErrors := parseResultMap["has_errors"].(bool)
+		// Omitted when false.
+		hasMacro, _ := parseResultMap["has_macro"].(bool)
 		fullyQualifiedNames := parseResultMap["fully_qualified_names"].([]interface{})
 		exportedSymbols := parseResultMap["symbols"].([]interface{})
+		companions := parseResultMap["companions"].([]interface{})
+		mainObjects := parseResultMap["main_objects"].([]interface{})
+
+		importPositions := unmarshalPositions(parseResultMap["import_positions"])
+		usagePositions := unmarshalPositions(parseResultMap["usage_positions"])
+
+		var importAliases map[string]string
+		if aliasesMap, exists := parseResultMap["import_aliases"]; exists {
+			importAliases = make(map[string]string)
+			for alias, importedSymbol := range aliasesMap.(map[string]interface{}) {
+				importAliases[alias] = importedSymbol.(string)
+			}
+		}
 
 		(*cacheMap)[hash] = &ParseResult{
-			File:    file,
-			Imports: treeset.NewWithStringComparator(imports...),
-			Package: pkg,
+			File:            file,
+			Imports:         treeset.NewWithStringComparator(imports...),
+			RelativeImports: treeset.NewWithStringComparator(relativeImports...),
+			AbsoluteImports: treeset.NewWithStringComparator(absoluteImports...),
+			Package:         pkg,
+			Packages:        treeset.NewWithStringComparator(packages...),
+			ImportPositions: importPositions,
+			ImportAliases:   importAliases,
+			HasErrors:       hasErrors,
+			HasMacro:        hasMacro,
+			MainObjects:     treeset.NewWithStringComparator(mainObjects...),
 			SymbolData: &SymbolData{
 				FullyQualifiedNames: treeset.NewWithStringComparator(fullyQualifiedNames...),
 				ExportedSymbols:     treeset.NewWithStringComparator(exportedSymbols...),
+				Companions:          treeset.NewWithStringComparator(companions...),
+				UsagePositions:      usagePositions,
 			},
 		}
 	}
 }
 
+// CacheFingerprint lists the exported kinds when they are restricted and whether positions
+// are tracked, as cached results parsed with other options would otherwise be reused.
+func (p *treeSitterParser) CacheFingerprint() string {
+	options := []string{}
+	if p.exportedKinds != nil && p.exportedKinds.Size() != allDefinitionKinds().Size() {
+		kinds := make([]string, 0, p.exportedKinds.Size())
+		for _, kind := range p.exportedKinds.Values() {
+			kinds = append(kinds, kind.(string))
+		}
+		options = append(options, "exported_kinds="+strings.Join(kinds, ","))
+	}
+	if p.trackPositions {
+		options = append(options, "track_positions")
+	}
+	return strings.Join(options, ";")
+}
+
 type Parser parse.CacheableParser[ParseResult]
 
 type treeSitterParser struct {
 	Parser
 	parser                  *sitter.Parser
+	javaParser              *sitter.Parser
 	debug                   bool
 	verboseTreeSitterErrors bool
 	dedupeParsing           bool
-	seenNodes               *treeset.Set
+	trackPositions          bool
+	// Definition kinds (see DEFINITION_KINDS) which contribute to ExportedSymbols, or nil to
+	// export every kind.
+	exportedKinds *treeset.Set
+	seenNodes     *treeset.Set
+	// Reused by every query the parser runs, as Exec resets any state left from the last one.
+	// Parsers are never used concurrently, so there is no need for a cursor per query.
+	queryCursor *sitter.QueryCursor
+	// Counts of the work done by the parser, if non-nil.
+	stats *parse.ParseStats
+	// Recoverable errors encountered while reading the nodes of the file currently being
+	// parsed, e.g. unexpected node types the grammar produced.
+	nodeErrors []error
+	// The exported class, trait or enum symbols and object symbols of the file currently
+	// being parsed, for pairing up companions once the whole file has been parsed.
+	classSymbols  *treeset.Set
+	objectSymbols *treeset.Set
 }
 
 var SCALA_LANG = scala.GetLanguage()
@@ -121,16 +445,56 @@ func scalaErrorQuery() *sitter.Query {
 
 var ERROR_QUERY = scalaErrorQuery()
 
-func NewParser(debug bool, verboseTreeSitterErrors bool, dedupeParsing bool) Parser {
-	sitter := sitter.NewParser()
-	sitter.SetLanguage(SCALA_LANG)
+func scalaMacroQuery() *sitter.Query {
+	query, err := sitter.NewQuery(
+		[]byte(`[(macro_body) (quote_expression) (splice_expression)] @macro`),
+		SCALA_LANG,
+	)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying for tree-sitter macros, exiting...\n")
+		panic(err)
+	}
+
+	return query
+}
+
+var MACRO_QUERY = scalaMacroQuery()
+
+// ParserOptions configures the output and diagnostics of a parser created by NewParser.
+type ParserOptions struct {
+	// If set, detailed parsing information is printed while parsing.
+	Debug bool
+	// If set, an error is returned for each tree-sitter error node in the parse tree.
+	VerboseTreeSitterErrors bool
+	// If set, parsing fails if the parser examines the same AST node multiple times.
+	DedupeParsing bool
+	// If set, the source positions of imports and fully qualified usages are recorded.
+	TrackPositions bool
+	// Definition kinds (see DEFINITION_KINDS) which contribute to ExportedSymbols, or nil to
+	// export every kind.
+	ExportedKinds *treeset.Set
+	// If non-nil, counts of the work done by the parser are recorded in Stats.
+	Stats *parse.ParseStats
+}
+
+func NewParser(opts ParserOptions) Parser {
+	scalaParser := sitter.NewParser()
+	scalaParser.SetLanguage(SCALA_LANG)
+	javaParser := sitter.NewParser()
+	javaParser.SetLanguage(JAVA_LANG)
 
 	return &treeSitterParser{
-		parser:                  sitter,
-		debug:                   debug,
-		verboseTreeSitterErrors: verboseTreeSitterErrors,
-		dedupeParsing:           dedupeParsing,
+		parser:                  scalaParser,
+		javaParser:              javaParser,
+		debug:                   opts.Debug,
+		verboseTreeSitterErrors: opts.VerboseTreeSitterErrors,
+		dedupeParsing:           opts.DedupeParsing,
+		trackPositions:          opts.TrackPositions,
+		exportedKinds:           opts.ExportedKinds,
 		seenNodes:               treeset.NewWithIntComparator(),
+		queryCursor:             sitter.NewQueryCursor(),
+		stats:                   opts.Stats,
 	}
 }
 
@@ -138,62 +502,67 @@ func (p *treeSitterParser) Parse(
 	filePath string,
 	source string,
 ) (*ParseResult, []error) {
+	if filepath.Ext(filePath) == JAVA_EXT {
+		return p.parseJava(filePath, []byte(source))
+	}
 
 	result := EmptyParseResult(filePath)
 	errs := make([]error, 0)
+	p.nodeErrors = make([]error, 0)
+	p.classSymbols = treeset.NewWithStringComparator()
+	p.objectSymbols = treeset.NewWithStringComparator()
 
 	ctx := context.Background()
 	sourceCode := []byte(source)
 
+	treeSitterStart := time.Now()
 	tree, err := p.parser.ParseCtx(ctx, nil, sourceCode)
 	if err != nil {
 		errs = append(errs, err)
 	}
+	walkingStart := time.Now()
+	defer func() {
+		p.stats.RecordParse(walkingStart.Sub(treeSitterStart), time.Since(walkingStart))
+	}()
 
 	if tree != nil {
 		rootNode := tree.RootNode()
 		rootIsError := rootNode.Type() == "ERROR"
+		result.HasErrors = rootIsError || rootNode.HasError()
+		result.HasMacro = p.hasMacro(rootNode)
 
 		if p.debug {
 			fmt.Fprintf(os.Stderr, "%+v\n", rootNode)
 		}
 
-		for i := 0; i < int(rootNode.NamedChildCount()); i++ {
-			nodeI := rootNode.NamedChild(i)
-
-			switch nodeI.Type() {
-			case "package_clause":
-				packageChild := getLoneChild(nodeI, "package_identifier")
-				parsedPackage := readPackageIdentifier(packageChild, sourceCode, false)
-
-				if result.Package != "" {
-					result.Package += "." + parsedPackage
-				} else {
-					result.Package = parsedPackage
-				}
+		subPackages := p.parseCompilationUnit(rootNode, sourceCode, result, "", rootIsError)
 
-			case "import_declaration":
-				importedSymbols := readImportDeclaration(nodeI, sourceCode)
-				result.Imports = result.Imports.Union(importedSymbols)
-
-			case "block":
-				// For some reason tree-sitter sometimes puts blocks attached to class/object/etc
-				// definitions as sibling nodes rather than nested as the body of their would-be
-				// parent node. Just skip these as they are handled when parsing the definition
-				// node.
-
-			default:
-				if !rootIsError {
-					initialNamespace := ""
-					childSymbolData := p.recursivelyParseSymbols(nodeI, sourceCode, &initialNamespace)
-					result.SymbolData = result.SymbolData.Union(childSymbolData)
-				}
-			}
+		if result.Package != "" {
+			result.Packages.Add(result.Package)
+		}
+		for _, subPackage := range subPackages {
+			result.Packages.Add(qualifySymbol(result.Package, subPackage))
 		}
 
 		if rootIsError {
 			result.ExportedSymbols = scanForDefinedSymbols(sourceCode)
 		}
+		result.Companions = p.classSymbols.Intersection(p.objectSymbols)
+
+		result.FullyQualifiedNames = result.resolveImportAliases(result.FullyQualifiedNames)
+		result.UsagePositions = result.resolveImportAliasPositions(result.UsagePositions)
+
+		importsIter := result.Imports.Iterator()
+		for importsIter.Next() {
+			importedSymbol := importsIter.Value().(string)
+			if isAbsoluteImport(importedSymbol) {
+				result.AbsoluteImports.Add(importedSymbol)
+			} else if isPossiblyRelativeImport(importedSymbol, result.Package) {
+				result.RelativeImports.Add(importedSymbol)
+			}
+		}
+
+		errs = append(errs, p.nodeErrors...)
 
 		if p.verboseTreeSitterErrors {
 			if treeErrors := p.queryErrors(sourceCode, rootNode); treeErrors != nil {
@@ -205,6 +574,139 @@ func (p *treeSitterParser) Parse(
 	return result, errs
 }
 
+// Parses the top-level statements of a compilation unit, or of the body of a braced
+// package declaration nested within one. Symbols defined inside braced package
+// declarations are exported relative to the file's top-level package, under the given
+// namespace. Returns the namespaces (relative to the top-level package) of any braced
+// package declarations found.
+func (p *treeSitterParser) parseCompilationUnit(
+	node *sitter.Node,
+	sourceCode []byte,
+	result *ParseResult,
+	namespace string,
+	rootIsError bool,
+) []string {
+	subPackages := make([]string, 0)
+
+	for i := 0; i < int(node.NamedChildCount()); i++ {
+		nodeI := node.NamedChild(i)
+
+		switch nodeI.Type() {
+		case "package_clause":
+			packageChild := getLoneChild(nodeI, "package_identifier")
+			parsedPackage, err := readPackageIdentifier(packageChild, sourceCode, false)
+			if err != nil {
+				p.nodeErrors = append(p.nodeErrors, err)
+				continue
+			}
+
+			if body := nodeI.ChildByFieldName("body"); body != nil {
+				// e.g. `package foo { object Bar }`, which defines foo.Bar relative to any
+				// enclosing package.
+				subPackage := namespace + parsedPackage
+				subPackages = append(subPackages, subPackage)
+
+				nestedPackages := p.parseCompilationUnit(
+					body,
+					sourceCode,
+					result,
+					subPackage+".",
+					rootIsError,
+				)
+				subPackages = append(subPackages, nestedPackages...)
+
+			} else if result.Package != "" {
+				result.Package += "." + parsedPackage
+			} else {
+				result.Package = parsedPackage
+			}
+
+		case "import_declaration":
+			importedSymbols, aliases, err := readImportDeclaration(nodeI, sourceCode)
+			if err != nil {
+				p.nodeErrors = append(p.nodeErrors, err)
+				continue
+			}
+			result.Imports = result.Imports.Union(importedSymbols)
+			result.addImportAliases(aliases)
+
+			if p.trackPositions {
+				position := nodePosition(nodeI)
+				importsIter := importedSymbols.Iterator()
+				for importsIter.Next() {
+					result.addImportPosition(importsIter.Value().(string), position)
+				}
+			}
+
+		case "block":
+			// For some reason tree-sitter sometimes puts blocks attached to class/object/etc
+			// definitions as sibling nodes rather than nested as the body of their would-be
+			// parent node. Just skip these as they are handled when parsing the definition
+			// node.
+
+		default:
+			if nodeI.Type() == "package_object" {
+				// e.g. `package object foo { ... }`, which also declares the package foo.
+				if nameNode := nodeI.ChildByFieldName("name"); nameNode != nil {
+					packageName := identifierName(nameNode, sourceCode)
+					subPackages = append(subPackages, namespace+packageName)
+				}
+			}
+
+			if !rootIsError {
+				if isMainObject(nodeI, sourceCode) || isMainMethod(nodeI, sourceCode) {
+					name := identifierName(nodeI.ChildByFieldName("name"), sourceCode)
+					result.MainObjects.Add(namespace + name)
+				}
+
+				initialNamespace := namespace
+				p.recursivelyParseSymbols(nodeI, sourceCode, &initialNamespace, result.SymbolData)
+			}
+		}
+	}
+
+	return subPackages
+}
+
+// ParseError is a syntax error tree-sitter found in a source file. Row and Column are
+// 1-based, and Snippet is the full source line containing the error.
+type ParseError struct {
+	Row     uint32 `json:"row"`
+	Column  uint32 `json:"column"`
+	Message string `json:"message"`
+	Snippet string `json:"snippet"`
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Row, e.Column, e.Message)
+}
+
+// Display formats the error for people reading it in a terminal, showing the offending
+// source line with a caret under the error's column.
+func (e *ParseError) Display() string {
+	prefix := fmt.Sprintf("     %d: ", e.Row)
+	caret := strings.Repeat(" ", len(prefix)+int(e.Column)-1) + "^"
+	return prefix + e.Snippet + "\n" + caret
+}
+
+// DisplayError formats the given error for printing, using ParseError.Display for parse
+// errors.
+func DisplayError(err error) string {
+	var parseError *ParseError
+	if errors.As(err, &parseError) {
+		return parseError.Display()
+	}
+	return err.Error()
+}
+
+// Returns whether the given node contains any macro definitions or implementations.
+func (p *treeSitterParser) hasMacro(node *sitter.Node) bool {
+	p.queryCursor.Exec(MACRO_QUERY, node)
+
+	_, ok := p.queryCursor.NextMatch()
+	return ok
+}
+
 // Taken from https://github.com/aspect-build/aspect-cli/blob/v1.509.25/gazelle/common/treesitter/queries.go#L93.
 // We unfortunately can't use their implementation as it refers to a hard-coded mapping
 // of languages they support.
@@ -215,14 +717,12 @@ func (p *treeSitterParser) queryErrors(sourceCode []byte, node *sitter.Node) []e
 
 	errors := make([]error, 0)
 
-	// Execute the import query
-	qc := sitter.NewQueryCursor()
-	defer qc.Close()
-	qc.Exec(ERROR_QUERY, node)
+	// Execute the error query
+	p.queryCursor.Exec(ERROR_QUERY, node)
 
-	// Collect import statements from the query results
+	// Collect errors from the query results
 	for {
-		m, ok := qc.NextMatch()
+		m, ok := p.queryCursor.NextMatch()
 		if !ok {
 			break
 		}
@@ -241,20 +741,40 @@ func (p *treeSitterParser) queryErrors(sourceCode []byte, node *sitter.Node) []e
 
 			// Extract only that line from the parent Node
 			lineI := int(atStart.Row - show.StartPoint().Row)
-			colI := int(atStart.Column)
 			line := strings.Split(show.Content(sourceCode), "\n")[lineI]
 
-			pre := fmt.Sprintf("     %d: ", atStart.Row+1)
-			msg := pre + line
-			arw := strings.Repeat(" ", len(pre)+colI) + "^"
-
-			errors = append(errors, fmt.Errorf(msg+"\n"+arw))
+			errors = append(errors, &ParseError{
+				Row:     atStart.Row + 1,
+				Column:  atStart.Column + 1,
+				Message: "syntax error",
+				Snippet: line,
+			})
 		}
 	}
 
 	return errors
 }
 
+// Whether the import is explicitly anchored at the root of the package hierarchy.
+func isAbsoluteImport(importedSymbol string) bool {
+	return strings.HasPrefix(importedSymbol, "_root_.")
+}
+
+// Scala imports are relative to their enclosing package unless prefixed with _root_, and
+// we have no way of knowing at parse time whether e.g. `import util.Helper` refers to a
+// top-level package `util` or a sub-package of the current package. We make a guess here
+// that imports sharing a root with the file's own package are absolute, and leave the
+// rest to be sorted out at resolve time.
+func isPossiblyRelativeImport(importedSymbol string, pkg string) bool {
+	if pkg == "" || isAbsoluteImport(importedSymbol) {
+		return false
+	}
+
+	importRoot, _, _ := strings.Cut(importedSymbol, ".")
+	packageRoot, _, _ := strings.Cut(pkg, ".")
+	return importRoot != packageRoot
+}
+
 /* NOTE(jacob): This regex is very much a simplification of the Scala grammar, and will
  *		miss symbols or get them wrong! Notably it misses many operator characters. See
  *		https://www.scala-lang.org/files/archive/spec/2.12/01-lexical-syntax.html#identifiers
@@ -264,7 +784,7 @@ func (p *treeSitterParser) queryErrors(sourceCode []byte, node *sitter.Node) []e
  *		defined with no indentation at the start of their line of code.
  */
 var DEFINITION_REGEX = regexp.MustCompile(
-	`^(?:(?:abstract|final)\s+)?(?:class|object|trait|type|val|var)\s+(\w+)\s+.*`,
+	`^(?:(?:abstract|final)\s+)?(?:class|object|trait|type|val|var)\s+(\w+|` + "`[^`]+`" + `)\s+.*`,
 )
 
 func scanForDefinedSymbols(sourceCode []byte) *treeset.Set {
@@ -280,13 +800,22 @@ func scanForDefinedSymbols(sourceCode []byte) *treeset.Set {
 
 		definition := DEFINITION_REGEX.FindStringSubmatch(line)
 		if definition != nil {
-			symbols.Add(definition[1])
+			symbols.Add(unquoteIdentifier(definition[1]))
 		}
 	}
 
 	return symbols
 }
 
+// Records a visit to the given node while walking for symbols, checking that it has not
+// been walked before if deduping is enabled.
+func (p *treeSitterParser) visitNode(node *sitter.Node, sourceCode []byte) {
+	p.stats.RecordNodeVisit()
+	if p.dedupeParsing {
+		p.checkForDoubleParsing(node, sourceCode)
+	}
+}
+
 func (p *treeSitterParser) checkForDoubleParsing(node *sitter.Node, sourceCode []byte) {
 	intID := int(node.ID())
 	if p.seenNodes.Contains(intID) {
@@ -302,28 +831,36 @@ func (p *treeSitterParser) checkForDoubleParsing(node *sitter.Node, sourceCode [
 	}
 }
 
+// Walks node for the symbols it uses and exports, adding them to symbolData. Every symbol
+// found in a walk is accumulated into the same symbolData rather than into a new one per
+// node, as the latter allocates heavily on deep trees.
 func (p *treeSitterParser) recursivelyParseSymbols(
 	node *sitter.Node,
 	sourceCode []byte,
 	namespace *string,
-) *SymbolData {
-	if p.dedupeParsing {
-		p.checkForDoubleParsing(node, sourceCode)
-	}
+	symbolData *SymbolData,
+) {
+	p.visitNode(node, sourceCode)
 
 	nodeType := node.Type()
 
 	if isDefinition(nodeType) {
-		return p.parseDefinition(node, sourceCode, namespace)
+		p.parseDefinition(node, sourceCode, namespace, symbolData)
 
 	} else if nodeType == "val_definition" || nodeType == "var_definition" {
-		return p.parseVariableDefinition(node, sourceCode, namespace)
+		p.parseVariableDefinition(node, sourceCode, namespace, symbolData)
+
+	} else if nodeType == "refinement" || nodeType == "structural_type" {
+		p.parseRefinement(node, sourceCode, symbolData)
 
 	} else if nodeType == "case_clause" ||
 		nodeType == "catch_clause" ||
+		// e.g. `self: com.foo.Logging =>`, which depends on its type. The self name itself
+		// is a bare identifier, so untyped aliases like `self =>` contribute nothing.
+		nodeType == "self_type" ||
 		isCodeBlock(nodeType) ||
 		isImplementationExpression(nodeType) {
-		return p.parseChildren(node, sourceCode, nil)
+		p.parseChildren(node, sourceCode, nil, symbolData)
 
 	} else if nodeType == "ERROR" {
 		if p.debug {
@@ -335,16 +872,36 @@ func (p *treeSitterParser) recursivelyParseSymbols(
 		}
 		// We might end up with some gibberish, but do our best to recover from
 		// tree-sitter parse errors.
-		return p.parseChildren(node, sourceCode, namespace)
+		p.parseChildren(node, sourceCode, namespace, symbolData)
+
+	} else if nodeType == "annotation" {
+		p.parseAnnotation(node, sourceCode, symbolData)
 
 	} else if nodeType == "field_expression" {
-		if usedName, ok := readFieldExpression(node, sourceCode); ok {
-			return SingleNameData(usedName)
+		usedName, ok, err := readFieldExpression(node, sourceCode)
+		if err != nil {
+			p.nodeErrors = append(p.nodeErrors, err)
+		} else if ok {
+			p.addFullyQualifiedName(symbolData, usedName, node)
 		}
 
 	} else if nodeType == "stable_type_identifier" {
-		usedName := readStableTypeIdentifier(node, sourceCode)
-		return SingleNameData(usedName)
+		usedName, err := readStableTypeIdentifier(node, sourceCode)
+		if err != nil {
+			p.nodeErrors = append(p.nodeErrors, err)
+		} else {
+			p.addFullyQualifiedName(symbolData, usedName, node)
+		}
+
+	} else if nodeType == "stable_identifier" {
+		// Those within a stable_type_identifier are read above, so this is a path on its own,
+		// e.g. the stable identifier pattern `case com.foo.Sentinel =>` or the singleton type
+		// `com.foo.Bar.type`.
+		p.addFullyQualifiedName(
+			symbolData,
+			strings.Join(stableIdentifierSegments(node, sourceCode, nil), "."),
+			node,
+		)
 
 	} else if nodeType == "import_declaration" {
 		/* TODO(jacob): Handle inline imports. These are tricky as they can be relative to
@@ -360,7 +917,6 @@ func (p *treeSitterParser) recursivelyParseSymbols(
 		 *    just blindly added `spark.implicits._` to our import set we might be unable to
 		 *    map it to a providing package later on.
 		 */
-		return EmptySymbolData()
 
 	} else if !isSkippable(nodeType) {
 		fmt.Printf(
@@ -371,10 +927,124 @@ func (p *treeSitterParser) recursivelyParseSymbols(
 		if p.debug {
 			fmt.Fprintf(os.Stderr, "Relevant node structure: %+v\n", node)
 		}
-		return EmptySymbolData()
+	}
+}
+
+// Attempt to find the body for this class/object/function/etc definition if it exists.
+// This could be in several different places:
+//  1. A child named "body" on this node (ideal case!)
+//  2. The next sibling node to this one. Sometimes tree-sitter builds the parse tree
+//     in this way instead of nesting the body node as a child. I don't know why.
+//  3. In the case of parse errors, the body for this definition node might actually
+//     be the next sibling of our parent.
+func definitionBody(node *sitter.Node) *sitter.Node {
+	body := node.ChildByFieldName("body")
+	if body == nil {
+		nextNode := node.NextSibling()
+		if nextNode != nil && nextNode.Type() == "block" {
+			body = nextNode
+		} else if nextNode == nil {
+			parentNode := node.Parent()
+			if parentNode.Type() == "ERROR" {
+				parentSibling := parentNode.NextSibling()
+				if parentSibling != nil && parentSibling.Type() == "block" {
+					body = parentSibling
+				}
+			}
+		}
 	}
 
-	return EmptySymbolData()
+	return body
+}
+
+var MAIN_ARGS_TYPE_REGEX = regexp.MustCompile(
+	`^(?:scala\.)?Array\[(?:scala\.|java\.lang\.|Predef\.)?String\]$`,
+)
+
+/* Returns whether the given node is a public object which can be run as a program, i.e.
+ * one which either extends App:
+ *  (object_definition
+ *      name: (identifier)
+ *      extend: (extends_clause type: (type_identifier) ...))
+ * or defines a main method taking the program arguments:
+ *  (object_definition
+ *      name: (identifier)
+ *      body: (template_body
+ *          (function_definition
+ *              name: (identifier)
+ *              parameters: (parameters (parameter type: (generic_type ...))))))
+ */
+func isMainObject(node *sitter.Node, sourceCode []byte) bool {
+	if node.Type() != "object_definition" || nodeHasAccessModifier(node) {
+		return false
+	}
+
+	if extend := node.ChildByFieldName("extend"); extend != nil {
+		for i := 0; i < int(extend.NamedChildCount()); i++ {
+			parentType := extend.NamedChild(i).Content(sourceCode)
+			if parentType == "App" || parentType == "scala.App" {
+				return true
+			}
+		}
+	}
+
+	body := definitionBody(node)
+	if body == nil {
+		return false
+	}
+
+	for i := 0; i < int(body.NamedChildCount()); i++ {
+		child := body.NamedChild(i)
+		if child.Type() != "function_definition" || nodeHasAccessModifier(child) {
+			continue
+		}
+		if name := child.ChildByFieldName("name"); name.Content(sourceCode) != "main" {
+			continue
+		}
+
+		parameters := child.ChildByFieldName("parameters")
+		if parameters == nil || parameters.NamedChildCount() != 1 {
+			continue
+		}
+		parameterType := parameters.NamedChild(0).ChildByFieldName("type")
+		if parameterType == nil {
+			continue
+		}
+
+		typeName := strings.Join(strings.Fields(parameterType.Content(sourceCode)), "")
+		if MAIN_ARGS_TYPE_REGEX.MatchString(typeName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* Returns whether the given node is a public Scala 3 entry point, i.e. a top-level method
+ * annotated with @main, for which the compiler generates a program class named after the
+ * method in the enclosing package:
+ *  (function_definition
+ *      (annotation name: (type_identifier))
+ *      name: (identifier)
+ *      parameters: (parameters ...))
+ */
+func isMainMethod(node *sitter.Node, sourceCode []byte) bool {
+	if node.Type() != "function_definition" || nodeHasAccessModifier(node) {
+		return false
+	}
+
+	for i := 0; i < int(node.NamedChildCount()); i++ {
+		child := node.NamedChild(i)
+		if child.Type() != "annotation" {
+			continue
+		}
+		annotationName := child.ChildByFieldName("name").Content(sourceCode)
+		if annotationName == "main" || annotationName == "scala.main" {
+			return true
+		}
+	}
+
+	return false
 }
 
 /* TODO(jacob): This function does not correctly export object symbols defined in parent
@@ -393,53 +1063,49 @@ func (p *treeSitterParser) parseDefinition(
 	node *sitter.Node,
 	sourceCode []byte,
 	namespace *string,
-) *SymbolData {
+	symbolData *SymbolData,
+) {
 	nodeType := node.Type()
-	symbolData := EmptySymbolData()
 
+	// Some fields may repeat, e.g. the parameter lists of a curried function like
+	// `def f(x: com.foo.Bar)(implicit y: com.foo.Baz)`, so parse every child with the field.
 	maybeParse := func(field string) {
-		fieldNode := node.ChildByFieldName(field)
-		if fieldNode != nil {
-			fieldSymbolData := p.recursivelyParseSymbols(fieldNode, sourceCode, nil)
-			symbolData = symbolData.Union(fieldSymbolData)
-		}
-	}
-
-	// Attempt to find the body for this class/object/function/etc definition if it exists.
-	// This could be in several different places:
-	//   1. A child named "body" on this node (ideal case!)
-	//   2. The next sibling node to this one. Sometimes tree-sitter builds the parse tree
-	//      in this way instead of nesting the body node as a child. I don't know why.
-	//   3. In the case of parse errors, the body for this definition node might actually
-	//      be the next sibling of our parent.
-	body := node.ChildByFieldName("body")
-	if body == nil {
-		nextNode := node.NextSibling()
-		if nextNode != nil && nextNode.Type() == "block" {
-			body = nextNode
-		} else if nextNode == nil {
-			parentNode := node.Parent()
-			if parentNode.Type() == "ERROR" {
-				parentSibling := parentNode.NextSibling()
-				if parentSibling != nil && parentSibling.Type() == "block" {
-					body = parentSibling
-				}
+		for i := 0; i < int(node.ChildCount()); i++ {
+			if node.FieldNameForChild(i) == field {
+				p.recursivelyParseSymbols(node.Child(i), sourceCode, nil, symbolData)
 			}
 		}
 	}
 
+	body := definitionBody(node)
+
 	var newNamespace *string = nil
-	if namespace != nil && !nodeHasAccessModifier(node) {
+	// Enum cases are accessed via the enum's name, like members of its companion object.
+	var enumCaseNamespace *string = nil
+	// Anonymous givens, e.g. `given com.foo.Ordering[Bar] = ...`, have no name to export.
+	name := node.ChildByFieldName("name")
+	if namespace != nil && name != nil && !nodeHasAccessModifier(node) {
 		// NOTE(jacob): For now, just assume any access modifier means this symbol
 		//    is not exported. Note this is particularly untrue for private class
 		//    constructors which use a `def this(...)` as their public interface.
-		name := node.ChildByFieldName("name")
-		symbol := *namespace + name.Content(sourceCode)
-		symbolData.ExportedSymbols.Add(symbol)
+		symbol := *namespace + identifierName(name, sourceCode)
+		if p.isExportedKind(nodeType) {
+			symbolData.ExportedSymbols.Add(symbol)
+		}
+
+		switch nodeType {
+		case "class_definition", "enum_definition", "trait_definition":
+			p.classSymbols.Add(symbol)
+		case "object_definition":
+			p.objectSymbols.Add(symbol)
+		}
 
 		if nodeType == "object_definition" || nodeType == "package_object" {
 			dottedSymbol := symbol + "."
 			newNamespace = &dottedSymbol
+		} else if nodeType == "enum_definition" {
+			dottedSymbol := symbol + "."
+			enumCaseNamespace = &dottedSymbol
 		}
 	}
 
@@ -449,15 +1115,22 @@ func (p *treeSitterParser) parseDefinition(
 			// definitions as sibling nodes rather than nested as the body of their would-be
 			// parent node. Just skip these as they are handled when parsing the definition
 			// node.
-			if child := body.NamedChild(i); child.Type() != "block" {
-				childSymbolData := p.recursivelyParseSymbols(child, sourceCode, newNamespace)
-				symbolData = symbolData.Union(childSymbolData)
+			if child := body.NamedChild(i); child.Type() == "enum_case_definitions" {
+				p.parseEnumCases(child, sourceCode, enumCaseNamespace, symbolData)
+			} else if child.Type() != "block" {
+				p.recursivelyParseSymbols(child, sourceCode, newNamespace, symbolData)
 			}
 		}
+
+		if nodeType == "package_object" && newNamespace != nil {
+			exportUnderEnclosingPackage(symbolData, *namespace, *newNamespace)
+		}
 	}
 
+	p.parseDefinitionAnnotations(node, sourceCode, symbolData)
+
 	switch nodeType {
-	case "class_definition", "trait_definition":
+	case "class_definition", "enum_definition", "trait_definition":
 		maybeParse("class_parameters")
 		maybeParse("derive")
 		maybeParse("extend")
@@ -487,17 +1160,109 @@ func (p *treeSitterParser) parseDefinition(
 		maybeParse("type")
 		maybeParse("type_parameters")
 	}
+}
 
-	return symbolData
+/* Annotations reference real compile dependencies via their type, which may be given
+ * either by a bare name or a fully qualified one, and optionally followed by one or
+ * more argument lists:
+ *  (annotation
+ *      name: (stable_type_identifier (stable_identifier ...) (type_identifier))
+ *      arguments: (arguments ...))
+ */
+func (p *treeSitterParser) parseAnnotation(
+	node *sitter.Node,
+	sourceCode []byte,
+	symbolData *SymbolData,
+) {
+	for i := 0; i < int(node.NamedChildCount()); i++ {
+		childNode := node.NamedChild(i)
+		if node.FieldNameForChild(i) == "name" && childNode.Type() == "stable_type_identifier" {
+			usedName, err := readStableTypeIdentifier(childNode, sourceCode)
+			if err != nil {
+				p.nodeErrors = append(p.nodeErrors, err)
+				continue
+			}
+			p.addFullyQualifiedName(symbolData, usedName, childNode)
+		} else {
+			p.recursivelyParseSymbols(childNode, sourceCode, nil, symbolData)
+		}
+	}
 }
 
-func (p *treeSitterParser) parseVariableDefinition(
+/* Members of a package object are also exported directly under the enclosing package,
+ * e.g. for `val helper` within `package object util` in package com.foo, we export both
+ * com.foo.util.helper and com.foo.helper so imports of either resolve.
+ */
+func exportUnderEnclosingPackage(
+	symbolData *SymbolData,
+	namespace string,
+	objectNamespace string,
+) {
+	for _, value := range symbolData.ExportedSymbols.Values() {
+		symbol := value.(string)
+		if member, ok := strings.CutPrefix(symbol, objectNamespace); ok {
+			symbolData.ExportedSymbols.Add(namespace + member)
+		}
+	}
+}
+
+/* Each case of a Scala 3 enum is exported under the enum's namespace, e.g. Color.Red and
+ * Color.Custom for:
+ *  (enum_case_definitions
+ *      (simple_enum_case name: (identifier))
+ *      (full_enum_case name: (identifier) class_parameters: (class_parameters ...)))
+ * along with any types referenced by parameterized cases or their extends clauses.
+ */
+func (p *treeSitterParser) parseEnumCases(
 	node *sitter.Node,
 	sourceCode []byte,
 	namespace *string,
-) *SymbolData {
-	symbolData := EmptySymbolData()
+	symbolData *SymbolData,
+) {
+	p.visitNode(node, sourceCode)
+
+	p.parseDefinitionAnnotations(node, sourceCode, symbolData)
+	exported := namespace != nil && !nodeHasAccessModifier(node)
+
+	for i := 0; i < int(node.NamedChildCount()); i++ {
+		enumCase := node.NamedChild(i)
+		if enumCase.Type() != "simple_enum_case" && enumCase.Type() != "full_enum_case" {
+			continue
+		}
+
+		for j := 0; j < int(enumCase.NamedChildCount()); j++ {
+			child := enumCase.NamedChild(j)
+			if enumCase.FieldNameForChild(j) == "name" {
+				if exported {
+					symbolData.ExportedSymbols.Add(*namespace + identifierName(child, sourceCode))
+				}
+			} else {
+				p.recursivelyParseSymbols(child, sourceCode, nil, symbolData)
+			}
+		}
+	}
+}
+
+// Parses any annotations attached directly to a definition node, e.g.
+// `@javax.inject.Singleton class Foo @javax.inject.Inject() (bar: Bar)`.
+func (p *treeSitterParser) parseDefinitionAnnotations(
+	node *sitter.Node,
+	sourceCode []byte,
+	symbolData *SymbolData,
+) {
+	for i := 0; i < int(node.NamedChildCount()); i++ {
+		if childNode := node.NamedChild(i); childNode.Type() == "annotation" {
+			p.recursivelyParseSymbols(childNode, sourceCode, nil, symbolData)
+		}
+	}
+}
 
+func (p *treeSitterParser) parseVariableDefinition(
+	node *sitter.Node,
+	sourceCode []byte,
+	namespace *string,
+	symbolData *SymbolData,
+) {
 	// Assume anything marked private/protected/etc is not exported and skip it.
 	if namespace != nil && !nodeHasAccessModifier(node) {
 		pattern := node.ChildByFieldName("pattern")
@@ -505,29 +1270,70 @@ func (p *treeSitterParser) parseVariableDefinition(
 			// TODO(jacob): We could also be binding symbols via pattern case syntax, e.g.
 			//    `val Array(one, two) = Array(1, 2)`. Just ignore this for now.
 		} else {
-			symbolData.ExportedSymbols.Add(*namespace + pattern.Content(sourceCode))
+			symbolData.ExportedSymbols.Add(*namespace + identifierName(pattern, sourceCode))
 		}
 	}
 
+	p.parseDefinitionAnnotations(node, sourceCode, symbolData)
+
+	// e.g. `val x: com.foo.Bar = ...`, which depends on its declared type wherever it is
+	// defined, including in the body of a loop.
+	if typeNode := node.ChildByFieldName("type"); typeNode != nil {
+		p.recursivelyParseSymbols(typeNode, sourceCode, nil, symbolData)
+	}
+
 	valueNode := node.ChildByFieldName("value")
-	valueSymbolData := p.recursivelyParseSymbols(valueNode, sourceCode, nil)
-	return symbolData.Union(valueSymbolData)
+	p.recursivelyParseSymbols(valueNode, sourceCode, nil, symbolData)
+}
+
+// Records a fully qualified name used at node, along with its position if positions are
+// tracked.
+func (p *treeSitterParser) addFullyQualifiedName(
+	symbolData *SymbolData,
+	usedName string,
+	node *sitter.Node,
+) {
+	symbolData.FullyQualifiedNames.Add(usedName)
+	if p.trackPositions {
+		symbolData.addUsagePosition(usedName, nodePosition(node))
+	}
 }
 
 func (p *treeSitterParser) parseChildren(
 	node *sitter.Node,
 	sourceCode []byte,
 	namespace *string,
-) *SymbolData {
-	symbolData := EmptySymbolData()
+	symbolData *SymbolData,
+) {
+	for i := 0; i < int(node.NamedChildCount()); i++ {
+		p.recursivelyParseSymbols(node.NamedChild(i), sourceCode, namespace, symbolData)
+	}
+}
 
+/* Member declarations in refinements and structural types aren't implemented anywhere we
+ * parse, so unlike declarations in traits we need to pick up the types they reference, e.g.
+ * com.foo.Bar in:
+ *  (structural_type
+ *      (function_declaration
+ *          name: (identifier)
+ *          return_type: (stable_type_identifier ...)))
+ */
+func (p *treeSitterParser) parseRefinement(
+	node *sitter.Node,
+	sourceCode []byte,
+	symbolData *SymbolData,
+) {
 	for i := 0; i < int(node.NamedChildCount()); i++ {
 		childNode := node.NamedChild(i)
-		childSymbolData := p.recursivelyParseSymbols(childNode, sourceCode, namespace)
-		symbolData = symbolData.Union(childSymbolData)
-	}
 
-	return symbolData
+		switch childNode.Type() {
+		case "function_declaration", "val_declaration", "var_declaration":
+			p.visitNode(childNode, sourceCode)
+			p.parseChildren(childNode, sourceCode, nil, symbolData)
+		default:
+			p.recursivelyParseSymbols(childNode, sourceCode, nil, symbolData)
+		}
+	}
 }
 
 func isCodeBlock(nodeType string) bool {
@@ -545,6 +1351,25 @@ func isCodeBlock(nodeType string) bool {
 	}
 }
 
+// The user-facing names of the definition node types accepted by isDefinition.
+var DEFINITION_KINDS = map[string]string{
+	"class_definition":     "class",
+	"enum_definition":      "enum",
+	"extension_definition": "extension",
+	"function_definition":  "def",
+	"given_definition":     "given",
+	"object_definition":    "object",
+	"package_object":       "package_object",
+	"trait_definition":     "trait",
+	"type_definition":      "type",
+}
+
+// Returns whether definitions of the given node type should be exported, per exportedKinds.
+// Members of an unexported object are still exported under its name.
+func (p *treeSitterParser) isExportedKind(nodeType string) bool {
+	return p.exportedKinds == nil || p.exportedKinds.Contains(DEFINITION_KINDS[nodeType])
+}
+
 func isDefinition(nodeType string) bool {
 	switch nodeType {
 	case "class_definition",
@@ -567,7 +1392,6 @@ func isImplementationExpression(nodeType string) bool {
 	switch nodeType {
 	case "alternative_pattern",
 		"annotated_type",
-		"annotation",
 		"arguments",
 		"ascription_expression",
 		"assignment_expression",
@@ -613,10 +1437,9 @@ func isImplementationExpression(nodeType string) bool {
 		"prefix_expression",
 		"projected_type",
 		"quote_expression",
-		"refinement",
 		"return_expression",
 		"singleton_type",
-		"structural_type",
+		"splice_expression",
 		"throw_expression",
 		"try_expression",
 		"tuple_expression",
@@ -654,6 +1477,7 @@ func isSkippable(nodeType string) bool {
 		"covariant_type_parameter",
 		"floating_point_literal",
 		"identifier",
+		"inline_modifier",
 		"integer_literal",
 		"literal_type",
 		"modifiers",
@@ -661,8 +1485,6 @@ func isSkippable(nodeType string) bool {
 		"operator_identifier",
 		"repeat_pattern",
 		"repeated_parameter_type",
-		"self_type",
-		"stable_identifier",
 		"string",
 		"type_identifier",
 		"unit",
@@ -690,6 +1512,23 @@ func lineHasAccessModifier(line string) bool {
 	return ACCESS_MODIFIER_REGEX.MatchString(line)
 }
 
+// Returns the name an identifier node refers to, unquoting backtick-quoted identifiers such
+// as `weird name` or `type` so that they match unquoted references to the same name.
+func identifierName(node *sitter.Node, sourceCode []byte) string {
+	return unquoteIdentifier(node.Content(sourceCode))
+}
+
+func unquoteIdentifier(name string) string {
+	if len(name) > 1 && strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") {
+		// Names containing dots keep their quotes, so they remain a single segment of any
+		// qualified name they are part of.
+		if unquoted := name[1 : len(name)-1]; !strings.Contains(unquoted, ".") {
+			return unquoted
+		}
+	}
+	return name
+}
+
 func getLoneChild(node *sitter.Node, childType string) *sitter.Node {
 	for i := 0; i < int(node.NamedChildCount()); i++ {
 		if node.NamedChild(i).Type() == childType {
@@ -700,23 +1539,63 @@ func getLoneChild(node *sitter.Node, childType string) *sitter.Node {
 	return nil
 }
 
-func readStableTypeIdentifier(node *sitter.Node, sourceCode []byte) string {
-	nodeType := node.Type()
-	if nodeType != "stable_type_identifier" {
-		fmt.Fprintf(
-			os.Stderr,
-			"Must be type 'stable_type_identifier': %v - %s\n",
-			nodeType,
-			node.Content(sourceCode),
-		)
-		os.Exit(1)
+// Describes where in its source file the given node starts, for error messages.
+func nodeLocation(node *sitter.Node) string {
+	startPoint := node.StartPoint()
+	return fmt.Sprintf("line %d, column %d", startPoint.Row+1, startPoint.Column+1)
+}
+
+func wrongNodeTypeError(node *sitter.Node, sourceCode []byte, expectedType string) error {
+	if node == nil {
+		return fmt.Errorf("missing node of type '%s'", expectedType)
 	}
 
-	return node.Content(sourceCode)
+	return fmt.Errorf(
+		"%s: must be type '%s': %v - %s",
+		nodeLocation(node),
+		expectedType,
+		node.Type(),
+		node.Content(sourceCode),
+	)
+}
+
+func unexpectedChildError(node *sitter.Node, child *sitter.Node, sourceCode []byte) error {
+	return fmt.Errorf(
+		"%s: unexpected node type '%v' within: %s",
+		nodeLocation(child),
+		child.Type(),
+		node.Content(sourceCode),
+	)
+}
+
+func readStableTypeIdentifier(node *sitter.Node, sourceCode []byte) (string, error) {
+	if node == nil || node.Type() != "stable_type_identifier" {
+		return "", wrongNodeTypeError(node, sourceCode, "stable_type_identifier")
+	}
+
+	// Types may be split across lines or contain comments, e.g. `new com.foo\n  .Bar`, so we
+	// rebuild the name from its path segments rather than using the node's content directly.
+	return strings.Join(stableIdentifierSegments(node, sourceCode, nil), "."), nil
+}
+
+// Appends the path segments of a stable_identifier or stable_type_identifier to segments,
+// skipping any separators and comments in between them.
+func stableIdentifierSegments(node *sitter.Node, sourceCode []byte, segments []string) []string {
+	for c := 0; c < int(node.ChildCount()); c++ {
+		nodeC := node.Child(c)
+		switch nodeC.Type() {
+		case ".", "comment", "block_comment":
+		case "stable_identifier":
+			segments = stableIdentifierSegments(nodeC, sourceCode, segments)
+		default:
+			segments = append(segments, nodeC.Content(sourceCode))
+		}
+	}
+	return segments
 }
 
 /* Returns a fully qualified name if one is found, along with a boolean indicating if
- * that is the case.
+ * that is the case, or an error if the node is not a field expression.
  *
  * Field expressions can contain any manner of child node types, but the ones we
  * care about are nested in reverse and look something like:
@@ -742,16 +1621,9 @@ func readStableTypeIdentifier(node *sitter.Node, sourceCode []byte) string {
  *      )
  *  )
  */
-func readFieldExpression(node *sitter.Node, sourceCode []byte) (string, bool) {
-	nodeType := node.Type()
-	if nodeType != "field_expression" {
-		fmt.Fprintf(
-			os.Stderr,
-			"Must be type 'field_expression': %v - %s\n",
-			nodeType,
-			node.Content(sourceCode),
-		)
-		os.Exit(1)
+func readFieldExpression(node *sitter.Node, sourceCode []byte) (string, bool, error) {
+	if node == nil || node.Type() != "field_expression" {
+		return "", false, wrongNodeTypeError(node, sourceCode, "field_expression")
 	}
 	fieldNode := node.ChildByFieldName("field")
 	name := fieldNode.Content(sourceCode)
@@ -759,8 +1631,8 @@ func readFieldExpression(node *sitter.Node, sourceCode []byte) (string, bool) {
 	childType := child.Type()
 
 	if childType == "field_expression" {
-		namePrefix, ok := readFieldExpression(child, sourceCode)
-		return namePrefix + "." + name, ok
+		namePrefix, ok, err := readFieldExpression(child, sourceCode)
+		return namePrefix + "." + name, ok, err
 
 	} else if childType == "identifier" {
 		id := child.Content(sourceCode)
@@ -768,37 +1640,35 @@ func readFieldExpression(node *sitter.Node, sourceCode []byte) (string, bool) {
 			// Implicits for DSLs such as scala xml or liftweb's inline html confuse
 			// tree-sitter. Most of the time we just handle weird parses gracefully,
 			// but here it can lead to missing identifiers.
-			return "", false
+			return "", false, nil
 		}
 		if id != "_root_" {
-			// We don't support relative imports currently, so everything is globally-
-			// scoped and we want to just ignore the _root_ prefix.
+			// Names used in code are never resolved relative to the file's package, so are
+			// already absolute and we want to just ignore the _root_ prefix.
 			name = id + "." + name
 		}
-		return name, true
+		return name, true, nil
 
 	} else {
 		// TODO(jacob): There _technically_ might still be other field_expression nodes
 		//      in children of this node.
-		return "", false
+		return "", false, nil
 	}
 }
 
-func readPackageIdentifier(node *sitter.Node, sourceCode []byte, ignoreLast bool) string {
-	nodeType := node.Type()
-	if nodeType != "package_identifier" {
-		fmt.Fprintf(
-			os.Stderr,
-			"Must be type 'package_identifier': %v - %s\n",
-			nodeType,
-			node.Content(sourceCode),
-		)
-		os.Exit(1)
+func readPackageIdentifier(
+	node *sitter.Node,
+	sourceCode []byte,
+	ignoreLast bool,
+) (string, error) {
+	if node == nil || node.Type() != "package_identifier" {
+		return "", wrongNodeTypeError(node, sourceCode, "package_identifier")
 	}
 
 	var s strings.Builder
 
-	total := int(node.NamedChildCount())
+	count := int(node.NamedChildCount())
+	total := count
 	if ignoreLast {
 		total = total - 1
 	}
@@ -807,64 +1677,96 @@ func readPackageIdentifier(node *sitter.Node, sourceCode []byte, ignoreLast bool
 		nodeC := node.NamedChild(c)
 		nodeCType := nodeC.Type()
 
+		// An unquoted operator is only expected as the innermost package, e.g.
+		// `package foo.bar.++`, so one anywhere else is reported as a recoverable error
+		// rather than joined into a package name.
+		if nodeCType == "operator_identifier" && c != count-1 {
+			return "", fmt.Errorf(
+				"%s: operator '%s' may only be the last segment of a package identifier: %s",
+				nodeLocation(nodeC),
+				nodeC.Content(sourceCode),
+				node.Content(sourceCode),
+			)
+		}
+
 		if nodeCType == "identifier" || nodeCType == "operator_identifier" {
 			if s.Len() > 0 {
 				s.WriteString(".")
 			}
-			s.WriteString(nodeC.Content(sourceCode))
+			s.WriteString(identifierName(nodeC, sourceCode))
 		} else {
-			fmt.Fprintf(
-				os.Stderr,
-				"Unexpected node type '%v' within: %s\n",
-				nodeCType,
-				node.Content(sourceCode),
-			)
-			os.Exit(1)
+			return "", unexpectedChildError(node, nodeC, sourceCode)
 		}
 	}
 
-	return s.String()
+	return s.String(), nil
 }
 
-func readNamespaceSelectors(node *sitter.Node, sourceCode []byte) *treeset.Set {
-	nodeType := node.Type()
-	if nodeType != "namespace_selectors" {
-		fmt.Fprintf(
-			os.Stderr,
-			"Must be type 'package_identifier': %v - %s\n",
-			nodeType,
-			node.Content(sourceCode),
-		)
-		os.Exit(1)
+// Returns whether the given node type renames an import, either with the arrow form
+// `Bar => Baz` or the Scala 3 `Bar as Baz`.
+func isRenamedIdentifier(nodeType string) bool {
+	return nodeType == "arrow_renamed_identifier" || nodeType == "as_renamed_identifier"
+}
+
+// Reads a renamed import, returning the original name along with the alias it is renamed to.
+// Hiding imports, e.g. `import foo.{Bar => _, _}` or `import foo.{Bar as _, *}`, don't
+// introduce an alias.
+func readRenamedIdentifier(node *sitter.Node, sourceCode []byte) (string, string, bool) {
+	name := identifierName(node.ChildByFieldName("name"), sourceCode)
+	alias := node.ChildByFieldName("alias")
+	if alias == nil || alias.Type() == "wildcard" {
+		return name, "", false
+	}
+	return name, identifierName(alias, sourceCode), true
+}
+
+// Reads the selectors of a braced import, returning the imported names along with a
+// mapping from any aliases they are renamed to back to their original names. Renamed
+// selectors may share a group with a wildcard, e.g. `import a.b.{C => D, _}`, in which case
+// both the renamed name and the wildcard are imported.
+func readNamespaceSelectors(
+	node *sitter.Node,
+	sourceCode []byte,
+) (*treeset.Set, map[string]string, error) {
+	if node == nil || node.Type() != "namespace_selectors" {
+		return nil, nil, wrongNodeTypeError(node, sourceCode, "namespace_selectors")
 	}
 
 	imports := treeset.NewWithStringComparator()
+	aliases := make(map[string]string)
 
 	for c := 0; c < int(node.NamedChildCount()); c++ {
 		nodeC := node.NamedChild(c)
 		nodeCType := nodeC.Type()
 
 		if nodeCType == "identifier" || nodeCType == "operator_identifier" {
-			imports.Add(nodeC.Content(sourceCode))
+			imports.Add(identifierName(nodeC, sourceCode))
 
 		} else if nodeCType == "namespace_wildcard" {
+			// Also covers bare Scala 3 given selectors, e.g. `import foo.{given, *}`.
 			imports.Add("_")
 
-		} else if nodeCType == "arrow_renamed_identifier" {
-			imports.Add(nodeC.ChildByFieldName("name").Content(sourceCode))
+		} else if nodeCType == "type_identifier" ||
+			nodeCType == "stable_type_identifier" ||
+			nodeCType == "generic_type" {
+			// Scala 3 given selectors by type, e.g. `import foo.{given Ordering[?]}`, import
+			// the given instances of that type from the package. We can't know which
+			// definitions those are, so treat them as a wildcard import.
+			imports.Add("_")
 
-		} else {
-			fmt.Fprintf(
-				os.Stderr,
-				"Unexpected node type '%v' within: %s\n",
-				nodeCType,
-				node.Content(sourceCode),
-			)
-			os.Exit(1)
+		} else if isRenamedIdentifier(nodeCType) {
+			name, alias, hasAlias := readRenamedIdentifier(nodeC, sourceCode)
+			imports.Add(name)
+			if hasAlias {
+				aliases[alias] = name
+			}
+
+		} else if nodeCType != "comment" && nodeCType != "block_comment" {
+			return nil, nil, unexpectedChildError(node, nodeC, sourceCode)
 		}
 	}
 
-	return imports
+	return imports, aliases, nil
 }
 
 /* imports look something like:
@@ -888,61 +1790,97 @@ func readNamespaceSelectors(node *sitter.Node, sourceCode []byte) *treeset.Set {
  * 		)
  * 	)
  */
-func readImportDeclaration(node *sitter.Node, sourceCode []byte) *treeset.Set {
-	nodeType := node.Type()
-	if nodeType != "import_declaration" {
-		fmt.Fprintf(
-			os.Stderr,
-			"Must be type 'identifier': %v - %s\n",
-			nodeType,
-			node.Content(sourceCode),
-		)
-		os.Exit(1)
+func readImportDeclaration(
+	node *sitter.Node,
+	sourceCode []byte,
+) (*treeset.Set, map[string]string, error) {
+	if node == nil || node.Type() != "import_declaration" {
+		return nil, nil, wrongNodeTypeError(node, sourceCode, "import_declaration")
 	}
 
 	var importBuilder strings.Builder
 	imports := treeset.NewWithStringComparator()
+	aliases := make(map[string]string)
+
+	// A single declaration may contain several comma-separated import clauses, e.g.
+	// `import a.b.{C, D}, x.y.Z`, which tree-sitter flattens into one list of children.
+	clauseDone := false
+	finishClause := func() {
+		// Single symbol imports without wildcards or braces are only complete here.
+		if !clauseDone && importBuilder.Len() > 0 {
+			imports.Add(importBuilder.String())
+		}
+		importBuilder.Reset()
+		clauseDone = false
+	}
 
-	for c := 0; c < int(node.NamedChildCount()); c++ {
-		nodeC := node.NamedChild(c)
+	for c := 0; c < int(node.ChildCount()); c++ {
+		nodeC := node.Child(c)
 		nodeCType := nodeC.Type()
 
-		if nodeCType == "identifier" || nodeCType == "operator_identifier" {
+		if !nodeC.IsNamed() {
+			if nodeCType == "," {
+				finishClause()
+			}
+
+		} else if nodeCType == "identifier" || nodeCType == "operator_identifier" {
+			segment := nodeC.Content(sourceCode)
+
+			// 'type' is a keyword, so as a path segment it can only be a singleton type
+			// reference, e.g. 'import foo.bar.Baz.type'. What we want to resolve is the
+			// singleton itself. A member actually named type would have to be backquoted.
+			if segment == "type" {
+				continue
+			}
+			segment = unquoteIdentifier(segment)
+
 			if importBuilder.Len() > 0 {
 				importBuilder.WriteString(".")
 			}
-			importBuilder.WriteString(nodeC.Content(sourceCode))
+			importBuilder.WriteString(segment)
 
 		} else if nodeCType == "namespace_selectors" {
 			importBuilder.WriteString(".")
 			importPackage := importBuilder.String()
 
-			symbols := readNamespaceSelectors(nodeC, sourceCode)
+			symbols, selectorAliases, err := readNamespaceSelectors(nodeC, sourceCode)
+			if err != nil {
+				return nil, nil, err
+			}
 			it := symbols.Iterator()
 			for it.Next() {
 				symbol := it.Value()
 				imports.Add(importPackage + symbol.(string))
 			}
-
-			return imports
+			for alias, name := range selectorAliases {
+				aliases[alias] = importPackage + name
+			}
+			clauseDone = true
 
 		} else if nodeCType == "namespace_wildcard" {
 			importBuilder.WriteString("._")
 			imports.Add(importBuilder.String())
-			return imports
+			clauseDone = true
+
+		} else if isRenamedIdentifier(nodeCType) {
+			// e.g. the Scala 3 `import com.foo.Bar as Baz`, where the renamed name is a child
+			// of the declaration itself rather than of a namespace_selectors node.
+			name, alias, hasAlias := readRenamedIdentifier(nodeC, sourceCode)
+			importedSymbol := name
+			if importBuilder.Len() > 0 {
+				importedSymbol = importBuilder.String() + "." + name
+			}
+			imports.Add(importedSymbol)
+			if hasAlias {
+				aliases[alias] = importedSymbol
+			}
+			clauseDone = true
 
 		} else if nodeCType != "comment" && nodeCType != "block_comment" {
-			fmt.Fprintf(
-				os.Stderr,
-				"Unexpected node type '%v' within: %s\n",
-				nodeCType,
-				node.Content(sourceCode),
-			)
-			os.Exit(1)
+			return nil, nil, unexpectedChildError(node, nodeC, sourceCode)
 		}
 	}
 
-	// Single symbol imports without wildcards or braces will fall through here.
-	imports.Add(importBuilder.String())
-	return imports
+	finishClause()
+	return imports, aliases, nil
 }
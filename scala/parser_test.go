@@ -1,32 +1,41 @@
 package scala
 
 import (
+	"archive/zip"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/emirpasic/gods/sets/treeset"
+	sitter "github.com/smacker/go-tree-sitter"
 	"github.com/stretchr/testify/require"
 
 	"github.com/foursquare/scala-gazelle/parse"
 )
 
-func TestParserIntegration(t *testing.T) {
-	parser := parse.NewUncachedParser[ParseResult](NewParser(false, false, false))
+// The files under testdata/parser_integration, without their extensions.
+var parserIntegrationFiles = []string{
+	filepath.Join("fsqio", "Lists"),
+	filepath.Join("fsqio", "Query"),
+	filepath.Join("fsqio", "TrivialORMQueryTest"),
+	filepath.Join("scalac", "Global"),
+	filepath.Join("scalac", "Implicits"),
+	filepath.Join("scalac", "Namers"),
+	filepath.Join("scripts", "Shebang"),
+	filepath.Join("spark", "AgnosticEncoder"),
+	filepath.Join("spark", "GeneralizedLinearRegression"),
+	filepath.Join("spark", "SparkSession"),
+}
 
-	testFiles := []string{
-		filepath.Join("fsqio", "Lists"),
-		filepath.Join("fsqio", "Query"),
-		filepath.Join("fsqio", "TrivialORMQueryTest"),
-		filepath.Join("scalac", "Global"),
-		filepath.Join("scalac", "Implicits"),
-		filepath.Join("scalac", "Namers"),
-		filepath.Join("spark", "AgnosticEncoder"),
-		filepath.Join("spark", "GeneralizedLinearRegression"),
-		filepath.Join("spark", "SparkSession"),
-	}
+func TestParserIntegration(t *testing.T) {
+	parser := parse.NewUncachedParser[ParseResult](NewParser(ParserOptions{}))
 
-	for _, file := range testFiles {
+	for _, file := range parserIntegrationFiles {
 		t.Run("parser integration test with "+file, func(t *testing.T) {
 			noExtPath := filepath.Join("testdata", "parser_integration", file)
 			parseResult, errs := parser.ParseFile(noExtPath + ".scala")
@@ -38,7 +47,7 @@ func TestParserIntegration(t *testing.T) {
 				t.Fail()
 			}
 
-			actualJsonBytes, err := json.Marshal(parseResult)
+			actualJsonBytes, err := json.Marshal(NewVersionedParseResult(parseResult))
 			if err != nil {
 				t.Error(err)
 			}
@@ -54,3 +63,1365 @@ func TestParserIntegration(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkParser(b *testing.B) {
+	for _, file := range parserIntegrationFiles {
+		path := filepath.Join("testdata", "parser_integration", file+".scala")
+		sourceCode, err := os.ReadFile(path)
+		require.NoError(b, err)
+
+		b.Run(file, func(b *testing.B) {
+			parser := NewParser(ParserOptions{})
+			b.ReportAllocs()
+			b.SetBytes(int64(len(sourceCode)))
+			for i := 0; i < b.N; i++ {
+				if _, errs := parser.Parse(path, string(sourceCode)); len(errs) != 0 {
+					b.Fatal(errs)
+				}
+			}
+		})
+	}
+}
+
+func TestParserSrcjarMultiPackageEntry(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+
+	srcjarPath := filepath.Join(t.TempDir(), "generated.srcjar")
+	srcjarFile, err := os.Create(srcjarPath)
+	require.NoError(t, err)
+
+	srcjarWriter := zip.NewWriter(srcjarFile)
+	entryWriter, err := srcjarWriter.Create("com/example/Generated.scala")
+	require.NoError(t, err)
+	_, err = entryWriter.Write([]byte(`package com.example
+
+package a {
+  object A
+}
+
+package b {
+  class B
+  trait C
+}
+`))
+	require.NoError(t, err)
+	require.NoError(t, srcjarWriter.Close())
+	require.NoError(t, srcjarFile.Close())
+
+	srcjarReader, err := zip.OpenReader(srcjarPath)
+	require.NoError(t, err)
+	defer srcjarReader.Close()
+	require.Len(t, srcjarReader.File, 1)
+
+	srcFile := srcjarReader.File[0]
+	reader, err := srcFile.Open()
+	require.NoError(t, err)
+	defer reader.Close()
+
+	srcFileBytes, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+
+	srcPath := fmt.Sprintf("%s!%s", srcjarPath, srcFile.Name)
+	parseResult, errs := parser.Parse(srcPath, string(srcFileBytes))
+	require.Empty(t, errs)
+
+	require.Equal(t, srcPath, parseResult.File)
+	require.Equal(t, "com.example", parseResult.Package)
+	require.Equal(
+		t,
+		[]interface{}{"com.example", "com.example.a", "com.example.b"},
+		parseResult.Packages.Values(),
+	)
+	require.Equal(
+		t,
+		[]interface{}{"com.example.a.A", "com.example.b.B", "com.example.b.C"},
+		parseResult.QualifiedExportedSymbols().Values(),
+	)
+}
+
+func TestParserTracksImportPositions(t *testing.T) {
+	source := `package com.example
+
+import com.example.util.Helper
+import com.example.other.{First, Second}
+`
+
+	untrackedResult, errs := NewParser(ParserOptions{}).Parse("Example.scala", source)
+	require.Empty(t, errs)
+	require.Nil(t, untrackedResult.ImportPositions)
+
+	parseResult, errs := NewParser(ParserOptions{TrackPositions: true}).Parse("Example.scala", source)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		map[string][]SourcePosition{
+			"com.example.util.Helper":  {{Line: 3, Column: 1, Offset: 21}},
+			"com.example.other.First":  {{Line: 4, Column: 1, Offset: 52}},
+			"com.example.other.Second": {{Line: 4, Column: 1, Offset: 52}},
+		},
+		parseResult.ImportPositions,
+	)
+
+	// Positions should survive a round trip through the parsing cache.
+	cacheBytes, err := json.Marshal(map[string]*ParseResult{"hash": parseResult})
+	require.NoError(t, err)
+
+	var interfaceMap map[string]interface{}
+	require.NoError(t, json.Unmarshal(cacheBytes, &interfaceMap))
+
+	cacheMap := make(map[string]*ParseResult)
+	(&treeSitterParser{}).UnmarshalParsingCache(&cacheMap, &interfaceMap)
+	require.Equal(t, parseResult.ImportPositions, cacheMap["hash"].ImportPositions)
+}
+
+func TestParserTracksUsagePositions(t *testing.T) {
+	source := `package com.example
+
+import com.example.util.{Helper => H}
+
+class Example(widget: com.foo.Widget) {
+  def run(): Unit = {
+    com.foo.Runner.run(widget)
+    H.help()
+  }
+}
+`
+
+	untrackedResult, errs := NewParser(ParserOptions{}).Parse("Example.scala", source)
+	require.Empty(t, errs)
+	require.Nil(t, untrackedResult.UsagePositions)
+
+	// Usages through a renamed import are recorded under the symbol they refer to.
+	parseResult, errs := NewParser(ParserOptions{TrackPositions: true}).Parse("Example.scala", source)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		map[string][]SourcePosition{
+			"com.foo.Widget":               {{Line: 5, Column: 23, Offset: 82}},
+			"com.foo.Runner.run":           {{Line: 7, Column: 5, Offset: 126}},
+			"com.example.util.Helper.help": {{Line: 8, Column: 5, Offset: 157}},
+		},
+		parseResult.UsagePositions,
+	)
+
+	cacheBytes, err := json.Marshal(map[string]*ParseResult{"hash": parseResult})
+	require.NoError(t, err)
+
+	var interfaceMap map[string]interface{}
+	require.NoError(t, json.Unmarshal(cacheBytes, &interfaceMap))
+
+	cacheMap := make(map[string]*ParseResult)
+	(&treeSitterParser{}).UnmarshalParsingCache(&cacheMap, &interfaceMap)
+	require.Equal(t, parseResult.UsagePositions, cacheMap["hash"].UsagePositions)
+
+	// Both usages and imports are reported as the sources of the symbols they use.
+	usedSymbols := UsedSymbolsForParseResult(parseResult, false)
+	require.Equal(
+		t,
+		[]interface{}{"Example.scala:7"},
+		usedSymbols.Sources["com.foo.Runner.run"].Values(),
+	)
+	require.Equal(
+		t,
+		[]interface{}{"Example.scala:3"},
+		usedSymbols.Sources["com.example.util.Helper"].Values(),
+	)
+}
+
+func TestParserCacheFingerprint(t *testing.T) {
+	require.Equal(t, "", NewParser(ParserOptions{}).CacheFingerprint())
+	require.Equal(
+		t,
+		"",
+		NewParser(ParserOptions{ExportedKinds: allDefinitionKinds()}).CacheFingerprint(),
+	)
+	require.Equal(
+		t,
+		"exported_kinds=class,object;track_positions",
+		NewParser(
+			ParserOptions{
+				TrackPositions: true,
+				ExportedKinds:  treeset.NewWithStringComparator("object", "class"),
+			},
+		).CacheFingerprint(),
+	)
+}
+
+func TestParserHandlesShebangs(t *testing.T) {
+	// The tree-sitter grammar recognizes a leading shebang line itself, so scripts parse
+	// cleanly and positions are reported relative to the original source, shebang included.
+	parseResult, errs := NewParser(ParserOptions{TrackPositions: true}).Parse("Script.scala", `#!/usr/bin/env scala
+package com.example
+
+import com.example.util.Helper
+
+object Script extends App
+`)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasErrors)
+	require.Equal(t, "com.example", parseResult.Package)
+	require.True(t, parseResult.ExportedSymbols.Contains("Script"))
+	require.Equal(
+		t,
+		map[string][]SourcePosition{
+			"com.example.util.Helper": {{Line: 4, Column: 1, Offset: 42}},
+		},
+		parseResult.ImportPositions,
+	)
+}
+
+func TestParserStripsSingletonTypeImports(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Singleton.scala", `package com.example
+
+import foo.bar.baz.type
+import foo.bar.Qux.type._
+import foo.bar.`+"`type`"+`
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{"foo.bar.Qux._", "foo.bar.baz", "foo.bar.type"},
+		parseResult.Imports.Values(),
+	)
+}
+
+func TestParserFindsMainObjects(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Main.scala", `package com.example
+
+object Script extends App {
+  println("hi")
+}
+
+object Tool {
+  def main(args: Array[String]): Unit = ()
+}
+
+object Nested {
+  object Inner extends App
+}
+
+object NotMain {
+  def main(): Unit = ()
+}
+
+private object Hidden extends scala.App
+
+package sub {
+  object SubTool extends scala.App
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{"Script", "Tool", "sub.SubTool"},
+		parseResult.MainObjects.Values(),
+	)
+	require.Equal(
+		t,
+		[]interface{}{"com.example.Script", "com.example.Tool", "com.example.sub.SubTool"},
+		parseResult.QualifiedMainObjects().Values(),
+	)
+
+	libraryResult, errs := NewParser(ParserOptions{}).Parse("Lib.scala", `package com.example
+
+object Lib {
+  def run(args: Array[String]): Unit = ()
+}
+`)
+	require.Empty(t, errs)
+	require.True(t, libraryResult.MainObjects.Empty())
+}
+
+func TestParserFindsScala3MainMethods(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Main.scala", `package com.example
+
+@main def run(): Unit = ()
+
+@main
+def greet(names: String*): Unit = ()
+
+@scala.main def qualified(): Unit = ()
+
+@deprecated def notMain(): Unit = ()
+
+@main private def hidden(): Unit = ()
+
+package sub {
+  @main def subRun(): Unit = ()
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{"greet", "qualified", "run", "sub.subRun"},
+		parseResult.MainObjects.Values(),
+	)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.example.greet",
+			"com.example.qualified",
+			"com.example.run",
+			"com.example.sub.subRun",
+		},
+		parseResult.QualifiedMainObjects().Values(),
+	)
+}
+
+func TestParserPackageClauses(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+
+	dottedResult, errs := parser.Parse("Dotted.scala", `package com
+package example
+
+object Bar
+`)
+	require.Empty(t, errs)
+	require.Equal(t, "com.example", dottedResult.Package)
+	require.Equal(t, []interface{}{"com.example"}, dottedResult.Packages.Values())
+	require.Equal(
+		t,
+		[]interface{}{"com.example.Bar"},
+		dottedResult.QualifiedExportedSymbols().Values(),
+	)
+
+	bracedResult, errs := parser.Parse("Braced.scala", `package com
+package example
+
+package object util {
+  def helper = 1
+}
+
+package foo {
+  import com.example.util.helper
+
+  object Bar
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(t, "com.example", bracedResult.Package)
+	require.Equal(
+		t,
+		[]interface{}{"com.example", "com.example.foo", "com.example.util"},
+		bracedResult.Packages.Values(),
+	)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.example.foo.Bar",
+			"com.example.helper",
+			"com.example.util",
+			"com.example.util.helper",
+		},
+		bracedResult.QualifiedExportedSymbols().Values(),
+	)
+	require.Equal(t, []interface{}{"com.example.util.helper"}, bracedResult.Imports.Values())
+
+	// Braced package declarations also work without any enclosing package.
+	unpackagedResult, errs := parser.Parse("Unpackaged.scala", `package foo {
+  object Bar
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(t, "", unpackagedResult.Package)
+	require.Equal(t, []interface{}{"foo"}, unpackagedResult.Packages.Values())
+	require.Equal(t, []interface{}{"foo.Bar"}, unpackagedResult.QualifiedExportedSymbols().Values())
+}
+
+func TestParserListedSymbols(t *testing.T) {
+	parser := parse.NewUncachedParser[ParseResult](NewParser(ParserOptions{}))
+
+	noExtPath := filepath.Join("testdata", "parser_integration", "fsqio", "Lists")
+	parseResult, errs := parser.ParseFile(noExtPath + ".scala")
+	require.Empty(t, errs)
+
+	expectedJsonBytes, err := ioutil.ReadFile(noExtPath + ".json")
+	require.NoError(t, err)
+
+	var expected struct {
+		Package             string   `json:"package"`
+		Imports             []string `json:"imports"`
+		FullyQualifiedNames []string `json:"fully_qualified_names"`
+		Symbols             []string `json:"symbols"`
+	}
+	require.NoError(t, json.Unmarshal(expectedJsonBytes, &expected))
+
+	expectedExported := make([]interface{}, 0, len(expected.Symbols))
+	for _, symbol := range expected.Symbols {
+		expectedExported = append(expectedExported, expected.Package+"."+symbol)
+	}
+	require.Equal(t, expectedExported, parseResult.QualifiedExportedSymbols().Values())
+
+	expectedUsed := treeset.NewWithStringComparator()
+	for _, symbol := range append(expected.Imports, expected.FullyQualifiedNames...) {
+		expectedUsed.Add(symbol)
+	}
+	require.Equal(t, expectedUsed.Values(), parseResult.UsedSymbols().Values())
+}
+
+func TestParserAnnotations(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+
+	parseResult, errs := parser.Parse("Annotated.scala", `package com.example
+
+@javax.inject.Singleton
+class Service @javax.inject.Inject() (dep: Dependency) {
+  @com.foo.Cacheable(ttl = 5)
+  def cached: Int = 1
+
+  @com.foo.Lazy val lazyValue = 2
+
+  @Deprecated
+  def bare: Int = 3
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Cacheable",
+			"com.foo.Lazy",
+			"javax.inject.Inject",
+			"javax.inject.Singleton",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserAnnotationArguments(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Arguments.scala", `package com.example
+
+class Widget(
+  @JsonProperty(com.foo.Constants.NAME) val name: String,
+  @Named(value = com.foo.Keys.Key) key: String
+) {
+  @com.bar.Annot(com.baz.Limits.Max, names = Array(com.qux.Names.First))
+  def f(): Unit = ()
+}
+
+@SuppressWarnings(Array(com.foo.Warnings.All))
+object Thing
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.bar.Annot",
+			"com.baz.Limits.Max",
+			"com.foo.Constants.NAME",
+			"com.foo.Keys.Key",
+			"com.foo.Warnings.All",
+			"com.qux.Names.First",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserLoopTypeReferences(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Loops.scala", `package com.example
+
+object Loops {
+  val top: com.foo.Top = null
+
+  def run(xs: List[Any], pairs: List[(Any, Any)]): Unit = {
+    for (x: com.foo.T <- xs) println(x)
+    for {
+      (a: com.bar.A, b) <- pairs
+      c: com.baz.C = a
+      if com.baz.Filter.accepts(c)
+    } yield c
+    while (cond) { val w: com.qux.While = null }
+    do { var d: com.qux.DoWhile = null } while (cond)
+  }
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.bar.A",
+			"com.baz.C",
+			"com.baz.Filter.accepts",
+			"com.foo.T",
+			"com.foo.Top",
+			"com.qux.DoWhile",
+			"com.qux.While",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserGivenImportSelectors(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Given.scala", `package com.example
+
+import com.example.bare.{given, *}
+import com.example.bareonly.{given}
+import com.example.typed.{given Ordering[?], Helper}
+import com.example.simple.{given Int}
+import com.example.qualified.{given scala.math.Ordering[Int]}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.example.bare._",
+			"com.example.bareonly._",
+			"com.example.qualified._",
+			"com.example.simple._",
+			"com.example.typed.Helper",
+			"com.example.typed._",
+		},
+		parseResult.Imports.Values(),
+	)
+}
+
+func TestParserEnumCases(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{DedupeParsing: true}).Parse("Enums.scala", `package com.example
+
+enum Color {
+  case Red, Green
+  case Custom(rgb: com.foo.Rgb)
+}
+
+enum Planet(mass: Double) extends java.lang.Enum[Planet]:
+  case Earth extends Planet(5.9)
+  def heavy: Boolean = mass > 1
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.example.Color",
+			"com.example.Color.Custom",
+			"com.example.Color.Green",
+			"com.example.Color.Red",
+			"com.example.Planet",
+			"com.example.Planet.Earth",
+		},
+		parseResult.QualifiedExportedSymbols().Values(),
+	)
+	require.Equal(
+		t,
+		[]interface{}{"com.foo.Rgb", "java.lang.Enum"},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserMultiClauseImports(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Multi.scala", `package com.example
+
+import com.foo.{Bar, Baz}, com.qux.Quux, com.wild._
+import scala.collection.mutable, mutable.ListBuffer
+
+object Multi
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Bar",
+			"com.foo.Baz",
+			"com.qux.Quux",
+			"com.wild._",
+			"mutable.ListBuffer",
+			"scala.collection.mutable",
+		},
+		parseResult.Imports.Values(),
+	)
+}
+
+func TestParserImportsWithComments(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Comments.scala", `package com.example
+
+import a.b.C // keep
+import a.b /* between */ .D
+import a.b.{E, /* selector */ F} // keep
+import a.b.{G /* renamed */ => H}
+import a.b.{
+  I, // first
+  J  // second
+}
+import a
+  // interleaved
+  .b.K
+
+object Comments
+`)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasErrors)
+	require.Equal(
+		t,
+		[]interface{}{"a.b.C", "a.b.D", "a.b.E", "a.b.F", "a.b.G", "a.b.I", "a.b.J", "a.b.K"},
+		parseResult.Imports.Values(),
+	)
+	require.Equal(t, map[string]string{"H": "a.b.G"}, parseResult.ImportAliases)
+}
+
+func TestParserRenamedImportAliases(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Renamed.scala", `package com.example
+
+import com.twitter.util.{Await, TimeoutException => TUTimeoutException, Hidden => _, _}
+
+object Renamed {
+  def timeout = TUTimeoutException.apply("timed out")
+  def check(e: Throwable) = e match {
+    case _: TUTimeoutException => true
+  }
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		map[string]string{"TUTimeoutException": "com.twitter.util.TimeoutException"},
+		parseResult.ImportAliases,
+	)
+	require.Equal(
+		t,
+		[]interface{}{"com.twitter.util.TimeoutException.apply"},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserBacktickIdentifiers(t *testing.T) {
+	sourceCode := `package com.example
+
+import com.foo.` + "`type`" + `
+import com.foo.{` + "`match` => Mtch, `weird name`" + `}
+import com.` + "`foo bar`" + `.Baz
+import com.` + "`dotted.name`" + `.Qux
+
+object ` + "`weird obj`" + ` {
+  val ` + "`weird name`" + ` = Mtch
+}
+
+class ` + "`Plain`" + ` extends Baz
+`
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Backticks.scala", sourceCode)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.`dotted.name`.Qux",
+			"com.foo bar.Baz",
+			"com.foo.match",
+			"com.foo.type",
+			"com.foo.weird name",
+		},
+		parseResult.Imports.Values(),
+	)
+	require.Equal(t, map[string]string{"Mtch": "com.foo.match"}, parseResult.ImportAliases)
+	require.Equal(
+		t,
+		[]interface{}{"com.example.Plain", "com.example.weird obj", "com.example.weird obj.weird name"},
+		parseResult.QualifiedExportedSymbols().Values(),
+	)
+
+	require.Equal(
+		t,
+		[]interface{}{"Plain", "weird obj"},
+		scanForDefinedSymbols([]byte(sourceCode)).Values(),
+	)
+}
+
+func TestParserDetectsMacros(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+	for name, sourceCode := range map[string]string{
+		"Scala2Macro.scala": `package com.example
+
+object Scala2Macro {
+  def assert(cond: Boolean): Unit = macro Impl.assert
+}
+`,
+		"Scala3Splice.scala": `package com.example
+
+object Scala3Splice {
+  inline def assert(inline cond: Boolean): Unit = ${ Impl.assertImpl('cond) }
+}
+`,
+		"Scala3Quote.scala": `package com.example
+
+object Impl {
+  def one(using Quotes): Expr[Int] = '{ 1 }
+}
+`,
+	} {
+		parseResult, errs := parser.Parse(name, sourceCode)
+		require.Empty(t, errs, name)
+		require.True(t, parseResult.HasMacro, name)
+	}
+
+	parseResult, errs := parser.Parse("Plain.scala", `package com.example
+
+object Plain {
+  inline def twice(x: Int): Int = x * 2
+  val macro_ = "not a macro"
+}
+`)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasMacro)
+}
+
+func TestParserAsRenamedImports(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("AsRenamed.scala", `package com.example
+
+import com.twitter.util.Duration as TDuration
+import com.twitter.util.{TimeoutException as TUTimeoutException, Await, Hidden as _, *}, com.foo.Bar as Baz
+
+object AsRenamed {
+  def timeout = TUTimeoutException.apply("timed out")
+  def duration: TDuration = Baz.make(TDuration.Top)
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Bar",
+			"com.twitter.util.Await",
+			"com.twitter.util.Duration",
+			"com.twitter.util.Hidden",
+			"com.twitter.util.TimeoutException",
+			"com.twitter.util._",
+		},
+		parseResult.Imports.Values(),
+	)
+	require.Equal(
+		t,
+		map[string]string{
+			"Baz":                "com.foo.Bar",
+			"TDuration":          "com.twitter.util.Duration",
+			"TUTimeoutException": "com.twitter.util.TimeoutException",
+		},
+		parseResult.ImportAliases,
+	)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Bar.make",
+			"com.twitter.util.Duration.Top",
+			"com.twitter.util.TimeoutException.apply",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserAbsoluteImports(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Absolute.scala", `package com.example
+
+import _root_.util.Helper
+import util.Other
+import com.example.sibling.Thing
+
+object Absolute {
+  def help = _root_.util.Helper.help(Other, Thing)
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{"_root_.util.Helper", "com.example.sibling.Thing", "util.Other"},
+		parseResult.Imports.Values(),
+	)
+	require.Equal(t, []interface{}{"_root_.util.Helper"}, parseResult.AbsoluteImports.Values())
+	require.Equal(t, []interface{}{"util.Other"}, parseResult.RelativeImports.Values())
+	require.Equal(t, []interface{}{"util.Helper.help"}, parseResult.FullyQualifiedNames.Values())
+
+	usedSymbols := UsedSymbolsForParseResult(parseResult, false)
+	require.Equal(t, []interface{}{"_root_.util.Helper"}, usedSymbols.AbsoluteSymbols.Values())
+	require.Contains(t, usedSymbols.RelativeSymbols, "util.Other")
+	require.NotContains(t, usedSymbols.RelativeSymbols, "_root_.util.Helper")
+}
+
+func TestParserRenamedWildcardSelectors(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("RenamedWildcard.scala", `package com.example
+
+import a.b.{C => D, _}
+import a.c.{E as F, *}
+import a.d.{G => _, _}
+
+object RenamedWildcard {
+  def d: D = new D
+  def f: F = new F
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"a.b.C",
+			"a.b._",
+			"a.c.E",
+			"a.c._",
+			"a.d.G",
+			"a.d._",
+		},
+		parseResult.Imports.Values(),
+	)
+	require.Equal(
+		t,
+		map[string]string{
+			"D": "a.b.C",
+			"F": "a.c.E",
+		},
+		parseResult.ImportAliases,
+	)
+}
+
+func TestParserSignatureTypes(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Signatures.scala", `package com.example
+
+class Service(client: com.foo.Client)(implicit ec: com.foo.ExecutionContext) {
+  def get(key: com.foo.Key)(implicit timeout: com.foo.Timeout): com.foo.Value = ???
+  def transform(fn: com.foo.In => com.foo.Out): Option[com.foo.Result] = ???
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Client",
+			"com.foo.ExecutionContext",
+			"com.foo.In",
+			"com.foo.Key",
+			"com.foo.Out",
+			"com.foo.Result",
+			"com.foo.Timeout",
+			"com.foo.Value",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserStructuralTypeReferences(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{DedupeParsing: true}).Parse("Structural.scala", `package com.example
+
+object Structural {
+  def close(closeable: { def close(): com.foo.Result; val handle: com.foo.Handle }): Unit = ()
+
+  type Named = com.foo.Base { def name(n: com.foo.Arg): com.foo.Name; var v: com.foo.Var }
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Arg",
+			"com.foo.Base",
+			"com.foo.Handle",
+			"com.foo.Name",
+			"com.foo.Result",
+			"com.foo.Var",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+	// Refinement members are not exported symbols.
+	require.Equal(
+		t,
+		[]interface{}{"Structural", "Structural.Named", "Structural.close"},
+		parseResult.ExportedSymbols.Values(),
+	)
+}
+
+func TestParserExportedKinds(t *testing.T) {
+	source := `package com.example
+
+object Implicits {
+  type Id = String
+  given ordering: Ordering[Id] = Ordering.String
+  def helper: Id = ""
+}
+`
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Implicits.scala", source)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"Implicits",
+			"Implicits.Id",
+			"Implicits.helper",
+			"Implicits.ordering",
+		},
+		parseResult.ExportedSymbols.Values(),
+	)
+
+	exportedKinds := treeset.NewWithStringComparator("def")
+	parseResult, errs = NewParser(ParserOptions{ExportedKinds: exportedKinds}).Parse(
+		"Implicits.scala",
+		source,
+	)
+	require.Empty(t, errs)
+	// Members are still exported under their unexported object.
+	require.Equal(t, []interface{}{"Implicits.helper"}, parseResult.ExportedSymbols.Values())
+}
+
+func TestParserPackageObjectMembers(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("package.scala", `package com.foo
+
+package object util {
+  val someHelper: Int = 1
+  private val hidden: Int = 2
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{"com.foo.someHelper", "com.foo.util", "com.foo.util.someHelper"},
+		parseResult.QualifiedExportedSymbols().Values(),
+	)
+}
+
+func TestParserRecoversFromUnexpectedNodes(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+
+	// Given selectors can't be renamed, and tree-sitter reads this as an infix type which our
+	// import reader does not model.
+	parseResult, errs := parser.Parse("Unexpected.scala", `package com.example
+
+import com.example.util.Helper
+import com.example.implicits.{given Ordering as ord}
+
+object Example
+`)
+	require.Len(t, errs, 1)
+	require.ErrorContains(
+		t,
+		errs[0],
+		"line 4, column 37: unexpected node type 'infix_type'",
+	)
+
+	// Everything else in the file is still parsed.
+	require.Equal(t, []interface{}{"com.example.util.Helper"}, parseResult.Imports.Values())
+	require.Equal(
+		t,
+		[]interface{}{"com.example.Example"},
+		parseResult.QualifiedExportedSymbols().Values(),
+	)
+}
+
+func TestParserSymbolRows(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+
+	parseResult, errs := parser.Parse("Rows.scala", `package com.example
+
+import com.example.util.Helper
+
+object Rows {
+  def run(): Unit = com.example.other.Runner.run()
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[][]string{
+			{"Rows.scala", "com.example", SYMBOL_KIND_IMPORT, "com.example.util.Helper"},
+			{"Rows.scala", "com.example", SYMBOL_KIND_EXPORT, "com.example.Rows"},
+			{"Rows.scala", "com.example", SYMBOL_KIND_EXPORT, "com.example.Rows.run"},
+			{"Rows.scala", "com.example", SYMBOL_KIND_FQN, "com.example.other.Runner.run"},
+		},
+		parseResult.SymbolRows(),
+	)
+}
+
+func TestParserProjectsFields(t *testing.T) {
+	parser := NewParser(ParserOptions{})
+
+	parseResult, errs := parser.Parse("Projected.scala", `package com.example
+
+import com.example.util.Helper
+
+object Projected {
+  def run(): Unit = com.example.other.Runner.run()
+}
+`)
+	require.Empty(t, errs)
+
+	projection, err := parseResult.Project([]string{PROJECTION_IMPORTS})
+	require.NoError(t, err)
+	encoded, err := json.Marshal(projection)
+	require.NoError(t, err)
+	require.JSONEq(
+		t,
+		`{"source": "Projected.scala", "imports": ["com.example.util.Helper"]}`,
+		string(encoded),
+	)
+	require.NotContains(t, projection, "symbols")
+	require.NotContains(t, projection, "fully_qualified_names")
+
+	projection, err = parseResult.Project([]string{PROJECTION_PACKAGE, PROJECTION_SYMBOLS})
+	require.NoError(t, err)
+	encoded, err = json.Marshal(projection)
+	require.NoError(t, err)
+	require.JSONEq(
+		t,
+		`{
+			"source": "Projected.scala",
+			"package": "com.example",
+			"symbols": ["Projected", "Projected.run"]
+		}`,
+		string(encoded),
+	)
+
+	_, err = parseResult.Project([]string{"fqns"})
+	require.ErrorContains(t, err, "unknown parse result field 'fqns'")
+}
+
+func TestParserJavaSources(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{TrackPositions: true}).Parse("Widget.java", `package com.example.widgets;
+
+import java.util.List;
+import static com.foo.Helpers.help;
+import com.bar.*;
+import com.baz
+    .Qux; // split across lines
+
+public class Widget {
+  private final List<com.qux.Gadget> gadgets = null;
+}
+`)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasErrors)
+	require.Equal(t, "com.example.widgets", parseResult.Package)
+	require.Equal(t, []interface{}{"com.example.widgets"}, parseResult.Packages.Values())
+	require.Equal(
+		t,
+		[]interface{}{"com.bar._", "com.baz.Qux", "com.foo.Helpers.help", "java.util.List"},
+		parseResult.Imports.Values(),
+	)
+	require.Empty(t, parseResult.RelativeImports.Values())
+	require.Empty(t, parseResult.ExportedSymbols.Values())
+	require.Equal(
+		t,
+		[]SourcePosition{{Line: 5, Column: 1, Offset: 89}},
+		parseResult.ImportPositions["com.bar._"],
+	)
+}
+
+func TestParserRecordsStats(t *testing.T) {
+	stats := &parse.ParseStats{}
+	parser := NewParser(ParserOptions{DedupeParsing: true, Stats: stats})
+
+	_, errs := parser.Parse("A.scala", "package com.example\n\nobject A {\n  val b = 1\n}\n")
+	require.Empty(t, errs)
+	_, errs = parser.Parse("B.java", "package com.example;\n\nimport java.util.List;\n")
+	require.Empty(t, errs)
+
+	require.Equal(t, 2, stats.FilesParsed)
+	require.Greater(t, stats.NodesVisited, 2)
+	require.Positive(t, stats.TreeSitterTime)
+	require.Zero(t, stats.CacheHits)
+}
+
+func TestParserInstanceExpressionTypes(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{DedupeParsing: true}).Parse("New.scala", `package com.example
+
+object New {
+  def fail(): Unit = throw new com.foo.MyException("bad")
+  val plain = new com.foo.Plain
+  val generic = new com.foo.Generic[Int]
+  val mixed = new com.foo.Base with com.foo.Mixin
+  val split = new com.foo
+    .Split
+  val commented = new com.foo. /* why */ Commented
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Base",
+			"com.foo.Commented",
+			"com.foo.Generic",
+			"com.foo.Mixin",
+			"com.foo.MyException",
+			"com.foo.Plain",
+			"com.foo.Split",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserReturnsStructuredErrors(t *testing.T) {
+	_, errs := NewParser(ParserOptions{VerboseTreeSitterErrors: true}).Parse("Broken.scala", `package com.example
+
+object Broken {
+  val x = (1,
+  def f = 2
+}
+`)
+	require.NotEmpty(t, errs)
+
+	var parseError *ParseError
+	require.ErrorAs(t, errs[0], &parseError)
+	require.Equal(
+		t,
+		ParseError{Row: 4, Column: 3, Message: "syntax error", Snippet: "  val x = (1,"},
+		*parseError,
+	)
+	require.Equal(t, "line 4, column 3: syntax error", parseError.Error())
+	require.Equal(t, "     4:   val x = (1,\n          ^", DisplayError(parseError))
+}
+
+func TestParserReusesQueryCursorAcrossFiles(t *testing.T) {
+	srcDir := t.TempDir()
+	srcs := map[string]string{
+		"BrokenA.scala": "package com.example\n\nobject A {\n  val x = (1,\n  def f = 2\n}\n",
+		"Macro.scala":   "package com.example\n\nobject M {\n  def m: Unit = macro Impl.m\n}\n",
+		"Clean.scala":   "package com.example\n\nobject Clean\n",
+		"BrokenB.scala": "package com.example\n\nobject B {\n\n\n  val y = (2,\n  def g = 3\n}\n",
+	}
+	names := []string{"BrokenA.scala", "Macro.scala", "Clean.scala", "BrokenB.scala"}
+
+	type queryResults struct {
+		hasMacro bool
+		errs     []error
+	}
+
+	// As in the caching path, a single parser instance handles every cache miss. Run through
+	// the files twice so that each follows both erroneous and clean files, varying their
+	// content so that the second round also misses the cache.
+	parser := parse.NewCachingParser[ParseResult](
+		NewParser(ParserOptions{VerboseTreeSitterErrors: true}),
+		filepath.Join(t.TempDir(), "cache.json"),
+		parse.CachingParserOptions{
+			PruneStaleEntries: true,
+		},
+	)
+	for i := 0; i < 2; i++ {
+		for _, name := range names {
+			content := srcs[name] + strings.Repeat("// padding\n", i)
+			path := filepath.Join(srcDir, fmt.Sprintf("%d%s", i, name))
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+			// Results from a fresh parser are the baseline the shared parser must match.
+			freshResult, freshErrs := NewParser(ParserOptions{VerboseTreeSitterErrors: true}).Parse(path, content)
+			require.Equal(t, strings.HasPrefix(name, "Broken"), len(freshErrs) > 0, path)
+			require.Equal(t, name == "Macro.scala", freshResult.HasMacro, path)
+
+			parseResult, errs := parser.ParseFile(path)
+			require.Equal(
+				t,
+				queryResults{freshResult.HasMacro, freshErrs},
+				queryResults{parseResult.HasMacro, errs},
+				path,
+			)
+		}
+	}
+}
+
+func TestParserSelfTypes(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("SelfTypes.scala", `package com.example
+
+trait Typed { self: com.foo.Logging with com.foo.Metrics[com.foo.Tag] =>
+  def me = self
+}
+`)
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]interface{}{"com.foo.Logging", "com.foo.Metrics", "com.foo.Tag"},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+
+	parseResult, errs = NewParser(ParserOptions{}).Parse("Untyped.scala", `package com.example
+
+trait Untyped { self =>
+  def me = self
+}
+`)
+	require.Empty(t, errs)
+	require.Empty(t, parseResult.FullyQualifiedNames.Values())
+}
+
+func TestReadPackageIdentifierWithOperatorSegments(t *testing.T) {
+	readPackage := func(sourceCode string, ignoreLast bool) (string, error) {
+		treeSitterParser := sitter.NewParser()
+		treeSitterParser.SetLanguage(SCALA_LANG)
+		tree, err := treeSitterParser.ParseCtx(context.Background(), nil, []byte(sourceCode))
+		require.NoError(t, err)
+
+		packageClause := tree.RootNode().NamedChild(0)
+		require.Equal(t, "package_clause", packageClause.Type())
+		return readPackageIdentifier(
+			getLoneChild(packageClause, "package_identifier"),
+			[]byte(sourceCode),
+			ignoreLast,
+		)
+	}
+
+	pkg, err := readPackage("package foo.bar.++\n", false)
+	require.NoError(t, err)
+	require.Equal(t, "foo.bar.++", pkg)
+
+	pkg, err = readPackage("package foo.bar.++\n", true)
+	require.NoError(t, err)
+	require.Equal(t, "foo.bar", pkg)
+
+	pkg, err = readPackage("package foo.`++`.bar\n", false)
+	require.NoError(t, err)
+	require.Equal(t, "foo.++.bar", pkg)
+
+	for _, ignoreLast := range []bool{false, true} {
+		_, err = readPackage("package foo.++.bar\n", ignoreLast)
+		require.EqualError(
+			t,
+			err,
+			"line 1, column 13: operator '++' may only be the last segment of a package "+
+				"identifier: foo.++.bar",
+		)
+	}
+
+	// A misplaced operator is recoverable, the rest of the file is still parsed.
+	parseResult, errs := NewParser(ParserOptions{}).Parse(
+		"Operator.scala",
+		"package foo.++.bar\n\nimport com.example.Thing\n\nobject Baz\n",
+	)
+	require.Len(t, errs, 1)
+	require.Equal(t, "", parseResult.Package)
+	require.Equal(t, []interface{}{"com.example.Thing"}, parseResult.Imports.Values())
+	require.Equal(t, []interface{}{"Baz"}, parseResult.ExportedSymbols.Values())
+}
+
+func TestParserUsingClausesAndContextBounds(t *testing.T) {
+	sourceCode := `package com.example
+
+object Contextual {
+  def f(x: Int)(using com.foo.Ctx): Int = x
+  def g(using ctx: com.foo.Named, other: com.foo.Second): Int = 1
+  def h[T <: com.foo.Upper : com.foo.Ordering](x: T): T = x
+
+  given com.foo.Anonymous = ???
+  given withCtx(using com.foo.GivenCtx): com.foo.Show = ???
+
+  extension (x: Int)(using com.foo.ExtensionCtx) def twice: Int = x
+}
+
+class Bounded[T: com.foo.ClassBound](x: Int)(using ctx: com.foo.ClassCtx)
+`
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Contextual.scala", sourceCode)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasErrors)
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Anonymous",
+			"com.foo.ClassBound",
+			"com.foo.ClassCtx",
+			"com.foo.Ctx",
+			"com.foo.ExtensionCtx",
+			"com.foo.GivenCtx",
+			"com.foo.Named",
+			"com.foo.Ordering",
+			"com.foo.Second",
+			"com.foo.Show",
+			"com.foo.Upper",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+	// Anonymous givens have no name to export.
+	require.Equal(
+		t,
+		[]interface{}{
+			"Bounded",
+			"Contextual",
+			"Contextual.f",
+			"Contextual.g",
+			"Contextual.h",
+			"Contextual.withCtx",
+		},
+		parseResult.ExportedSymbols.Values(),
+	)
+}
+
+func TestParserTypedAndStablePatterns(t *testing.T) {
+	sourceCode := `package com.example
+
+object Patterns {
+  def f(x: Any): Int = x match {
+    case _: com.foo.Special => 1
+    case s: com.foo.Generic[Int] => 2
+    case _: com.foo.Left | _: com.foo.Right => 3
+    case Some(_: com.foo.Nested) => 4
+    case com.foo.Sentinel => 5
+    case _: Special => 6
+    case _ => 7
+  }
+}
+`
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Patterns.scala", sourceCode)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasErrors)
+	// Bare type names are not fully qualified, and are resolved via imports instead.
+	require.Equal(
+		t,
+		[]interface{}{
+			"com.foo.Generic",
+			"com.foo.Left",
+			"com.foo.Nested",
+			"com.foo.Right",
+			"com.foo.Sentinel",
+			"com.foo.Special",
+		},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserMatchTypes(t *testing.T) {
+	sourceCode := `package com.example
+
+object MatchTypes:
+  type Elem[X] = X match
+    case com.foo.Container[t] => t
+    case com.foo.Plain => Int
+    case Array[com.foo.Element] => Char
+`
+	parseResult, errs := NewParser(ParserOptions{}).Parse("MatchTypes.scala", sourceCode)
+	require.Empty(t, errs)
+	require.False(t, parseResult.HasErrors)
+	require.Equal(
+		t,
+		[]interface{}{"com.foo.Container", "com.foo.Element", "com.foo.Plain"},
+		parseResult.FullyQualifiedNames.Values(),
+	)
+}
+
+func TestParserCompanions(t *testing.T) {
+	parseResult, errs := NewParser(ParserOptions{}).Parse("Companions.scala", `package com.example
+
+case class Foo(x: Int)
+
+object Foo {
+  val default = Foo(0)
+  def fromString(s: String): Foo = Foo(s.toInt)
+}
+
+trait Shape
+object Shape {
+  class Circle
+  object Circle {
+    val unit = new Circle
+  }
+}
+
+class Lonely
+object Other
+private class Hidden
+object Hidden
+`)
+	require.Empty(t, errs)
+	require.Equal(t, []interface{}{"Foo", "Shape", "Shape.Circle"}, parseResult.Companions.Values())
+	// Companion object members are exported under the name shared with the class.
+	for _, symbol := range []string{"Foo.default", "Foo.fromString", "Shape.Circle.unit"} {
+		require.True(t, parseResult.ExportedSymbols.Contains(symbol), symbol)
+	}
+
+	// Companions should survive a round trip through the parsing cache.
+	cacheBytes, err := json.Marshal(map[string]*ParseResult{"hash": parseResult})
+	require.NoError(t, err)
+
+	var interfaceMap map[string]interface{}
+	require.NoError(t, json.Unmarshal(cacheBytes, &interfaceMap))
+
+	cacheMap := make(map[string]*ParseResult)
+	(&treeSitterParser{}).UnmarshalParsingCache(&cacheMap, &interfaceMap)
+	require.Equal(t, parseResult.Companions.Values(), cacheMap["hash"].Companions.Values())
+}
@@ -0,0 +1,14 @@
+#!/usr/bin/env -S scala-cli shebang
+// NOTE(scala-gazelle): a standalone script, which must begin with its shebang line.
+
+package io.fsq.scripts
+
+import java.nio.file.{Files, Paths}
+import scala.jdk.CollectionConverters._
+
+object Shebang {
+  def main(args: Array[String]): Unit = {
+    val lines = Files.readAllLines(Paths.get(args(0))).asScala
+    lines.foreach(println)
+  }
+}